@@ -0,0 +1,52 @@
+package analysis
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// Command runs the analyze subcommand with args and returns its exit
+// status:
+//
+//	pabft analyze [-format text|csv] [run directory]
+//
+// The run directory defaults to logs/recent, where run_nodes.sh puts
+// the logs and traces of the latest run.
+func Command(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "report as text or csv")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: analyze [-format text|csv] [run directory]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 || (*format != "text" && *format != "csv") {
+		flags.Usage()
+		return 2
+	}
+	dir := "logs/recent"
+	if flags.NArg() == 1 {
+		dir = flags.Arg(0)
+	}
+
+	run, err := Load(dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	report := run.Report()
+	if *format == "csv" {
+		err = report.WriteCSV(stdout)
+	} else {
+		err = report.WriteText(stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,401 @@
+// Package analysis reports on a run from the traces and logs of its
+// replicas: throughput, commit latency, time spent in each phase, view
+// changes, and how sequences were committed.
+package analysis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// Longest line read; debug logs of large messages can be long.
+const maxLineSize = 16 << 20
+
+// Log messages a run is told from; see the network package.
+const (
+	msgProposing          = "proposing"
+	msgExecuted           = "executed"
+	msgViewChangeDone     = "view change done"
+	msgCommittedVoteAQ    = "committed on adaptive vote quorum"
+	msgCommittedCollateAQ = "committed on adaptive collate quorum"
+	msgCommittedCollate   = "committed on collate quorum"
+	msgCommittedCommitted = "committed on COMMITTED collates"
+)
+
+// Commit rules the logs tell apart.
+var logRules = map[string]string{
+	msgCommittedVoteAQ:    network.RuleVoteAQ,
+	msgCommittedCollateAQ: network.RuleCollateAQ,
+	msgCommittedCollate:   network.RuleCollateQuorum,
+	msgCommittedCommitted: network.RuleCommittedCollate,
+}
+
+// Run is what the traces and logs of a run tell.
+type Run struct {
+	Dir        string
+	TraceFiles int
+	LogFiles   int
+
+	// How each node went through each sequence, from the traces or,
+	// without traces, from the logs.
+	sequences map[sequenceKey]*sequence
+	// When each sequence was first proposed.
+	proposals map[int64]time.Time
+	// How long each view change took, as the replicas logged it.
+	viewChanges []time.Duration
+	nodes       map[string]bool
+
+	traced bool // sequences come from traces
+}
+
+type sequenceKey struct {
+	node string
+	seq  int64
+}
+
+// sequence is how a node went through a sequence. A zero time is an
+// event the node did not record.
+type sequence struct {
+	prepared  time.Time // PREPARE received, or prepare timer expired
+	voted     time.Time // collate sent or commit, whichever first
+	committed time.Time
+	executed  time.Time
+	rule      string
+}
+
+// Load reads the traces and logs under dir: every file whose lines are
+// trace records or log records, in text or JSON. Other lines are
+// skipped. With traces, the logs only tell the view changes.
+func Load(dir string) (*Run, error) {
+	run := &Run{
+		Dir:       dir,
+		sequences: make(map[sequenceKey]*sequence),
+		proposals: make(map[int64]time.Time),
+		nodes:     make(map[string]bool),
+	}
+	// logs/recent is a link to the latest run.
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	var traces, logs []string
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		kind, err := fileKind(path)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case kindTrace:
+			traces = append(traces, path)
+		case kindLog:
+			logs = append(logs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(traces) == 0 && len(logs) == 0 {
+		return nil, fmt.Errorf("no traces or logs in %s", dir)
+	}
+
+	run.traced = len(traces) > 0
+	for _, path := range traces {
+		if err := run.readFile(path, run.addTrace); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range logs {
+		if err := run.readFile(path, run.addLog); err != nil {
+			return nil, err
+		}
+	}
+	run.TraceFiles, run.LogFiles = len(traces), len(logs)
+	return run, nil
+}
+
+const (
+	kindNone = iota
+	kindTrace
+	kindLog
+)
+
+// fileKind tells a trace from a log by its first line that is either.
+func fileKind(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return kindNone, err
+	}
+	defer file.Close()
+	scanner := newScanner(file)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if _, ok := parseTrace(line); ok {
+			return kindTrace, nil
+		}
+		if _, ok := parseLog(line); ok {
+			return kindLog, nil
+		}
+	}
+	return kindNone, nil
+}
+
+func (run *Run) readFile(path string, add func(line []byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := newScanner(file)
+	for scanner.Scan() {
+		add(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return scanner
+}
+
+func parseTrace(line []byte) (*network.TraceRecord, bool) {
+	if len(line) == 0 || line[0] != '{' {
+		return nil, false
+	}
+	var record network.TraceRecord
+	if err := json.Unmarshal(line, &record); err != nil || record.NodeID == "" || record.Events == nil {
+		return nil, false
+	}
+	return &record, true
+}
+
+func (run *Run) addTrace(line []byte) {
+	record, ok := parseTrace(line)
+	if !ok {
+		return
+	}
+	run.nodes[record.NodeID] = true
+	for _, event := range record.Events {
+		if event.Event == network.TracePrepareSent {
+			run.propose(record.SequenceID, event.Time)
+		}
+	}
+	if !record.Executed {
+		return
+	}
+
+	s := run.sequence(record.NodeID, record.SequenceID)
+	s.rule = record.Rule
+	for _, event := range record.Events {
+		switch event.Event {
+		case network.TracePrepareReceived:
+			setFirst(&s.prepared, event.Time)
+		case network.TraceTimerExpired:
+			if event.Phase == "prepare" {
+				setFirst(&s.prepared, event.Time)
+			}
+		case network.TraceCollateSent:
+			setFirst(&s.voted, event.Time)
+		case network.TraceCommit:
+			setFirst(&s.voted, event.Time)
+			setFirst(&s.committed, event.Time)
+		case network.TraceExecute:
+			s.executed = event.Time
+		}
+	}
+}
+
+// logRecord is a line of a log, in text or JSON.
+type logRecord struct {
+	time  time.Time
+	msg   string
+	attrs map[string]string
+}
+
+func (record *logRecord) int(key string) (int64, bool) {
+	n, err := strconv.ParseInt(record.attrs[key], 10, 64)
+	return n, err == nil
+}
+
+func (run *Run) addLog(line []byte) {
+	record, ok := parseLog(line)
+	if !ok {
+		return
+	}
+	if node := record.attrs["node"]; node != "" {
+		run.nodes[node] = true
+	}
+
+	if record.msg == msgViewChangeDone {
+		if took, ok := parseDuration(record.attrs["took"]); ok {
+			run.viewChanges = append(run.viewChanges, took)
+		}
+		return
+	}
+	if run.traced {
+		return
+	}
+	seq, ok := record.int("seq")
+	node := record.attrs["node"]
+	if !ok || node == "" {
+		return
+	}
+	switch record.msg {
+	case msgProposing:
+		run.propose(seq, record.time)
+	case msgExecuted:
+		s := run.sequence(node, seq)
+		s.executed = record.time
+		if s.rule == "" {
+			// The vote quorum is the only rule not logged at info.
+			s.rule = network.RuleVoteQuorum
+		}
+	default:
+		if rule, ok := logRules[record.msg]; ok {
+			s := run.sequence(node, seq)
+			if s.rule == "" {
+				s.rule = rule
+			}
+			setFirst(&s.committed, record.time)
+		}
+	}
+}
+
+func parseLog(line []byte) (*logRecord, bool) {
+	if len(line) > 0 && line[0] == '{' {
+		return parseJSONLog(line)
+	}
+	if !strings.HasPrefix(string(line), "time=") {
+		return nil, false
+	}
+	attrs := parseLogfmt(string(line))
+	t, err := time.Parse(time.RFC3339Nano, attrs["time"])
+	if err != nil || attrs["msg"] == "" {
+		return nil, false
+	}
+	return &logRecord{time: t, msg: attrs["msg"], attrs: attrs}, true
+}
+
+func parseJSONLog(line []byte) (*logRecord, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, false
+	}
+	msg, _ := fields["msg"].(string)
+	stamp, _ := fields["time"].(string)
+	t, err := time.Parse(time.RFC3339Nano, stamp)
+	if msg == "" || err != nil {
+		return nil, false
+	}
+	attrs := make(map[string]string, len(fields))
+	for key, value := range fields {
+		switch value := value.(type) {
+		case string:
+			attrs[key] = value
+		case float64:
+			attrs[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			attrs[key] = fmt.Sprint(value)
+		}
+	}
+	return &logRecord{time: t, msg: msg, attrs: attrs}, true
+}
+
+// parseLogfmt splits a line of the slog text handler into its keys and
+// values. Quoted values are unquoted.
+func parseLogfmt(line string) map[string]string {
+	attrs := make(map[string]string)
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			break
+		}
+		key := line[:eq]
+		line = line[eq+1:]
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			end := closingQuote(line)
+			unquoted, err := strconv.Unquote(line[:end])
+			if err != nil {
+				break
+			}
+			value, line = unquoted, line[end:]
+		} else {
+			end := strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			value, line = line[:end], line[end:]
+		}
+		attrs[key] = value
+	}
+	return attrs
+}
+
+// closingQuote returns the end of the quoted string s starts with.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// parseDuration reads a duration as the text handler writes it, e.g.
+// 1.5s, or as the JSON handler does, in nanoseconds.
+func parseDuration(s string) (time.Duration, bool) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, true
+	}
+	if ns, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(ns), true
+	}
+	return 0, false
+}
+
+func (run *Run) sequence(node string, seq int64) *sequence {
+	key := sequenceKey{node: node, seq: seq}
+	s, ok := run.sequences[key]
+	if !ok {
+		s = &sequence{}
+		run.sequences[key] = s
+	}
+	return s
+}
+
+func (run *Run) propose(seq int64, t time.Time) {
+	if first, ok := run.proposals[seq]; !ok || t.Before(first) {
+		run.proposals[seq] = t
+	}
+}
+
+func setFirst(t *time.Time, candidate time.Time) {
+	if t.IsZero() || candidate.Before(*t) {
+		*t = candidate
+	}
+}
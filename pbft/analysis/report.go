@@ -0,0 +1,293 @@
+package analysis
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// Phases of a sequence, as the metrics of the nodes name them.
+var phaseNames = []string{"prepare", "vote", "collate", "execute"}
+
+// Commit rules, in the order they are reported.
+var rules = []string{
+	network.RuleVoteQuorum,
+	network.RuleCollateQuorum,
+	network.RuleCommittedCollate,
+	network.RuleVoteAQ,
+	network.RuleCollateAQ,
+}
+
+// Rules that commit on an adaptive quorum, when a phase timer ran out.
+var adaptiveRules = map[string]bool{
+	network.RuleVoteAQ:    true,
+	network.RuleCollateAQ: true,
+}
+
+// Report sums up a run.
+type Report struct {
+	Dir        string
+	TraceFiles int
+	LogFiles   int
+
+	Nodes     int
+	Sequences int // executed by at least one node
+	// Sequences executed by the node that executed the fewest and by
+	// the one that executed the most.
+	MinExecuted, MaxExecuted int
+	// From the first proposal to the last execution.
+	Duration   time.Duration
+	Throughput float64 // sequences per second
+
+	// From the proposal of a sequence to its execution, on every node.
+	Latency Distribution
+	// Time spent in each phase, on every node; traces only.
+	Phases map[string]Distribution
+	// View changes, as the nodes logged them.
+	ViewChanges Distribution
+
+	// Sequences executed on each node, by the rule that committed them.
+	Rules map[string]int
+	// Of those, committed on an adaptive quorum and on a full one.
+	Adaptive, Full int
+}
+
+// Distribution sums up durations.
+type Distribution struct {
+	Count         int
+	Mean          time.Duration
+	P50, P90, P99 time.Duration
+	Min, Max      time.Duration
+}
+
+// Report sums up the run.
+func (run *Run) Report() *Report {
+	report := &Report{
+		Dir:        run.Dir,
+		TraceFiles: run.TraceFiles,
+		LogFiles:   run.LogFiles,
+		Nodes:      len(run.nodes),
+		Phases:     make(map[string]Distribution),
+		Rules:      make(map[string]int),
+	}
+
+	var latencies []time.Duration
+	phases := make(map[string][]time.Duration)
+	executedBy := make(map[string]int)
+	executed := make(map[int64]bool)
+	var first, last time.Time
+	for key, s := range run.sequences {
+		if s.executed.IsZero() {
+			continue
+		}
+		executedBy[key.node]++
+		executed[key.seq] = true
+		if last.IsZero() || s.executed.After(last) {
+			last = s.executed
+		}
+
+		start, proposed := run.proposals[key.seq]
+		if proposed {
+			setFirst(&first, start)
+			latencies = appendPositive(latencies, start, s.executed)
+		}
+		if run.traced {
+			if !proposed {
+				start = s.prepared
+			}
+			steps := []time.Time{start, s.prepared, s.voted, s.committed, s.executed}
+			for i, phase := range phaseNames {
+				if !steps[i].IsZero() && !steps[i+1].IsZero() {
+					phases[phase] = appendPositive(phases[phase], steps[i], steps[i+1])
+				}
+			}
+		}
+
+		report.Rules[s.rule]++
+		if adaptiveRules[s.rule] {
+			report.Adaptive++
+		} else {
+			report.Full++
+		}
+	}
+
+	report.Sequences = len(executed)
+	for i, node := range sortedNodes(run.nodes) {
+		n := executedBy[node]
+		if i == 0 || n < report.MinExecuted {
+			report.MinExecuted = n
+		}
+		if n > report.MaxExecuted {
+			report.MaxExecuted = n
+		}
+	}
+	if !first.IsZero() && last.After(first) {
+		report.Duration = last.Sub(first)
+		report.Throughput = float64(report.Sequences) / report.Duration.Seconds()
+	}
+	report.Latency = Summarize(latencies)
+	for _, phase := range phaseNames {
+		if len(phases[phase]) > 0 {
+			report.Phases[phase] = Summarize(phases[phase])
+		}
+	}
+	report.ViewChanges = Summarize(run.viewChanges)
+	return report
+}
+
+// appendPositive appends the time from start to end to durations; clocks of
+// different machines can put end before start.
+func appendPositive(durations []time.Duration, start time.Time, end time.Time) []time.Duration {
+	if d := end.Sub(start); d >= 0 {
+		return append(durations, d)
+	}
+	return durations
+}
+
+// Summarize returns the count, mean, percentiles and range of durations.
+func Summarize(durations []time.Duration) Distribution {
+	if len(durations) == 0 {
+		return Distribution{}
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	return Distribution{
+		Count: len(sorted),
+		Mean:  sum / time.Duration(len(sorted)),
+		P50:   percentile(sorted, 0.50),
+		P90:   percentile(sorted, 0.90),
+		P99:   percentile(sorted, 0.99),
+		Min:   sorted[0],
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func sortedNodes(nodes map[string]bool) []string {
+	sorted := make([]string, 0, len(nodes))
+	for node := range nodes {
+		sorted = append(sorted, node)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// WriteText writes the report for people.
+func (report *Report) WriteText(w io.Writer) error {
+	out := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(out, "run\t%s (%d traces, %d logs)\n", report.Dir, report.TraceFiles, report.LogFiles)
+	fmt.Fprintf(out, "nodes\t%d\n", report.Nodes)
+	fmt.Fprintf(out, "sequences\t%d executed (%d to %d per node)\n",
+		report.Sequences, report.MinExecuted, report.MaxExecuted)
+	if report.Duration > 0 {
+		fmt.Fprintf(out, "throughput\t%.2f sequences/s over %v\n",
+			report.Throughput, report.Duration.Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(out, "throughput\tunknown: no proposal found\n")
+	}
+
+	fmt.Fprintf(out, "\n(ms)\tcount\tmean\tp50\tp90\tp99\tmin\tmax\n")
+	writeTextRow(out, "commit latency", report.Latency)
+	for _, phase := range phaseNames {
+		if d, ok := report.Phases[phase]; ok {
+			writeTextRow(out, "  "+phase, d)
+		}
+	}
+	writeTextRow(out, "view change", report.ViewChanges)
+
+	committed := report.Adaptive + report.Full
+	fmt.Fprintf(out, "\ncommit rule\tsequences\tshare\n")
+	for _, rule := range rules {
+		fmt.Fprintf(out, "%s\t%d\t%s\n", rule, report.Rules[rule], share(report.Rules[rule], committed))
+	}
+	fmt.Fprintf(out, "adaptive quorum\t%d\t%s\n", report.Adaptive, share(report.Adaptive, committed))
+	fmt.Fprintf(out, "full quorum\t%d\t%s\n", report.Full, share(report.Full, committed))
+	if len(report.Phases) == 0 {
+		fmt.Fprintf(out, "\nno traces: no phase breakdown; run the nodes with -trace\n")
+	}
+	return out.Flush()
+}
+
+func writeTextRow(out io.Writer, name string, d Distribution) {
+	if d.Count == 0 {
+		fmt.Fprintf(out, "%s\t0\t-\t-\t-\t-\t-\t-\n", name)
+		return
+	}
+	fmt.Fprintf(out, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", name, d.Count,
+		millis(d.Mean), millis(d.P50), millis(d.P90), millis(d.P99), millis(d.Min), millis(d.Max))
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
+
+func share(n int, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+// WriteCSV writes the report as rows of metric, label, stat and value,
+// durations in milliseconds.
+func (report *Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"metric", "label", "stat", "value"})
+	row := func(metric string, label string, stat string, value string) {
+		out.Write([]string{metric, label, stat, value})
+	}
+	count := func(n int) string { return strconv.Itoa(n) }
+
+	row("nodes", "", "count", count(report.Nodes))
+	row("sequences", "", "count", count(report.Sequences))
+	row("sequences", "", "min_per_node", count(report.MinExecuted))
+	row("sequences", "", "max_per_node", count(report.MaxExecuted))
+	row("duration_ms", "", "value", millis(report.Duration))
+	row("throughput", "", "per_second", strconv.FormatFloat(report.Throughput, 'f', 3, 64))
+
+	distributionRows := func(metric string, label string, d Distribution) {
+		row(metric, label, "count", count(d.Count))
+		for _, stat := range []struct {
+			name  string
+			value time.Duration
+		}{
+			{"mean", d.Mean}, {"p50", d.P50}, {"p90", d.P90}, {"p99", d.P99}, {"min", d.Min}, {"max", d.Max},
+		} {
+			row(metric, label, stat.name, millis(stat.value))
+		}
+	}
+	distributionRows("latency_ms", "", report.Latency)
+	for _, phase := range phaseNames {
+		if d, ok := report.Phases[phase]; ok {
+			distributionRows("phase_ms", phase, d)
+		}
+	}
+	distributionRows("view_change_ms", "", report.ViewChanges)
+
+	for _, rule := range rules {
+		row("commit_rule", rule, "count", count(report.Rules[rule]))
+	}
+	row("quorum", "adaptive", "count", count(report.Adaptive))
+	row("quorum", "full", "count", count(report.Full))
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,178 @@
+// Package bench is a load generator for the replicas. Its clients sign
+// requests and send them to every replica, and measure the time from
+// submitting a request to getting the same reply from f+1 replicas.
+//
+// The load is either closed-loop, each client keeping a number of
+// requests outstanding, or open-loop, the clients together submitting
+// requests at a target rate whether replies come back or not. Results
+// are written in the same form for every run, with a label naming the
+// protocol mode the replicas ran in, so runs can be put side by side.
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/analysis"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// Operation of the requests of a benchmark.
+const benchOperation = "bench"
+
+// Time a client waits after failing to submit, before trying again.
+const submitRetry = 100 * time.Millisecond
+
+// Load modes.
+const (
+	ClosedLoop = "closed"
+	OpenLoop   = "open"
+)
+
+// Config is the load a benchmark puts on the replicas.
+type Config struct {
+	Label       string        // names the run, e.g. the protocol mode
+	Mode        string        // ClosedLoop or OpenLoop
+	Outstanding int           // closed-loop: requests in flight per client
+	Rate        float64       // open-loop: requests per second, all clients together
+	Size        int           // bytes of data per request
+	Duration    time.Duration // time requests are submitted for
+	Timeout     time.Duration // time a request waits for its reply
+}
+
+// Result is what a benchmark measured.
+type Result struct {
+	Config
+	Clients int
+
+	Submitted int
+	Completed int // replied to by f+1 replicas
+	TimedOut  int
+	Failed    int // could not be sent
+
+	// From the first submission to the last reply.
+	Elapsed    time.Duration
+	Throughput float64 // completed requests per second
+
+	// From submission to the f+1-th matching reply.
+	Latency analysis.Distribution
+}
+
+// recorder collects what the clients measure.
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	submitted int
+	timedOut  int
+	failed    int
+	first     time.Time
+	last      time.Time
+}
+
+// Run puts the load of config on the replicas through requesters,
+// which are connected, and returns what it measured once every request
+// is replied to or timed out.
+func Run(config Config, requesters []*network.Requester) (*Result, error) {
+	if len(requesters) == 0 {
+		return nil, fmt.Errorf("no clients")
+	}
+	data := bytes.Repeat([]byte{'b'}, config.Size)
+	rec := &recorder{}
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+
+	switch config.Mode {
+	case ClosedLoop:
+		if config.Outstanding < 1 {
+			return nil, fmt.Errorf("closed loop needs at least 1 request outstanding")
+		}
+		for _, requester := range requesters {
+			for i := 0; i < config.Outstanding; i++ {
+				wg.Add(1)
+				go func(requester *network.Requester) {
+					defer wg.Done()
+					for time.Now().Before(deadline) {
+						if !rec.issue(requester, data, config.Timeout) {
+							time.Sleep(submitRetry)
+						}
+					}
+				}(requester)
+			}
+		}
+	case OpenLoop:
+		if config.Rate <= 0 {
+			return nil, fmt.Errorf("open loop needs a rate above 0")
+		}
+		interval := time.Duration(float64(time.Second) / config.Rate)
+		for i := 0; ; i++ {
+			at := start.Add(time.Duration(i) * interval)
+			if !at.Before(deadline) {
+				break
+			}
+			time.Sleep(time.Until(at))
+			wg.Add(1)
+			go func(requester *network.Requester) {
+				defer wg.Done()
+				rec.issue(requester, data, config.Timeout)
+			}(requesters[i%len(requesters)])
+		}
+	default:
+		return nil, fmt.Errorf("unknown load mode %q (want %s or %s)", config.Mode, ClosedLoop, OpenLoop)
+	}
+	wg.Wait()
+
+	result := &Result{
+		Config:    config,
+		Clients:   len(requesters),
+		Submitted: rec.submitted,
+		Completed: len(rec.latencies),
+		TimedOut:  rec.timedOut,
+		Failed:    rec.failed,
+		Latency:   analysis.Summarize(rec.latencies),
+	}
+	if result.Completed > 0 && rec.last.After(rec.first) {
+		result.Elapsed = rec.last.Sub(rec.first)
+		result.Throughput = float64(result.Completed) / result.Elapsed.Seconds()
+	}
+	return result, nil
+}
+
+// issue submits a request and waits for its reply. It returns false if
+// the request could not be sent.
+func (rec *recorder) issue(requester *network.Requester, data []byte, timeout time.Duration) bool {
+	submitted := time.Now()
+	timestamp, done, err := requester.Submit(benchOperation, data)
+	rec.mu.Lock()
+	if err != nil {
+		rec.failed++
+		rec.mu.Unlock()
+		return false
+	}
+	rec.submitted++
+	if rec.first.IsZero() {
+		rec.first = submitted
+	}
+	rec.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		replied := time.Now()
+		rec.mu.Lock()
+		rec.latencies = append(rec.latencies, replied.Sub(submitted))
+		if replied.After(rec.last) {
+			rec.last = replied
+		}
+		rec.mu.Unlock()
+	case <-timer.C:
+		requester.Forget(timestamp)
+		rec.mu.Lock()
+		rec.timedOut++
+		rec.mu.Unlock()
+	}
+	return true
+}
@@ -0,0 +1,228 @@
+package bench
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// Command runs the bench subcommand with args and returns its exit
+// status:
+//
+//	pabft keygen -n 19 -clients 4
+//	pabft bench -clients 4 -outstanding 2 -label binary [node.list]
+//	pabft bench -mode open -rate 20 -format csv -label json > json.csv
+//
+// Client i signs with keys/Client<i>.priv; the replicas pick up the
+// keys/Client*.pub there are when they start. The node list defaults
+// to /tmp/node.list, which run_nodes.sh writes.
+func Command(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var config Config
+	clients := flags.Int("clients", 1, "number of clients, Client1 and up")
+	flags.StringVar(&config.Mode, "mode", ClosedLoop, "load: closed (requests outstanding) or open (target rate)")
+	flags.IntVar(&config.Outstanding, "outstanding", 1, "closed loop: requests in flight per client")
+	flags.Float64Var(&config.Rate, "rate", 10, "open loop: requests per second, all clients together")
+	flags.IntVar(&config.Size, "size", 1024, "bytes of data per request")
+	flags.DurationVar(&config.Duration, "duration", 30*time.Second, "time to submit requests for")
+	flags.DurationVar(&config.Timeout, "timeout", 30*time.Second, "time a request waits for f+1 replies")
+	flags.StringVar(&config.Label, "label", "", "name of the run in the results, e.g. the protocol mode")
+	codec := flags.String("codec", "binary", "preferred wire codec (binary or json)")
+	useTLS := flags.Bool("tls", true, "connect with mutual TLS (certificates from pabft keygen)")
+	keyDir := flags.String("keys", "keys", "directory of the key files")
+	format := flags.String("format", "text", "write the results as text or csv")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bench [flags] [node.list]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 || *clients < 1 || (*format != "text" && *format != "csv") {
+		flags.Usage()
+		return 2
+	}
+	nodeListPath := "/tmp/node.list"
+	if flags.NArg() == 1 {
+		nodeListPath = flags.Arg(0)
+	}
+	fail := func(err error) int {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if _, err := consensus.CodecByName(*codec); err != nil {
+		return fail(err)
+	}
+
+	nodeTable, err := loadNodeTable(nodeListPath, *keyDir)
+	if err != nil {
+		return fail(err)
+	}
+	var requesters []*network.Requester
+	defer func() {
+		for _, requester := range requesters {
+			requester.Close()
+		}
+	}()
+	for i := 1; i <= *clients; i++ {
+		requester, err := newRequester(fmt.Sprintf("Client%d", i), nodeTable, *keyDir, *codec, *useTLS)
+		if err != nil {
+			return fail(err)
+		}
+		requesters = append(requesters, requester)
+		errs := requester.Connect()
+		for _, err := range errs {
+			fmt.Fprintf(stderr, "Client%d: %v\n", i, err)
+		}
+		if len(nodeTable)-len(errs) < requester.Quorum() {
+			return fail(fmt.Errorf("Client%d reached %d replicas, fewer than the %d that must reply",
+				i, len(nodeTable)-len(errs), requester.Quorum()))
+		}
+	}
+
+	result, err := Run(config, requesters)
+	if err != nil {
+		return fail(err)
+	}
+	if *format == "csv" {
+		err = result.WriteCSV(stdout)
+	} else {
+		err = result.WriteText(stdout)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+// loadNodeTable reads the node list at path and the public keys of
+// its replicas.
+func loadNodeTable(path string, keyDir string) ([]*network.NodeInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nodeTable []*network.NodeInfo
+	if err := json.Unmarshal(data, &nodeTable); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, nodeInfo := range nodeTable {
+		pubKeyFile := filepath.Join(keyDir, nodeInfo.NodeID+".pub")
+		pubPEM, err := ioutil.ReadFile(pubKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if nodeInfo.PubKey, err = consensus.ParsePublicKeyPEM(pubPEM); err != nil {
+			return nil, fmt.Errorf("%s: %v", pubKeyFile, err)
+		}
+	}
+	return nodeTable, nil
+}
+
+func newRequester(clientID string, nodeTable []*network.NodeInfo, keyDir string, codec string, useTLS bool) (*network.Requester, error) {
+	privKeyFile := filepath.Join(keyDir, clientID+".priv")
+	privPEM, err := ioutil.ReadFile(privKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := consensus.ParsePrivateKeyPEM(privPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", privKeyFile, err)
+	}
+	requester := network.NewRequester(clientID, signer, nodeTable)
+	if err := requester.SetCodec(codec); err != nil {
+		return nil, err
+	}
+	if !useTLS {
+		return requester, nil
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(keyDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	certFile := filepath.Join(keyDir, clientID+".crt")
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := requester.EnableTLS(caPEM, certPEM); err != nil {
+		return nil, fmt.Errorf("%s: %v", certFile, err)
+	}
+	return requester, nil
+}
+
+// WriteText writes the result for people.
+func (result *Result) WriteText(w io.Writer) error {
+	out := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if result.Label != "" {
+		fmt.Fprintf(out, "run\t%s\n", result.Label)
+	}
+	if result.Mode == OpenLoop {
+		fmt.Fprintf(out, "load\topen loop, %g requests/s from %d clients, %d bytes each, for %v\n",
+			result.Rate, result.Clients, result.Size, result.Duration)
+	} else {
+		fmt.Fprintf(out, "load\tclosed loop, %d clients with %d outstanding, %d bytes each, for %v\n",
+			result.Clients, result.Outstanding, result.Size, result.Duration)
+	}
+	fmt.Fprintf(out, "requests\t%d submitted, %d completed, %d timed out, %d not sent\n",
+		result.Submitted, result.Completed, result.TimedOut, result.Failed)
+	fmt.Fprintf(out, "throughput\t%.2f requests/s over %v\n",
+		result.Throughput, result.Elapsed.Round(time.Millisecond))
+	d := result.Latency
+	if d.Count > 0 {
+		fmt.Fprintf(out, "latency (ms)\tmean %s  p50 %s  p90 %s  p99 %s  min %s  max %s\n",
+			millis(d.Mean), millis(d.P50), millis(d.P90), millis(d.P99), millis(d.Min), millis(d.Max))
+	}
+	return out.Flush()
+}
+
+// WriteCSV writes the result as rows of metric, label, stat and value,
+// as the analyze subcommand does, with durations in milliseconds. The
+// label is the label of the run.
+func (result *Result) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"metric", "label", "stat", "value"})
+	row := func(metric string, stat string, value string) {
+		out.Write([]string{metric, result.Label, stat, value})
+	}
+	count := func(n int) string { return strconv.Itoa(n) }
+
+	row("load", "mode", result.Mode)
+	row("load", "clients", count(result.Clients))
+	row("load", "outstanding", count(result.Outstanding))
+	row("load", "rate", strconv.FormatFloat(result.Rate, 'f', -1, 64))
+	row("load", "size", count(result.Size))
+	row("load", "duration_ms", millis(result.Duration))
+	row("requests", "submitted", count(result.Submitted))
+	row("requests", "completed", count(result.Completed))
+	row("requests", "timed_out", count(result.TimedOut))
+	row("requests", "failed", count(result.Failed))
+	row("throughput", "per_second", strconv.FormatFloat(result.Throughput, 'f', 3, 64))
+	d := result.Latency
+	row("latency_ms", "count", count(d.Count))
+	for _, stat := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"mean", d.Mean}, {"p50", d.P50}, {"p90", d.P90}, {"p99", d.P99}, {"min", d.Min}, {"max", d.Max},
+	} {
+		row("latency_ms", stat.name, millis(stat.value))
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
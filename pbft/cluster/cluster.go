@@ -0,0 +1,473 @@
+// Package cluster runs the replicas of a local cluster as child
+// processes and looks after them: it keeps their logs, notices when one
+// crashes and may start it again, kills and revives replicas when told
+// to, and stops them all when it is interrupted.
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Config is what a cluster runs and how it looks after it.
+type Config struct {
+	Binary   string   // pabft, to run the replicas with
+	NodeList string   // node list the replicas read
+	Args     []string // flags of every replica; {id} becomes its node id
+
+	LogDir string    // <LogDir>/<id>.log gets the output of a replica, if set
+	Stream io.Writer // every line of output, prefixed with the node id, if set
+
+	Restart      bool          // start a replica again when it crashes
+	RestartDelay time.Duration // after this long
+	MaxRestarts  int           // at most this many times in a row, 0 for always
+	Grace        time.Duration // time replicas have to stop before they are killed
+}
+
+// State is where a replica of the cluster is at.
+type State string
+
+const (
+	Running    State = "running"
+	Stopping   State = "stopping"
+	Stopped    State = "stopped"
+	Crashed    State = "crashed"
+	Restarting State = "restarting"
+)
+
+// Cluster is a set of replicas running as child processes.
+type Cluster struct {
+	config Config
+	events io.Writer
+	nodes  []*node
+	byID   map[string]*node
+
+	exits    chan exit
+	restarts chan *node
+	done     chan struct{}
+	stopping bool
+
+	// Lines of the replicas and events go out whole.
+	out sync.Mutex
+}
+
+type node struct {
+	id      string
+	cmd     *exec.Cmd
+	output  *output
+	log     *os.File
+	state   State
+	started time.Time
+	crashes int   // in a row, since it was last started by hand
+	err     error // of the last exit
+	revive  bool  // start it again once it has stopped
+}
+
+type exit struct {
+	node *node
+	cmd  *exec.Cmd
+	err  error
+}
+
+// New returns the cluster of the replicas ids, none started yet. What
+// it does is reported to events.
+func New(config Config, ids []string, events io.Writer) (*Cluster, error) {
+	c := &Cluster{
+		config:   config,
+		events:   events,
+		byID:     make(map[string]*node),
+		exits:    make(chan exit),
+		restarts: make(chan *node),
+		done:     make(chan struct{}),
+	}
+	if config.LogDir != "" {
+		if err := os.MkdirAll(config.LogDir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range ids {
+		if c.byID[id] != nil {
+			return nil, fmt.Errorf("%s is in the cluster twice", id)
+		}
+		n := &node{id: id, state: Stopped}
+		if config.LogDir != "" {
+			log, err := os.OpenFile(filepath.Join(config.LogDir, id+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				c.closeLogs()
+				return nil, err
+			}
+			n.log = log
+		}
+		c.nodes = append(c.nodes, n)
+		c.byID[id] = n
+	}
+	return c, nil
+}
+
+// Run starts every replica and looks after them until a quit command
+// or an interrupt, then stops them. Commands are lines like "kill
+// Node3"; see Help. Run returns an error if every replica is down with
+// no commands left to revive them.
+func (c *Cluster) Run(commands <-chan string, interrupts <-chan os.Signal) error {
+	defer c.closeLogs()
+	defer close(c.done)
+
+	for _, n := range c.nodes {
+		c.start(n)
+	}
+	for {
+		if commands == nil && c.idle() {
+			return errors.New("every replica is down")
+		}
+		select {
+		case e := <-c.exits:
+			c.exited(e)
+		case n := <-c.restarts:
+			if n.state == Restarting {
+				c.start(n)
+			}
+		case line, ok := <-commands:
+			if !ok {
+				commands = nil
+				continue
+			}
+			if c.command(line) {
+				c.shutdown(interrupts)
+				return nil
+			}
+		case sig := <-interrupts:
+			c.event("%v, stopping the cluster", sig)
+			c.shutdown(interrupts)
+			return nil
+		}
+	}
+}
+
+// Help is what commands Run takes.
+const Help = `commands:
+  status               state of every replica
+  kill <id>...|all     kill replicas at once, as a crash would
+  stop <id>...|all     ask replicas to stop
+  start <id>...|all    start stopped or crashed replicas (or revive)
+  restart <id>...|all  stop replicas and start them again
+  quit                 stop the cluster (or Ctrl-C)`
+
+// command carries out a command line and returns true for quit.
+func (c *Cluster) command(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	verb, ids := fields[0], fields[1:]
+	var do func(n *node)
+	switch verb {
+	case "quit", "exit":
+		return true
+	case "help":
+		c.event("%s", Help)
+		return false
+	case "status", "ps":
+		c.status()
+		return false
+	case "kill":
+		do = c.kill
+	case "stop":
+		do = c.stop
+	case "start", "revive":
+		do = func(n *node) {
+			if n.cmd != nil {
+				c.event("%s is already running", n.id)
+				return
+			}
+			n.crashes = 0
+			c.start(n)
+		}
+	case "restart":
+		do = func(n *node) {
+			if n.cmd == nil {
+				n.crashes = 0
+				c.start(n)
+				return
+			}
+			n.revive = true
+			c.stop(n)
+		}
+	default:
+		c.event("unknown command %q; type help for the commands", verb)
+		return false
+	}
+	if len(ids) == 0 {
+		c.event("%s which replicas?", verb)
+		return false
+	}
+	if len(ids) == 1 && ids[0] == "all" {
+		ids = ids[:0]
+		for _, n := range c.nodes {
+			ids = append(ids, n.id)
+		}
+	}
+	for _, id := range ids {
+		n := c.byID[id]
+		if n == nil {
+			c.event("no replica %s in the cluster", id)
+			continue
+		}
+		do(n)
+	}
+	return false
+}
+
+func (c *Cluster) start(n *node) {
+	args := []string{"run", "-id", n.id, "-node-list", c.config.NodeList}
+	for _, arg := range c.config.Args {
+		args = append(args, strings.Replace(arg, "{id}", n.id, -1))
+	}
+	cmd := exec.Command(c.config.Binary, args...)
+	n.output = &output{prefix: []byte(n.id + " | "), stream: c.config.Stream, mu: &c.out}
+	if n.log != nil {
+		n.output.file = n.log
+	}
+	// The same writer for both makes them share a pipe, and keeps the
+	// order of their lines.
+	cmd.Stdout = n.output
+	cmd.Stderr = n.output
+	// Ctrl-C in a terminal goes to the whole process group; the
+	// cluster stops its replicas itself.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		n.state, n.err = Crashed, err
+		c.event("%s did not start: %v", n.id, err)
+		return
+	}
+	n.cmd, n.state, n.started, n.err = cmd, Running, time.Now(), nil
+	c.event("%s started, pid %d", n.id, cmd.Process.Pid)
+	go func() {
+		err := cmd.Wait()
+		select {
+		case c.exits <- exit{node: n, cmd: cmd, err: err}:
+		case <-c.done:
+		}
+	}()
+}
+
+func (c *Cluster) stop(n *node) {
+	if n.cmd == nil {
+		if n.state == Restarting {
+			n.state = Stopped
+			c.event("%s stays down", n.id)
+			return
+		}
+		c.event("%s is not running", n.id)
+		return
+	}
+	n.state = Stopping
+	if err := n.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		c.event("%s: %v", n.id, err)
+	}
+}
+
+func (c *Cluster) kill(n *node) {
+	if n.cmd == nil {
+		if n.state == Restarting {
+			n.state = Stopped
+			c.event("%s stays down", n.id)
+			return
+		}
+		c.event("%s is not running", n.id)
+		return
+	}
+	// Killed on purpose, it stays down like a stopped replica.
+	n.state = Stopping
+	if err := n.cmd.Process.Kill(); err != nil {
+		c.event("%s: %v", n.id, err)
+	}
+}
+
+func (c *Cluster) exited(e exit) {
+	n := e.node
+	if n.cmd != e.cmd {
+		return
+	}
+	n.output.flush()
+	n.cmd, n.err = nil, e.err
+	ran := time.Since(n.started).Round(time.Millisecond)
+
+	if n.state == Stopping {
+		n.state = Stopped
+		c.event("%s stopped after %v (%s)", n.id, ran, exitStatus(e.err))
+		if n.revive && !c.stopping {
+			n.revive = false
+			n.crashes = 0
+			c.start(n)
+		}
+		return
+	}
+
+	n.state = Crashed
+	n.crashes++
+	if !c.config.Restart || c.stopping ||
+		(c.config.MaxRestarts > 0 && n.crashes > c.config.MaxRestarts) {
+		c.event("%s crashed after %v (%s)", n.id, ran, exitStatus(e.err))
+		return
+	}
+	n.state = Restarting
+	c.event("%s crashed after %v (%s), restarting in %v (%d in a row)",
+		n.id, ran, exitStatus(e.err), c.config.RestartDelay, n.crashes)
+	time.AfterFunc(c.config.RestartDelay, func() {
+		select {
+		case c.restarts <- n:
+		case <-c.done:
+		}
+	})
+}
+
+// shutdown asks every replica to stop and kills those still running
+// after the grace period, or at a second interrupt.
+func (c *Cluster) shutdown(interrupts <-chan os.Signal) {
+	c.stopping = true
+	for _, n := range c.nodes {
+		n.revive = false
+		if n.cmd != nil && n.state != Stopping {
+			c.stop(n)
+		}
+	}
+	grace := time.NewTimer(c.config.Grace)
+	defer grace.Stop()
+	killAll := func() {
+		for _, n := range c.nodes {
+			if n.cmd != nil {
+				n.cmd.Process.Kill()
+			}
+		}
+	}
+	for c.running() > 0 {
+		select {
+		case e := <-c.exits:
+			c.exited(e)
+		case <-grace.C:
+			c.event("%d replicas still running after %v, killing them", c.running(), c.config.Grace)
+			killAll()
+		case <-interrupts:
+			killAll()
+		}
+	}
+	c.event("cluster stopped")
+}
+
+func (c *Cluster) running() int {
+	running := 0
+	for _, n := range c.nodes {
+		if n.cmd != nil {
+			running++
+		}
+	}
+	return running
+}
+
+// idle is true when no replica runs or is about to.
+func (c *Cluster) idle() bool {
+	for _, n := range c.nodes {
+		if n.cmd != nil || n.state == Restarting {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cluster) status() {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tPID\tUP\tCRASHES\tLAST EXIT")
+	for _, n := range c.nodes {
+		pid, up, last := "-", "-", "-"
+		if n.cmd != nil {
+			pid = fmt.Sprint(n.cmd.Process.Pid)
+			up = time.Since(n.started).Round(time.Second).String()
+		}
+		if n.err != nil || n.state == Stopped && !n.started.IsZero() {
+			last = exitStatus(n.err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", n.id, n.state, pid, up, n.crashes, last)
+	}
+	w.Flush()
+	c.out.Lock()
+	c.events.Write(b.Bytes())
+	c.out.Unlock()
+}
+
+func (c *Cluster) event(format string, args ...interface{}) {
+	c.out.Lock()
+	defer c.out.Unlock()
+	fmt.Fprintf(c.events, "cluster: "+format+"\n", args...)
+}
+
+func (c *Cluster) closeLogs() {
+	for _, n := range c.nodes {
+		if n.log != nil {
+			n.log.Close()
+		}
+	}
+}
+
+func exitStatus(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// output copies what a replica writes to its log file, and line by
+// line, prefixed with its id, to the stream.
+type output struct {
+	prefix  []byte
+	file    io.Writer
+	stream  io.Writer
+	mu      *sync.Mutex
+	partial []byte
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	if o.file != nil {
+		if _, err := o.file.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	if o.stream == nil {
+		return len(p), nil
+	}
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.writeLine(o.partial[:i+1])
+		o.partial = o.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes out the last line of a replica that did not end it.
+func (o *output) flush() {
+	if o.stream != nil && len(o.partial) > 0 {
+		o.writeLine(append(o.partial, '\n'))
+		o.partial = nil
+	}
+}
+
+func (o *output) writeLine(line []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.stream.Write(o.prefix)
+	o.stream.Write(line)
+}
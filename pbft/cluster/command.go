@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/nodelist"
+)
+
+// Command runs the cluster subcommand with args and returns its exit
+// status:
+//
+//	pabft cluster -n 19 -restart
+//	pabft cluster -stream -logs - -nodes Node1,Node2 -- -trace 'logs/{id}.trace.jsonl'
+//
+// Flags after -- go to every replica, {id} in them replaced by its node
+// id. Commands on stdin kill, stop and start replicas; see Help.
+func Command(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cluster", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var config Config
+	numNodes := flags.Int("n", 0, "write a local node list of this many replicas to -node-list first")
+	flags.StringVar(&config.NodeList, "node-list", "/tmp/node.list", "node list of the cluster")
+	only := flags.String("nodes", "", "run only these replicas of the node list, e.g. Node1,Node2")
+	flags.StringVar(&config.Binary, "bin", "", "pabft binary to run the replicas with (default this one)")
+	flags.StringVar(&config.LogDir, "logs", "", "directory for <id>.log of every replica (default logs/<date>, linked from logs/recent; - for none)")
+	stream := flags.Bool("stream", false, "copy every line of the replicas to stdout, prefixed with the node id")
+	flags.BoolVar(&config.Restart, "restart", false, "start a replica again when it crashes")
+	flags.DurationVar(&config.RestartDelay, "restart-delay", time.Second, "time before a crashed replica starts again")
+	flags.IntVar(&config.MaxRestarts, "max-restarts", 3, "restarts in a row after which a crashed replica stays down, 0 for none")
+	flags.DurationVar(&config.Grace, "grace", 5*time.Second, "time replicas have to stop before they are killed")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cluster [flags] [-- replica flags]")
+		flags.PrintDefaults()
+		fmt.Fprintln(flags.Output(), Help)
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	config.Args = flags.Args()
+	fail := func(err error) int {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if config.Binary == "" {
+		binary, err := os.Executable()
+		if err != nil {
+			return fail(err)
+		}
+		config.Binary = binary
+	}
+	if *numNodes > 0 {
+		if err := nodelist.WriteFile(config.NodeList, nodelist.Local(*numNodes, "localhost"), stdout); err != nil {
+			return fail(err)
+		}
+	}
+	nodeTable, err := nodelist.Read(config.NodeList)
+	if err != nil {
+		return fail(err)
+	}
+	var ids []string
+	listed := make(map[string]bool)
+	for _, nodeInfo := range nodeTable {
+		ids = append(ids, nodeInfo.NodeID)
+		listed[nodeInfo.NodeID] = true
+	}
+	if *only != "" {
+		ids = strings.Split(*only, ",")
+		for _, id := range ids {
+			if !listed[id] {
+				return fail(fmt.Errorf("%s is not in %s", id, config.NodeList))
+			}
+		}
+	}
+
+	logDate := ""
+	switch config.LogDir {
+	case "-":
+		config.LogDir = ""
+	case "":
+		logDate = time.Now().Format("2006-01-02_15:04:05")
+		config.LogDir = filepath.Join("logs", logDate)
+	}
+	if *stream || config.LogDir == "" {
+		config.Stream = stdout
+	}
+
+	cluster, err := New(config, ids, stderr)
+	if err != nil {
+		return fail(err)
+	}
+	if logDate != "" {
+		recent := filepath.Join("logs", "recent")
+		os.Remove(recent)
+		os.Symlink(logDate, recent)
+	}
+	if config.LogDir != "" {
+		fmt.Fprintf(stderr, "cluster: %d replicas of %s, logs in %s\n", len(ids), config.NodeList, config.LogDir)
+	}
+
+	commands := make(chan string)
+	go func() {
+		defer close(commands)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			commands <- scanner.Text()
+		}
+	}()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+
+	if err := cluster.Run(commands, interrupts); err != nil {
+		return fail(err)
+	}
+	return 0
+}
@@ -0,0 +1,95 @@
+package consensus
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+
+	"filippo.io/edwards25519"
+)
+
+// SignedData is one signature to be checked by VerifyBatch.
+type SignedData struct {
+	Verifier  Verifier
+	Data      []byte
+	Signature []byte
+}
+
+// VerifyBatch reports whether every signature in items is valid.
+// All items must use the given scheme. Schemes that support batch
+// verification check the whole batch at once; the others fall back
+// to checking one signature after another. When the batch fails,
+// the caller has to verify the items one by one to find the bad ones.
+func VerifyBatch(scheme SignatureScheme, items []SignedData) bool {
+	if scheme == SchemeEd25519 && len(items) > 1 {
+		return verifyEd25519Batch(items)
+	}
+	for _, item := range items {
+		if !item.Verifier.Verify(item.Data, item.Signature) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyEd25519Batch checks the random linear combination
+//
+//	[8]( -(sum z_i s_i) B + sum z_i R_i + sum (z_i k_i) A_i ) = 0
+//
+// with 128-bit random z_i. It is the cofactored equation, which accepts
+// a few crafted signatures that ed25519.Verify rejects. Those can only be
+// made by the owner of the key, so a Byzantine replica gains nothing it
+// could not get by sending different messages to different replicas.
+func verifyEd25519Batch(items []SignedData) bool {
+	scalars := make([]*edwards25519.Scalar, 0, 2*len(items)+1)
+	points := make([]*edwards25519.Point, 0, 2*len(items)+1)
+
+	sumZS := edwards25519.NewScalar()
+	for _, item := range items {
+		pubKey, ok := item.Verifier.PublicKey().(ed25519.PublicKey)
+		if !ok || len(pubKey) != ed25519.PublicKeySize ||
+			len(item.Signature) != ed25519.SignatureSize {
+			return false
+		}
+		A, err := new(edwards25519.Point).SetBytes(pubKey)
+		if err != nil {
+			return false
+		}
+		R, err := new(edwards25519.Point).SetBytes(item.Signature[:32])
+		if err != nil {
+			return false
+		}
+		s, err := edwards25519.NewScalar().SetCanonicalBytes(item.Signature[32:])
+		if err != nil {
+			return false
+		}
+
+		h := sha512.New()
+		h.Write(item.Signature[:32])
+		h.Write(pubKey)
+		h.Write(item.Data)
+		k, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+		if err != nil {
+			return false
+		}
+
+		var zBytes [32]byte
+		if _, err := rand.Read(zBytes[:16]); err != nil {
+			return false
+		}
+		z, err := edwards25519.NewScalar().SetCanonicalBytes(zBytes[:])
+		if err != nil {
+			return false
+		}
+
+		sumZS.MultiplyAdd(z, s, sumZS)
+		scalars = append(scalars, z, edwards25519.NewScalar().Multiply(z, k))
+		points = append(points, R, A)
+	}
+	scalars = append(scalars, edwards25519.NewScalar().Negate(sumZS))
+	points = append(points, edwards25519.NewGeneratorPoint())
+
+	check := new(edwards25519.Point).VarTimeMultiScalarMult(scalars, points)
+	check.MultByCofactor(check)
+	return check.Equal(edwards25519.NewIdentityPoint()) == 1
+}
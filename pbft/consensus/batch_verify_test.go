@@ -0,0 +1,37 @@
+package consensus
+
+import (
+	"fmt"
+	"testing"
+)
+
+func signedBatch(t *testing.T, scheme SignatureScheme, n int) []SignedData {
+	t.Helper()
+	items := make([]SignedData, n)
+	for i := range items {
+		signer, err := GenerateSigner(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(fmt.Sprintf("message %d", i))
+		signature, err := signer.Sign(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items[i] = SignedData{Verifier: signer.Verifier(), Data: data, Signature: signature}
+	}
+	return items
+}
+
+func TestVerifyBatch(t *testing.T) {
+	for _, scheme := range []SignatureScheme{SchemeEd25519, SchemeECDSAP256} {
+		items := signedBatch(t, scheme, 8)
+		if !VerifyBatch(scheme, items) {
+			t.Errorf("%s: valid batch rejected", scheme)
+		}
+		items[5].Data = []byte("another message")
+		if VerifyBatch(scheme, items) {
+			t.Errorf("%s: batch with a bad signature accepted", scheme)
+		}
+	}
+}
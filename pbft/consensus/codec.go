@@ -0,0 +1,506 @@
+package consensus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Binary encoding of the consensus messages.
+//
+// Fields are written in declaration order: integers as varints, strings
+// and byte slices with a length prefix, pointers behind a presence byte,
+// and maps as a count followed by the entries sorted by key. The output
+// only depends on the message contents, so it is used for digests and
+// signatures as well as on the wire.
+
+var (
+	errShortBuffer = errors.New("binary message is truncated")
+	errNestedProof = errors.New("proof of a vote holds a proof itself")
+)
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) varint(v int64) {
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// present writes the presence byte of an optional field.
+func (e *encoder) present(ok bool) bool {
+	if ok {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+	return ok
+}
+
+type decoder struct {
+	buf []byte
+	err error
+
+	inProof bool // decoding the vote in a proof, see Envelope.decodeProof
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.buf = nil
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(errShortBuffer)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(errShortBuffer)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail(errShortBuffer)
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.buf)
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail(errShortBuffer)
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) present() bool {
+	if len(d.buf) == 0 {
+		d.fail(errShortBuffer)
+		return false
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	if b > 1 {
+		d.fail(fmt.Errorf("invalid presence byte %d", b))
+		return false
+	}
+	return b == 1
+}
+
+// count reads the number of entries of a map, bounded by the bytes left
+// so that a forged count cannot make us allocate a huge map.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail(errShortBuffer)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = fmt.Errorf("%d trailing bytes after binary message", len(d.buf))
+	}
+	return d.err
+}
+
+func marshal(encode func(e *encoder)) ([]byte, error) {
+	var e encoder
+	encode(&e)
+	return e.buf, nil
+}
+
+func unmarshal(data []byte, decode func(d *decoder)) error {
+	d := decoder{buf: data}
+	decode(&d)
+	return d.finish()
+}
+
+func (msg *RequestMsg) encode(e *encoder) {
+	e.varint(msg.Timestamp)
+	e.string(msg.ClientID)
+	e.string(msg.Operation)
+	e.string(msg.Data)
+	e.varint(msg.SequenceID)
+}
+
+func (msg *RequestMsg) decode(d *decoder) {
+	msg.Timestamp = d.varint()
+	msg.ClientID = d.string()
+	msg.Operation = d.string()
+	msg.Data = d.string()
+	msg.SequenceID = d.varint()
+}
+
+func (msg *RequestMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *RequestMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *ReplyMsg) encode(e *encoder) {
+	e.varint(msg.ViewID)
+	e.varint(msg.Timestamp)
+	e.string(msg.ClientID)
+	e.string(msg.NodeID)
+	e.string(msg.Result)
+}
+
+func (msg *ReplyMsg) decode(d *decoder) {
+	msg.ViewID = d.varint()
+	msg.Timestamp = d.varint()
+	msg.ClientID = d.string()
+	msg.NodeID = d.string()
+	msg.Result = d.string()
+}
+
+func (msg *ReplyMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *ReplyMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *PrepareMsg) encode(e *encoder) {
+	e.varint(msg.ViewID)
+	e.varint(msg.SequenceID)
+	e.string(msg.Digest)
+	e.varint(msg.EpochID)
+	e.string(msg.NodeID)
+	e.varint(int64(msg.Seed))
+}
+
+func (msg *PrepareMsg) decode(d *decoder) {
+	msg.ViewID = d.varint()
+	msg.SequenceID = d.varint()
+	msg.Digest = d.string()
+	msg.EpochID = d.varint()
+	msg.NodeID = d.string()
+	msg.Seed = int(d.varint())
+}
+
+func (msg *PrepareMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *PrepareMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func encodePrepareMsg(e *encoder, msg *PrepareMsg) {
+	if e.present(msg != nil) {
+		msg.encode(e)
+	}
+}
+
+func decodePrepareMsg(d *decoder) *PrepareMsg {
+	if !d.present() {
+		return nil
+	}
+	msg := &PrepareMsg{}
+	msg.decode(d)
+	return msg
+}
+
+func (msg *ReqPrePareMsgs) encode(e *encoder) {
+	if e.present(msg.RequestMsg != nil) {
+		msg.RequestMsg.encode(e)
+	}
+	encodePrepareMsg(e, msg.PrepareMsg)
+}
+
+func (msg *ReqPrePareMsgs) decode(d *decoder) {
+	if d.present() {
+		msg.RequestMsg = &RequestMsg{}
+		msg.RequestMsg.decode(d)
+	}
+	msg.PrepareMsg = decodePrepareMsg(d)
+}
+
+func (msg *ReqPrePareMsgs) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *ReqPrePareMsgs) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *PayloadMsg) encode(e *encoder) {
+	e.string(msg.Digest)
+	if e.present(msg.RequestMsg != nil) {
+		msg.RequestMsg.encode(e)
+	}
+}
+
+func (msg *PayloadMsg) decode(d *decoder) {
+	msg.Digest = d.string()
+	if d.present() {
+		msg.RequestMsg = &RequestMsg{}
+		msg.RequestMsg.decode(d)
+	}
+}
+
+func (msg *PayloadMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *PayloadMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *FetchMsg) encode(e *encoder) {
+	e.string(msg.Digest)
+	e.varint(msg.SequenceID)
+}
+
+func (msg *FetchMsg) decode(d *decoder) {
+	msg.Digest = d.string()
+	msg.SequenceID = d.varint()
+}
+
+func (msg *FetchMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *FetchMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *ChunkMsg) encode(e *encoder) {
+	e.string(msg.Digest)
+	e.varint(msg.SequenceID)
+	e.bytes(msg.Root)
+	e.varint(msg.Size)
+	e.varint(msg.DataShards)
+	e.varint(msg.Total)
+	e.varint(msg.Index)
+	e.bytes(msg.Chunk)
+	e.uvarint(uint64(len(msg.Proof)))
+	for _, hash := range msg.Proof {
+		e.bytes(hash)
+	}
+}
+
+func (msg *ChunkMsg) decode(d *decoder) {
+	msg.Digest = d.string()
+	msg.SequenceID = d.varint()
+	msg.Root = d.bytes()
+	msg.Size = d.varint()
+	msg.DataShards = d.varint()
+	msg.Total = d.varint()
+	msg.Index = d.varint()
+	msg.Chunk = d.bytes()
+	n := d.count()
+	msg.Proof = make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		msg.Proof = append(msg.Proof, d.bytes())
+	}
+}
+
+func (msg *ChunkMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *ChunkMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *VoteMsg) encode(e *encoder) {
+	e.varint(msg.ViewID)
+	e.varint(msg.SequenceID)
+	encodePrepareMsg(e, msg.PrepareMsg)
+	e.string(msg.Digest)
+	e.string(msg.NodeID)
+	e.varint(int64(msg.MsgType))
+	if e.present(msg.Proof != nil) {
+		msg.Proof.encode(e)
+	}
+}
+
+func (msg *VoteMsg) decode(d *decoder) {
+	msg.ViewID = d.varint()
+	msg.SequenceID = d.varint()
+	msg.PrepareMsg = decodePrepareMsg(d)
+	msg.Digest = d.string()
+	msg.NodeID = d.string()
+	msg.MsgType = MsgType(d.varint())
+	if d.present() {
+		msg.Proof = &Envelope{}
+		msg.Proof.decodeProof(d)
+	}
+}
+
+func (msg *VoteMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *VoteMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func encodeVoteMsgs(e *encoder, votes map[string]*VoteMsg) {
+	keys := make([]string, 0, len(votes))
+	for k := range votes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	e.uvarint(uint64(len(keys)))
+	for _, k := range keys {
+		e.string(k)
+		if e.present(votes[k] != nil) {
+			votes[k].encode(e)
+		}
+	}
+}
+
+func decodeVoteMsgs(d *decoder) map[string]*VoteMsg {
+	n := d.count()
+	votes := make(map[string]*VoteMsg, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.string()
+		var vote *VoteMsg
+		if d.present() {
+			vote = &VoteMsg{}
+			vote.decode(d)
+		}
+		votes[k] = vote
+	}
+	return votes
+}
+
+func (msg *CollateMsg) encode(e *encoder) {
+	encodePrepareMsg(e, msg.ReceivedPrepare)
+	encodeVoteMsgs(e, msg.ReceivedVoteMsg)
+	if e.present(msg.SentVoteMsg != nil) {
+		msg.SentVoteMsg.encode(e)
+	}
+	e.varint(msg.ViewID)
+	e.varint(msg.SequenceID)
+	e.string(msg.Digest)
+	e.varint(int64(msg.MsgType))
+	e.string(msg.NodeID)
+}
+
+func (msg *CollateMsg) decode(d *decoder) {
+	msg.ReceivedPrepare = decodePrepareMsg(d)
+	msg.ReceivedVoteMsg = decodeVoteMsgs(d)
+	if d.present() {
+		msg.SentVoteMsg = &VoteMsg{}
+		msg.SentVoteMsg.decode(d)
+	}
+	msg.ViewID = d.varint()
+	msg.SequenceID = d.varint()
+	msg.Digest = d.string()
+	msg.MsgType = MsgType(d.varint())
+	msg.NodeID = d.string()
+}
+
+func (msg *CollateMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *CollateMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *CheckPointMsg) encode(e *encoder) {
+	e.varint(msg.SequenceID)
+	e.string(msg.Digest)
+	e.string(msg.NodeID)
+}
+
+func (msg *CheckPointMsg) decode(d *decoder) {
+	msg.SequenceID = d.varint()
+	msg.Digest = d.string()
+	msg.NodeID = d.string()
+}
+
+func (msg *CheckPointMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *CheckPointMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *ViewChangeMsg) encode(e *encoder) {
+	e.string(msg.NodeID)
+	e.varint(msg.SequenceID)
+	e.varint(msg.NextCandidateIdx)
+	e.varint(msg.StableCheckPoint)
+
+	keys := make([]int64, 0, len(msg.SetP))
+	for k := range msg.SetP {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	e.uvarint(uint64(len(keys)))
+	for _, k := range keys {
+		e.varint(k)
+		if setPm := msg.SetP[k]; e.present(setPm != nil) {
+			encodePrepareMsg(e, setPm.PrepareMsg)
+			encodeVoteMsgs(e, setPm.VoteMsgs)
+		}
+	}
+}
+
+func (msg *ViewChangeMsg) decode(d *decoder) {
+	msg.NodeID = d.string()
+	msg.SequenceID = d.varint()
+	msg.NextCandidateIdx = d.varint()
+	msg.StableCheckPoint = d.varint()
+
+	n := d.count()
+	msg.SetP = make(map[int64]*SetPm, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.varint()
+		var setPm *SetPm
+		if d.present() {
+			setPm = &SetPm{
+				PrepareMsg: decodePrepareMsg(d),
+				VoteMsgs:   decodeVoteMsgs(d),
+			}
+		}
+		msg.SetP[k] = setPm
+	}
+}
+
+func (msg *ViewChangeMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *ViewChangeMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
+
+func (msg *NewViewMsg) encode(e *encoder) {
+	e.string(msg.NodeID)
+	e.varint(msg.SequenceID)
+	e.varint(msg.NextCandidateIdx)
+	e.varint(msg.EpochID)
+
+	keys := make([]string, 0, len(msg.SetViewChangeMsgs))
+	for k := range msg.SetViewChangeMsgs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	e.uvarint(uint64(len(keys)))
+	for _, k := range keys {
+		e.string(k)
+		if vcm := msg.SetViewChangeMsgs[k]; e.present(vcm != nil) {
+			vcm.encode(e)
+		}
+	}
+	e.varint(msg.Min_S)
+}
+
+func (msg *NewViewMsg) decode(d *decoder) {
+	msg.NodeID = d.string()
+	msg.SequenceID = d.varint()
+	msg.NextCandidateIdx = d.varint()
+	msg.EpochID = d.varint()
+
+	n := d.count()
+	msg.SetViewChangeMsgs = make(map[string]*ViewChangeMsg, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		k := d.string()
+		var vcm *ViewChangeMsg
+		if d.present() {
+			vcm = &ViewChangeMsg{}
+			vcm.decode(d)
+		}
+		msg.SetViewChangeMsgs[k] = vcm
+	}
+	msg.Min_S = d.varint()
+}
+
+func (msg *NewViewMsg) MarshalBinary() ([]byte, error)    { return marshal(msg.encode) }
+func (msg *NewViewMsg) UnmarshalBinary(data []byte) error { return unmarshal(data, msg.decode) }
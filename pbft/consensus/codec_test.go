@@ -0,0 +1,231 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// sampleMessages returns a message of every type, by path, with every
+// field set.
+func sampleMessages() map[string]Message {
+	prepare := &PrepareMsg{ViewID: 2, SequenceID: 7, Digest: "d7", EpochID: 1, NodeID: "Node1", Seed: 5}
+	vote := &VoteMsg{ViewID: 2, SequenceID: 7, PrepareMsg: prepare, Digest: "d7", NodeID: "Node2", MsgType: VOTE}
+	request := &RequestMsg{Timestamp: 1600000000, ClientID: "Client1", Operation: "put", Data: "x=1", SequenceID: 7}
+	return map[string]Message{
+		"/prepare": &ReqPrePareMsgs{RequestMsg: request, PrepareMsg: prepare},
+		"/vote":    vote,
+		"/collate": &CollateMsg{
+			ReceivedPrepare: prepare,
+			ReceivedVoteMsg: map[string]*VoteMsg{"Node2": vote, "Node3": nil},
+			SentVoteMsg:     vote,
+			ViewID:          2,
+			SequenceID:      7,
+			Digest:          "d7",
+			MsgType:         COMMITTED,
+			NodeID:          "Node3",
+		},
+		"/checkpoint": &CheckPointMsg{SequenceID: 10, Digest: "d10", NodeID: "Node4"},
+		"/viewchange": &ViewChangeMsg{
+			NodeID:           "Node2",
+			SequenceID:       8,
+			NextCandidateIdx: 11,
+			StableCheckPoint: 5,
+			SetP: map[int64]*SetPm{
+				6: {PrepareMsg: prepare, VoteMsgs: map[string]*VoteMsg{"Node2": vote}},
+				7: nil,
+			},
+		},
+		"/newview": &NewViewMsg{
+			NodeID:            "Node11",
+			SequenceID:        8,
+			NextCandidateIdx:  11,
+			EpochID:           1,
+			SetViewChangeMsgs: map[string]*ViewChangeMsg{"Node2": {NodeID: "Node2", SequenceID: 8, SetP: map[int64]*SetPm{}}},
+			Min_S:             6,
+		},
+		"/request": request,
+		"/reply":   &ReplyMsg{ViewID: 2, Timestamp: 1600000000, ClientID: "Client1", NodeID: "Node1", Result: "ok"},
+		"/payload": &PayloadMsg{Digest: "d7", RequestMsg: request},
+		"/fetch":   &FetchMsg{Digest: "d7", SequenceID: 7},
+		"/chunk": &ChunkMsg{
+			Digest: "d7", SequenceID: 7, Root: []byte{1, 2}, Size: 3, DataShards: 2, Total: 4,
+			Index: 1, Chunk: []byte{3, 4}, Proof: [][]byte{{5}, {6, 7}},
+		},
+	}
+}
+
+// sampleEnvelope returns msg in an envelope as sent by Node1, with a
+// made-up signature.
+func sampleEnvelope(t *testing.T, msgType string, msg Message) *Envelope {
+	t.Helper()
+	env, err := NewEnvelope(msgType, "Node1", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Receiver = "Node2"
+	env.Scheme = SchemeEd25519
+	env.Signature = []byte{0xde, 0xad, 0xbe, 0xef}
+	return env
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{BinaryCodec, JSONCodec} {
+		for msgType, msg := range sampleMessages() {
+			env := sampleEnvelope(t, msgType, msg)
+			data, err := codec.Marshal(env)
+			if err != nil {
+				t.Fatalf("%s %s: %v", codec.Name(), msgType, err)
+			}
+			decoded, err := codec.Unmarshal(data)
+			if err != nil {
+				t.Fatalf("%s %s: %v", codec.Name(), msgType, err)
+			}
+			if !reflect.DeepEqual(decoded, env) {
+				t.Errorf("%s %s: decoded\n%+v\nwant\n%+v", codec.Name(), msgType, decoded, env)
+			}
+			// The signature covers the same bytes whichever codec carried it.
+			if !bytes.Equal(decoded.SigningBytes(), env.SigningBytes()) {
+				t.Errorf("%s %s: signing bytes changed", codec.Name(), msgType)
+			}
+			peekType, sender, err := codec.PeekHeader(data)
+			if err != nil || peekType != msgType || sender != "Node1" {
+				t.Errorf("%s %s: PeekHeader = %q, %q, %v", codec.Name(), msgType, peekType, sender, err)
+			}
+		}
+	}
+}
+
+// The binary encoding is signed and hashed, so it must not change
+// between versions of the code.
+func TestBinaryGolden(t *testing.T) {
+	golden := map[string]string{
+		"/checkpoint": "1403643130054e6f646534",
+		"/chunk":      "0264370e02010206040802020304020105020607",
+		"/collate":    "01040e02643702054e6f6465310a02054e6f64653201040e01040e02643702054e6f6465310a026437054e6f6465320000054e6f6465330001040e01040e02643702054e6f6465310a026437054e6f6465320000040e02643706054e6f646533",
+		"/fetch":      "0264370e",
+		"/newview":    "064e6f6465313110160201054e6f64653201054e6f646532100000000c",
+		"/payload":    "0264370180c0f0f50b07436c69656e74310370757403783d310e",
+		"/prepare":    "0180c0f0f50b07436c69656e74310370757403783d310e01040e02643702054e6f6465310a",
+		"/reply":      "0480c0f0f50b07436c69656e7431054e6f646531026f6b",
+		"/request":    "80c0f0f50b07436c69656e74310370757403783d310e",
+		"/viewchange": "054e6f64653210160a020c0101040e02643702054e6f6465310a01054e6f64653201040e01040e02643702054e6f6465310a026437054e6f64653200000e00",
+		"/vote":       "040e01040e02643702054e6f6465310a026437054e6f6465320000",
+	}
+	for msgType, msg := range sampleMessages() {
+		data, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", msgType, err)
+		}
+		if got := hex.EncodeToString(data); got != golden[msgType] {
+			t.Errorf("%s: encoded as\n%s\nwant\n%s", msgType, got, golden[msgType])
+		}
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	for msgType, msg := range sampleMessages() {
+		data, err := BinaryCodec.Marshal(sampleEnvelope(t, msgType, msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(data); n++ {
+			if _, err := BinaryCodec.Unmarshal(data[:n]); err == nil {
+				t.Errorf("%s: %d of %d bytes decoded", msgType, n, len(data))
+			}
+		}
+		if _, err := BinaryCodec.Unmarshal(append(data, 0)); err == nil {
+			t.Errorf("%s: trailing byte decoded", msgType)
+		}
+	}
+}
+
+func TestBinaryOversizedLength(t *testing.T) {
+	// A length or a count far beyond the bytes that follow it.
+	var e encoder
+	e.string("Node1")
+	e.varint(7)
+	e.uvarint(1 << 62)
+	for _, msg := range []Message{&CheckPointMsg{}, &ViewChangeMsg{}, &NewViewMsg{}, &ChunkMsg{}} {
+		if err := msg.UnmarshalBinary(e.buf); err == nil {
+			t.Errorf("%T decoded from an oversized length", msg)
+		}
+	}
+	var env encoder
+	env.uvarint(EnvelopeVersion)
+	env.uvarint(1 << 40)
+	if err := (&Envelope{}).UnmarshalBinary(env.buf); !errors.Is(err, errShortBuffer) {
+		t.Errorf("envelope with an oversized message type: %v, want %v", err, errShortBuffer)
+	}
+}
+
+func TestJSONMalformed(t *testing.T) {
+	data, err := JSONCodec.Marshal(sampleEnvelope(t, "/vote", sampleMessages()["/vote"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := JSONCodec.Unmarshal(data[:n]); err == nil {
+			t.Errorf("%d of %d bytes decoded", n, len(data))
+		}
+	}
+}
+
+// provenVote returns a vote carrying the envelope it was sent in.
+func provenVote(t *testing.T) *VoteMsg {
+	t.Helper()
+	vote := *sampleMessages()["/vote"].(*VoteMsg)
+	env := sampleEnvelope(t, "/vote", &vote)
+	vote.Proof = env
+	return &vote
+}
+
+func TestForwardedVotes(t *testing.T) {
+	vote := provenVote(t)
+	collate := &CollateMsg{ReceivedVoteMsg: map[string]*VoteMsg{"Node2": vote}, SequenceID: 7, NodeID: "Node3"}
+	for _, codec := range []Codec{BinaryCodec, JSONCodec} {
+		data, err := codec.Marshal(sampleEnvelope(t, "/collate", collate))
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		env, err := codec.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		proof := env.Msg.(*CollateMsg).ReceivedVoteMsg["Node2"].Proof
+		if proof == nil || !bytes.Equal(proof.SigningBytes(), vote.Proof.SigningBytes()) {
+			t.Errorf("%s: proof of the forwarded vote lost", codec.Name())
+		}
+	}
+}
+
+func TestNestedProofRejected(t *testing.T) {
+	// A proof whose vote carries a proof again.
+	inner := provenVote(t)
+	outer := *inner
+	outer.Proof = &Envelope{
+		Version: EnvelopeVersion, MsgType: "/vote", Sender: "Node2", Msg: inner,
+		Scheme: SchemeEd25519, Signature: []byte{1},
+	}
+	var payload encoder
+	inner.encode(&payload)
+	outer.Proof.Payload = payload.buf
+
+	data, err := outer.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&VoteMsg{}).UnmarshalBinary(data); !errors.Is(err, errNestedProof) {
+		t.Errorf("binary: %v, want %v", err, errNestedProof)
+	}
+
+	proof := `{"version":1,"msgType":"/vote","sender":"Node2","payload":{"nodeID":"Node2"}}`
+	for i := 0; i < 2; i++ {
+		proof = `{"version":1,"msgType":"/vote","sender":"Node2","payload":{"nodeID":"Node2","proof":` + proof + `}}`
+	}
+	if _, err := JSONCodec.Unmarshal([]byte(proof)); !errors.Is(err, errNestedProof) {
+		t.Errorf("json: %v, want %v", err, errNestedProof)
+	}
+}
@@ -0,0 +1,441 @@
+package consensus
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+)
+
+// EnvelopeVersion is the version of the envelope layout written by this node.
+const EnvelopeVersion = 1
+
+// Message is implemented by every message that can be put in an Envelope.
+type Message interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// Envelope wraps a consensus message on the wire. The header repeats
+// the epoch, view and sequence of the message so that a receiver can
+// route or drop it without decoding the payload. Receiver is set on
+// messages sent to a single node and is empty otherwise. The signature covers
+// the binary encoding of every other field (see SigningBytes), so it
+// does not depend on the codec the envelope travelled with.
+type Envelope struct {
+	Version    int
+	MsgType    string // "/prepare", "/vote", "/collate", ...
+	Sender     string
+	Receiver   string
+	EpochID    int64
+	ViewID     int64
+	SequenceID int64
+	Payload    []byte // binary encoding of Msg
+	Scheme     SignatureScheme
+	Signature  []byte
+
+	// Msg is the decoded payload. It is not encoded itself.
+	Msg Message
+}
+
+// NewMessage returns an empty message of the type sent on path msgType.
+func NewMessage(msgType string) (Message, error) {
+	switch msgType {
+	case "/prepare":
+		// ReqPrePareMsgs have RequestMsg and PrepareMsg
+		return &ReqPrePareMsgs{}, nil
+	case "/vote":
+		return &VoteMsg{}, nil
+	case "/collate":
+		return &CollateMsg{}, nil
+	case "/checkpoint":
+		return &CheckPointMsg{}, nil
+	case "/viewchange":
+		return &ViewChangeMsg{}, nil
+	case "/newview":
+		return &NewViewMsg{}, nil
+	case "/request":
+		return &RequestMsg{}, nil
+	case "/reply":
+		return &ReplyMsg{}, nil
+	case "/payload":
+		return &PayloadMsg{}, nil
+	case "/fetch":
+		return &FetchMsg{}, nil
+	case "/chunk":
+		return &ChunkMsg{}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %q", msgType)
+}
+
+// NewEnvelope encodes msg into an unsigned envelope from sender.
+func NewEnvelope(msgType string, sender string, msg Message) (*Envelope, error) {
+	payload, err := msg.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{
+		Version: EnvelopeVersion,
+		MsgType: msgType,
+		Sender:  sender,
+		Payload: payload,
+		Msg:     msg,
+	}
+	env.EpochID, env.ViewID, env.SequenceID = messageHeader(msg)
+	return env, nil
+}
+
+// Sign signs the envelope with the key of its sender.
+func (env *Envelope) Sign(signer Signer) error {
+	env.Scheme = signer.Scheme()
+	signature, err := signer.Sign(env.SigningBytes())
+	if err != nil {
+		return err
+	}
+	env.Signature = signature
+	return nil
+}
+
+// SigningBytes returns the deterministic encoding that is signed.
+func (env *Envelope) SigningBytes() []byte {
+	var e encoder
+	env.encodeHeader(&e)
+	return e.buf
+}
+
+func messageHeader(msg Message) (epochID int64, viewID int64, sequenceID int64) {
+	switch m := msg.(type) {
+	case *ReqPrePareMsgs:
+		if m.PrepareMsg != nil {
+			return m.PrepareMsg.EpochID, m.PrepareMsg.ViewID, m.PrepareMsg.SequenceID
+		}
+	case *PrepareMsg:
+		return m.EpochID, m.ViewID, m.SequenceID
+	case *VoteMsg:
+		if m.PrepareMsg != nil {
+			epochID = m.PrepareMsg.EpochID
+		}
+		return epochID, m.ViewID, m.SequenceID
+	case *CollateMsg:
+		if m.ReceivedPrepare != nil {
+			epochID = m.ReceivedPrepare.EpochID
+		}
+		return epochID, m.ViewID, m.SequenceID
+	case *CheckPointMsg:
+		return 0, 0, m.SequenceID
+	case *ViewChangeMsg:
+		return 0, 0, m.SequenceID
+	case *NewViewMsg:
+		return m.EpochID, 0, m.SequenceID
+	case *ReplyMsg:
+		return 0, m.ViewID, 0
+	case *RequestMsg:
+		return 0, 0, m.SequenceID
+	case *PayloadMsg:
+		if m.RequestMsg != nil {
+			return 0, 0, m.RequestMsg.SequenceID
+		}
+	case *FetchMsg:
+		return 0, 0, m.SequenceID
+	case *ChunkMsg:
+		return 0, 0, m.SequenceID
+	}
+	return 0, 0, 0
+}
+
+// messageAuthor returns the node a message names as its author, and
+// false for messages that name none.
+func messageAuthor(msg Message) (string, bool) {
+	switch m := msg.(type) {
+	case *ReqPrePareMsgs:
+		if m.PrepareMsg != nil {
+			return m.PrepareMsg.NodeID, true
+		}
+	case *PrepareMsg:
+		return m.NodeID, true
+	case *VoteMsg:
+		return m.NodeID, true
+	case *CollateMsg:
+		return m.NodeID, true
+	case *CheckPointMsg:
+		return m.NodeID, true
+	case *ViewChangeMsg:
+		return m.NodeID, true
+	case *NewViewMsg:
+		return m.NodeID, true
+	case *ReplyMsg:
+		return m.NodeID, true
+	}
+	return "", false
+}
+
+// CheckAuthor returns an error if the message names another node as
+// its author than the sender who signed the envelope. The signature
+// only vouches for the sender, so a replica must not be able to speak
+// in the name of another.
+func (env *Envelope) CheckAuthor() error {
+	if author, ok := messageAuthor(env.Msg); ok && author != env.Sender {
+		return fmt.Errorf("%s message of %q sent by %q", env.MsgType, author, env.Sender)
+	}
+	return nil
+}
+
+func (env *Envelope) encodeHeader(e *encoder) {
+	e.uvarint(uint64(env.Version))
+	e.string(env.MsgType)
+	e.string(env.Sender)
+	e.string(env.Receiver)
+	e.varint(env.EpochID)
+	e.varint(env.ViewID)
+	e.varint(env.SequenceID)
+	e.bytes(env.Payload)
+	e.string(string(env.Scheme))
+}
+
+func (env *Envelope) encode(e *encoder) {
+	env.encodeHeader(e)
+	e.bytes(env.Signature)
+}
+
+func (env *Envelope) decode(d *decoder) {
+	env.decodeFields(d)
+	if d.err != nil {
+		return
+	}
+	if err := env.decodePayload(); err != nil {
+		d.fail(err)
+	}
+}
+
+// decodeFields decodes the envelope but not its payload.
+func (env *Envelope) decodeFields(d *decoder) {
+	env.Version = int(d.uvarint())
+	if d.err == nil && env.Version != EnvelopeVersion {
+		d.fail(fmt.Errorf("unsupported envelope version %d", env.Version))
+		return
+	}
+	env.MsgType = d.string()
+	env.Sender = d.string()
+	env.Receiver = d.string()
+	env.EpochID = d.varint()
+	env.ViewID = d.varint()
+	env.SequenceID = d.varint()
+	env.Payload = d.bytes()
+	env.Scheme = SignatureScheme(d.string())
+	env.Signature = d.bytes()
+}
+
+// decodeProof decodes the envelope a vote was received in, see
+// VoteMsg.Proof. It holds a vote without a proof of its own: envelopes
+// nested deeper would each be decoded and copied again.
+func (env *Envelope) decodeProof(d *decoder) {
+	if d.inProof {
+		d.fail(errNestedProof)
+		return
+	}
+	env.decodeFields(d)
+	if d.err != nil {
+		return
+	}
+	if env.MsgType != "/vote" {
+		d.fail(fmt.Errorf("proof of a vote is a %s message", env.MsgType))
+		return
+	}
+	vote := &VoteMsg{}
+	payload := decoder{buf: env.Payload, inProof: true}
+	vote.decode(&payload)
+	if err := payload.finish(); err != nil {
+		d.fail(fmt.Errorf("cannot decode proof of a vote: %w", err))
+		return
+	}
+	env.Msg = vote
+}
+
+func (env *Envelope) decodePayload() error {
+	msg, err := NewMessage(env.MsgType)
+	if err != nil {
+		return err
+	}
+	if err := msg.UnmarshalBinary(env.Payload); err != nil {
+		return fmt.Errorf("cannot decode %s message: %v", env.MsgType, err)
+	}
+	env.Msg = msg
+	return nil
+}
+
+func (env *Envelope) MarshalBinary() ([]byte, error) {
+	var e encoder
+	env.encode(&e)
+	return e.buf, nil
+}
+
+func (env *Envelope) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, env.decode)
+}
+
+// JSON form of an envelope. The payload is written as the JSON of the
+// message, so that it can be read when debugging.
+type jsonEnvelope struct {
+	Version    int             `json:"version"`
+	MsgType    string          `json:"msgType"`
+	Sender     string          `json:"sender"`
+	Receiver   string          `json:"receiver,omitempty"`
+	EpochID    int64           `json:"epochID"`
+	ViewID     int64           `json:"viewID"`
+	SequenceID int64           `json:"sequenceID"`
+	Payload    json.RawMessage `json:"payload"`
+	Scheme     SignatureScheme `json:"scheme"`
+	Signature  []byte          `json:"signature"`
+}
+
+func (env *Envelope) MarshalJSON() ([]byte, error) {
+	if env.Msg == nil {
+		if err := env.decodePayload(); err != nil {
+			return nil, err
+		}
+	}
+	msg := env.Msg
+	// A vote points back to the envelope it came in, which is not part
+	// of its payload.
+	if vote, ok := msg.(*VoteMsg); ok && vote.Proof != nil {
+		unproven := *vote
+		unproven.Proof = nil
+		msg = &unproven
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonEnvelope{
+		Version:    env.Version,
+		MsgType:    env.MsgType,
+		Sender:     env.Sender,
+		Receiver:   env.Receiver,
+		EpochID:    env.EpochID,
+		ViewID:     env.ViewID,
+		SequenceID: env.SequenceID,
+		Payload:    payload,
+		Scheme:     env.Scheme,
+		Signature:  env.Signature,
+	})
+}
+
+// UnmarshalJSON decodes the payload and re-encodes it in binary,
+// which is what the signature was made over.
+func (env *Envelope) UnmarshalJSON(data []byte) error {
+	var j jsonEnvelope
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.Version != EnvelopeVersion {
+		return fmt.Errorf("unsupported envelope version %d", j.Version)
+	}
+	msg, err := NewMessage(j.MsgType)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(j.Payload, msg); err != nil {
+		return fmt.Errorf("cannot decode %s message: %v", j.MsgType, err)
+	}
+	if vote, ok := msg.(*VoteMsg); ok && vote.Proof != nil {
+		if proven, ok := vote.Proof.Msg.(*VoteMsg); !ok || proven.Proof != nil {
+			return errNestedProof
+		}
+	}
+	payload, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	*env = Envelope{
+		Version:    j.Version,
+		MsgType:    j.MsgType,
+		Sender:     j.Sender,
+		Receiver:   j.Receiver,
+		EpochID:    j.EpochID,
+		ViewID:     j.ViewID,
+		SequenceID: j.SequenceID,
+		Payload:    payload,
+		Scheme:     j.Scheme,
+		Signature:  j.Signature,
+		Msg:        msg,
+	}
+	return nil
+}
+
+// Codec encodes envelopes for the wire.
+type Codec interface {
+	Name() string
+	Marshal(env *Envelope) ([]byte, error)
+	Unmarshal(data []byte) (*Envelope, error)
+
+	// PeekHeader returns the message type and sender of an encoded
+	// envelope without decoding the rest of it.
+	PeekHeader(data []byte) (msgType string, sender string, err error)
+}
+
+var (
+	// BinaryCodec is the compact default codec.
+	BinaryCodec Codec = binaryCodec{}
+	// JSONCodec is slower and larger, but readable.
+	JSONCodec Codec = jsonCodec{}
+)
+
+// CodecByName returns the codec called name ("binary" or "json").
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case BinaryCodec.Name():
+		return BinaryCodec, nil
+	case JSONCodec.Name():
+		return JSONCodec, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q (want %s or %s)",
+		name, BinaryCodec.Name(), JSONCodec.Name())
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return "binary" }
+
+func (binaryCodec) Marshal(env *Envelope) ([]byte, error) { return env.MarshalBinary() }
+
+func (binaryCodec) Unmarshal(data []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := env.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (binaryCodec) PeekHeader(data []byte) (string, string, error) {
+	d := decoder{buf: data}
+	if version := int(d.uvarint()); d.err == nil && version != EnvelopeVersion {
+		return "", "", fmt.Errorf("unsupported envelope version %d", version)
+	}
+	msgType := d.string()
+	sender := d.string()
+	return msgType, sender, d.err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(env *Envelope) ([]byte, error) { return json.Marshal(env) }
+
+func (jsonCodec) Unmarshal(data []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(data, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (jsonCodec) PeekHeader(data []byte) (string, string, error) {
+	var header struct {
+		MsgType string `json:"msgType"`
+		Sender  string `json:"sender"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return "", "", err
+	}
+	return header.MsgType, header.Sender, nil
+}
@@ -1,13 +1,16 @@
 package consensus
+
 import (
+	"log/slog"
 	"time"
 )
+
 type PBFT interface {
 	/*
-	StartConsensus(request *RequestMsg, sequenceID int64) (*PrePrepareMsg, error)
-	PrePrepare(prePrepareMsg *PrePrepareMsg) (*VoteMsg, error)
-	Prepare(prepareMsg *VoteMsg) (*VoteMsg, error)
-	Commit(commitMsg *VoteMsg) (*ReplyMsg, *RequestMsg, error)
+		StartConsensus(request *RequestMsg, sequenceID int64) (*PrePrepareMsg, error)
+		PrePrepare(prePrepareMsg *PrePrepareMsg) (*VoteMsg, error)
+		Prepare(prepareMsg *VoteMsg) (*VoteMsg, error)
+		Commit(commitMsg *VoteMsg) (*ReplyMsg, *RequestMsg, error)
 	*/
 	//StartConsensus(request *RequestMsg, sequenceID int64) (*PrepareMsg, error)
 	Prepare(prepareMsg *PrepareMsg, requestMsg *RequestMsg) (VoteMsg, error)
@@ -19,13 +22,14 @@ type PBFT interface {
 	SetBizantine(nodeID string) bool
 	GetSequenceID() int64
 	GetF() int
+	GetLogger() *slog.Logger
 
 	GetMsgReceiveChannel() <-chan interface{}
 	GetMsgSendChannel() chan<- interface{}
 	GetMsgExitReceiveChannel() <-chan int64
 	GetMsgExitSendChannel() chan<- int64
 	GetMsgExitReceiveChannel1() <-chan int64
-	GetMsgExitSendChannel1() chan<- int64	
+	GetMsgExitSendChannel1() chan<- int64
 	GetTimerStartReceiveChannel() <-chan string
 	GetTimerStartSendChannel() chan<- string
 	GetTimerStopReceiveChannel() <-chan string
@@ -4,85 +4,94 @@ import (
 	"errors"
 	"fmt"
 	// "log"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 )
+
 type State struct {
-	ViewID          int64
-	NodeID          string
-	MsgLogs         *MsgLogs
-	SequenceID      int64
+	ViewID     int64
+	NodeID     string
+	MsgLogs    *MsgLogs
+	SequenceID int64
 
-	MsgState 	chan interface{}
-	MsgExit		chan int64
-	MsgExit1	chan int64
-	TimerStartCh	chan string
-	TimerStopCh		chan string
+	MsgState     chan interface{}
+	MsgExit      chan int64
+	MsgExit1     chan int64
+	TimerStartCh chan string
+	TimerStopCh  chan string
 
 	// f: the number of Byzantine faulty nodes
 	// f = (n-1) / 3
 	// e.g., n = 5, f = 1
 
-	F int
-	B int
+	F     int
+	B     int
 	BNode map[string]int
 
 	ReceivedPrepareTime time.Time
+
+	// Logs with the node, epoch, view and seq of the state
+	Log *slog.Logger
 }
 
 type MsgLogs struct {
-	ReqMsg        *RequestMsg
-	Digest		  string
+	ReqMsg *RequestMsg
+	Digest string
 
-	PrepareMsg    *PrepareMsg
-	SentVoteMsg	  *VoteMsg
-	VoteMsgs       map[string]*VoteMsg
-	CollateMsgs    map[string]*CollateMsg
+	PrepareMsg  *PrepareMsg
+	SentVoteMsg *VoteMsg
+	VoteMsgs    map[string]*VoteMsg
+	CollateMsgs map[string]*CollateMsg
 
 	//PrepareMsgsMutex sync.RWMutex
 	//CommitMsgsMutex  sync.RWMutex
-	VoteMsgsMutex sync.RWMutex
+	VoteMsgsMutex    sync.RWMutex
 	CollateMsgsMutex sync.RWMutex
-	BNodeMutex sync.RWMutex
+	BNodeMutex       sync.RWMutex
 
 	// Count PREPARE message created from the current node
 	// as one PREPARE message. PRE-PREPARE message from
 	// primary node is also regarded as PREPARE message but
 	// do not count it, because it is not real PREPARE message.
-	TotalVoteMsg int32
-	TotalVoteOKMsg int32
+	TotalVoteMsg    int32
+	TotalVoteOKMsg  int32
 	TotalCollateMsg int32
 }
 
-func CreateState(viewID int64, nodeID string, totNodes int,  seqID int64) *State {
+func CreateState(viewID int64, nodeID string, totNodes int, seqID int64, logger *slog.Logger) *State {
+	if logger == nil {
+		logger = slog.Default()
+	}
 	state := &State{
 		ViewID: viewID,
 		NodeID: nodeID,
 		MsgLogs: &MsgLogs{
-			ReqMsg:        nil,
-			PrepareMsg:    nil,
-			SentVoteMsg:   nil,
-			VoteMsgs:	   make(map[string]*VoteMsg),
-			CollateMsgs:   make(map[string]*CollateMsg),
+			ReqMsg:      nil,
+			PrepareMsg:  nil,
+			SentVoteMsg: nil,
+			VoteMsgs:    make(map[string]*VoteMsg),
+			CollateMsgs: make(map[string]*CollateMsg),
 
 			// Setting these counters during consensus is unsafe
 			// because quorum condition check can be skipped.
-			TotalVoteMsg:		0,
-			TotalVoteOKMsg:    0,			
-			TotalCollateMsg:    0,
+			TotalVoteMsg:    0,
+			TotalVoteOKMsg:  0,
+			TotalCollateMsg: 0,
 		},
 		SequenceID: seqID,
 
-		MsgState: make(chan interface{}, totNodes * 200), // stack enough
-		MsgExit: make(chan int64, totNodes * 100),
-		MsgExit1: make(chan int64, totNodes * 100),
-		TimerStartCh: make(chan string, totNodes * 100),
-		TimerStopCh: make(chan string, totNodes * 100),
+		MsgState:     make(chan interface{}, totNodes*200), // stack enough
+		MsgExit:      make(chan int64, totNodes*100),
+		MsgExit1:     make(chan int64, totNodes*100),
+		TimerStartCh: make(chan string, totNodes*100),
+		TimerStopCh:  make(chan string, totNodes*100),
 
-		F: (totNodes-1) / 3,
+		F: (totNodes - 1) / 3,
 		B: 0,
 		//succChkPointDelete: 0,
+		Log: logger,
 	}
 	return state
 }
@@ -92,24 +101,23 @@ func (state *State) Prepare(prepareMsg *PrepareMsg, requestMsg *RequestMsg) (Vot
 	// case1: Making NULL Msg
 	if requestMsg == nil {
 		voteMsg = VoteMsg{
-			ViewID: state.ViewID,
-			Digest: "NULL",
+			ViewID:     state.ViewID,
+			Digest:     "NULL",
 			PrepareMsg: prepareMsg,
-			NodeID: "",
-			SequenceID: state.SequenceID, 	//This sequence number is already known..
-			MsgType: NULLMSG,
+			NodeID:     "",
+			SequenceID: state.SequenceID, //This sequence number is already known..
+			MsgType:    NULLMSG,
 		}
 		state.MsgLogs.Digest = "NULL"
 		state.MsgLogs.ReqMsg = nil
 		state.MsgLogs.PrepareMsg = prepareMsg
 
-		state.SequenceID = state.SequenceID		
 		state.MsgLogs.SentVoteMsg = &voteMsg
 		return voteMsg, nil
 	}
 
 	// case2: Making VoteMsg
-	digest, err := Digest(state.MsgLogs.ReqMsg)
+	digest, err := Digest(requestMsg)
 	if err != nil {
 		return voteMsg, err
 	}
@@ -119,13 +127,13 @@ func (state *State) Prepare(prepareMsg *PrepareMsg, requestMsg *RequestMsg) (Vot
 
 	state.SequenceID = prepareMsg.SequenceID
 	voteMsg = VoteMsg{
-		ViewID: state.ViewID,
-		Digest: state.MsgLogs.Digest,
+		ViewID:     state.ViewID,
+		Digest:     state.MsgLogs.Digest,
 		PrepareMsg: prepareMsg,
-		NodeID: "",
+		NodeID:     "",
 		SequenceID: state.SequenceID,
-		MsgType: VOTE,
-	}	
+		MsgType:    VOTE,
+	}
 	state.MsgLogs.SentVoteMsg = &voteMsg
 
 	// Verify if v, n(a.k.a. sequenceID), d are correct.
@@ -136,21 +144,21 @@ func (state *State) Prepare(prepareMsg *PrepareMsg, requestMsg *RequestMsg) (Vot
 	}
 	return voteMsg, nil
 }
-func (state *State) Vote(voteMsg *VoteMsg, totNodes int64) (CollateMsg, error){
+func (state *State) Vote(voteMsg *VoteMsg, totNodes int64) (CollateMsg, error) {
 	var collateMsg CollateMsg
 	var newTotalVoteOKMsg int32
 	var newTotalVoteMsg int32
 	// case1: Making UNCOMMITTED Msg
 	if voteMsg == nil {
 		collateMsg = CollateMsg{
-	   		ReceivedPrepare:	state.MsgLogs.PrepareMsg,
-	   		ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-	   		SentVoteMsg:    	state.MsgLogs.SentVoteMsg,
-	   		ViewID:				state.ViewID,
-	   		Digest:				state.MsgLogs.Digest,
-	   		NodeID:				"",
-	   		SequenceID:			state.SequenceID,
-	   		MsgType:			UNCOMMITTED,
+			ReceivedPrepare: state.MsgLogs.PrepareMsg,
+			ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+			SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+			ViewID:          state.ViewID,
+			Digest:          state.MsgLogs.Digest,
+			NodeID:          "",
+			SequenceID:      state.SequenceID,
+			MsgType:         UNCOMMITTED,
 		}
 		return collateMsg, nil
 	}
@@ -161,8 +169,7 @@ func (state *State) Vote(voteMsg *VoteMsg, totNodes int64) (CollateMsg, error){
 	state.MsgLogs.VoteMsgsMutex.Lock()
 	if _, ok := state.MsgLogs.VoteMsgs[voteMsg.NodeID]; ok {
 		state.SetBizantine(voteMsg.NodeID)
-		fmt.Printf("Vote message from %s is already received, sequence number=%d\n",
-		           voteMsg.NodeID, state.SequenceID)
+		state.Log.Debug("vote already received", "from", voteMsg.NodeID)
 		state.MsgLogs.VoteMsgsMutex.Unlock()
 		return collateMsg, nil
 	}
@@ -171,67 +178,68 @@ func (state *State) Vote(voteMsg *VoteMsg, totNodes int64) (CollateMsg, error){
 	newTotalVoteMsg = atomic.AddInt32(&state.MsgLogs.TotalVoteMsg, 1)
 	if voteMsg.MsgType == VOTE {
 		newTotalVoteOKMsg = atomic.AddInt32(&state.MsgLogs.TotalVoteOKMsg, 1)
-		
+
 	}
-	
+
 	// Verify Message
 	if err := state.verifyMsg(voteMsg.ViewID, voteMsg.SequenceID, voteMsg.Digest); err != nil {
 		state.SetBizantine(voteMsg.NodeID)
 		return collateMsg, errors.New("vote message is corrupted: " + err.Error() + " (nodeID: " + voteMsg.NodeID + ")")
 	}
 	// If Committed, make CollateMsg
-	if int(newTotalVoteOKMsg) == 2*state.F + 1 {
-	   	collateMsg := CollateMsg{
-	   		ReceivedPrepare: 	state.MsgLogs.PrepareMsg,
-	   		ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-	   		SentVoteMsg:        state.MsgLogs.SentVoteMsg,
-	   		ViewID:		state.ViewID,
-	   		Digest:		state.MsgLogs.Digest,
-	   		NodeID:		"",
-	   		SequenceID:	state.SequenceID,
-	   		MsgType:	COMMITTED,
-	   	}
+	if int(newTotalVoteOKMsg) == 2*state.F+1 {
+		collateMsg := CollateMsg{
+			ReceivedPrepare: state.MsgLogs.PrepareMsg,
+			ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+			SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+			ViewID:          state.ViewID,
+			Digest:          state.MsgLogs.Digest,
+			NodeID:          "",
+			SequenceID:      state.SequenceID,
+			MsgType:         COMMITTED,
+		}
 		return collateMsg, nil
 	}
-	if (int64(newTotalVoteMsg) == totNodes) && (int(newTotalVoteOKMsg) < 2*state.F + 1) {
-	   	collateMsg := CollateMsg{
-	   		ReceivedPrepare: 	state.MsgLogs.PrepareMsg,
-	   		ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-	   		SentVoteMsg:        state.MsgLogs.SentVoteMsg,
-	   		ViewID:		state.ViewID,
-	   		Digest:		state.MsgLogs.Digest,
-	   		NodeID:		"",
-	   		SequenceID:	state.SequenceID,
-	   		MsgType:	UNCOMMITTED,
-	   	}
-		return collateMsg, nil		
+	if (int64(newTotalVoteMsg) == totNodes) && (int(newTotalVoteOKMsg) < 2*state.F+1) {
+		collateMsg := CollateMsg{
+			ReceivedPrepare: state.MsgLogs.PrepareMsg,
+			ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+			SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+			ViewID:          state.ViewID,
+			Digest:          state.MsgLogs.Digest,
+			NodeID:          "",
+			SequenceID:      state.SequenceID,
+			MsgType:         UNCOMMITTED,
+		}
+		return collateMsg, nil
 	}
 
 	return collateMsg, nil
 }
-func (state *State) VoteAQ(TotalNode int32) (CollateMsg, error){
+func (state *State) VoteAQ(TotalNode int32) (CollateMsg, error) {
 
 	newTotalVoteOKMsg := state.MsgLogs.TotalVoteOKMsg
 	newTotalVoteMsg := state.MsgLogs.TotalVoteMsg
 	// byzantine length
 	byzantine := TotalNode - newTotalVoteMsg
-	fmt.Println("TotalNode :",TotalNode, "newTotalVoteMsg :",newTotalVoteMsg,  "newTotalVoteOKMsg :",newTotalVoteOKMsg,"byzantine length :", byzantine, "state.SequenceID :", state.SequenceID)
+	state.Log.Debug("adaptive vote quorum", "nodes", TotalNode, "votes", newTotalVoteMsg,
+		"ok", newTotalVoteOKMsg, "missing", byzantine)
 	collateMsg := CollateMsg{
-		ReceivedPrepare: 	state.MsgLogs.PrepareMsg,
-		ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-		SentVoteMsg:        state.MsgLogs.SentVoteMsg,
-		ViewID:		state.ViewID,
-		Digest:		state.MsgLogs.Digest,
-		NodeID:		"",
-		SequenceID:	state.SequenceID,
-		MsgType:	0,
-	}	
+		ReceivedPrepare: state.MsgLogs.PrepareMsg,
+		ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+		SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+		ViewID:          state.ViewID,
+		Digest:          state.MsgLogs.Digest,
+		NodeID:          "",
+		SequenceID:      state.SequenceID,
+		MsgType:         0,
+	}
 	// If Committed, make CollateMsg
-	if int(newTotalVoteOKMsg) >= (2*state.F - int(byzantine) + 1) && (2*state.F - int(byzantine) + 1) >= 1{
+	if int(newTotalVoteOKMsg) >= (2*state.F-int(byzantine)+1) && (2*state.F-int(byzantine)+1) >= 1 {
 		collateMsg.MsgType = COMMITTED
 
-	}else {
-		collateMsg.MsgType = UNCOMMITTED	
+	} else {
+		collateMsg.MsgType = UNCOMMITTED
 	}
 
 	return collateMsg, nil
@@ -243,10 +251,9 @@ func (state *State) Collate(collateMsg *CollateMsg) (CollateMsg, error) {
 	state.MsgLogs.CollateMsgsMutex.Lock()
 	if _, ok := state.MsgLogs.CollateMsgs[collateMsg.NodeID]; ok {
 		state.SetBizantine(collateMsg.NodeID)
-		fmt.Printf("Commit message from %s is already received, sequence number=%d\n",
-		           collateMsg.NodeID, state.SequenceID)
+		state.Log.Debug("collate already received", "from", collateMsg.NodeID)
 		state.MsgLogs.CollateMsgsMutex.Unlock()
-		return newcollateMsg,nil
+		return newcollateMsg, nil
 	}
 	state.MsgLogs.CollateMsgs[collateMsg.NodeID] = collateMsg
 	atomic.AddInt32(&state.MsgLogs.TotalCollateMsg, 1)
@@ -262,84 +269,85 @@ func (state *State) Collate(collateMsg *CollateMsg) (CollateMsg, error) {
 	switch collateMsg.MsgType {
 	case COMMITTED:
 		return CollateMsg{
-			ReceivedPrepare: 	state.MsgLogs.PrepareMsg,
-			ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-			SentVoteMsg:        state.MsgLogs.SentVoteMsg,
-			ViewID:		state.ViewID,
-			Digest:		state.MsgLogs.Digest,
-			NodeID:		"",
-			SequenceID:	state.SequenceID,
-			MsgType:	COMMITTED,
+			ReceivedPrepare: state.MsgLogs.PrepareMsg,
+			ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+			SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+			ViewID:          state.ViewID,
+			Digest:          state.MsgLogs.Digest,
+			NodeID:          "",
+			SequenceID:      state.SequenceID,
+			MsgType:         COMMITTED,
 		}, nil
 
 	case UNCOMMITTED:
-		if int(state.MsgLogs.TotalVoteOKMsg) >= 2*state.F + 1 {
+		if int(state.MsgLogs.TotalVoteOKMsg) >= 2*state.F+1 {
 			return CollateMsg{
 				//ReceivedPrepare: 	state.MsgLogs.PrepareMsg,
-				ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-				SentVoteMsg:        state.MsgLogs.SentVoteMsg,
-				ViewID:		state.ViewID,
-				Digest:		state.MsgLogs.Digest,
-				NodeID:		"",
-				SequenceID:	state.SequenceID,
-				MsgType:	COMMITTED,
+				ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+				SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+				ViewID:          state.ViewID,
+				Digest:          state.MsgLogs.Digest,
+				NodeID:          "",
+				SequenceID:      state.SequenceID,
+				MsgType:         COMMITTED,
 			}, nil
 		} else {
 			return CollateMsg{
 				//ReceivedPrepare: 	state.MsgLogs.PrepareMsg,
-				ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-				SentVoteMsg:        state.MsgLogs.SentVoteMsg,
-				ViewID:		state.ViewID,
-				Digest:		state.MsgLogs.Digest,
-				NodeID:		"",
-				SequenceID:	state.SequenceID,
-				MsgType:	UNCOMMITTED,
-			}, nil	
+				ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+				SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+				ViewID:          state.ViewID,
+				Digest:          state.MsgLogs.Digest,
+				NodeID:          "",
+				SequenceID:      state.SequenceID,
+				MsgType:         UNCOMMITTED,
+			}, nil
 		}
 		// TODO implement this
-	
+
 	}
 	return newcollateMsg, nil
 }
-func (state *State) CollateAQ(TotalNode int32) (CollateMsg, error){
+func (state *State) CollateAQ(TotalNode int32) (CollateMsg, error) {
 	newTotalCollateMsg := state.MsgLogs.TotalCollateMsg
 	newTotalVoteOKMsg := state.MsgLogs.TotalVoteOKMsg
 	//newTotalVoteMsg := state.MsgLogs.TotalVoteMsg
 	// byzantine length
 	byzantine := TotalNode - newTotalCollateMsg
-	fmt.Println("TotalNode :",TotalNode, "newTotalCollateMsg :",newTotalCollateMsg, "byzantine length :", byzantine, "state.SequenceID :", state.SequenceID)
+	state.Log.Debug("adaptive collate quorum", "nodes", TotalNode, "collates", newTotalCollateMsg,
+		"missing", byzantine)
 	collateMsg := CollateMsg{
-		ReceivedPrepare: 	state.MsgLogs.PrepareMsg,
-		ReceivedVoteMsg:	state.MsgLogs.VoteMsgs,
-		SentVoteMsg:        state.MsgLogs.SentVoteMsg,
-		ViewID:		state.ViewID,
-		Digest:		state.MsgLogs.Digest,
-		NodeID:		"",
-		SequenceID:	state.SequenceID,
-		MsgType:	0,
-	}	
+		ReceivedPrepare: state.MsgLogs.PrepareMsg,
+		ReceivedVoteMsg: state.MsgLogs.VoteMsgs,
+		SentVoteMsg:     state.MsgLogs.SentVoteMsg,
+		ViewID:          state.ViewID,
+		Digest:          state.MsgLogs.Digest,
+		NodeID:          "",
+		SequenceID:      state.SequenceID,
+		MsgType:         0,
+	}
 	// If Committed, make CollateMsg
-	if int(newTotalVoteOKMsg) >= (2*state.F - int(byzantine) + 1) && (2*state.F - int(byzantine) + 1) >= 1{
+	if int(newTotalVoteOKMsg) >= (2*state.F-int(byzantine)+1) && (2*state.F-int(byzantine)+1) >= 1 {
 		collateMsg.MsgType = COMMITTED
 
-	}else {
-		collateMsg.MsgType = UNCOMMITTED	
+	} else {
+		collateMsg.MsgType = UNCOMMITTED
 	}
 
 	return collateMsg, nil
 }
 func (state *State) SetBizantine(nodeID string) bool {
 	/*
-	state.MsgLogs.BNodeMutex.Lock()
-	if _, ok := state.BNode[nodeID]; !ok {
-		state.BNode[nodeID] = 1
-		state.B += 1
-		state.MsgLogs.BNodeMutex.Unlock()
-		return true
-	} else {
-		state.MsgLogs.BNodeMutex.Unlock()
-		return false
-	}
+		state.MsgLogs.BNodeMutex.Lock()
+		if _, ok := state.BNode[nodeID]; !ok {
+			state.BNode[nodeID] = 1
+			state.B += 1
+			state.MsgLogs.BNodeMutex.Unlock()
+			return true
+		} else {
+			state.MsgLogs.BNodeMutex.Unlock()
+			return false
+		}
 	*/
 	return false
 
@@ -350,6 +358,9 @@ func (state *State) GetSequenceID() int64 {
 func (state *State) GetF() int {
 	return state.F
 }
+func (state *State) GetLogger() *slog.Logger {
+	return state.Log
+}
 func (state *State) GetMsgReceiveChannel() <-chan interface{} {
 	return state.MsgState
 }
@@ -390,7 +401,7 @@ func (state *State) GetReqMsg() *RequestMsg {
 func (state *State) GetPrepareMsg() *PrepareMsg {
 	return state.MsgLogs.PrepareMsg
 }
-func (state *State) GetVoteMsgs() map[string]*VoteMsg{
+func (state *State) GetVoteMsgs() map[string]*VoteMsg {
 	newMap := make(map[string]*VoteMsg)
 
 	state.MsgLogs.VoteMsgsMutex.RLock()
@@ -419,18 +430,18 @@ func (state *State) FillHoleVoteMsgs(collateMsg *CollateMsg) {
 	var newTotalVoteOKMsg int32
 	//state.MsgLogs.VoteMsgsMutex.RLock()
 	for NodeID, VoteMsg := range state.GetVoteMsgs() {
-			if  VoteMsg == collateMsg.ReceivedVoteMsg[NodeID] || collateMsg.ReceivedVoteMsg[NodeID] == nil {
-				// fmt.Println("Already Save VoteMsg ", NodeID)
-				continue
-			}
-			state.GetVoteMsgs()[NodeID] = collateMsg.ReceivedVoteMsg[NodeID]
-			// fmt.Println("Save VoteMsg ", NodeID)
-			if collateMsg.ReceivedVoteMsg[NodeID].MsgType == VOTE {
-				// fmt.Println("Save VoteOKMsg ", NodeID)
-				newTotalVoteOKMsg = atomic.AddInt32(&state.MsgLogs.TotalVoteOKMsg, 1)
-			}			
+		if VoteMsg == collateMsg.ReceivedVoteMsg[NodeID] || collateMsg.ReceivedVoteMsg[NodeID] == nil {
+			// fmt.Println("Already Save VoteMsg ", NodeID)
+			continue
+		}
+		state.GetVoteMsgs()[NodeID] = collateMsg.ReceivedVoteMsg[NodeID]
+		// fmt.Println("Save VoteMsg ", NodeID)
+		if collateMsg.ReceivedVoteMsg[NodeID].MsgType == VOTE {
+			// fmt.Println("Save VoteOKMsg ", NodeID)
+			newTotalVoteOKMsg = atomic.AddInt32(&state.MsgLogs.TotalVoteOKMsg, 1)
+		}
 	}
-	fmt.Println("Total VoteOKMsg : ", newTotalVoteOKMsg)
+	state.Log.Debug("filled in votes from a collate", "ok", newTotalVoteOKMsg)
 	//state.MsgLogs.VoteMsgsMutex.RUnlock()
 }
 
@@ -488,7 +499,7 @@ func (state *State) committed() bool {
 	}
 
 	//if int(atomic.LoadInt32(&state.MsgLogs.TotalCommitMsg)) < 2*state.F + 1 {
-	if int(atomic.LoadInt32(&state.MsgLogs.TotalCollateMsg)) <= 2*state.F + 1 {
+	if int(atomic.LoadInt32(&state.MsgLogs.TotalCollateMsg)) <= 2*state.F+1 {
 		return false
 	}
 
@@ -1,6 +1,6 @@
 package consensus
 
-import "math/big"
+import "fmt"
 
 // Messages are TOCS style.
 
@@ -21,50 +21,72 @@ type ReplyMsg struct {
 }
 
 type PrepareMsg struct {
+	ViewID     int64  `json:"viewID"`
+	SequenceID int64  `json:"sequenceID"`
+	Digest     string `json:"digest"`
+	EpochID    int64  `json:"epochID"`
+	NodeID     string `json:"nodeID"`
+	Seed       int
+}
+
+type VoteMsg struct {
 	ViewID     int64       `json:"viewID"`
 	SequenceID int64       `json:"sequenceID"`
+	PrepareMsg *PrepareMsg `json:"prepareMsg"`
 	Digest     string      `json:"digest"`
-	EpochID 	int64      `json:"epochID"`
-	NodeID      string     `json:"nodeID"`
-	Seed		int
-}
+	NodeID     string      `json:"nodeID"`
+	MsgType    `json:"msgType"`
 
-type VoteMsg struct {
-	ViewID     int64  		`json:"viewID"`
-	SequenceID int64  		`json:"sequenceID"`
-	PrepareMsg *PrepareMsg	`json:"prepareMsg"`
-	Digest     string 		`json:"digest"`
-	NodeID     string 		`json:"nodeID"`
-	MsgType           		`json:"msgType"`
+	// The signed message this vote was received in. It lets a vote
+	// forwarded inside a COLLATE message be checked against the
+	// signature of the node that cast it.
+	Proof *Envelope `json:"proof,omitempty"`
 }
 
-//Adaptive BFT
+// Adaptive BFT
 type CollateMsg struct {
-	ReceivedPrepare		*PrepareMsg 		`json:"received_prepare`
-	ReceivedVoteMsg     map[string]*VoteMsg `json:"commit_proof"`
-	SentVoteMsg         *VoteMsg   			`json:"sent_vote_msg"`
-	ViewID              int64      			`json:"viewID"`
-	SequenceID          int64      			`json:"sequenceID"`
-	Digest              string     			`json:"digest"`
-	MsgType             				`json:"msgType"`
-	NodeID              string     			`json:"nodeID"`
+	ReceivedPrepare *PrepareMsg         `json:"received_prepare"`
+	ReceivedVoteMsg map[string]*VoteMsg `json:"commit_proof"`
+	SentVoteMsg     *VoteMsg            `json:"sent_vote_msg"`
+	ViewID          int64               `json:"viewID"`
+	SequenceID      int64               `json:"sequenceID"`
+	Digest          string              `json:"digest"`
+	MsgType         `json:"msgType"`
+	NodeID          string `json:"nodeID"`
 }
-type ReqPrePareMsgs struct {
-	RequestMsg *RequestMsg 
-	PrepareMsg *PrepareMsg 
+
+// Body of a request. It is disseminated apart from the PREPARE
+// message, which orders the request by digest only.
+type PayloadMsg struct {
+	Digest     string      `json:"digest"`
+	RequestMsg *RequestMsg `json:"requestMsg"`
 }
-type SignatureMsg struct {
-	// signature
-	Signature []byte `json:"signature"`
-	R *big.Int `json:"r"`
-	S *big.Int `json:"s"`
-	MsgType		string 	`json:"msgType"`
-
-	// any consensus messages
-	MarshalledMsg []byte `json:"marshalledmsg"`
+
+// Asks a replica for the body of a request it voted for.
+type FetchMsg struct {
+	Digest     string `json:"digest"`
+	SequenceID int64  `json:"sequenceID"`
 }
 
+// One erasure-coded shard of a request body, with the proof that it
+// belongs to the Merkle root the primary committed to. Any DataShards
+// of the Total shards give the body back.
+type ChunkMsg struct {
+	Digest     string   `json:"digest"`
+	SequenceID int64    `json:"sequenceID"`
+	Root       []byte   `json:"root"`
+	Size       int64    `json:"size"`
+	DataShards int64    `json:"dataShards"`
+	Total      int64    `json:"total"`
+	Index      int64    `json:"index"`
+	Chunk      []byte   `json:"chunk"`
+	Proof      [][]byte `json:"proof"`
+}
 
+type ReqPrePareMsgs struct {
+	RequestMsg *RequestMsg
+	PrepareMsg *PrepareMsg
+}
 type CheckPointMsg struct {
 	SequenceID int64  `json:"sequenceID"`
 	Digest     string `json:"digest"`
@@ -72,12 +94,12 @@ type CheckPointMsg struct {
 }
 
 type ViewChangeMsg struct {
-	NodeID     string `json:"nodeID"`
-	SequenceID int64  `json:"sequenceID"`
+	NodeID           string `json:"nodeID"`
+	SequenceID       int64  `json:"sequenceID"`
 	NextCandidateIdx int64  `json:"nextcandidateIdx"`
-	StableCheckPoint int64 `json:"stableCheckPoint"`
+	StableCheckPoint int64  `json:"stableCheckPoint"`
 	//SetC map[string]*CheckPointMsg `json:"setC"`//C checkpointmsg_set 2f+1
-	SetP  map[int64]*SetPm	`json:"setP"`//SetP -> a set of preprepare + (preparemsg * 2f+1) from stablecheckpoint to the biggest sequence_num that node received
+	SetP map[int64]*SetPm `json:"setP"` //SetP -> a set of preprepare + (preparemsg * 2f+1) from stablecheckpoint to the biggest sequence_num that node received
 }
 
 type SetPm struct {
@@ -85,13 +107,12 @@ type SetPm struct {
 	VoteMsgs   map[string]*VoteMsg
 }
 
-
 type NewViewMsg struct {
-	NodeID     string `json:"nodeID"`
-	SequenceID int64  `json:"sequenceID"`
-	NextCandidateIdx int64  `json:"nextcandidateIdx"`
-	EpochID    int64 `json:"epochID"`
-	SetViewChangeMsgs map[string]*ViewChangeMsg `json:"setViewchangemsgs"` 	//V a set containing the valid ViewChageMsg 
+	NodeID            string                    `json:"nodeID"`
+	SequenceID        int64                     `json:"sequenceID"`
+	NextCandidateIdx  int64                     `json:"nextcandidateIdx"`
+	EpochID           int64                     `json:"epochID"`
+	SetViewChangeMsgs map[string]*ViewChangeMsg `json:"setViewchangemsgs"` //V a set containing the valid ViewChageMsg
 	//SetPrepareMsgs map[int64]*PrepareMsg `json:"setPrepreparemsgs"`
 	//PrepareMsg *PrepareMsg `json:"Preparemsg"`
 	//O a set of PrePrepareMsgs from latest stable checkpoint(min-s) in V to the highest sequence number(max-s) in a PrepareMsg in V
@@ -100,15 +121,31 @@ type NewViewMsg struct {
 	Min_S int64 `json:"min_s"`
 }
 
-
 type MsgType int
+
 const (
 	//PrepareMsg MsgType = iota
 	//CommitMsg
 	//Aaptive BFT
-	VOTE 	MsgType = iota
+	VOTE MsgType = iota
 	REJECT
 	NULLMSG
 	COMMITTED
 	UNCOMMITTED
 )
+
+func (t MsgType) String() string {
+	switch t {
+	case VOTE:
+		return "VOTE"
+	case REJECT:
+		return "REJECT"
+	case NULLMSG:
+		return "NULL"
+	case COMMITTED:
+		return "COMMITTED"
+	case UNCOMMITTED:
+		return "UNCOMMITTED"
+	}
+	return fmt.Sprintf("MsgType(%d)", int(t))
+}
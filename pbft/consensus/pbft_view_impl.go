@@ -2,20 +2,20 @@
 
 package consensus
 
-import(
-	"fmt"
+import (
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type VCState struct {
-	NextCandidateIdx  	int64
-	ViewChangeMsgLogs   *ViewChangeMsgLogs
-	NewViewMsg			*NewViewMsg
-	NodeID		   		string
-	StableCheckPoint 	int64
-	SequenceID			int64
+	NextCandidateIdx  int64
+	ViewChangeMsgLogs *ViewChangeMsgLogs
+	NewViewMsg        *NewViewMsg
+	NodeID            string
+	StableCheckPoint  int64
+	SequenceID        int64
 
 	// f: the number of Byzantine faulty nodes
 	// f = (n-1) / 3
@@ -23,73 +23,80 @@ type VCState struct {
 	f int
 
 	ReceivedViewchangeTime time.Time
+
+	// Logs with the node and seq of the view change
+	Log *slog.Logger
 }
 
 type ViewChangeMsgLogs struct {
 	// key: nodeID, value: VIEW-CHANGE message
-	ViewChangeMsgs map[string]*ViewChangeMsg
-	TotalViewChangeMsg  int32
+	ViewChangeMsgs     map[string]*ViewChangeMsg
+	TotalViewChangeMsg int32
 	ViewChangeMsgMutex sync.RWMutex
 
 	// Flags whether VIEW-CHANGE message has broadcasted.
 	// Its value is atomically swapped by CompareAndSwapInt32.
-	msgSent   int32 // atomic bool
+	msgSent int32 // atomic bool
 }
 
-func CreateViewChangeState(nodeID string, totNodes int, nextcandidateIdx int64, stablecheckpoint int64, sequenceID int64) *VCState {
+func CreateViewChangeState(nodeID string, totNodes int, nextcandidateIdx int64, stablecheckpoint int64, sequenceID int64, logger *slog.Logger) *VCState {
+	if logger == nil {
+		logger = slog.Default()
+	}
 	return &VCState{
 		NextCandidateIdx: nextcandidateIdx,
-		SequenceID: sequenceID,
+		SequenceID:       sequenceID,
 		ViewChangeMsgLogs: &ViewChangeMsgLogs{
-			ViewChangeMsgs:make(map[string]*ViewChangeMsg),
+			ViewChangeMsgs:     make(map[string]*ViewChangeMsg),
 			TotalViewChangeMsg: 0,
-			msgSent: 0,
-	
+			msgSent:            0,
 		},
-		NewViewMsg: nil,
-		NodeID: nodeID,
+		NewViewMsg:       nil,
+		NodeID:           nodeID,
 		StableCheckPoint: stablecheckpoint,
 
-		f: (totNodes - 1) / 3,
+		f:   (totNodes - 1) / 3,
+		Log: logger,
 	}
 }
 
-func (vcs *VCState) ViewChange(viewchangeMsg *ViewChangeMsg) (*NewViewMsg, error) {
+// ViewChange takes in a VIEW-CHANGE message received at now, on the
+// clock of the node, and returns the NEW-VIEW message once there are enough.
+func (vcs *VCState) ViewChange(viewchangeMsg *ViewChangeMsg, now time.Time) (*NewViewMsg, error) {
 	// verify VIEW-CHANGE message.
 	// TODO verity sender's signature
 	//if err := vcs.verifyVCMsg(viewchangeMsg.NodeID, viewchangeMsg.NextViewID, viewchangeMsg.StableCheckPoint); err != nil {
 	//	return nil, errors.New("view-change message is corrupted: " + err.Error() + " (nextviewID " + fmt.Sprintf("%d", viewchangeMsg.NextViewID) + ")")
 	//}
 
-	
 	// Append VIEW-CHANGE message to its logs.
 	vcs.ViewChangeMsgLogs.ViewChangeMsgMutex.Lock()
-        if _, ok := vcs.ViewChangeMsgLogs.ViewChangeMsgs[viewchangeMsg.NodeID]; ok {
-                fmt.Printf("View-change message from %s is already received, NextCandidateIdx=%d\n",
-                           viewchangeMsg.NodeID, vcs.NextCandidateIdx)
+	if _, ok := vcs.ViewChangeMsgLogs.ViewChangeMsgs[viewchangeMsg.NodeID]; ok {
+		vcs.Log.Debug("VIEW-CHANGE already received", "from", viewchangeMsg.NodeID,
+			"nextCandidateIdx", vcs.NextCandidateIdx)
 		vcs.ViewChangeMsgLogs.ViewChangeMsgMutex.Unlock()
-                return nil, nil
-        }
+		return nil, nil
+	}
 	vcs.ViewChangeMsgLogs.ViewChangeMsgs[viewchangeMsg.NodeID] = viewchangeMsg
 	vcs.ViewChangeMsgLogs.ViewChangeMsgMutex.Unlock()
 	newTotalViewchangeMsg := atomic.AddInt32(&vcs.ViewChangeMsgLogs.TotalViewChangeMsg, 1)
 
-	if int64(newTotalViewchangeMsg) == int64(vcs.f + 1) {
-		vcs.SetReceiveViewchangeTime(time.Now())
+	if int64(newTotalViewchangeMsg) == int64(vcs.f+1) {
+		vcs.SetReceiveViewchangeTime(now)
 	}
 	// Print current voting status.
-	fmt.Printf("[View-Change-Vote]: %d\n", newTotalViewchangeMsg)
+	vcs.Log.Info("VIEW-CHANGE received", "from", viewchangeMsg.NodeID, "count", newTotalViewchangeMsg)
 
 	// Return NEW-VIEW message only once.
-	// TODO: 2*vcs.f + 1 - Adaptive Quorum 
-	if int(newTotalViewchangeMsg) >= 2*vcs.f + 1 &&
-	   atomic.CompareAndSwapInt32(&vcs.ViewChangeMsgLogs.msgSent, 0, 1) {
+	// TODO: 2*vcs.f + 1 - Adaptive Quorum
+	if int(newTotalViewchangeMsg) >= 2*vcs.f+1 &&
+		atomic.CompareAndSwapInt32(&vcs.ViewChangeMsgLogs.msgSent, 0, 1) {
 		return &NewViewMsg{
-			NodeID: vcs.NodeID,
-			SequenceID: vcs.SequenceID,
-			NextCandidateIdx: vcs.NextCandidateIdx,
+			NodeID:            vcs.NodeID,
+			SequenceID:        vcs.SequenceID,
+			NextCandidateIdx:  vcs.NextCandidateIdx,
 			SetViewChangeMsgs: vcs.GetViewChangeMsgs(),
-			EpochID: 0,
+			EpochID:           0,
 			//PrepareMsg: nil,
 			Min_S: 0,
 		}, nil
@@ -124,9 +131,9 @@ func (state *State) ClearMsgLogs() {
 		state.MsgLogs.VoteMsgs[seq] = nil
 	}
 	/*
-	for seq, _ := range state.MsgLogs.CommitMsgs {
-		state.MsgLogs.CommitMsgs[seq] = nil
-	}
+		for seq, _ := range state.MsgLogs.CommitMsgs {
+			state.MsgLogs.CommitMsgs[seq] = nil
+		}
 	*/
 	state.MsgLogs.TotalVoteMsg = 0
 	state.MsgLogs.TotalCollateMsg = 0
@@ -152,4 +159,4 @@ func (vcs *VCState) SetReceiveViewchangeTime(time time.Time) {
 
 func (vcs *VCState) GetReceiveViewchangeTime() time.Time {
 	return vcs.ReceivedViewchangeTime
- }
+}
@@ -0,0 +1,271 @@
+package consensus
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SignatureScheme names the algorithm a key signs with. It is carried by
+// every signed message and every key file, so that replicas configured
+// with different schemes reject each other's messages up front instead
+// of failing verification for an unclear reason.
+type SignatureScheme string
+
+const (
+	SchemeECDSAP256 SignatureScheme = "ecdsa-p256"
+	SchemeEd25519   SignatureScheme = "ed25519"
+
+	// Keys created by the old openssl key_gen.sh are secp224r1.
+	// They are still accepted, but new keys are never generated with it.
+	SchemeECDSAP224 SignatureScheme = "ecdsa-p224"
+)
+
+// PEM header holding the signature scheme of a key file.
+const pemSchemeHeader = "Scheme"
+
+// Signer signs outgoing consensus messages with the private key of this node.
+type Signer interface {
+	Scheme() SignatureScheme
+	Sign(data []byte) ([]byte, error)
+	Verifier() Verifier
+	PrivateKey() crypto.PrivateKey
+}
+
+// Verifier checks signatures made by the Signer of a single node.
+type Verifier interface {
+	Scheme() SignatureScheme
+	Verify(data, signature []byte) bool
+	PublicKey() crypto.PublicKey
+}
+
+// ParseSignatureScheme returns the scheme for a name given by the user.
+func ParseSignatureScheme(name string) (SignatureScheme, error) {
+	switch scheme := SignatureScheme(strings.ToLower(name)); scheme {
+	case SchemeECDSAP256, SchemeEd25519:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("unknown signature scheme %q (want %s or %s)",
+		name, SchemeECDSAP256, SchemeEd25519)
+}
+
+// GenerateSigner creates a fresh key pair for the given scheme.
+func GenerateSigner(scheme SignatureScheme) (Signer, error) {
+	switch scheme {
+	case SchemeECDSAP256:
+		privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsaSigner{privKey: privKey, scheme: scheme}, nil
+	case SchemeEd25519:
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return ed25519Signer(privKey), nil
+	}
+	return nil, fmt.Errorf("cannot generate keys for signature scheme %q", scheme)
+}
+
+// NewSigner wraps an already loaded private key.
+func NewSigner(privKey crypto.PrivateKey) (Signer, error) {
+	switch k := privKey.(type) {
+	case *ecdsa.PrivateKey:
+		scheme, err := ecdsaScheme(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsaSigner{privKey: k, scheme: scheme}, nil
+	case ed25519.PrivateKey:
+		return ed25519Signer(k), nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", privKey)
+}
+
+// NewVerifier wraps an already loaded public key.
+func NewVerifier(pubKey crypto.PublicKey) (Verifier, error) {
+	switch k := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		scheme, err := ecdsaScheme(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsaVerifier{pubKey: k, scheme: scheme}, nil
+	case ed25519.PublicKey:
+		return ed25519Verifier(k), nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", pubKey)
+}
+
+// MarshalPrivateKeyPEM encodes the key of a signer as PKCS #8,
+// tagging the PEM block with its signature scheme.
+func MarshalPrivateKeyPEM(signer Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(signer.PrivateKey())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{pemSchemeHeader: string(signer.Scheme())},
+		Bytes:   der,
+	}), nil
+}
+
+// MarshalPublicKeyPEM encodes the key of a verifier as PKIX,
+// tagging the PEM block with its signature scheme.
+func MarshalPublicKeyPEM(verifier Verifier) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(verifier.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    "PUBLIC KEY",
+		Headers: map[string]string{pemSchemeHeader: string(verifier.Scheme())},
+		Bytes:   der,
+	}), nil
+}
+
+// ParsePrivateKeyPEM decodes a private key file. Besides PKCS #8 keys
+// written by MarshalPrivateKeyPEM, SEC 1 "EC PRIVATE KEY" files made
+// by openssl are accepted.
+func ParsePrivateKeyPEM(pemEncoded []byte) (Signer, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, errors.New("no PEM block found in private key file")
+	}
+
+	var privKey crypto.PrivateKey
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		privKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q in private key file", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := NewSigner(privKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPEMScheme(block, signer.Scheme()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// ParsePublicKeyPEM decodes a public key file.
+func ParsePublicKeyPEM(pemEncoded []byte) (Verifier, error) {
+	block, _ := pem.Decode(pemEncoded)
+	if block == nil {
+		return nil, errors.New("no PEM block found in public key file")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unexpected PEM block %q in public key file", block.Type)
+	}
+
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := NewVerifier(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPEMScheme(block, verifier.Scheme()); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// The scheme header is optional for keys made before it existed,
+// but must agree with the key if it is present.
+func checkPEMScheme(block *pem.Block, scheme SignatureScheme) error {
+	name, ok := block.Headers[pemSchemeHeader]
+	if !ok || SignatureScheme(name) == scheme {
+		return nil
+	}
+	return fmt.Errorf("key file says scheme %q but holds a %s key", name, scheme)
+}
+
+func ecdsaScheme(curve elliptic.Curve) (SignatureScheme, error) {
+	switch curve {
+	case elliptic.P256():
+		return SchemeECDSAP256, nil
+	case elliptic.P224():
+		return SchemeECDSAP224, nil
+	}
+	return "", fmt.Errorf("unsupported ECDSA curve %s", curve.Params().Name)
+}
+
+// ECDSA signatures are ASN.1 encoded over the SHA-256 digest of the data.
+type ecdsaSigner struct {
+	privKey *ecdsa.PrivateKey
+	scheme  SignatureScheme
+}
+
+func (s *ecdsaSigner) Scheme() SignatureScheme { return s.scheme }
+
+func (s *ecdsaSigner) Sign(data []byte) ([]byte, error) {
+	signHash := sha256.Sum256(data)
+	return ecdsa.SignASN1(rand.Reader, s.privKey, signHash[:])
+}
+
+func (s *ecdsaSigner) Verifier() Verifier {
+	return &ecdsaVerifier{pubKey: &s.privKey.PublicKey, scheme: s.scheme}
+}
+
+func (s *ecdsaSigner) PrivateKey() crypto.PrivateKey { return s.privKey }
+
+type ecdsaVerifier struct {
+	pubKey *ecdsa.PublicKey
+	scheme SignatureScheme
+}
+
+func (v *ecdsaVerifier) Scheme() SignatureScheme { return v.scheme }
+
+func (v *ecdsaVerifier) Verify(data, signature []byte) bool {
+	signHash := sha256.Sum256(data)
+	return ecdsa.VerifyASN1(v.pubKey, signHash[:], signature)
+}
+
+func (v *ecdsaVerifier) PublicKey() crypto.PublicKey { return v.pubKey }
+
+// Ed25519 signs the data itself; hashing is part of the algorithm.
+type ed25519Signer ed25519.PrivateKey
+
+func (s ed25519Signer) Scheme() SignatureScheme { return SchemeEd25519 }
+
+func (s ed25519Signer) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(s), data), nil
+}
+
+func (s ed25519Signer) Verifier() Verifier {
+	return ed25519Verifier(ed25519.PrivateKey(s).Public().(ed25519.PublicKey))
+}
+
+func (s ed25519Signer) PrivateKey() crypto.PrivateKey { return ed25519.PrivateKey(s) }
+
+type ed25519Verifier ed25519.PublicKey
+
+func (v ed25519Verifier) Scheme() SignatureScheme { return SchemeEd25519 }
+
+func (v ed25519Verifier) Verify(data, signature []byte) bool {
+	return ed25519.Verify(ed25519.PublicKey(v), data, signature)
+}
+
+func (v ed25519Verifier) PublicKey() crypto.PublicKey { return ed25519.PublicKey(v) }
@@ -2,12 +2,9 @@ package consensus
 
 import (
 	"crypto/sha256"
+	"encoding"
 	"encoding/hex"
 	"encoding/json"
-
-	"math/big"
-	"crypto/ecdsa"
-	"crypto/rand"
 	// mrand "math/rand"
 )
 
@@ -17,8 +14,16 @@ func Hash(content []byte) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// Digest hashes the binary encoding of a message,
+// or the JSON encoding of any other object.
 func Digest(object interface{}) (string, error) {
-	msg, err := json.Marshal(object)
+	var msg []byte
+	var err error
+	if m, ok := object.(encoding.BinaryMarshaler); ok {
+		msg, err = m.MarshalBinary()
+	} else {
+		msg, err = json.Marshal(object)
+	}
 
 	if err != nil {
 		return "", err
@@ -26,30 +31,8 @@ func Digest(object interface{}) (string, error) {
 
 	return Hash(msg), nil
 }
-func Sign(privKey *ecdsa.PrivateKey, data []byte) (*big.Int, *big.Int, []byte, error) {
-	r := big.NewInt(0)
-	s := big.NewInt(0)
-	signHash := sha256.Sum256(data)
-
-	r, s, err := ecdsa.Sign(rand.Reader, privKey, signHash[:])
-
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	signature := r.Bytes()
-	signature = append(signature, s.Bytes()...)
-
-	return r, s, signature, nil
-}
-
-func Verify(pubKey *ecdsa.PublicKey, r, s *big.Int, data []byte) bool {
-	signHash := sha256.Sum256(data)
-	return ecdsa.Verify(pubKey, signHash[:], r, s)
-}
-
 func NumOfPhase(s string) int64 {
-	switch s{
+	switch s {
 	case "Prepare":
 		return 0
 	case "Vote":
@@ -60,6 +43,6 @@ func NumOfPhase(s string) int64 {
 		return 3
 	case "Total":
 		return 4
-	}	
+	}
 	return -1
 }
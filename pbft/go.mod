@@ -0,0 +1,8 @@
+module github.com/bigpicturelabs/consensusPBFT/pbft
+
+go 1.22
+
+require (
+	filippo.io/edwards25519 v1.1.0
+	github.com/gorilla/websocket v1.4.2
+)
@@ -0,0 +1,419 @@
+// Package inspect tells what is in key files and node lists, and what
+// is wrong with them:
+//
+//	pabft inspect keys                       every key of a key directory
+//	pabft inspect keys/Node1.crt             one key file
+//	pabft inspect -keys keys /tmp/node.list  a node list, with its keys
+//
+// A key is named by the first bytes of the SHA-256 of its public key.
+// A certificate is good if the CA of its directory issued it, for the
+// key of its id, and it is valid now. The exit status is 1 if anything
+// is wrong.
+package inspect
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/nodelist"
+)
+
+// Command runs the inspect subcommand with args and returns its exit
+// status.
+func Command(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	keyDir := flags.String("keys", "", "check the nodes of a node list against the keys in this directory")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: inspect [-keys dir] <key directory, key file or node list>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	out := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	var problems []string
+	for i, path := range flags.Args() {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		info, err := os.Stat(path)
+		switch {
+		case err != nil:
+			problems = append(problems, err.Error())
+		case info.IsDir():
+			problems = append(problems, KeyDir(out, path)...)
+		case isKeyFile(path):
+			problems = append(problems, KeyFile(out, path)...)
+		default:
+			problems = append(problems, NodeList(out, path, *keyDir)...)
+		}
+	}
+	out.Flush()
+	if len(problems) > 0 {
+		fmt.Fprintln(stdout)
+		for _, problem := range problems {
+			fmt.Fprintln(stdout, "problem:", problem)
+		}
+		return 1
+	}
+	return 0
+}
+
+func isKeyFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".priv", ".pub", ".crt", ".key":
+		return true
+	}
+	return false
+}
+
+// key is what the files of an id in a key directory hold.
+type key struct {
+	id      string
+	scheme  consensus.SignatureScheme
+	public  crypto.PublicKey
+	hasPriv bool
+	hasPub  bool
+	cert    *x509.Certificate
+}
+
+// KeyDir writes the keys of the directory dir and returns what is
+// wrong with them.
+func KeyDir(out io.Writer, dir string) []string {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	ca, err := readCertificate(filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		problem("%v", err)
+	}
+	fmt.Fprintf(out, "key directory\t%s\n", dir)
+	if ca != nil {
+		fmt.Fprintf(out, "CA\t%s, valid until %s\n", ca.Subject.CommonName, ca.NotAfter.Format("2006-01-02"))
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	keys := make(map[string]*key)
+	keyOf := func(id string) *key {
+		if keys[id] == nil {
+			keys[id] = &key{id: id}
+		}
+		return keys[id]
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		id := strings.TrimSuffix(name, filepath.Ext(name))
+		if entry.IsDir() || id == "ca" {
+			continue
+		}
+		switch filepath.Ext(name) {
+		case ".priv":
+			signer, err := readPrivateKey(path)
+			if err != nil {
+				problem("%v", err)
+				continue
+			}
+			k := keyOf(id)
+			k.hasPriv = true
+			if k.public != nil && !samePublicKey(k.public, signer.Verifier().PublicKey()) {
+				problem("%s: private and public key do not match", id)
+			}
+			k.scheme, k.public = signer.Scheme(), signer.Verifier().PublicKey()
+		case ".pub":
+			verifier, err := readPublicKey(path)
+			if err != nil {
+				problem("%v", err)
+				continue
+			}
+			k := keyOf(id)
+			k.hasPub = true
+			if k.public != nil && !samePublicKey(k.public, verifier.PublicKey()) {
+				problem("%s: private and public key do not match", id)
+			}
+			k.scheme, k.public = verifier.Scheme(), verifier.PublicKey()
+		case ".crt":
+			cert, err := readCertificate(path)
+			if err != nil {
+				problem("%v", err)
+				continue
+			}
+			keyOf(id).cert = cert
+		}
+	}
+
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return lessID(ids[i], ids[j]) })
+	schemes := make(map[consensus.SignatureScheme]int)
+	fmt.Fprintf(out, "\nID\tSCHEME\tKEY\tFILES\tCERTIFICATE\n")
+	for _, id := range ids {
+		k := keys[id]
+		var files []string
+		if k.hasPriv {
+			files = append(files, "priv")
+		}
+		if k.hasPub {
+			files = append(files, "pub")
+		} else {
+			problem("%s: no public key", id)
+		}
+		if k.cert != nil {
+			files = append(files, "crt")
+		}
+		certStatus := "-"
+		if k.cert != nil {
+			certStatus = "good"
+			if err := checkCertificate(k.cert, ca, id, k.public); err != nil {
+				certStatus = "bad"
+				problem("%s: %v", id, err)
+			}
+		}
+		if k.public != nil {
+			schemes[k.scheme]++
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\n", id, k.scheme, fingerprint(k.public), strings.Join(files, ","), certStatus)
+	}
+	if len(schemes) > 1 {
+		problem("keys of different schemes %v; all replicas have to sign with the same one", schemes)
+	}
+	return problems
+}
+
+// KeyFile writes what the key file at path holds and returns what is
+// wrong with it.
+func KeyFile(out io.Writer, path string) []string {
+	fmt.Fprintf(out, "file\t%s\n", path)
+	switch filepath.Ext(path) {
+	case ".priv", ".key":
+		signer, err := readPrivateKey(path)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		fmt.Fprintf(out, "private key\t%s %s\n", signer.Scheme(), fingerprint(signer.Verifier().PublicKey()))
+	case ".pub":
+		verifier, err := readPublicKey(path)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		fmt.Fprintf(out, "public key\t%s %s\n", verifier.Scheme(), fingerprint(verifier.PublicKey()))
+	case ".crt":
+		cert, err := readCertificate(path)
+		if err != nil {
+			return []string{err.Error()}
+		}
+		fmt.Fprintf(out, "certificate\t%s, issued by %s\n", cert.Subject.CommonName, cert.Issuer.CommonName)
+		fmt.Fprintf(out, "key\t%s\n", fingerprint(cert.PublicKey))
+		fmt.Fprintf(out, "valid\t%s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		if cert.IsCA {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		ca, err := readCertificate(filepath.Join(dir, "ca.crt"))
+		if err != nil {
+			return []string{err.Error()}
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".crt")
+		var public crypto.PublicKey
+		if verifier, err := readPublicKey(filepath.Join(dir, id+".pub")); err == nil {
+			public = verifier.PublicKey()
+		}
+		if err := checkCertificate(cert, ca, id, public); err != nil {
+			return []string{fmt.Sprintf("%s: %v", path, err)}
+		}
+		fmt.Fprintf(out, "status\tgood\n")
+	}
+	return nil
+}
+
+// NodeList writes the replicas of the node list at path and returns
+// what is wrong with it. With keyDir set, every replica must have a key
+// there.
+func NodeList(out io.Writer, path string, keyDir string) []string {
+	nodeTable, err := nodelist.Read(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	ids := make(map[string]bool)
+	urls := make(map[string]string)
+	hosts := make(map[string]bool)
+	for _, nodeInfo := range nodeTable {
+		if ids[nodeInfo.NodeID] {
+			problem("%s is in the list twice", nodeInfo.NodeID)
+		}
+		ids[nodeInfo.NodeID] = true
+		host, _, err := net.SplitHostPort(nodeInfo.Url)
+		if err != nil {
+			problem("%s: url %q: %v", nodeInfo.NodeID, nodeInfo.Url, err)
+		} else {
+			hosts[host] = true
+		}
+		if other, ok := urls[nodeInfo.Url]; ok {
+			problem("%s and %s both listen on %s", other, nodeInfo.NodeID, nodeInfo.Url)
+		}
+		urls[nodeInfo.Url] = nodeInfo.NodeID
+	}
+	fmt.Fprintf(out, "node list\t%s: %d nodes on %d hosts, up to f=%d faulty\n",
+		path, len(nodeTable), len(hosts), (len(nodeTable)-1)/3)
+
+	fmt.Fprintf(out, "\nNODE\tURL")
+	if keyDir != "" {
+		fmt.Fprintf(out, "\tKEY")
+	}
+	fmt.Fprintln(out)
+	schemes := make(map[consensus.SignatureScheme]int)
+	for _, nodeInfo := range nodeTable {
+		fmt.Fprintf(out, "%s\t%s", nodeInfo.NodeID, nodeInfo.Url)
+		if keyDir != "" {
+			verifier, err := readPublicKey(filepath.Join(keyDir, nodeInfo.NodeID+".pub"))
+			if err != nil {
+				problem("%v", err)
+				fmt.Fprintf(out, "\t-")
+			} else {
+				schemes[verifier.Scheme()]++
+				fmt.Fprintf(out, "\t%s %s", verifier.Scheme(), fingerprint(verifier.PublicKey()))
+			}
+		}
+		fmt.Fprintln(out)
+	}
+	if len(schemes) > 1 {
+		problem("keys of different schemes %v; all replicas have to sign with the same one", schemes)
+	}
+	return problems
+}
+
+func readPrivateKey(path string) (consensus.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := consensus.ParsePrivateKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return signer, nil
+}
+
+func readPublicKey(path string) (consensus.Verifier, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := consensus.ParsePublicKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return verifier, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cert, nil
+}
+
+// checkCertificate checks that ca issued cert to id for public, and
+// that it is valid now.
+func checkCertificate(cert *x509.Certificate, ca *x509.Certificate, id string, public crypto.PublicKey) error {
+	if cert.Subject.CommonName != id {
+		return fmt.Errorf("certificate is for %q", cert.Subject.CommonName)
+	}
+	if public == nil {
+		return errors.New("no key to check the certificate against")
+	}
+	if !samePublicKey(cert.PublicKey, public) {
+		return errors.New("certificate is not for the key")
+	}
+	if ca == nil {
+		return errors.New("no CA to check the certificate against")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	_, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	return err
+}
+
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// fingerprint names a public key by the first bytes of its SHA-256.
+func fingerprint(public crypto.PublicKey) string {
+	if public == nil {
+		return "-"
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "?"
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8])
+}
+
+// lessID puts Node2 before Node10.
+func lessID(a string, b string) bool {
+	prefixA, numA := splitID(a)
+	prefixB, numB := splitID(b)
+	if prefixA != prefixB {
+		return prefixA < prefixB
+	}
+	if numA != numB {
+		return numA < numB
+	}
+	return a < b
+}
+
+func splitID(id string) (string, int) {
+	i := len(id)
+	for i > 0 && id[i-1] >= '0' && id[i-1] <= '9' {
+		i--
+	}
+	n := 0
+	fmt.Sscanf(id[i:], "%d", &n)
+	return id[:i], n
+}
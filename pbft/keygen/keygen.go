@@ -0,0 +1,182 @@
+// Package keygen creates the keys of the replicas and clients, and a
+// local CA that certifies them for the TLS connections between them:
+//
+//	pabft keygen -n 19 -clients 4
+//	pabft keygen -n 19 -scheme ed25519 -dir keys -force
+//
+// For each id it writes <dir>/<id>.priv, <dir>/<id>.pub and
+// <dir>/<id>.crt; the CA goes to <dir>/ca.key and <dir>/ca.crt.
+package keygen
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// Command runs the keygen subcommand with args and returns its exit
+// status.
+func Command(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	numNodes := flags.Int("n", 0, "number of nodes, Node1 and up")
+	numClients := flags.Int("clients", 4, "number of clients, Client1 and up, for pabft bench")
+	schemeName := flags.String("scheme", string(consensus.SchemeECDSAP256), "signature scheme (ecdsa-p256 or ed25519)")
+	dir := flags.String("dir", "keys", "directory for the key files")
+	force := flags.Bool("force", false, "replace the key files already in the directory")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: keygen -n <number of nodes> [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *numNodes < 1 || *numClients < 0 || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	fail := func(err error) int {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	scheme, err := consensus.ParseSignatureScheme(*schemeName)
+	if err != nil {
+		return fail(err)
+	}
+
+	existing, err := keyFiles(*dir)
+	if err != nil {
+		return fail(err)
+	}
+	if len(existing) > 0 {
+		if !*force {
+			return fail(fmt.Errorf("%s already holds %d key files; -force replaces them", *dir, len(existing)))
+		}
+		// Keys of an earlier, larger cluster would stay behind.
+		for _, file := range existing {
+			if err := os.Remove(file); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	var ids []string
+	for i := 1; i <= *numNodes; i++ {
+		ids = append(ids, fmt.Sprintf("Node%d", i))
+	}
+	for i := 1; i <= *numClients; i++ {
+		ids = append(ids, fmt.Sprintf("Client%d", i))
+	}
+	if err := Generate(*dir, scheme, ids); err != nil {
+		return fail(err)
+	}
+	fmt.Fprintf(stdout, "%d node keys and %d client keys (%s) created in %s\n",
+		*numNodes, *numClients, scheme, *dir)
+	return 0
+}
+
+// keyFiles returns the files in dir that keygen writes.
+func keyFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		switch {
+		case name == "ca.key", name == "ca.crt",
+			strings.HasSuffix(name, ".priv"), strings.HasSuffix(name, ".pub"), strings.HasSuffix(name, ".crt"):
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	return files, nil
+}
+
+// Generate creates a CA in dir and the keys of ids, signing with scheme.
+func Generate(dir string, scheme consensus.SignatureScheme, ids []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	ca, caPEM, err := GenerateCA(dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := GenerateKeyFiles(dir, id, scheme, ca, caPEM); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateCA writes the key and certificate of a new CA to <dir>/ca.key
+// and <dir>/ca.crt.
+func GenerateCA(dir string) (consensus.Signer, []byte, error) {
+	ca, err := consensus.GenerateSigner(consensus.SchemeECDSAP256)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKeyPEM, err := consensus.MarshalPrivateKeyPEM(ca)
+	if err != nil {
+		return nil, nil, err
+	}
+	caPEM, err := network.NewCA(ca)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.key"), caKeyPEM, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caPEM, 0644); err != nil {
+		return nil, nil, err
+	}
+	return ca, caPEM, nil
+}
+
+// GenerateKeyFiles writes <dir>/<nodeID>.priv, <dir>/<nodeID>.pub and
+// <dir>/<nodeID>.crt, the certificate of the key issued by ca.
+func GenerateKeyFiles(dir string, nodeID string, scheme consensus.SignatureScheme,
+	ca consensus.Signer, caPEM []byte) error {
+	signer, err := consensus.GenerateSigner(scheme)
+	if err != nil {
+		return err
+	}
+	privPEM, err := consensus.MarshalPrivateKeyPEM(signer)
+	if err != nil {
+		return err
+	}
+	pubPEM, err := consensus.MarshalPublicKeyPEM(signer.Verifier())
+	if err != nil {
+		return err
+	}
+
+	privKeyFile := filepath.Join(dir, nodeID+".priv")
+	if err := ioutil.WriteFile(privKeyFile, privPEM, 0600); err != nil {
+		return err
+	}
+	pubKeyFile := filepath.Join(dir, nodeID+".pub")
+	if err := ioutil.WriteFile(pubKeyFile, pubPEM, 0644); err != nil {
+		return err
+	}
+
+	certPEM, err := network.IssueNodeCertificate(caPEM, ca, nodeID, signer.Verifier())
+	if err != nil {
+		return err
+	}
+	certFile := filepath.Join(dir, nodeID+".crt")
+	return ioutil.WriteFile(certFile, certPEM, 0644)
+}
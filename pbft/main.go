@@ -1,47 +1,149 @@
 package main
 
 import (
-	"crypto/ecdsa"
-	"crypto/x509"
-	"encoding/json"
-	"encoding/pem"
+	"context"
+	"flag"
 	"fmt"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/analysis"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/bench"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/cluster"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/inspect"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/keygen"
 	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/nodelist"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
-// Hard-coded for test.
-var viewID = int64(10000000000)
+// Time a node has to stop on SIGINT or SIGTERM; less than the grace of
+// pabft cluster before it kills its replicas.
+const stopTimeout = 4 * time.Second
 
 func main() {
+	// Without a subcommand, pabft runs a node as it always has.
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "analyze":
+			os.Exit(analysis.Command(args[1:], os.Stdout, os.Stderr))
+		case "bench":
+			os.Exit(bench.Command(args[1:], os.Stdout, os.Stderr))
+		case "keygen":
+			os.Exit(keygen.Command(args[1:], os.Stdout, os.Stderr))
+		case "nodelist":
+			os.Exit(nodelist.Command(args[1:], os.Stdout, os.Stderr))
+		case "inspect":
+			os.Exit(inspect.Command(args[1:], os.Stdout, os.Stderr))
+		case "cluster":
+			os.Exit(cluster.Command(args[1:], os.Stdout, os.Stderr))
+		case "run":
+			args = args[1:]
+		}
+	}
+
+	printConfig := flag.Bool("print-config", false, "write the configuration as JSON, e.g. to start a -config file, and exit")
+	config, err := network.ParseConfig(flag.CommandLine, args)
+	AssertError(err)
+	args = flag.Args()
 
-	if len(os.Args) < 2 {
-		fmt.Println("Usage:", os.Args[0], "<nodeID> <TOTALNUM> [node.list]")
+	// run_nodes.sh passes the node id, the number of nodes and the node list.
+	if len(args) > 0 {
+		config.NodeID = args[0]
+	}
+	if len(args) > 2 {
+		config.NodeList = args[2]
+	}
+	if *printConfig {
+		AssertError(config.Write(os.Stdout))
+		return
+	}
+	if config.NodeID == "" {
+		fmt.Println("Usage: pabft [run] [-config file] [flags] -id <nodeID>")
+		fmt.Println("       pabft [run] [-config file] [flags] <nodeID> <TOTALNUM> [node.list]")
+		fmt.Println("       pabft keygen -n <number of nodes> [-clients 4] [-scheme ecdsa-p256] [-dir keys] [-force]")
+		fmt.Println("       pabft nodelist local|hosts|aws [flags]")
+		fmt.Println("       pabft cluster [-n <number of nodes>] [-restart] [flags] [-- replica flags]")
+		fmt.Println("       pabft inspect [-keys dir] <key directory, key file or node list>...")
+		fmt.Println("       pabft analyze [-format text|csv] [run directory]")
+		fmt.Println("       pabft bench [flags] [node.list]")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
 		return
 	}
-	nodeID := os.Args[1]
+	AssertError(config.Validate())
+
+	logging := network.NewLogging(os.Stderr, config.LogFormat == "json", slog.LevelInfo)
+	AssertError(logging.SetLevels(config.LogLevel))
+	config.Logging = logging
+
+	var traceFile *os.File
+	if config.Trace != "" {
+		var err error
+		traceFile, err = os.OpenFile(config.Trace, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		AssertError(err)
+		config.TraceOutput = network.NewTraceOutput(traceFile)
+	}
 
 	// Generate NodeTable
-	nodeTable:=GenNodeTable(os.Args[3])
+	nodeTable := GenNodeTable(config.NodeList)
+	AssertError(config.CheckNodeTable(nodeTable))
 
 	// Generate SeedNodeTable
-	seedNodeTables:=GenSeedNodeTables(nodeTable)
+	seedNodeTables := GenSeedNodeTables(nodeTable)
 
 	// Load public key for each node.
-	GenPublicKeys(&nodeTable)
+	GenPublicKeys(config.KeyDir, &nodeTable)
+
+	// Clients with keys may submit requests.
+	clientTable := GenClientTable(config.KeyDir)
+	config.Clients = clientTable
 
 	// Make NodeID PriveKey
-	decodePrivKey:=GenPrivateKeys(nodeID)
+	decodePrivKey := GenPrivateKeys(config.KeyDir, config.NodeID)
+
+	// All replicas have to sign with the same scheme.
+	AssertError(CheckSignatureSchemes(nodeTable, decodePrivKey.Scheme()))
+
+	if config.TLS {
+		config.TLSIdentity = LoadTLS(config.KeyDir, config.NodeID, append(nodeTable[:len(nodeTable):len(nodeTable)], clientTable...), decodePrivKey)
+	}
 
 	// Make server object
-	server := network.NewServer(nodeID, nodeTable, seedNodeTables, 
-		viewID, decodePrivKey)
+	server := network.NewServer(config, nodeTable, seedNodeTables, decodePrivKey)
 
 	// start server
 	if server != nil {
-		server.Start()
+		// Stop the node, which writes the sequences in flight, before going.
+		stopped := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+			defer cancel()
+			if err := server.Stop(ctx); err != nil {
+				log.Println(err)
+			}
+			if traceFile != nil {
+				traceFile.Close()
+			}
+			close(stopped)
+		}()
+		if config.Admin != "" {
+			go func() {
+				AssertError(server.ServeAdmin(config.Admin))
+			}()
+		}
+		AssertError(server.Start())
+		<-stopped
 	}
 }
 
@@ -52,58 +154,79 @@ func AssertError(err error) {
 	log.Println(err)
 	os.Exit(1)
 }
-func GenNodeTable(NODELISTPATH string) []*network.NodeInfo{
+func GenNodeTable(NODELISTPATH string) []*network.NodeInfo {
 	// Local: "/tmp/node.list"
 	// Remote: "./nodeList/nodeNum"$TOTALNODE"/nodeList_remote.json"
 	// AWS: "./nodeList/nodeNum"$TOTALNODE"/nodeList_aws.json"
-	var nodeTable []*network.NodeInfo
-	jsonFile, err := os.Open(NODELISTPATH)
-	AssertError(err)
-	defer jsonFile.Close()
-	err = json.NewDecoder(jsonFile).Decode(&nodeTable)
+	nodeTable, err := nodelist.Read(NODELISTPATH)
 	AssertError(err)
 	return nodeTable
 }
-func GenSeedNodeTables(nodeTable []*network.NodeInfo) [][]*network.NodeInfo{
-	randomNum:=2
+func GenSeedNodeTables(nodeTable []*network.NodeInfo) [][]*network.NodeInfo {
+	randomNum := 2
 	seedNodeTables := make([][]*network.NodeInfo, randomNum)
-	for i:=0; i<randomNum; i++{
-		seedNodeTables[i] = make([]*network.NodeInfo,len(nodeTable))
-		front:=nodeTable[0:i]
-		end:=nodeTable[i:len(nodeTable)]
-		seedNodeTables[i]=append(end, front...)
+	for i := 0; i < randomNum; i++ {
+		seedNodeTables[i] = make([]*network.NodeInfo, len(nodeTable))
+		front := nodeTable[0:i]
+		end := nodeTable[i:len(nodeTable)]
+		seedNodeTables[i] = append(end, front...)
 	}
 	return seedNodeTables
 }
-func GenPublicKeys(nodeTable *[]*network.NodeInfo) {
+func GenPublicKeys(keyDir string, nodeTable *[]*network.NodeInfo) {
 	for _, nodeInfo := range *nodeTable {
-		pubKeyFile := fmt.Sprintf("keys/%s.pub", nodeInfo.NodeID)
+		pubKeyFile := filepath.Join(keyDir, nodeInfo.NodeID+".pub")
 		pubBytes, err := ioutil.ReadFile(pubKeyFile)
 		AssertError(err)
 
-		decodePubKey := PublicKeyDecode(pubBytes)
+		decodePubKey, err := consensus.ParsePublicKeyPEM(pubBytes)
+		if err != nil {
+			AssertError(fmt.Errorf("%s: %v", pubKeyFile, err))
+		}
 		nodeInfo.PubKey = decodePubKey
 	}
 }
-func GenPrivateKeys(nodeID string) *ecdsa.PrivateKey {
-	privKeyFile := fmt.Sprintf("keys/%s.priv", nodeID)
+
+// GenClientTable returns the clients whose public keys are in keyDir.
+func GenClientTable(keyDir string) []*network.NodeInfo {
+	pubKeyFiles, err := filepath.Glob(filepath.Join(keyDir, "Client*.pub"))
+	AssertError(err)
+	var clientTable []*network.NodeInfo
+	for _, pubKeyFile := range pubKeyFiles {
+		clientID := strings.TrimSuffix(filepath.Base(pubKeyFile), ".pub")
+		clientTable = append(clientTable, &network.NodeInfo{NodeID: clientID})
+	}
+	GenPublicKeys(keyDir, &clientTable)
+	return clientTable
+}
+func GenPrivateKeys(keyDir string, nodeID string) consensus.Signer {
+	privKeyFile := filepath.Join(keyDir, nodeID+".priv")
 	privbytes, err := ioutil.ReadFile(privKeyFile)
 	AssertError(err)
-	decodePrivKey := PrivateKeyDecode(privbytes)
+	decodePrivKey, err := consensus.ParsePrivateKeyPEM(privbytes)
+	if err != nil {
+		AssertError(fmt.Errorf("%s: %v", privKeyFile, err))
+	}
 	return decodePrivKey
 }
-func PrivateKeyDecode(pemEncoded []byte) *ecdsa.PrivateKey {
-	blockPriv, _ := pem.Decode(pemEncoded)
-	x509Encoded := blockPriv.Bytes
-	privateKey, _ := x509.ParseECPrivateKey(x509Encoded)
-
-	return privateKey
+func LoadTLS(keyDir string, nodeID string, nodeTable []*network.NodeInfo, decodePrivKey consensus.Signer) *network.TLSIdentity {
+	caPEM, err := ioutil.ReadFile(filepath.Join(keyDir, "ca.crt"))
+	AssertError(err)
+	certFile := filepath.Join(keyDir, nodeID+".crt")
+	certPEM, err := ioutil.ReadFile(certFile)
+	AssertError(err)
+	identity, err := network.NewTLSIdentity(caPEM, certPEM, decodePrivKey, nodeTable)
+	if err != nil {
+		AssertError(fmt.Errorf("%s: %v", certFile, err))
+	}
+	return identity
 }
-func PublicKeyDecode(pemEncoded []byte) *ecdsa.PublicKey {
-	blockPub, _ := pem.Decode(pemEncoded)
-	x509EncodedPub := blockPub.Bytes
-	genericPublicKey, _ := x509.ParsePKIXPublicKey(x509EncodedPub)
-	publicKey := genericPublicKey.(*ecdsa.PublicKey)
-
-	return publicKey
+func CheckSignatureSchemes(nodeTable []*network.NodeInfo, scheme consensus.SignatureScheme) error {
+	for _, nodeInfo := range nodeTable {
+		if nodeInfo.PubKey.Scheme() != scheme {
+			return fmt.Errorf("%s uses signature scheme %s, but this node uses %s",
+				nodeInfo.NodeID, nodeInfo.PubKey.Scheme(), scheme)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// The admin API tells what a running replica is doing. It is read-only
+// and served on a port of its own, apart from the replicas' traffic:
+//
+//	pabft -admin localhost:3111 Node1 19
+//	curl http://localhost:3111/status
+//	curl http://localhost:3111/metrics
+//
+// With -faults it also serves /admin/faults, which changes the faults
+// the replica injects (see faults.go). It is plain HTTP, so bind it to
+// an address only operators reach.
+
+// Number of errors kept for /status.
+const recentErrorsKept = 20
+
+// NodeStatus is what /status returns.
+type NodeStatus struct {
+	NodeID           string           `json:"nodeID"`
+	View             int64            `json:"view"`
+	Primary          string           `json:"primary"`
+	Epoch            int64            `json:"epoch"`
+	StableCheckPoint int64            `json:"stableCheckPoint"`
+	LastExecuted     int64            `json:"lastExecuted"`
+	IsViewChanging   bool             `json:"isViewChanging"`
+	NextCandidateIdx int64            `json:"nextCandidateIdx"`
+	PendingRequests  int              `json:"pendingRequests"` // of clients, not proposed yet
+	Sequences        []SequenceStatus `json:"sequences"`       // in flight, by sequence
+	Peers            []PeerStatus     `json:"peers"`           // over websockets only
+	Errors           []ErrorStatus    `json:"errors"`          // latest last
+}
+
+// SequenceStatus describes a sequence started and not executed yet.
+type SequenceStatus struct {
+	SequenceID int64      `json:"seq"`
+	Phase      string     `json:"phase"` // the phase it waits in
+	Digest     string     `json:"digest,omitempty"`
+	PreparedAt *time.Time `json:"preparedAt,omitempty"` // when its PREPARE came in
+	Votes      int        `json:"votes"`
+	Collates   int        `json:"collates"`
+	Committed  bool       `json:"committed"` // waits for the sequences before it
+}
+
+// ErrorStatus is an error sent to MsgError.
+type ErrorStatus struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// errorLog keeps the latest errors of a node.
+type errorLog struct {
+	mu     sync.Mutex
+	errors []ErrorStatus
+	next   int // where the next error goes once full
+}
+
+func (l *errorLog) add(now time.Time, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	status := ErrorStatus{Time: now, Error: err.Error()}
+	if len(l.errors) < recentErrorsKept {
+		l.errors = append(l.errors, status)
+		return
+	}
+	l.errors[l.next] = status
+	l.next = (l.next + 1) % recentErrorsKept
+}
+
+// all returns the errors kept, oldest first.
+func (l *errorLog) all() []ErrorStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	errors := make([]ErrorStatus, 0, len(l.errors))
+	errors = append(errors, l.errors[l.next:]...)
+	return append(errors, l.errors[:l.next]...)
+}
+
+// Status returns what the node is doing.
+func (node *Node) Status() NodeStatus {
+	view := node.currentView()
+	status := NodeStatus{
+		NodeID:           node.MyInfo.NodeID,
+		View:             view.ID,
+		Epoch:            atomic.LoadInt64(&node.EpochID),
+		StableCheckPoint: atomic.LoadInt64(&node.StableCheckPoint),
+		LastExecuted:     atomic.LoadInt64(&node.LastExecuted),
+		IsViewChanging:   node.IsViewChanging.Load(),
+		NextCandidateIdx: atomic.LoadInt64(&node.NextCandidateIdx),
+		PendingRequests:  node.Requests.Len(),
+		Sequences:        []SequenceStatus{},
+		Peers:            []PeerStatus{},
+		Errors:           node.errors.all(),
+	}
+	if primary := view.Primary; primary != nil {
+		status.Primary = primary.NodeID
+	}
+
+	node.StatesMutex.RLock()
+	for seqID, state := range node.States {
+		if seqID <= status.LastExecuted {
+			continue
+		}
+		status.Sequences = append(status.Sequences, node.sequenceStatus(seqID, state))
+	}
+	node.StatesMutex.RUnlock()
+	sort.Slice(status.Sequences, func(i, j int) bool {
+		return status.Sequences[i].SequenceID < status.Sequences[j].SequenceID
+	})
+	return status
+}
+
+func (node *Node) sequenceStatus(seqID int64, state consensus.PBFT) SequenceStatus {
+	sequence := SequenceStatus{
+		SequenceID: seqID,
+		Phase:      node.Metrics.phaseOf(seqID),
+		Votes:      len(state.GetVoteMsgs()),
+		Collates:   len(state.GetCollateMsgs()),
+	}
+	if seqID >= 0 && seqID < int64(len(node.Committed)) {
+		sequence.Committed = atomic.LoadInt64(&node.Committed[seqID]) != 0
+	}
+	if prepareMsg := state.GetPrepareMsg(); prepareMsg != nil {
+		sequence.Digest = prepareMsg.Digest
+		preparedAt := state.GetReceivePrepareTime()
+		sequence.PreparedAt = &preparedAt
+	}
+	return sequence
+}
+
+// Status returns what the node of the server is doing, and how its
+// connections to the other replicas are.
+func (server *Server) Status() NodeStatus {
+	status := server.node.Status()
+	if server.ws != nil {
+		status.Peers = server.ws.Statuses()
+	}
+	return status
+}
+
+// AdminHandler returns the endpoints of the admin API.
+func (server *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", server.serveStatus)
+	mux.HandleFunc("/metrics", server.serveMetrics)
+	if server.faults != nil {
+		mux.Handle("/admin/faults", server.faults)
+	}
+	return mux
+}
+
+// ServeAdmin serves the admin API on addr. It blocks until Stop.
+func (server *Server) ServeAdmin(addr string) error {
+	server.node.logger(SubsystemNetwork).Info("admin API starting", "url", addr)
+	return server.serve(&http.Server{Addr: addr, Handler: server.AdminHandler()}, &server.adminServer, false)
+}
+
+func (server *Server) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(server.Status())
+}
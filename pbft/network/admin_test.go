@@ -0,0 +1,40 @@
+package network
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// get returns the status code handler answers a GET of path with.
+func get(handler http.Handler, path string) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code
+}
+
+func TestAdminEndpointsOffConsensusPort(t *testing.T) {
+	server := newMemoryCluster(t, 4, nil).servers[0]
+	for _, path := range []string{"/status", "/metrics"} {
+		if code := get(server.AdminHandler(), path); code != http.StatusOK {
+			t.Errorf("admin %s: status %d, want %d", path, code, http.StatusOK)
+		}
+		if code := get(server.Handler(), path); code != http.StatusNotFound {
+			t.Errorf("consensus port %s: status %d, want %d", path, code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestAdminFaultsOnlyWithFlag(t *testing.T) {
+	faulty := newMemoryCluster(t, 4, func(config *Config) { config.Faults = true }).servers[0]
+	if code := get(faulty.AdminHandler(), "/admin/faults"); code != http.StatusOK {
+		t.Errorf("admin /admin/faults with -faults: status %d, want %d", code, http.StatusOK)
+	}
+	if code := get(faulty.Handler(), "/admin/faults"); code != http.StatusNotFound {
+		t.Errorf("consensus port /admin/faults: status %d, want %d", code, http.StatusNotFound)
+	}
+	server := newMemoryCluster(t, 4, nil).servers[0]
+	if code := get(server.AdminHandler(), "/admin/faults"); code != http.StatusNotFound {
+		t.Errorf("admin /admin/faults without -faults: status %d, want %d", code, http.StatusNotFound)
+	}
+}
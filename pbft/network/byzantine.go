@@ -0,0 +1,328 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Byzantine replicas, to check that the honest ones stay safe and live
+// when some misbehave on purpose. A node with a Byzantine misbehaves in
+// each mode set in it; the node of an honest replica has none, and its
+// code paths only pass through hooks that return at once. With
+// -byzantine a replica starts in the given modes:
+//
+//	pabft -byzantine equivocate,crash=20 Node1 19
+//
+// Testing only: at most f replicas of a cluster should be Byzantine.
+
+// Byzantine is the set of ways a replica misbehaves. A Byzantine is
+// meant for one node: it remembers whether that node has crashed.
+type Byzantine struct {
+	Silent       bool          // sends nothing, but goes on receiving
+	CrashAfter   int64         // stops for good after executing this many sequences; 0 never
+	Equivocate   bool          // as primary, proposes another request to half the replicas
+	WrongDigest  bool          // votes for a digest nobody proposed
+	DoubleVote   bool          // votes twice in a sequence, for two digests
+	ForgeCollate bool          // claims COMMITTED in its collates, with votes it made up
+	Delay        time.Duration // holds every message back this long
+	Withhold     bool          // as primary, sends no PREPARE
+
+	crashed int32 // atomic
+}
+
+// ParseByzantine parses a comma-separated list of modes: silent,
+// crash=N, equivocate, wrong-digest, double-vote, forge-collate,
+// delay=D and withhold. An empty list is an honest replica, nil.
+func ParseByzantine(spec string) (*Byzantine, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	b := &Byzantine{}
+	for _, mode := range strings.Split(spec, ",") {
+		name, value := mode, ""
+		if i := strings.IndexByte(mode, '='); i >= 0 {
+			name, value = mode[:i], mode[i+1:]
+		}
+		if (name == "crash" || name == "delay") != (value != "") {
+			return nil, fmt.Errorf("byzantine mode %q: crash and delay take a value, the others none", mode)
+		}
+		switch name {
+		case "silent":
+			b.Silent = true
+		case "crash":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("byzantine mode %q: need a number of sequences", mode)
+			}
+			b.CrashAfter = n
+		case "equivocate":
+			b.Equivocate = true
+		case "wrong-digest":
+			b.WrongDigest = true
+		case "double-vote":
+			b.DoubleVote = true
+		case "forge-collate":
+			b.ForgeCollate = true
+		case "delay":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("byzantine mode %q: need a duration like 200ms", mode)
+			}
+			b.Delay = d
+		case "withhold":
+			b.Withhold = true
+		default:
+			return nil, fmt.Errorf("unknown byzantine mode %q", mode)
+		}
+	}
+	return b, nil
+}
+
+// String returns the modes of b in the form ParseByzantine reads.
+func (b *Byzantine) String() string {
+	if b == nil {
+		return ""
+	}
+	var modes []string
+	flags := []struct {
+		on   bool
+		name string
+	}{
+		{b.Silent, "silent"},
+		{b.Equivocate, "equivocate"},
+		{b.WrongDigest, "wrong-digest"},
+		{b.DoubleVote, "double-vote"},
+		{b.ForgeCollate, "forge-collate"},
+		{b.Withhold, "withhold"},
+	}
+	for _, flag := range flags {
+		if flag.on {
+			modes = append(modes, flag.name)
+		}
+	}
+	if b.CrashAfter > 0 {
+		modes = append(modes, fmt.Sprintf("crash=%d", b.CrashAfter))
+	}
+	if b.Delay > 0 {
+		modes = append(modes, "delay="+b.Delay.String())
+	}
+	return strings.Join(modes, ",")
+}
+
+// hasCrashed reports whether the node has crashed. A crashed node
+// sends nothing, and its server delivers it nothing more.
+func (b *Byzantine) hasCrashed() bool {
+	return b != nil && atomic.LoadInt32(&b.crashed) == 1
+}
+
+// executed is told of every sequence the node executes, and crashes it
+// after CrashAfter of them: its transport is closed, so that it neither
+// sends nor receives anymore.
+func (b *Byzantine) executed(node *Node, sequenceID int64) {
+	if b == nil || b.CrashAfter == 0 || sequenceID < b.CrashAfter {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&b.crashed, 0, 1) {
+		return
+	}
+	node.logger(SubsystemFaults).Warn("Byzantine crash", "seq", sequenceID)
+	if err := node.Transport.Close(); err != nil {
+		node.reportErrors([]error{err})
+	}
+}
+
+// outbound is a message as a Byzantine node sends it; nil to is every replica.
+type outbound struct {
+	to   []string
+	msg  consensus.Message
+	path string
+}
+
+// intercept is called with every message the node sends, to the
+// replicas to or to every replica if to is nil. It returns false if the
+// message goes out as it is; otherwise b took care of it: sent it
+// tampered with, late, or not at all.
+func (b *Byzantine) intercept(node *Node, msg consensus.Message, path string, to []string) bool {
+	if b == nil {
+		return false
+	}
+	if b.Silent || b.hasCrashed() {
+		return true
+	}
+	msgs := b.tamper(node, outbound{to: to, msg: msg, path: path})
+	if msgs == nil && b.Delay == 0 {
+		return false
+	}
+	if msgs == nil {
+		msgs = []outbound{{to: to, msg: msg, path: path}}
+	}
+	if b.Delay == 0 {
+		b.send(node, msgs)
+		return true
+	}
+	node.spawn(func() {
+		if node.sleep(b.Delay) {
+			b.send(node, msgs)
+		}
+	})
+	return true
+}
+
+// tamper returns the messages sent instead of out, or nil if out is
+// left alone.
+func (b *Byzantine) tamper(node *Node, out outbound) []outbound {
+	switch msg := out.msg.(type) {
+	case *consensus.ReqPrePareMsgs:
+		if b.Withhold {
+			return []outbound{}
+		}
+		if b.Equivocate && out.to == nil {
+			return b.equivocate(node, msg)
+		}
+	case *consensus.VoteMsg:
+		if msg.Digest == "" || !(b.WrongDigest || b.DoubleVote) {
+			return nil
+		}
+		vote := msg
+		if b.WrongDigest {
+			vote = withDigest(msg, wrongDigest(msg.Digest))
+		}
+		msgs := []outbound{{to: out.to, msg: vote, path: out.path}}
+		if b.DoubleVote {
+			// The second vote is for the other digest: the one
+			// proposed if the first was wrong, a wrong one otherwise.
+			second := withDigest(msg, wrongDigest(msg.Digest))
+			if b.WrongDigest {
+				second = msg
+			}
+			msgs = append(msgs, outbound{to: out.to, msg: second, path: out.path})
+		}
+		return msgs
+	case *consensus.CollateMsg:
+		if b.ForgeCollate {
+			return []outbound{{to: out.to, msg: forgeCollate(node, msg), path: out.path}}
+		}
+	}
+	return nil
+}
+
+// equivocate proposes the request of prepare to half of the replicas,
+// this one among them, and a request altered by one byte to the others.
+func (b *Byzantine) equivocate(node *Node, prepare *consensus.ReqPrePareMsgs) []outbound {
+	requestMsg := node.Payloads.Get(prepare.PrepareMsg.Digest)
+	if requestMsg == nil {
+		return nil
+	}
+	altRequest := *requestMsg
+	altRequest.Data += "'"
+	altDigest, err := consensus.Digest(&altRequest)
+	if err == nil {
+		err = node.Payloads.Put(node.MyInfo.NodeID, altDigest, &altRequest)
+	}
+	if err != nil {
+		node.reportErrors([]error{err})
+		return nil
+	}
+	altPrepare := *prepare.PrepareMsg
+	altPrepare.Digest = altDigest
+
+	var honest, fooled []string
+	for _, nodeInfo := range node.NodeTable {
+		if nodeInfo.NodeID == node.MyInfo.NodeID || len(honest) < len(node.NodeTable)/2 {
+			honest = append(honest, nodeInfo.NodeID)
+		} else {
+			fooled = append(fooled, nodeInfo.NodeID)
+		}
+	}
+	node.logger(SubsystemFaults).Warn("Byzantine equivocation", "seq", altPrepare.SequenceID,
+		"digest", prepare.PrepareMsg.Digest, "replicas", len(honest), "altDigest", altDigest, "altReplicas", len(fooled))
+	return []outbound{
+		{to: honest, msg: prepare, path: "/prepare"},
+		{to: fooled, msg: &consensus.PayloadMsg{Digest: altDigest, RequestMsg: &altRequest}, path: "/payload"},
+		{to: fooled, msg: &consensus.ReqPrePareMsgs{PrepareMsg: &altPrepare}, path: "/prepare"},
+	}
+}
+
+// forgeCollate turns collate into a COMMITTED one with a vote from
+// every replica. The votes it makes up carry the proof of another
+// replica's vote, which the receivers find out and throw away.
+func forgeCollate(node *Node, collate *consensus.CollateMsg) *consensus.CollateMsg {
+	forged := *collate
+	forged.MsgType = consensus.COMMITTED
+	forged.ReceivedVoteMsg = make(map[string]*consensus.VoteMsg, len(node.NodeTable))
+	var model *consensus.VoteMsg
+	for nodeID, vote := range collate.ReceivedVoteMsg {
+		forged.ReceivedVoteMsg[nodeID] = vote
+		if model == nil || vote.NodeID < model.NodeID {
+			model = vote
+		}
+	}
+	if model == nil {
+		return &forged
+	}
+	for _, nodeInfo := range node.NodeTable {
+		if _, ok := forged.ReceivedVoteMsg[nodeInfo.NodeID]; ok {
+			continue
+		}
+		vote := *model
+		vote.NodeID = nodeInfo.NodeID
+		vote.MsgType = consensus.VOTE
+		forged.ReceivedVoteMsg[nodeInfo.NodeID] = &vote
+	}
+	return &forged
+}
+
+// withDigest returns a copy of vote for digest.
+func withDigest(vote *consensus.VoteMsg, digest string) *consensus.VoteMsg {
+	forged := *vote
+	forged.Digest = digest
+	if vote.PrepareMsg != nil {
+		prepareMsg := *vote.PrepareMsg
+		prepareMsg.Digest = digest
+		forged.PrepareMsg = &prepareMsg
+	}
+	return &forged
+}
+
+// wrongDigest returns a digest of the same form as digest, which no
+// request is likely to have.
+func wrongDigest(digest string) string {
+	sum := sha256.Sum256([]byte("byzantine:" + digest))
+	return hex.EncodeToString(sum[:])
+}
+
+// send signs and sends msgs as the honest paths would.
+func (b *Byzantine) send(node *Node, msgs []outbound) {
+	var errs []error
+	for _, out := range msgs {
+		receiver := ""
+		if len(out.to) == 1 {
+			receiver = out.to[0]
+		}
+		env := node.signedEnvelope(out.msg, out.path, receiver)
+		if env == nil {
+			continue
+		}
+		if out.to == nil {
+			if err := node.Transport.Broadcast(env); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		for _, nodeID := range out.to {
+			if err := node.Transport.Send(nodeID, env); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		node.reportErrors(errs)
+	}
+}
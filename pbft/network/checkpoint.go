@@ -1,8 +1,10 @@
 package network
+
 /*
 import (
 	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
 	"fmt"
+	"sync/atomic"
 )
 
 const periodCheckPoint = 5
@@ -60,7 +62,7 @@ func (node *Node) CheckPoint(msg *consensus.CheckPointMsg) {
 
 	// Checkpoint only once for each sequence number.
 	if node.Checkpointchk(msg.SequenceID) && !ok {
-		fStableCheckPoint := node.StableCheckPoint + periodCheckPoint
+		fStableCheckPoint := atomic.LoadInt64(&node.StableCheckPoint) + periodCheckPoint
 		// Delete Checkpoint Message Logs
 		for v, _ := range node.CheckPointMsgsLog {
 			if int64(v) < fStableCheckPoint {
@@ -77,7 +79,7 @@ func (node *Node) CheckPoint(msg *consensus.CheckPointMsg) {
 		node.StatesMutex.Unlock()
 
 		// Node Update StableCheckPoint
-		node.StableCheckPoint = fStableCheckPoint
+		atomic.StoreInt64(&node.StableCheckPoint, fStableCheckPoint)
 		LogStage("CHECKPOINT", true)
 	}
 
@@ -95,7 +97,10 @@ func (node *Node) CheckPointMissCheck(sequenceID int64) bool {
 		if state == nil {
 			return false
 		}
-		if node.CommittedMsgs[i - 1] == nil{
+		node.CommittedMutex.RLock()
+		committed := node.CommittedMsgs[i - 1]
+		node.CommittedMutex.RUnlock()
+		if committed == nil{
 			return false
 		}
 	}
@@ -125,4 +130,4 @@ func (node *Node) CheckPointMissCheck(sequenceID int64) bool {
 
 	return nil
 }
-*/
\ No newline at end of file
+*/
@@ -0,0 +1,205 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Erasure-coded dissemination of request bodies. Instead of pushing the
+// whole body to every replica, the primary cuts it into f+1 data shards,
+// extends them to one shard per replica and sends each replica its own
+// shard with a Merkle proof on /chunk. Every replica passes its shard on
+// to the others, so the primary uploads about three bodies instead of
+// n-1, which matters when its uplink spans regions. Any f+1 shards give
+// the body back, and the body is only stored if re-encoding it gives
+// the root the primary committed to.
+
+const (
+	// Number of bodies being rebuilt from chunks at the same time.
+	chunkStoreSize = 64
+
+	// Time given to the chunks of a body to arrive before it is fetched.
+	chunkFetchDelay = 500 * time.Millisecond
+)
+
+// dataShards is the number of chunks that give a body back among n
+// replicas: f+1, so that the honest replicas alone hold enough.
+func dataShards(n int) int {
+	return (n-1)/3 + 1
+}
+
+type chunkSet struct {
+	shards [][]byte
+	have   int
+	echoed bool
+	done   bool
+}
+
+// ChunkStore collects the chunks of bodies that are being rebuilt.
+type ChunkStore struct {
+	mu    sync.Mutex
+	sets  map[string]*chunkSet
+	order []string
+	next  int
+}
+
+func NewChunkStore(size int) *ChunkStore {
+	return &ChunkStore{
+		sets:  make(map[string]*chunkSet, size),
+		order: make([]string, 0, size),
+	}
+}
+
+// add records chunk and returns whether this node should pass it on,
+// and the shards once enough of them are there to rebuild the body.
+// The shards are returned once per body.
+func (store *ChunkStore) add(chunk *consensus.ChunkMsg, mine bool) (echo bool, shards [][]byte) {
+	// Chunks only belong together if the primary sent them with the
+	// same parameters; the root does not cover those.
+	key := fmt.Sprintf("%x/%s/%d/%d/%d", chunk.Root, chunk.Digest, chunk.Size, chunk.DataShards, chunk.Total)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	set, ok := store.sets[key]
+	if !ok {
+		if len(store.order) < cap(store.order) {
+			store.order = append(store.order, key)
+		} else {
+			delete(store.sets, store.order[store.next])
+			store.order[store.next] = key
+			store.next = (store.next + 1) % len(store.order)
+		}
+		set = &chunkSet{shards: make([][]byte, chunk.Total)}
+		store.sets[key] = set
+	}
+	if mine && !set.echoed {
+		set.echoed = true
+		echo = true
+	}
+	if set.done || set.shards[chunk.Index] != nil {
+		return echo, nil
+	}
+	set.shards[chunk.Index] = chunk.Chunk
+	set.have++
+	if set.have < int(chunk.DataShards) {
+		return echo, nil
+	}
+	set.done = true
+	shards, set.shards = set.shards, nil
+	return echo, shards
+}
+
+// disperseChunks sends every replica its chunk of payload.
+func (node *Node) disperseChunks(payload *consensus.PayloadMsg) error {
+	block, err := payload.RequestMsg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	n := len(node.NodeTable)
+	rs, err := newReedSolomon(dataShards(n), n)
+	if err != nil {
+		return err
+	}
+	shards := rs.encode(block)
+	levels := merkleTree(shards)
+
+	for i, nodeInfo := range node.NodeTable {
+		chunk := &consensus.ChunkMsg{
+			Digest:     payload.Digest,
+			SequenceID: payload.RequestMsg.SequenceID,
+			Root:       merkleRoot(levels),
+			Size:       int64(len(block)),
+			DataShards: int64(rs.dataShards),
+			Total:      int64(n),
+			Index:      int64(i),
+			Chunk:      shards[i],
+			Proof:      merkleProof(levels, i),
+		}
+		if nodeInfo.NodeID == node.MyInfo.NodeID {
+			// Nobody else passes on the chunk of the primary.
+			node.Broadcast(chunk, "/chunk")
+		} else {
+			node.SendTo(nodeInfo.NodeID, chunk, "/chunk")
+		}
+	}
+	return nil
+}
+
+// GetChunk checks a chunk against its root, passes it on if it is the
+// chunk of this node, and rebuilds the body once there are enough.
+func (node *Node) GetChunk(from string, chunk *consensus.ChunkMsg) {
+	if err := node.checkChunk(chunk); err != nil {
+		node.reportErrors([]error{fmt.Errorf("chunk from %s: %v", from, err)})
+		return
+	}
+	mine := from != node.MyInfo.NodeID && node.nodeIndex(node.MyInfo.NodeID) == int(chunk.Index)
+	echo, shards := node.Chunks.add(chunk, mine)
+	if echo {
+		node.Broadcast(chunk, "/chunk")
+	}
+	if shards == nil || node.Payloads.Get(chunk.Digest) != nil {
+		return
+	}
+
+	body, err := rebuildBody(chunk, shards)
+	if err == nil {
+		err = node.Payloads.Put(node.primaryOf(chunk.SequenceID), chunk.Digest, body)
+	}
+	if err != nil {
+		node.reportErrors([]error{fmt.Errorf("cannot rebuild payload of sequence %d: %v", chunk.SequenceID, err)})
+	}
+}
+
+// checkChunk checks the parameters of chunk and its Merkle proof.
+func (node *Node) checkChunk(chunk *consensus.ChunkMsg) error {
+	n := int64(len(node.NodeTable))
+	if chunk.Total != n || chunk.DataShards != int64(dataShards(len(node.NodeTable))) {
+		return fmt.Errorf("coded into %d of %d chunks, want %d of %d",
+			chunk.DataShards, chunk.Total, dataShards(len(node.NodeTable)), n)
+	}
+	if chunk.Size <= 0 || chunk.Size > maxMessageSize {
+		return fmt.Errorf("bad payload size %d", chunk.Size)
+	}
+	if want := (chunk.Size + chunk.DataShards - 1) / chunk.DataShards; int64(len(chunk.Chunk)) != want {
+		return fmt.Errorf("chunk has %d bytes, want %d", len(chunk.Chunk), want)
+	}
+	if !verifyMerkleProof(chunk.Root, chunk.Chunk, int(chunk.Index), int(chunk.Total), chunk.Proof) {
+		return fmt.Errorf("chunk %d does not match its root", chunk.Index)
+	}
+	return nil
+}
+
+// rebuildBody decodes the body from shards and checks that it encodes
+// to the root of chunk, so that every replica gets the same body.
+func rebuildBody(chunk *consensus.ChunkMsg, shards [][]byte) (*consensus.RequestMsg, error) {
+	rs, err := newReedSolomon(int(chunk.DataShards), int(chunk.Total))
+	if err != nil {
+		return nil, err
+	}
+	block, err := rs.reconstruct(shards, int(chunk.Size))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(merkleRoot(merkleTree(rs.encode(block))), chunk.Root) {
+		return nil, fmt.Errorf("chunks of %s are not from one body", chunk.Digest)
+	}
+	body := &consensus.RequestMsg{}
+	if err := body.UnmarshalBinary(block); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// nodeIndex returns the position of nodeID in the node table, or -1.
+func (node *Node) nodeIndex(nodeID string) int {
+	for i, nodeInfo := range node.NodeTable {
+		if nodeInfo.NodeID == nodeID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// encodeChunks codes body for n replicas as the primary does, letting
+// tamper change the shards before the root is taken.
+func encodeChunks(t *testing.T, body *consensus.RequestMsg, n int, tamper func(shards [][]byte)) []*consensus.ChunkMsg {
+	t.Helper()
+	block, err := body.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := newReedSolomon(dataShards(n), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := rs.encode(block)
+	if tamper != nil {
+		tamper(shards)
+	}
+	levels := merkleTree(shards)
+	chunks := make([]*consensus.ChunkMsg, n)
+	for i := range chunks {
+		chunks[i] = &consensus.ChunkMsg{
+			Digest:     "digest",
+			SequenceID: 1,
+			Root:       merkleRoot(levels),
+			Size:       int64(len(block)),
+			DataShards: int64(rs.dataShards),
+			Total:      int64(n),
+			Index:      int64(i),
+			Chunk:      shards[i],
+			Proof:      merkleProof(levels, i),
+		}
+	}
+	return chunks
+}
+
+// shardsOf returns the shards of the chunks at indexes.
+func shardsOf(chunks []*consensus.ChunkMsg, indexes ...int) [][]byte {
+	shards := make([][]byte, len(chunks))
+	for _, i := range indexes {
+		shards[i] = chunks[i].Chunk
+	}
+	return shards
+}
+
+func testBody() *consensus.RequestMsg {
+	return &consensus.RequestMsg{Timestamp: 1, ClientID: "Client1", Operation: "put", Data: "a body of some length", SequenceID: 1}
+}
+
+func TestRebuildBody(t *testing.T) {
+	body := testBody()
+	chunks := encodeChunks(t, body, 7, nil)
+	// f+1 = 3 of the 7 chunks, data or parity.
+	for _, indexes := range [][]int{{0, 1, 2}, {4, 5, 6}, {0, 3, 6}, {1, 2, 3, 4, 5}} {
+		got, err := rebuildBody(chunks[0], shardsOf(chunks, indexes...))
+		if err != nil {
+			t.Errorf("chunks %v: %v", indexes, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, body) {
+			t.Errorf("chunks %v: rebuilt %+v, want %+v", indexes, got, body)
+		}
+	}
+	if _, err := rebuildBody(chunks[0], shardsOf(chunks, 0, 6)); err == nil {
+		t.Error("rebuilt from f chunks")
+	}
+}
+
+func TestRebuildBodyInconsistentChunks(t *testing.T) {
+	// A primary that commits to a parity chunk not coded from the body.
+	// Every chunk matches the root, but no body codes to it, whichever
+	// chunks a replica gets.
+	chunks := encodeChunks(t, testBody(), 7, func(shards [][]byte) {
+		shards[5][0] ^= 0xff
+	})
+	node := &Node{NodeTable: make([]*NodeInfo, 7)}
+	for _, chunk := range chunks {
+		if err := node.checkChunk(chunk); err != nil {
+			t.Fatalf("chunk %d: %v", chunk.Index, err)
+		}
+	}
+	for _, indexes := range [][]int{{0, 1, 2}, {3, 4, 5}, {5, 6, 0}} {
+		if body, err := rebuildBody(chunks[0], shardsOf(chunks, indexes...)); err == nil {
+			t.Errorf("chunks %v: rebuilt %+v", indexes, body)
+		}
+	}
+}
+
+func TestCheckChunk(t *testing.T) {
+	node := &Node{NodeTable: make([]*NodeInfo, 7)}
+	for name, tamper := range map[string]func(chunk *consensus.ChunkMsg){
+		"bad proof":      func(chunk *consensus.ChunkMsg) { chunk.Proof[0] = chunk.Root },
+		"other chunk":    func(chunk *consensus.ChunkMsg) { chunk.Chunk[0] ^= 1 },
+		"other index":    func(chunk *consensus.ChunkMsg) { chunk.Index++ },
+		"short chunk":    func(chunk *consensus.ChunkMsg) { chunk.Chunk = chunk.Chunk[1:] },
+		"zero size":      func(chunk *consensus.ChunkMsg) { chunk.Size = 0 },
+		"other coding":   func(chunk *consensus.ChunkMsg) { chunk.DataShards++ },
+		"other replicas": func(chunk *consensus.ChunkMsg) { chunk.Total++ },
+	} {
+		chunk := encodeChunks(t, testBody(), 7, nil)[2]
+		tamper(chunk)
+		if err := node.checkChunk(chunk); err == nil {
+			t.Errorf("%s: chunk accepted", name)
+		}
+	}
+}
@@ -5,10 +5,10 @@
 package network
 
 import (
-	"log"
 	"net/http"
 	"time"
 
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
 	"github.com/gorilla/websocket"
 )
 
@@ -29,8 +29,8 @@ const (
 )
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024*1024*50,
-	WriteBufferSize: 1024*1024*50,
+	ReadBufferSize:  1024 * 1024 * 50,
+	WriteBufferSize: 1024 * 1024 * 50,
 }
 
 // Client is a middleman between the websocket connection and the hub.
@@ -42,17 +42,36 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// Wire codec negotiated for this connection.
+	codec consensus.Codec
+
+	// Node or client id the peer gave when connecting.
+	id string
+
+	// Who the connection counts as in flow control, see Hub.peerOf.
+	peer string
+
+	// Messages read, waiting for the verification pool.
+	inbound chan []byte
+
+	// Token buckets of the peer, shared with its other connections.
+	limiter *inboundLimiter
 }
 
-// readPump pumps messages from the websocket connection to the hub.
+// readPump pumps messages from the websocket connection to the node.
 //
 // The application runs readPump in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.quit:
+		}
 		c.conn.Close()
+		close(c.inbound)
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -61,12 +80,55 @@ func (c *Client) readPump() {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				c.hub.wire.log.Warn("websocket closed", "peer", c.name(), "err", err)
 			}
 			break
 		}
 		//log.Println("RECV:", message)
-		c.hub.broadcast <- message
+		c.hub.traffic.received(c.name(), len(message))
+		c.admit(message)
+	}
+}
+
+// admit queues a message read from the connection if it is within the
+// limits of the connection.
+func (c *Client) admit(message []byte) {
+	msgType, _, err := c.codec.PeekHeader(message)
+	if err != nil {
+		c.hub.drops.add(c.name(), "", DropMalformed)
+		return
+	}
+	if !c.limiter.allow(msgType, len(message)) {
+		c.hub.drops.add(c.name(), msgType, DropRateLimited)
+		return
+	}
+	if c.hub.policy == FlowBlock {
+		select {
+		case c.inbound <- message:
+		case <-c.hub.quit:
+		}
+		return
+	}
+	select {
+	case c.inbound <- message:
+	default:
+		c.hub.drops.add(c.name(), msgType, DropQueueFull)
+	}
+}
+
+// name identifies the peer in drop and traffic counters: its id if it
+// is in the node table, else unknownPeer, so that a peer cannot add
+// counters by connecting under made-up ids.
+func (c *Client) name() string {
+	return c.peer
+}
+
+// deliverPump hands the queued messages of the connection to the node.
+// It blocks while the verification pool is busy, and so does the reader
+// once the queue is full.
+func (c *Client) deliverPump() {
+	for message := range c.inbound {
+		c.hub.deliver(c.codec, message)
 	}
 }
 
@@ -87,29 +149,21 @@ func (c *Client) writePump() {
 			//c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write(<-c.send)
-			}
-
-			if err := w.Close(); err != nil {
+			// Every message gets its own frame; binary envelopes
+			// cannot be told apart when concatenated.
+			if err := c.conn.WriteMessage(frameType(c.codec), message); err != nil {
 				return
 			}
+			c.hub.traffic.sent(c.name(), len(message))
 		case <-ticker.C:
 			//c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Println("Ping error!")
+				c.hub.wire.log.Debug("ping failed", "peer", c.name(), "err", err)
 				return
 			}
 		}
@@ -118,17 +172,36 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	codec, header := negotiateCodec(r, hub.wire.codec)
+	if codec == nil {
+		http.Error(w, "no common wire codec", http.StatusBadRequest)
+		return
+	}
+	// Over TLS the peer was checked against the node table in the
+	// handshake, and its certificate says who it is.
+	id := r.URL.Query().Get("id")
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		id = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
-		log.Println(err)
+		hub.wire.log.Warn("websocket upgrade failed", "peer", id, "err", err)
 		return
 	}
 	//client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 512)}
-	client.hub.register <- client
+	peer := hub.peerOf(id)
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 512), codec: codec, id: id, peer: peer,
+		inbound: make(chan []byte, inboundQueueSize), limiter: hub.limiterOf(peer)}
+	select {
+	case client.hub.register <- client:
+	case <-hub.quit:
+		conn.Close()
+		return
+	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
 	go client.readPump()
+	go client.deliverPump()
 }
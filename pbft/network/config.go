@@ -0,0 +1,413 @@
+package network
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Config is what a replica runs with: who it is, where the others are,
+// the parameters of the protocol and the options of the node.
+// DefaultConfig holds the values the replicas were built with. A JSON
+// file overrides them, and flags override the file (see ParseConfig):
+//
+//	{
+//		"nodeID": "Node1",
+//		"nodeList": "/tmp/node.list",
+//		"phaseTimeouts": {"prepare": "5s", "vote": "5s"},
+//		"codec": "json"
+//	}
+//
+// Fields the file leaves out keep their values; fields it does not
+// know are an error. -print-config writes the whole of it.
+type Config struct {
+	NodeID   string `json:"nodeID"`
+	NodeList string `json:"nodeList"` // JSON list of the replicas
+	KeyDir   string `json:"keyDir"`   // keys and certificates, see pabft keygen
+
+	// View of the first sequence.
+	InitialView int64 `json:"initialView"`
+	// Sequences in an epoch. The primary moves on with every sequence,
+	// through the first EpochLength replicas of the node table.
+	EpochLength int64 `json:"epochLength"`
+	// Index in the node table of the first candidate primary of a view
+	// change, at the start of an epoch, and after a NEW-VIEW that ends one.
+	FirstCandidate   int64 `json:"firstCandidate"`
+	NewViewCandidate int64 `json:"newViewCandidate"`
+	// Time a sequence waits in a phase before it moves on without the
+	// messages it waits for. With adaptive timeouts, only until the
+	// phase has been seen to end.
+	PhaseTimeouts    PhaseTimeouts    `json:"phaseTimeouts"`
+	AdaptiveTimeouts AdaptiveTimeouts `json:"adaptiveTimeouts"`
+
+	ProposeDelay    Duration `json:"proposeDelay"`    // before a PREPARE
+	GenesisDelay    Duration `json:"genesisDelay"`    // before the PREPARE of the first sequence
+	ViewChangeDelay Duration `json:"viewChangeDelay"` // before a view change starts over
+	RetryDelay      Duration `json:"retryDelay"`      // before a message put back is resolved again
+
+	// Goroutines that hand messages to the sequences, and that find the
+	// sequence of a message.
+	Dispatchers int `json:"dispatchers"`
+	Resolvers   int `json:"resolvers"`
+	// Messages queued for a peer; more are dropped.
+	SendQueue int `json:"sendQueue"`
+	// Bytes of the request a primary proposes when no client request waits.
+	FillerSize int `json:"fillerSize"`
+	// Rates each peer may send at; more is dropped, see flow.go.
+	InboundLimits InboundLimits `json:"inboundLimits"`
+
+	// Options of the node, as the flags of main.go describe them.
+	Codec     string `json:"codec"`
+	TLS       bool   `json:"tls"`
+	Erasure   bool   `json:"erasure"`
+	Inbound   string `json:"inbound"`
+	Faults    bool   `json:"faults"`
+	Byzantine string `json:"byzantine"`
+	LogFormat string `json:"logFormat"`
+	LogLevel  string `json:"logLevel"`
+	Trace     string `json:"trace"`
+	Admin     string `json:"admin"`
+
+	// What the program that runs the node loads or opens for it, rather
+	// than a file says.
+	Clients     []*NodeInfo  `json:"-"` // may submit requests; clients have no url
+	TLSIdentity *TLSIdentity `json:"-"` // certificate of the node, required with TLS
+	TraceOutput *TraceOutput `json:"-"` // where the trace goes; nil traces nothing
+	Logging     *Logging     `json:"-"` // nil logs to stderr as LogFormat and LogLevel say
+	// Shared by the replicas of one node table in a process, such as the
+	// simulator's, so each signature is verified once; nil for one's own.
+	SignatureCache *SignatureCache `json:"-"`
+}
+
+// PhaseTimeouts are the phase timers of a sequence.
+type PhaseTimeouts struct {
+	Prepare    Duration `json:"prepare"`
+	Vote       Duration `json:"vote"`
+	Collate    Duration `json:"collate"`
+	ViewChange Duration `json:"viewChange"`
+}
+
+// AdaptiveTimeouts make the phase timers follow the time the phases
+// take, plus Margin, within Min and Max; see timeouts.go.
+type AdaptiveTimeouts struct {
+	Enabled bool     `json:"enabled"`
+	Margin  Duration `json:"margin"`
+	Min     Duration `json:"min"`
+	Max     Duration `json:"max"`
+}
+
+// DefaultConfig returns the configuration the replicas were built with.
+func DefaultConfig() *Config {
+	return &Config{
+		NodeList: "/tmp/node.list", // run_nodes.sh writes the local node list here.
+		KeyDir:   "keys",
+
+		// The view of 10000000000 the replicas used to start in, mod 10.
+		InitialView:      0,
+		EpochLength:      10,
+		FirstCandidate:   10,
+		NewViewCandidate: 7,
+		PhaseTimeouts: PhaseTimeouts{
+			Prepare:    Duration(20 * time.Second),
+			Vote:       Duration(20 * time.Second),
+			Collate:    Duration(20 * time.Second),
+			ViewChange: Duration(20 * time.Second),
+		},
+		AdaptiveTimeouts: AdaptiveTimeouts{
+			Enabled: true,
+			Margin:  Duration(200 * time.Millisecond),
+			Min:     Duration(500 * time.Millisecond),
+			Max:     Duration(60 * time.Second),
+		},
+
+		ProposeDelay:    Duration(100 * time.Millisecond),
+		GenesisDelay:    Duration(300 * time.Millisecond),
+		ViewChangeDelay: Duration(200 * time.Millisecond),
+		RetryDelay:      Duration(50 * time.Millisecond),
+
+		Dispatchers: 19,
+		Resolvers:   19,
+		SendQueue:   peerSendQueueSize,
+		FillerSize:  1 << 20,
+
+		InboundLimits: defaultInboundLimits(),
+
+		Codec:     "binary",
+		TLS:       true,
+		Inbound:   "block",
+		LogFormat: "text",
+		LogLevel:  "info",
+	}
+}
+
+// withLogging returns config, or a copy of it with Logging set if it
+// has none, so that the node and its transport share one.
+func withLogging(config *Config) *Config {
+	if config.Logging != nil {
+		return config
+	}
+	withLogging := *config
+	withLogging.Logging = NewLogging(os.Stderr, config.LogFormat == "json", slog.LevelInfo)
+	// Validate checks the levels.
+	withLogging.Logging.SetLevels(config.LogLevel)
+	return &withLogging
+}
+
+// LoadConfig reads the JSON file at path over config.
+func LoadConfig(path string, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// RegisterFlags defines a flag for every field of config, which sets
+// the field and defaults to its value.
+func (config *Config) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&config.NodeID, "id", config.NodeID, "id of this node in the node list")
+	flags.StringVar(&config.NodeList, "node-list", config.NodeList, "JSON list of the replicas")
+	flags.StringVar(&config.KeyDir, "keys", config.KeyDir, "directory of the keys and certificates")
+
+	flags.Int64Var(&config.InitialView, "initial-view", config.InitialView, "view of the first sequence")
+	flags.Int64Var(&config.EpochLength, "epoch-length", config.EpochLength, "sequences in an epoch; primaries rotate through as many replicas")
+	flags.Int64Var(&config.FirstCandidate, "first-candidate", config.FirstCandidate, "node table index of the first view-change candidate of an epoch")
+	flags.Int64Var(&config.NewViewCandidate, "newview-candidate", config.NewViewCandidate, "node table index of the view-change candidate after a NEW-VIEW ending an epoch")
+	durationFlag(flags, &config.PhaseTimeouts.Prepare, "prepare-timeout", "time to wait for a PREPARE")
+	durationFlag(flags, &config.PhaseTimeouts.Vote, "vote-timeout", "time to wait for a vote quorum")
+	durationFlag(flags, &config.PhaseTimeouts.Collate, "collate-timeout", "time to wait for a collate quorum")
+	durationFlag(flags, &config.PhaseTimeouts.ViewChange, "viewchange-timeout", "time to wait for a view change")
+	flags.BoolVar(&config.AdaptiveTimeouts.Enabled, "adaptive-timeouts", config.AdaptiveTimeouts.Enabled, "derive the phase timeouts from the time the phases take; the ones above are the first")
+	durationFlag(flags, &config.AdaptiveTimeouts.Margin, "timeout-margin", "time added to the estimate of a phase")
+	durationFlag(flags, &config.AdaptiveTimeouts.Min, "min-timeout", "shortest adaptive phase timeout")
+	durationFlag(flags, &config.AdaptiveTimeouts.Max, "max-timeout", "longest adaptive phase timeout, backoff included")
+	durationFlag(flags, &config.ProposeDelay, "propose-delay", "pause before a PREPARE")
+	durationFlag(flags, &config.GenesisDelay, "genesis-delay", "pause before the PREPARE of the first sequence")
+	durationFlag(flags, &config.ViewChangeDelay, "viewchange-delay", "pause before a view change starts over")
+	durationFlag(flags, &config.RetryDelay, "retry-delay", "pause before a message put back is resolved again")
+	flags.IntVar(&config.Dispatchers, "dispatchers", config.Dispatchers, "goroutines handing messages to the sequences")
+	flags.IntVar(&config.Resolvers, "resolvers", config.Resolvers, "goroutines finding the sequence of a message")
+	flags.IntVar(&config.SendQueue, "send-queue", config.SendQueue, "messages queued for a peer before dropping")
+	flags.IntVar(&config.FillerSize, "filler-size", config.FillerSize, "bytes of the request proposed when no client request waits")
+	flags.Var(&typeRateLimitsFlag{limits: &config.InboundLimits}, "rate-limits", "inbound messages per second and peer of message types, e.g. /vote=1000:500,/fetch=100:50 for rate:burst")
+	flags.Var(rateLimitFlag{&config.InboundLimits.Default}, "default-rate-limit", "inbound messages per second and peer of the other types, as rate:burst")
+	flags.Var(rateLimitFlag{&config.InboundLimits.Bytes}, "byte-rate-limit", "inbound bytes per second and peer, as rate:burst")
+
+	flags.StringVar(&config.Codec, "codec", config.Codec, "preferred wire codec (binary or json)")
+	flags.BoolVar(&config.TLS, "tls", config.TLS, "connect replicas with mutual TLS (certificates from pabft keygen)")
+	flags.BoolVar(&config.Erasure, "erasure", config.Erasure, "as primary, send request bodies as erasure-coded chunks")
+	flags.StringVar(&config.Inbound, "inbound", config.Inbound, "when a peer's inbound queue is full: block (push back) or drop")
+	flags.BoolVar(&config.Faults, "faults", config.Faults, "inject network faults, set at runtime on /admin/faults of the admin API (testing only)")
+	flags.StringVar(&config.Byzantine, "byzantine", config.Byzantine, "misbehave on purpose, e.g. silent or equivocate,crash=20 (testing only)")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "log as text or json")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "log level, for all subsystems or some, e.g. info,consensus=debug")
+	flags.StringVar(&config.Trace, "trace", config.Trace, "append a JSON line per sequence, telling how it unfolded, to this file")
+	flags.StringVar(&config.Admin, "admin", config.Admin, "serve the read-only admin API on this address, e.g. localhost:3111")
+}
+
+func durationFlag(flags *flag.FlagSet, d *Duration, name string, usage string) {
+	flags.DurationVar((*time.Duration)(d), name, time.Duration(*d), usage)
+}
+
+// rateLimitFlag sets a rate limit from rate:burst.
+type rateLimitFlag struct {
+	limit *RateLimit
+}
+
+func (f rateLimitFlag) String() string {
+	if f.limit == nil {
+		return ""
+	}
+	return f.limit.String()
+}
+
+func (f rateLimitFlag) Set(s string) error {
+	limit, err := parseRateLimit(s)
+	if err != nil {
+		return err
+	}
+	*f.limit = limit
+	return nil
+}
+
+// typeRateLimitsFlag sets the rate limits of message types from
+// type=rate:burst, comma separated. Its value is what it set, so that
+// ParseConfig sets those types again over a file and leaves the others.
+type typeRateLimitsFlag struct {
+	limits *InboundLimits
+	set    []string
+}
+
+func (f *typeRateLimitsFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.set, ",")
+}
+
+func (f *typeRateLimitsFlag) Set(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		msgType, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("rate limit %q is not type=rate:burst", entry)
+		}
+		limit, err := parseRateLimit(value)
+		if err != nil {
+			return err
+		}
+		if f.limits.ByType == nil {
+			f.limits.ByType = make(map[string]RateLimit)
+		}
+		f.limits.ByType[msgType] = limit
+		f.set = append(f.set, entry)
+	}
+	return nil
+}
+
+// ParseConfig parses args with flags, which gets a flag for every field
+// of the configuration and -config: the configuration is the default
+// one, then the file of -config, then the flags set.
+func ParseConfig(flags *flag.FlagSet, args []string) (*Config, error) {
+	config := DefaultConfig()
+	path := flags.String("config", "", "read the configuration from this JSON file; flags override it")
+	config.RegisterFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if *path == "" {
+		return config, nil
+	}
+
+	set := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	// The flags point into config; load the file over the defaults
+	// there, then set the flags given again.
+	*config = *DefaultConfig()
+	if err := LoadConfig(*path, config); err != nil {
+		return nil, err
+	}
+	for name, value := range set {
+		if err := flags.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Validate checks the values of config on their own; see also
+// CheckNodeTable.
+func (config *Config) Validate() error {
+	if config.NodeID == "" {
+		return fmt.Errorf("no node id")
+	}
+	if config.InitialView < 0 {
+		return fmt.Errorf("initial view %d is negative", config.InitialView)
+	}
+	if config.EpochLength < 1 {
+		return fmt.Errorf("epoch length %d is not positive", config.EpochLength)
+	}
+	if config.FirstCandidate < 0 || config.NewViewCandidate < 0 {
+		return fmt.Errorf("view-change candidates %d and %d must not be negative",
+			config.FirstCandidate, config.NewViewCandidate)
+	}
+	for name, d := range map[string]Duration{
+		"prepare":    config.PhaseTimeouts.Prepare,
+		"vote":       config.PhaseTimeouts.Vote,
+		"collate":    config.PhaseTimeouts.Collate,
+		"viewChange": config.PhaseTimeouts.ViewChange,
+	} {
+		if d <= 0 {
+			return fmt.Errorf("%s timeout %v is not positive", name, time.Duration(d))
+		}
+	}
+	if adaptive := config.AdaptiveTimeouts; adaptive.Enabled {
+		if adaptive.Margin < 0 {
+			return fmt.Errorf("timeout margin %v is negative", time.Duration(adaptive.Margin))
+		}
+		if adaptive.Min <= 0 || adaptive.Max < adaptive.Min {
+			return fmt.Errorf("adaptive timeouts from %v to %v: want 0 < min <= max",
+				time.Duration(adaptive.Min), time.Duration(adaptive.Max))
+		}
+	}
+	for name, d := range map[string]Duration{
+		"propose":    config.ProposeDelay,
+		"genesis":    config.GenesisDelay,
+		"viewChange": config.ViewChangeDelay,
+		"retry":      config.RetryDelay,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s delay %v is negative", name, time.Duration(d))
+		}
+	}
+	if config.Dispatchers < 1 || config.Resolvers < 1 {
+		return fmt.Errorf("%d dispatchers and %d resolvers: need at least one of each",
+			config.Dispatchers, config.Resolvers)
+	}
+	if config.SendQueue < 1 {
+		return fmt.Errorf("send queue of %d messages", config.SendQueue)
+	}
+	if config.FillerSize < 1 {
+		return fmt.Errorf("filler request of %d bytes", config.FillerSize)
+	}
+	if err := config.InboundLimits.validate(); err != nil {
+		return err
+	}
+
+	if _, err := consensus.CodecByName(config.Codec); err != nil {
+		return err
+	}
+	if _, err := ParseFlowPolicy(config.Inbound); err != nil {
+		return err
+	}
+	if _, err := ParseByzantine(config.Byzantine); err != nil {
+		return err
+	}
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		return fmt.Errorf("unknown log format %q (want text or json)", config.LogFormat)
+	}
+	if err := NewLogging(io.Discard, false, slog.LevelInfo).SetLevels(config.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CheckNodeTable checks config against the replicas of nodeTable.
+func (config *Config) CheckNodeTable(nodeTable []*NodeInfo) error {
+	if findNode(nodeTable, config.NodeID) == nil {
+		return fmt.Errorf("%s is not in the node list", config.NodeID)
+	}
+	n := int64(len(nodeTable))
+	if config.EpochLength > n {
+		return fmt.Errorf("epoch length %d is more than the %d replicas", config.EpochLength, n)
+	}
+	if config.FirstCandidate >= n || config.NewViewCandidate >= n {
+		return fmt.Errorf("view-change candidates %d and %d must index the %d replicas",
+			config.FirstCandidate, config.NewViewCandidate, n)
+	}
+	return nil
+}
+
+// Write writes config as JSON, as LoadConfig reads it.
+func (config *Config) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
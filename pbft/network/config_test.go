@@ -0,0 +1,258 @@
+package network
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to a config file of the test and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parseConfig(args ...string) (*Config, error) {
+	flags := flag.NewFlagSet("pabft", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return ParseConfig(flags, args)
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{"nodeID": "Node3", "epochLength": 5, "codec": "json", "phaseTimeouts": {"vote": "2s"}}`)
+	config := DefaultConfig()
+	if err := LoadConfig(path, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.NodeID != "Node3" || config.EpochLength != 5 || config.Codec != "json" {
+		t.Errorf("loaded node %q, epoch length %d, codec %q; want Node3, 5, json",
+			config.NodeID, config.EpochLength, config.Codec)
+	}
+	if time.Duration(config.PhaseTimeouts.Vote) != 2*time.Second {
+		t.Errorf("vote timeout %v, want 2s", time.Duration(config.PhaseTimeouts.Vote))
+	}
+	// What the file leaves out keeps its default.
+	defaults := DefaultConfig()
+	if config.SendQueue != defaults.SendQueue || config.PhaseTimeouts.Prepare != defaults.PhaseTimeouts.Prepare {
+		t.Errorf("send queue %d, prepare timeout %v; want the defaults", config.SendQueue,
+			time.Duration(config.PhaseTimeouts.Prepare))
+	}
+}
+
+func TestLoadConfigRoundTrip(t *testing.T) {
+	config := DefaultConfig()
+	config.NodeID = "Node2"
+	config.PhaseTimeouts.Vote = Duration(1500 * time.Millisecond)
+	config.Byzantine = "silent"
+	var buf bytes.Buffer
+	if err := config.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Config{}
+	if err := LoadConfig(writeConfig(t, buf.String()), loaded); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := loaded.Write(&again); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != buf.String() {
+		t.Errorf("config changed on the way through a file:\n%s\nwant\n%s", again.String(), buf.String())
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field": `{"nodeID": "Node1", "epochLenght": 5}`,
+		"wrong type":    `{"epochLength": "five"}`,
+		"bad duration":  `{"phaseTimeouts": {"vote": "soon"}}`,
+		"not json":      `nodeId = Node1`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfig(t, content)
+			err := LoadConfig(path, DefaultConfig())
+			if err == nil {
+				t.Fatal("loaded")
+			}
+			if !strings.Contains(err.Error(), path) {
+				t.Errorf("error %q does not name the file", err)
+			}
+		})
+	}
+	if err := LoadConfig(filepath.Join(t.TempDir(), "missing.json"), DefaultConfig()); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestParseConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `{"nodeID": "Node1", "epochLength": 5, "codec": "json", "erasure": true}`)
+
+	// Defaults, then the file, then the flags, wherever -config is.
+	for _, args := range [][]string{
+		{"-config", path, "-epoch-length", "7", "-log-level", "debug"},
+		{"-epoch-length", "7", "-config", path, "-log-level", "debug"},
+	} {
+		config, err := parseConfig(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.EpochLength != 7 {
+			t.Errorf("%v: epoch length %d, want 7 from the flag", args, config.EpochLength)
+		}
+		if config.NodeID != "Node1" || config.Codec != "json" || !config.Erasure {
+			t.Errorf("%v: node %q, codec %q, erasure %v; want Node1, json, true from the file",
+				args, config.NodeID, config.Codec, config.Erasure)
+		}
+		if config.LogLevel != "debug" {
+			t.Errorf("%v: log level %q, want debug from the flag", args, config.LogLevel)
+		}
+		if config.SendQueue != DefaultConfig().SendQueue {
+			t.Errorf("%v: send queue %d, want the default", args, config.SendQueue)
+		}
+	}
+
+	// A flag set to its default still overrides the file.
+	config, err := parseConfig("-config", path, "-codec", "binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Codec != "binary" {
+		t.Errorf("codec %q, want binary from the flag", config.Codec)
+	}
+
+	// Without -config the flags go over the defaults.
+	config, err = parseConfig("-id", "Node4", "-vote-timeout", "3s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NodeID != "Node4" || time.Duration(config.PhaseTimeouts.Vote) != 3*time.Second {
+		t.Errorf("node %q, vote timeout %v; want Node4, 3s", config.NodeID, time.Duration(config.PhaseTimeouts.Vote))
+	}
+	if config.EpochLength != DefaultConfig().EpochLength {
+		t.Errorf("epoch length %d, want the default", config.EpochLength)
+	}
+
+	if _, err := parseConfig("-config", filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("parsed with a missing config file")
+	}
+	if _, err := parseConfig("-no-such-flag"); err == nil {
+		t.Error("parsed an unknown flag")
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	path := writeConfig(t, `{"nodeID": "Node1", "inboundLimits": {"byType": {"/vote": {"rate": 10, "burst": 5}}}}`)
+	config, err := parseConfig("-config", path, "-rate-limits", "/fetch=20:10,/chunk=30:15", "-default-rate-limit", "5:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultConfig().InboundLimits
+	for msgType, want := range map[string]RateLimit{
+		"/vote":    {Rate: 10, Burst: 5},
+		"/fetch":   {Rate: 20, Burst: 10},
+		"/chunk":   {Rate: 30, Burst: 15},
+		"/prepare": defaults.ByType["/prepare"],
+	} {
+		if got := config.InboundLimits.ByType[msgType]; got != want {
+			t.Errorf("rate limit of %s %v, want %v", msgType, got, want)
+		}
+	}
+	if got := config.InboundLimits.Default; got != (RateLimit{Rate: 5, Burst: 5}) {
+		t.Errorf("default rate limit %v, want 5:5 from the flag", got)
+	}
+	if got := config.InboundLimits.Bytes; got != defaults.Bytes {
+		t.Errorf("byte rate limit %v, want the default %v", got, defaults.Bytes)
+	}
+
+	for _, args := range [][]string{
+		{"-rate-limits", "/vote"},
+		{"-rate-limits", "/vote=fast:5"},
+		{"-byte-rate-limit", "100"},
+	} {
+		if _, err := parseConfig(args...); err == nil {
+			t.Errorf("parsed %v", args)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		config := DefaultConfig()
+		config.NodeID = "Node1"
+		return config
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("default config with a node id: %v", err)
+	}
+
+	for name, mutate := range map[string]func(config *Config){
+		"no node id":          func(config *Config) { config.NodeID = "" },
+		"negative view":       func(config *Config) { config.InitialView = -1 },
+		"empty epoch":         func(config *Config) { config.EpochLength = 0 },
+		"negative candidate":  func(config *Config) { config.FirstCandidate = -1 },
+		"zero vote timeout":   func(config *Config) { config.PhaseTimeouts.Vote = 0 },
+		"negative delay":      func(config *Config) { config.RetryDelay = Duration(-time.Second) },
+		"no dispatchers":      func(config *Config) { config.Dispatchers = 0 },
+		"empty send queue":    func(config *Config) { config.SendQueue = 0 },
+		"empty filler":        func(config *Config) { config.FillerSize = 0 },
+		"zero vote rate":      func(config *Config) { config.InboundLimits.ByType["/vote"] = RateLimit{Burst: 10} },
+		"small byte burst":    func(config *Config) { config.InboundLimits.Bytes.Burst = 1024 },
+		"unknown codec":       func(config *Config) { config.Codec = "xml" },
+		"unknown policy":      func(config *Config) { config.Inbound = "spill" },
+		"unknown byzantine":   func(config *Config) { config.Byzantine = "sneaky" },
+		"crash without count": func(config *Config) { config.Byzantine = "crash" },
+		"unknown log format":  func(config *Config) { config.LogFormat = "xml" },
+		"unknown log level":   func(config *Config) { config.LogLevel = "loud" },
+		"unknown subsystem":   func(config *Config) { config.LogLevel = "storage=debug" },
+		"negative margin":     func(config *Config) { config.AdaptiveTimeouts.Margin = Duration(-time.Millisecond) },
+		"adaptive min > max": func(config *Config) {
+			config.AdaptiveTimeouts.Min = config.AdaptiveTimeouts.Max + 1
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := valid()
+			config.AdaptiveTimeouts.Enabled = true
+			mutate(config)
+			if err := config.Validate(); err == nil {
+				t.Error("valid")
+			}
+		})
+	}
+}
+
+func TestCheckNodeTable(t *testing.T) {
+	nodeTable := make([]*NodeInfo, 4)
+	for i := range nodeTable {
+		nodeTable[i] = &NodeInfo{NodeID: "Node" + string(rune('1'+i))}
+	}
+	config := DefaultConfig()
+	config.NodeID = "Node1"
+	config.EpochLength = 4
+	config.FirstCandidate = 2
+	config.NewViewCandidate = 3
+	if err := config.CheckNodeTable(nodeTable); err != nil {
+		t.Fatal(err)
+	}
+	for name, mutate := range map[string]func(config *Config){
+		"not in the table":   func(config *Config) { config.NodeID = "Node9" },
+		"epoch too long":     func(config *Config) { config.EpochLength = 5 },
+		"candidate past end": func(config *Config) { config.NewViewCandidate = 4 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			broken := *config
+			mutate(&broken)
+			if err := broken.CheckNodeTable(nodeTable); err == nil {
+				t.Error("valid")
+			}
+		})
+	}
+}
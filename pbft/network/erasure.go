@@ -0,0 +1,220 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Systematic Reed-Solomon code over GF(2^8). A block is cut into
+// dataShards shards and extended to totalShards; any dataShards of them
+// give the block back. The first dataShards shards are the block itself.
+
+// Multiplication table of GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1.
+var gfMul [256][256]byte
+
+// Multiplicative inverses in GF(2^8); gfInv[0] is unused.
+var gfInv [256]byte
+
+func init() {
+	var exp [510]byte
+	var log [256]int
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = exp[log[a]+log[b]]
+		}
+		gfInv[a] = exp[255-log[a]]
+	}
+}
+
+func gfPow(a byte, n int) byte {
+	result := byte(1)
+	for i := 0; i < n; i++ {
+		result = gfMul[result][a]
+	}
+	return result
+}
+
+type reedSolomon struct {
+	dataShards  int
+	totalShards int
+
+	// totalShards x dataShards; shard i is matrix[i] times the data shards.
+	matrix [][]byte
+}
+
+func newReedSolomon(dataShards int, totalShards int) (*reedSolomon, error) {
+	if dataShards < 1 || totalShards < dataShards || totalShards > 256 {
+		return nil, fmt.Errorf("cannot code %d data shards into %d", dataShards, totalShards)
+	}
+	// A Vandermonde matrix has every dataShards rows independent.
+	// Multiplying it by the inverse of its top square makes the code
+	// systematic without losing that property.
+	vandermonde := make([][]byte, totalShards)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := invertMatrix(vandermonde[:dataShards])
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{
+		dataShards:  dataShards,
+		totalShards: totalShards,
+		matrix:      multiplyMatrix(vandermonde, top),
+	}, nil
+}
+
+// shardSize is the size of each shard of a block of size bytes.
+func (rs *reedSolomon) shardSize(size int) int {
+	return (size + rs.dataShards - 1) / rs.dataShards
+}
+
+// encode splits block into totalShards shards of equal size.
+func (rs *reedSolomon) encode(block []byte) [][]byte {
+	size := rs.shardSize(len(block))
+	if size == 0 {
+		size = 1
+	}
+	padded := make([]byte, size*rs.totalShards)
+	copy(padded, block)
+
+	shards := make([][]byte, rs.totalShards)
+	for i := range shards {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+	for i := rs.dataShards; i < rs.totalShards; i++ {
+		combine(shards[i], rs.matrix[i], shards[:rs.dataShards])
+	}
+	return shards
+}
+
+// reconstruct returns the block of size bytes from the shards that are
+// not nil, of which there must be at least dataShards.
+func (rs *reedSolomon) reconstruct(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) != rs.totalShards {
+		return nil, fmt.Errorf("got %d shards, want %d", len(shards), rs.totalShards)
+	}
+	shardSize := rs.shardSize(size)
+	if shardSize == 0 {
+		shardSize = 1
+	}
+	var rows [][]byte
+	var inputs [][]byte
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if len(shard) != shardSize {
+			return nil, fmt.Errorf("shard %d has %d bytes, want %d", i, len(shard), shardSize)
+		}
+		rows = append(rows, rs.matrix[i])
+		inputs = append(inputs, shard)
+		if len(rows) == rs.dataShards {
+			break
+		}
+	}
+	if len(rows) < rs.dataShards {
+		return nil, fmt.Errorf("%d shards are not enough, need %d", len(rows), rs.dataShards)
+	}
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	block := make([]byte, shardSize*rs.dataShards)
+	for i := 0; i < rs.dataShards; i++ {
+		out := block[i*shardSize : (i+1)*shardSize]
+		if shards[i] != nil {
+			// The code is systematic, and data shards that came in are
+			// among the first picked: they are the block itself.
+			copy(out, shards[i])
+			continue
+		}
+		combine(out, decode[i], inputs)
+	}
+	return block[:size], nil
+}
+
+// combine sets out to the sum of coefficients[i] times inputs[i].
+func combine(out []byte, coefficients []byte, inputs [][]byte) {
+	for i := range out {
+		out[i] = 0
+	}
+	for i, c := range coefficients {
+		if c == 0 {
+			continue
+		}
+		table := &gfMul[c]
+		for j, b := range inputs[i] {
+			out[j] ^= table[b]
+		}
+	}
+}
+
+func multiplyMatrix(a [][]byte, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for c := range out[r] {
+			var sum byte
+			for i := range b {
+				sum ^= gfMul[a[r][i]][b[i][c]]
+			}
+			out[r][c] = sum
+		}
+	}
+	return out
+}
+
+// invertMatrix inverts a square matrix by Gauss-Jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for r := range m {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		scale := gfInv[work[c][c]]
+		for i := range work[c] {
+			work[c][i] = gfMul[scale][work[c][i]]
+		}
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= gfMul[factor][work[c][i]]
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range work {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
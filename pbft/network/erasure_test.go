@@ -0,0 +1,66 @@
+package network
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+func TestReedSolomonAnyDataShards(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, n := range []int{4, 7, 10} {
+		rs, err := newReedSolomon(dataShards(n), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range []int{0, 1, rs.dataShards, 1000} {
+			block := make([]byte, size)
+			random.Read(block)
+			shards := rs.encode(block)
+			// Every subset of the shards, given any f+1 of them or more,
+			// gives the block back; fewer do not.
+			for subset := 0; subset < 1<<n; subset++ {
+				kept := make([][]byte, n)
+				for i := range kept {
+					if subset&(1<<i) != 0 {
+						kept[i] = shards[i]
+					}
+				}
+				got, err := rs.reconstruct(kept, size)
+				if bits.OnesCount(uint(subset)) < rs.dataShards {
+					if err == nil {
+						t.Errorf("n=%d size=%d: rebuilt from shards %b", n, size, subset)
+					}
+					continue
+				}
+				if err != nil || !bytes.Equal(got, block) {
+					t.Errorf("n=%d size=%d: shards %b gave %x, %v", n, size, subset, got, err)
+				}
+			}
+		}
+	}
+}
+
+func TestReedSolomonBadShardSize(t *testing.T) {
+	rs, err := newReedSolomon(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := rs.encode([]byte("body"))
+	shards[1] = shards[1][:1]
+	if _, err := rs.reconstruct(shards, 4); err == nil {
+		t.Error("rebuilt from a short shard")
+	}
+	if _, err := rs.reconstruct(shards[:3], 4); err == nil {
+		t.Error("rebuilt from too short a shard list")
+	}
+}
+
+func TestNewReedSolomonBounds(t *testing.T) {
+	for _, shards := range [][2]int{{0, 4}, {5, 4}, {2, 257}} {
+		if _, err := newReedSolomon(shards[0], shards[1]); err == nil {
+			t.Errorf("coded %d data shards into %d", shards[0], shards[1])
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Fault injection, to check liveness under a bad network. A
+// FaultyTransport wraps another transport and, following a FaultConfig,
+// delays, drops, duplicates or reorders messages on their way out and
+// in, and cuts the links between partitions. With -faults the config
+// can be read and changed at runtime on /admin/faults of the admin API:
+//
+//	pabft -faults -admin localhost:3111 Node1 19
+//	curl -X PUT http://localhost:3111/admin/faults -d '{"rules": [{"to": "Node3", "msgType": "/vote", "delay": "200ms", "drop": 0.1}]}'
+//
+// Without -faults the endpoint is not there.
+
+// Extra delay of a message that is reordered, so that later ones overtake it.
+const faultReorderHold = 100 * time.Millisecond
+
+// Directions of a FaultRule.
+const (
+	FaultOutbound = "outbound"
+	FaultInbound  = "inbound"
+)
+
+// Duration is a time.Duration written in JSON as a string like "150ms".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"50ms\": %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FaultRule says what happens to the messages of one link and type.
+// Empty From, To and MsgType match anything. Outbound rules act on the
+// sending node, inbound rules on the receiving one.
+type FaultRule struct {
+	Direction string `json:"direction,omitempty"` // outbound (default) or inbound
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	MsgType   string `json:"msgType,omitempty"`
+
+	Delay     Duration `json:"delay,omitempty"`
+	Jitter    Duration `json:"jitter,omitempty"`    // random extra delay, up to this
+	Drop      float64  `json:"drop,omitempty"`      // probability of losing a message
+	Duplicate float64  `json:"duplicate,omitempty"` // probability of delivering it twice
+	Reorder   float64  `json:"reorder,omitempty"`   // probability of holding it back
+}
+
+func (rule *FaultRule) matches(direction string, from string, to string, msgType string) bool {
+	ruleDirection := rule.Direction
+	if ruleDirection == "" {
+		ruleDirection = FaultOutbound
+	}
+	return ruleDirection == direction &&
+		(rule.From == "" || rule.From == from) &&
+		(rule.To == "" || rule.To == to) &&
+		(rule.MsgType == "" || rule.MsgType == msgType)
+}
+
+// FaultConfig is the set of faults a FaultyTransport injects.
+type FaultConfig struct {
+	// The first rule that matches a message applies to it.
+	Rules []FaultRule `json:"rules,omitempty"`
+
+	// Nodes in different groups cannot reach each other. Nodes in no
+	// group reach everyone.
+	Partitions [][]string `json:"partitions,omitempty"`
+
+	// Seed of the random choices, to repeat a run; zero seeds from the clock.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+func (config *FaultConfig) validate() error {
+	for i, rule := range config.Rules {
+		if rule.Direction != "" && rule.Direction != FaultOutbound && rule.Direction != FaultInbound {
+			return fmt.Errorf("rule %d: direction must be %s or %s", i, FaultOutbound, FaultInbound)
+		}
+		if rule.Delay < 0 || rule.Jitter < 0 {
+			return fmt.Errorf("rule %d: negative delay", i)
+		}
+		for _, p := range []float64{rule.Drop, rule.Duplicate, rule.Reorder} {
+			if p < 0 || p > 1 {
+				return fmt.Errorf("rule %d: probability %v is not in [0, 1]", i, p)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, group := range config.Partitions {
+		for _, nodeID := range group {
+			if seen[nodeID] {
+				return fmt.Errorf("%s is in more than one partition", nodeID)
+			}
+			seen[nodeID] = true
+		}
+	}
+	return nil
+}
+
+// FaultyTransport injects faults into the messages of another transport.
+type FaultyTransport struct {
+	inner   Transport
+	nodeID  string
+	nodeIDs []string
+	log     *slog.Logger
+	inbound chan WireMessage
+	errors  chan []error
+
+	mu     sync.Mutex
+	config FaultConfig
+	group  map[string]int
+	rand   *rand.Rand
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFaultyTransport wraps inner, the transport of nodeID. It injects no
+// faults until SetConfig is called.
+func NewFaultyTransport(inner Transport, nodeID string, nodeTable []*NodeInfo, log *slog.Logger) *FaultyTransport {
+	t := &FaultyTransport{
+		inner:   inner,
+		nodeID:  nodeID,
+		log:     log,
+		inbound: make(chan WireMessage, cap(inner.Inbound())),
+		errors:  make(chan []error, len(nodeTable)),
+		group:   make(map[string]int),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:    make(chan struct{}),
+	}
+	for _, nodeInfo := range nodeTable {
+		t.nodeIDs = append(t.nodeIDs, nodeInfo.NodeID)
+	}
+	if reporter, ok := inner.(errorReporter); ok {
+		go func() {
+			for {
+				select {
+				case errs := <-reporter.Errors():
+					t.report(errs)
+				case <-t.done:
+					return
+				}
+			}
+		}()
+	}
+	go t.receiveLoop()
+	return t
+}
+
+// SetConfig replaces the faults injected from now on. Messages already
+// held back are still delivered.
+func (t *FaultyTransport) SetConfig(config FaultConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	group := make(map[string]int)
+	for i, nodes := range config.Partitions {
+		for _, nodeID := range nodes {
+			group[nodeID] = i + 1
+		}
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	t.mu.Lock()
+	t.config = config
+	t.group = group
+	t.rand = rand.New(rand.NewSource(seed))
+	t.mu.Unlock()
+
+	t.log.Info("fault injection configured",
+		"rules", len(config.Rules), "partitions", len(config.Partitions))
+	return nil
+}
+
+// Config returns the faults injected now.
+func (t *FaultyTransport) Config() FaultConfig {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.config
+}
+
+func (t *FaultyTransport) active() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.config.Rules) > 0 || len(t.config.Partitions) > 0
+}
+
+// decide returns the delay of each copy of a message to deliver; none
+// if it is lost.
+func (t *FaultyTransport) decide(direction string, from string, to string, msgType string) []time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if g, h := t.group[from], t.group[to]; g != 0 && h != 0 && g != h {
+		return nil
+	}
+	for i := range t.config.Rules {
+		rule := &t.config.Rules[i]
+		if !rule.matches(direction, from, to, msgType) {
+			continue
+		}
+		if t.rand.Float64() < rule.Drop {
+			return nil
+		}
+		copies := 1
+		if t.rand.Float64() < rule.Duplicate {
+			copies++
+		}
+		delays := make([]time.Duration, copies)
+		for c := range delays {
+			delays[c] = time.Duration(rule.Delay)
+			if rule.Jitter > 0 {
+				delays[c] += time.Duration(t.rand.Int63n(int64(rule.Jitter) + 1))
+			}
+			if t.rand.Float64() < rule.Reorder {
+				delays[c] += faultReorderHold
+			}
+		}
+		return delays
+	}
+	return []time.Duration{0}
+}
+
+// after runs f once delay has passed, unless the transport is closed by then.
+func (t *FaultyTransport) after(delay time.Duration, f func()) {
+	if delay <= 0 {
+		f()
+		return
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case <-t.done:
+		default:
+			f()
+		}
+	})
+}
+
+func (t *FaultyTransport) Send(nodeID string, env *consensus.Envelope) error {
+	delays := t.decide(FaultOutbound, t.nodeID, nodeID, env.MsgType)
+	if len(delays) == 1 && delays[0] == 0 {
+		return t.inner.Send(nodeID, env)
+	}
+	for _, delay := range delays {
+		t.after(delay, func() {
+			if err := t.inner.Send(nodeID, env); err != nil {
+				t.report([]error{err})
+			}
+		})
+	}
+	return nil
+}
+
+// Broadcast hands env to the inner transport as is, unless faults are
+// injected; then every replica is sent a copy of its own.
+func (t *FaultyTransport) Broadcast(env *consensus.Envelope) error {
+	if !t.active() {
+		return t.inner.Broadcast(env)
+	}
+	var errs []error
+	for _, nodeID := range t.nodeIDs {
+		if err := t.Send(nodeID, env); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+func (t *FaultyTransport) receiveLoop() {
+	for {
+		select {
+		case msg := <-t.inner.Inbound():
+			t.receive(msg)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *FaultyTransport) receive(msg WireMessage) {
+	deliver := func() {
+		select {
+		case t.inbound <- msg:
+		case <-t.done:
+		}
+	}
+	msgType, sender, err := msg.Codec.PeekHeader(msg.Data)
+	if err != nil {
+		// Let verification reject it.
+		deliver()
+		return
+	}
+	for _, delay := range t.decide(FaultInbound, sender, t.nodeID, msgType) {
+		t.after(delay, deliver)
+	}
+}
+
+func (t *FaultyTransport) Inbound() <-chan WireMessage {
+	return t.inbound
+}
+
+func (t *FaultyTransport) Errors() <-chan []error {
+	return t.errors
+}
+
+func (t *FaultyTransport) report(errs []error) {
+	select {
+	case t.errors <- errs:
+	case <-t.done:
+	}
+}
+
+// Drain drains the inner transport. Messages still delayed are dropped.
+func (t *FaultyTransport) Drain(ctx context.Context) error {
+	if inner, ok := t.inner.(drainer); ok {
+		return inner.Drain(ctx)
+	}
+	return nil
+}
+
+func (t *FaultyTransport) Close() error {
+	return t.CloseContext(context.Background())
+}
+
+// CloseContext closes the transport and the one it wraps, waiting for
+// the latter no longer than ctx.
+func (t *FaultyTransport) CloseContext(ctx context.Context) error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+	return closeTransport(ctx, t.inner)
+}
+
+// ServeHTTP serves the config: GET returns it, PUT or POST replaces it,
+// DELETE clears it.
+func (t *FaultyTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var config FaultConfig
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := t.SetConfig(config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		t.SetConfig(FaultConfig{})
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Config())
+}
@@ -0,0 +1,260 @@
+package network
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Inbound flow control. Every peer of the hub has a token bucket per
+// message type and one for its bytes, shared by its connections, so
+// that opening more connections does not raise its rate; peers that are
+// not in the node table share one set. Every connection has a bounded
+// queue in front of the verification pool. Messages over the rate are
+// dropped. When
+// the queue is full the reader either stops reading, which pushes back
+// on that peer only, or drops the message. Each connection feeds the
+// pool from its own goroutine, so a full pool serves the peers in turn
+// and a flooding replica cannot starve the others.
+
+// FlowPolicy says what happens to a message when the inbound queue of
+// its connection is full.
+type FlowPolicy int
+
+const (
+	FlowBlock FlowPolicy = iota // stop reading the connection until there is room
+	FlowDrop                    // drop the message
+)
+
+func (policy FlowPolicy) String() string {
+	switch policy {
+	case FlowBlock:
+		return "block"
+	case FlowDrop:
+		return "drop"
+	}
+	return fmt.Sprintf("FlowPolicy(%d)", int(policy))
+}
+
+// ParseFlowPolicy returns the policy called name ("block" or "drop").
+func ParseFlowPolicy(name string) (FlowPolicy, error) {
+	switch name {
+	case "block":
+		return FlowBlock, nil
+	case "drop":
+		return FlowDrop, nil
+	}
+	return 0, fmt.Errorf("unknown inbound policy %q (want block or drop)", name)
+}
+
+// RateLimit is the rate and burst of a token bucket.
+type RateLimit struct {
+	Rate  float64 `json:"rate"` // tokens per second
+	Burst float64 `json:"burst"`
+}
+
+// String returns limit as rate:burst, as parseRateLimit reads it.
+func (limit RateLimit) String() string {
+	return strconv.FormatFloat(limit.Rate, 'g', -1, 64) + ":" + strconv.FormatFloat(limit.Burst, 'g', -1, 64)
+}
+
+func parseRateLimit(s string) (RateLimit, error) {
+	rate, burst, ok := strings.Cut(s, ":")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q is not rate:burst", s)
+	}
+	var limit RateLimit
+	var err error
+	if limit.Rate, err = strconv.ParseFloat(rate, 64); err != nil {
+		return RateLimit{}, fmt.Errorf("rate limit %q: %v", s, err)
+	}
+	if limit.Burst, err = strconv.ParseFloat(burst, 64); err != nil {
+		return RateLimit{}, fmt.Errorf("rate limit %q: %v", s, err)
+	}
+	return limit, nil
+}
+
+// InboundLimits are the rates a peer may send at; what goes over them
+// is dropped.
+type InboundLimits struct {
+	ByType  map[string]RateLimit `json:"byType"`  // messages per second, by message type
+	Default RateLimit            `json:"default"` // messages per second of the other types
+	Bytes   RateLimit            `json:"bytes"`   // bytes per second
+}
+
+// defaultInboundLimits leave room for a primary proposing back to back
+// and for the fetches of a lagging replica. The burst of bytes lets the
+// largest message through.
+func defaultInboundLimits() InboundLimits {
+	return InboundLimits{
+		ByType: map[string]RateLimit{
+			"/prepare":    {Rate: 200, Burst: 100},
+			"/payload":    {Rate: 50, Burst: 20},
+			"/chunk":      {Rate: 400, Burst: 200},
+			"/fetch":      {Rate: 100, Burst: 50},
+			"/vote":       {Rate: 1000, Burst: 500},
+			"/collate":    {Rate: 1000, Burst: 500},
+			"/checkpoint": {Rate: 100, Burst: 100},
+			"/viewchange": {Rate: 50, Burst: 50},
+			"/newview":    {Rate: 50, Burst: 50},
+			"/request":    {Rate: 1000, Burst: 1000},
+		},
+		Default: RateLimit{Rate: 100, Burst: 100},
+		Bytes:   RateLimit{Rate: 64 << 20, Burst: 2 * maxMessageSize},
+	}
+}
+
+// validate checks that the limits let a message through, and the burst
+// of bytes the largest one.
+func (limits InboundLimits) validate() error {
+	for msgType, limit := range limits.ByType {
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return fmt.Errorf("rate limit %v of %s: want a positive rate and a burst of at least 1", limit, msgType)
+		}
+	}
+	if limits.Default.Rate <= 0 || limits.Default.Burst < 1 {
+		return fmt.Errorf("default rate limit %v: want a positive rate and a burst of at least 1", limits.Default)
+	}
+	if limits.Bytes.Rate <= 0 || limits.Bytes.Burst < maxMessageSize {
+		return fmt.Errorf("byte rate limit %v: want a positive rate and a burst of at least %d", limits.Bytes, maxMessageSize)
+	}
+	return nil
+}
+
+const (
+	// Messages queued per connection ahead of the verification pool.
+	inboundQueueSize = 256
+
+	// Drops of one kind reported after the first.
+	dropReportEvery = 10000
+)
+
+// Reasons for dropping an inbound message.
+const (
+	DropMalformed   = "malformed" // message type cannot be read
+	DropRateLimited = "rate"      // over the rate of its type or connection
+	DropQueueFull   = "queue"     // inbound queue full under FlowDrop
+	DropSendFull    = "send"      // outbound buffer of a hub client full
+)
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.Burst, last: time.Now()}
+}
+
+// allow takes cost tokens if there are that many. It is not safe for
+// concurrent use; each bucket belongs to one limiter, which locks it.
+func (b *tokenBucket) allow(now time.Time, cost float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > b.limit.Burst {
+		b.tokens = b.limit.Burst
+	}
+	b.last = now
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+// inboundLimiter holds the buckets of one peer, for the readers of all
+// its connections.
+type inboundLimiter struct {
+	mu      sync.Mutex
+	bytes   *tokenBucket
+	byType  map[string]*tokenBucket
+	unknown *tokenBucket
+}
+
+func newInboundLimiter(limits InboundLimits) *inboundLimiter {
+	limiter := &inboundLimiter{
+		bytes:   newTokenBucket(limits.Bytes),
+		byType:  make(map[string]*tokenBucket, len(limits.ByType)),
+		unknown: newTokenBucket(limits.Default),
+	}
+	for msgType, limit := range limits.ByType {
+		limiter.byType[msgType] = newTokenBucket(limit)
+	}
+	return limiter
+}
+
+func (limiter *inboundLimiter) allow(msgType string, size int) bool {
+	// Types are only known from the table, so that a peer cannot make
+	// us keep a bucket for every string it sends.
+	bucket := limiter.byType[msgType]
+	if bucket == nil {
+		bucket = limiter.unknown
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	now := time.Now()
+	return bucket.allow(now, 1) && limiter.bytes.allow(now, float64(size))
+}
+
+// DropCount counts the messages of one type from or to one peer
+// dropped for one reason.
+type DropCount struct {
+	Peer    string `json:"peer"`
+	MsgType string `json:"msgType"`
+	Reason  string `json:"reason"`
+	Count   uint64 `json:"count"`
+}
+
+type dropKey struct {
+	peer    string
+	msgType string
+	reason  string
+}
+
+type dropCounters struct {
+	log    *slog.Logger
+	mu     sync.Mutex
+	counts map[dropKey]uint64
+}
+
+func newDropCounters(log *slog.Logger) *dropCounters {
+	return &dropCounters{log: log, counts: make(map[dropKey]uint64)}
+}
+
+func (c *dropCounters) add(peer string, msgType string, reason string) {
+	key := dropKey{peer: peer, msgType: msgType, reason: reason}
+	c.mu.Lock()
+	c.counts[key]++
+	count := c.counts[key]
+	c.mu.Unlock()
+
+	if count == 1 || count%dropReportEvery == 0 {
+		c.log.Warn("inbound message dropped", "type", msgType, "from", peer, "reason", reason, "count", count)
+	}
+}
+
+// all returns the counters sorted by peer, type and reason.
+func (c *dropCounters) all() []DropCount {
+	c.mu.Lock()
+	drops := make([]DropCount, 0, len(c.counts))
+	for key, count := range c.counts {
+		drops = append(drops, DropCount{Peer: key.peer, MsgType: key.msgType, Reason: key.reason, Count: count})
+	}
+	c.mu.Unlock()
+
+	sort.Slice(drops, func(i, j int) bool {
+		a, b := drops[i], drops[j]
+		if a.Peer != b.Peer {
+			return a.Peer < b.Peer
+		}
+		if a.MsgType != b.MsgType {
+			return a.MsgType < b.MsgType
+		}
+		return a.Reason < b.Reason
+	})
+	return drops
+}
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+func newTestHub(limits InboundLimits) *Hub {
+	wire := wireOptions{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	return NewHub(nil, wire, FlowDrop, limits, []*NodeInfo{{NodeID: "Node1"}, {NodeID: "Node2"}})
+}
+
+func TestHubLimitsByPeer(t *testing.T) {
+	hub := newTestHub(defaultInboundLimits())
+	if hub.limiterOf(hub.peerOf("Node1")) != hub.limiterOf(hub.peerOf("Node1")) {
+		t.Error("two connections of Node1 have buckets of their own")
+	}
+	if hub.limiterOf(hub.peerOf("Node1")) == hub.limiterOf(hub.peerOf("Node2")) {
+		t.Error("Node1 and Node2 share buckets")
+	}
+	for _, id := range []string{"", "Node9", "anyone"} {
+		if peer := hub.peerOf(id); peer != unknownPeer {
+			t.Errorf("id %q counts as %s, want %s", id, peer, unknownPeer)
+		}
+	}
+}
+
+func TestHubLimitSharedByConnections(t *testing.T) {
+	// No tokens come back while the test runs.
+	limits := defaultInboundLimits()
+	limits.ByType["/vote"] = RateLimit{Rate: 0, Burst: 100}
+	hub := newTestHub(limits)
+	burst := int(limits.ByType["/vote"].Burst)
+	first, second := hub.limiterOf("Node1"), hub.limiterOf("Node1")
+	for i := 0; i < burst; i++ {
+		limiter := first
+		if i%2 == 1 {
+			limiter = second
+		}
+		if !limiter.allow("/vote", 1) {
+			t.Fatalf("vote %d refused within the burst of %d", i, burst)
+		}
+	}
+	if second.allow("/vote", 1) {
+		t.Errorf("a second connection let a vote over the burst of %d through", burst)
+	}
+}
+
+func TestHubCountsUnknownPeersAsOne(t *testing.T) {
+	hub := newTestHub(defaultInboundLimits())
+	codec, err := consensus.CodecByName("binary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"Node1", "x", "y", "z"} {
+		peer := hub.peerOf(id)
+		c := &Client{hub: hub, codec: codec, id: id, peer: peer, limiter: hub.limiterOf(peer)}
+		c.admit([]byte("not an envelope"))
+	}
+	drops := hub.Drops()
+	want := []DropCount{
+		{Peer: "Node1", Reason: DropMalformed, Count: 1},
+		{Peer: unknownPeer, Reason: DropMalformed, Count: 3},
+	}
+	if len(drops) != len(want) || drops[0] != want[0] || drops[1] != want[1] {
+		t.Errorf("drops %+v, want %+v", drops, want)
+	}
+}
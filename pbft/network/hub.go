@@ -4,29 +4,115 @@
 
 package network
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients. 
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Hub maintains the set of active clients, the inbound connections
+// that peers send their messages on, and hands what they read to the
+// node.
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Latest registered client of each id.
+	byID map[string]*Client
+
+	// Called with every message read from a client.
+	deliver func(codec consensus.Codec, data []byte)
+
+	// Codec preferred on the connections, and their logger.
+	wire wireOptions
+
+	// What a connection does when its inbound queue is full.
+	policy FlowPolicy
+
+	// Ids of the replicas and clients of the node table. Connections
+	// under other ids count as one peer, unknownPeer.
+	known map[string]bool
+
+	// Token buckets of each peer, shared by its connections.
+	limits     InboundLimits
+	limitersMu sync.Mutex
+	limiters   map[string]*inboundLimiter
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Messages to send to one client.
+	unicast chan *hubUnicast
+
+	// Messages dropped by flow control, see flow.go.
+	drops *dropCounters
+
+	// Bytes sent and received, by peer. Shared with the PeerSet.
+	traffic *trafficCounters
+
+	// Closed by Close.
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+type hubUnicast struct {
+	to   string
+	msg  *outboundMsg
+	done chan error
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
+func NewHub(deliver func(codec consensus.Codec, data []byte), wire wireOptions, policy FlowPolicy,
+	limits InboundLimits, known []*NodeInfo) *Hub {
+	hub := &Hub{
+		deliver:    deliver,
+		wire:       wire,
+		policy:     policy,
+		limits:     limits,
+		known:      make(map[string]bool, len(known)),
+		limiters:   make(map[string]*inboundLimiter),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		unicast:    make(chan *hubUnicast),
 		clients:    make(map[*Client]bool),
+		byID:       make(map[string]*Client),
+		drops:      newDropCounters(wire.log),
+		traffic:    newTrafficCounters(),
+		quit:       make(chan struct{}),
 	}
+	for _, nodeInfo := range known {
+		hub.known[nodeInfo.NodeID] = true
+	}
+	return hub
+}
+
+// unknownPeer is who connections count as under an id that is not in
+// the node table.
+const unknownPeer = "unknown"
+
+// peerOf returns who a connection under id counts as: the replica or
+// client of that id, or unknownPeer. With TLS the id was checked in the
+// handshake; without, it is only the one the peer gave.
+func (h *Hub) peerOf(id string) string {
+	if h.known[id] {
+		return id
+	}
+	return unknownPeer
+}
+
+// limiterOf returns the token buckets of peer.
+func (h *Hub) limiterOf(peer string) *inboundLimiter {
+	h.limitersMu.Lock()
+	defer h.limitersMu.Unlock()
+	limiter := h.limiters[peer]
+	if limiter == nil {
+		limiter = newInboundLimiter(h.limits)
+		h.limiters[peer] = limiter
+	}
+	return limiter
 }
 
 func (h *Hub) run() {
@@ -34,20 +120,70 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			if client.id != "" {
+				h.byID[client.id] = client
+			}
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
 			}
-		case message := <-h.broadcast:
+		case u := <-h.unicast:
+			u.done <- h.send(u.to, u.msg)
+		case <-h.quit:
 			for client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+				h.remove(client)
 			}
+			return
 		}
 	}
 }
+
+// Close disconnects every client and stops the hub.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.quit)
+	})
+}
+
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	if h.byID[client.id] == client {
+		delete(h.byID, client.id)
+	}
+	close(client.send)
+}
+
+func (h *Hub) send(to string, msg *outboundMsg) error {
+	client := h.byID[to]
+	if client == nil {
+		return fmt.Errorf("%s is not connected", to)
+	}
+	data, err := msg.encode(client.codec)
+	if err != nil {
+		return err
+	}
+	// A slow client loses the message, not its connection.
+	select {
+	case client.send <- data:
+		return nil
+	default:
+		h.drops.add(to, msg.env.MsgType, DropSendFull)
+		return fmt.Errorf("send buffer of %s is full", to)
+	}
+}
+
+// Drops returns the number of messages dropped by flow control.
+func (h *Hub) Drops() []DropCount {
+	return h.drops.all()
+}
+
+// sendTo queues msg on the connection that to opened to this hub.
+func (h *Hub) sendTo(to string, msg *outboundMsg) error {
+	u := &hubUnicast{to: to, msg: msg, done: make(chan error, 1)}
+	select {
+	case h.unicast <- u:
+		return <-u.done
+	case <-h.quit:
+		return fmt.Errorf("%s is not connected", to)
+	}
+}
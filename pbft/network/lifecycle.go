@@ -0,0 +1,166 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Every goroutine of a node runs under its context, and Stop cancels
+// it: the dispatchers, resolvers, executor and error logger, the
+// goroutines and timers of each sequence, and sleeps such as the
+// propose delay. Sends into the channels of the node give up too, so
+// that nothing waits on a goroutine that is gone.
+
+// spawn runs f in a goroutine of the node, unless the node is stopped.
+func (node *Node) spawn(f func()) {
+	node.lifecycle.Lock()
+	defer node.lifecycle.Unlock()
+	if node.ctx.Err() != nil {
+		return
+	}
+	node.running.Add(1)
+	ticket := node.ready()
+	go func() {
+		defer node.running.Done()
+		node.run(ticket)
+		defer node.park()
+		f()
+	}()
+}
+
+// Done is closed once the node is told to stop.
+func (node *Node) Done() <-chan struct{} {
+	return node.ctx.Done()
+}
+
+// Stop stops every goroutine of the node and waits for them until ctx
+// is done. Then it writes the trace of the sequences in flight.
+func (node *Node) Stop(ctx context.Context) error {
+	node.lifecycle.Lock()
+	node.cancel()
+	node.lifecycle.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		node.running.Wait()
+		close(stopped)
+	}()
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = fmt.Errorf("%s: goroutines still running: %v", node.MyInfo.NodeID, ctx.Err())
+	}
+	node.FlushTrace()
+	return err
+}
+
+// sleep waits d on the clock of the node. It returns false if the node
+// was stopped first.
+func (node *Node) sleep(d time.Duration) bool {
+	timer := node.Clock.NewTimer(d)
+	defer timer.Stop()
+	_, ok := await(node, timer.C())
+	return ok
+}
+
+// reportErrors hands errs to the error logger, or logs them here once
+// the node is stopped.
+func (node *Node) reportErrors(errs []error) {
+	if !send(node, node.errorInbox, node.MsgError, errs) {
+		for _, err := range errs {
+			node.logger(SubsystemConsensus).Error(err.Error())
+		}
+	}
+}
+
+// queueExecution hands a committed PREPARE to the executor.
+func (node *Node) queueExecution(prepareMsg *consensus.PrepareMsg) {
+	send(node, node.executionInbox, node.MsgExecution, prepareMsg)
+}
+
+// drainer is implemented by transports that queue messages, so that
+// what is queued can be sent before they are closed.
+type drainer interface {
+	// Drain waits until what is queued for the replicas that are up
+	// has been sent, or ctx is done.
+	Drain(ctx context.Context) error
+}
+
+// contextCloser is implemented by transports whose Close waits for
+// goroutines, such as writers in the middle of a write.
+type contextCloser interface {
+	// CloseContext is Close, but gives up waiting once ctx is done.
+	CloseContext(ctx context.Context) error
+}
+
+// closeTransport closes t, waiting no longer than ctx if t allows.
+func closeTransport(ctx context.Context, t Transport) error {
+	if closer, ok := t.(contextCloser); ok {
+		return closer.CloseContext(ctx)
+	}
+	return t.Close()
+}
+
+// Stop stops the server. It closes the listeners, so nothing more comes
+// in, stops the node, sends what is still queued for the other replicas
+// and closes the connections. It returns once that is done or ctx is,
+// with the errors on the way.
+func (server *Server) Stop(ctx context.Context) error {
+	server.mu.Lock()
+	server.stopping = true
+	listeners := []*http.Server{server.httpServer, server.adminServer}
+	server.mu.Unlock()
+
+	var errs []error
+	for _, listener := range listeners {
+		if listener == nil {
+			continue
+		}
+		if err := listener.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", listener.Addr, err))
+		}
+	}
+	if err := server.node.Stop(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if transport, ok := server.transport.(drainer); ok {
+		if err := transport.Drain(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := closeTransport(ctx, server.transport); err != nil {
+		errs = append(errs, err)
+	}
+	server.verifyPool.Close()
+	server.node.logger(SubsystemNetwork).Info("server stopped")
+	return errors.Join(errs...)
+}
+
+// serve serves handler on httpServer until Stop, which makes it return
+// nil. The listener is registered first, so that Stop finds it.
+func (server *Server) serve(httpServer *http.Server, slot **http.Server, useTLS bool) error {
+	server.mu.Lock()
+	if server.stopping {
+		server.mu.Unlock()
+		return nil
+	}
+	*slot = httpServer
+	server.mu.Unlock()
+
+	var err error
+	if useTLS {
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
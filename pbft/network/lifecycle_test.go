@@ -0,0 +1,119 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// blackHole accepts connections and never answers, so that dialing it
+// hangs in the handshake.
+func blackHole(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestServerStopHonoursDeadline(t *testing.T) {
+	// Node1 runs; Node2 hangs whoever dials it and the others are down.
+	nodeTable := make([]*NodeInfo, 11)
+	var signer consensus.Signer
+	for i := range nodeTable {
+		s, err := consensus.GenerateSigner(consensus.SchemeEd25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			signer = s
+		}
+		nodeTable[i] = &NodeInfo{NodeID: fmt.Sprintf("Node%d", i+1), Url: freeAddr(t), PubKey: s.Verifier()}
+	}
+	nodeTable[1].Url = blackHole(t)
+
+	config := DefaultConfig()
+	config.NodeID = "Node1"
+	config.TLS = false
+	config.GenesisDelay = 0
+	config.Logging = NewLogging(io.Discard, false, slog.LevelInfo)
+	server := NewServer(config, nodeTable, [][]*NodeInfo{nodeTable}, signer)
+	if server == nil {
+		t.Fatal("no server")
+	}
+	started := make(chan error, 1)
+	go func() { started <- server.Start() }()
+
+	// Wait until Node1 listens.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", nodeTable[0].Url)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Node1 does not listen: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const timeout = 500 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Stop(ctx) }()
+	select {
+	case err := <-stopped:
+		// Nothing waits for the peer that never answers.
+		if err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+	case <-time.After(timeout + 2*time.Second):
+		t.Fatalf("Stop has not returned %v after its deadline", 2*time.Second)
+	}
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Start has not returned after Stop")
+	}
+}
@@ -1,43 +1,187 @@
 package network
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"time"
-	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
 )
 
-func LogMsg(msg interface{}) {
-	t := time.Now().UnixNano()
-
-	switch m := msg.(type) {
-	//case *consensus.RequestMsg:
-	//	fmt.Printf("%d: [REQUEST] ClientID: %s, Timestamp: %d, Operation: %s\n", t, m.ClientID, m.Timestamp, m.Operation)
-	//case *consensus.PrePrepareMsg:
-	//	fmt.Printf("%d: [PREPREPARE] SequenceID: %d\n", t, m.SequenceID)
-	case *consensus.PrepareMsg:
-		fmt.Printf("%d: [PREPARE] SequenceID: %d\n", t, m.SequenceID)
-	case *consensus.VoteMsg:
-		fmt.Printf("%d: [VOTE] NodeID: %s\n", t, m.NodeID)
-		//if m.MsgType == consensus.PrepareMsg {
-		//	fmt.Printf("%d: [PREPARE] NodeID: %s\n", t, m.NodeID)
-		//} else if m.MsgType == consensus.CommitMsg {
-		//	fmt.Printf("%d: [COMMIT] NodeID: %s\n", t, m.NodeID)
-		//}
-	case *consensus.CollateMsg:
-		fmt.Printf("%d: [COLLATE] NodeID: %s\n", t, m.NodeID)
-	case *consensus.ReplyMsg:
-		fmt.Printf("%d: [REPLY] Result: %s by %s\n", t, m.Result, m.NodeID)
-	//case *consensus.CheckPointMsg:
-	//	fmt.Printf("%d: [CheckPointMsg] NodeID: %s\n", t, m.NodeID)
-	case *consensus.ViewChangeMsg:
-		fmt.Printf("%d: [ViewChangeMsg] NodeID: %s\n", t, m.NodeID)
-	}
-}
-
-func LogStage(stage string, isDone bool) {
-	if isDone {
-		fmt.Printf("[STAGE-DONE] %s\n", stage)
+// Logging goes through log/slog. Every record carries the subsystem
+// that logged it and the node; records about a sequence also carry its
+// epoch, view, seq and, where it matters, phase. Each subsystem has its
+// own level, which can be changed at runtime on /admin/log:
+//
+//	curl http://<node>/admin/log
+//	curl -X PUT http://<node>/admin/log -d '{"consensus": "debug"}'
+//
+// Over TLS the request needs the certificate of a replica.
+
+// Subsystems that log.
+const (
+	SubsystemConsensus  = "consensus"  // PREPARE, votes, collates and execution
+	SubsystemView       = "view"       // view changes
+	SubsystemCheckpoint = "checkpoint" // checkpoints
+	SubsystemNetwork    = "network"    // transports, peers, flow control and verification
+	SubsystemFaults     = "faults"     // injected faults and Byzantine behaviour
+)
+
+var subsystems = []string{
+	SubsystemConsensus,
+	SubsystemView,
+	SubsystemCheckpoint,
+	SubsystemNetwork,
+	SubsystemFaults,
+}
+
+// Logging holds the logger and the level of every subsystem.
+type Logging struct {
+	levels  map[string]*slog.LevelVar
+	loggers map[string]*slog.Logger
+}
+
+// NewLogging logs to w, as JSON lines or as text, with every subsystem
+// at level.
+func NewLogging(w io.Writer, asJSON bool, level slog.Level) *Logging {
+	var handler slog.Handler
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if asJSON {
+		handler = slog.NewJSONHandler(w, options)
 	} else {
-		fmt.Printf("[STAGE-BEGIN] %s\n", stage)
+		handler = slog.NewTextHandler(w, options)
+	}
+	l := &Logging{
+		levels:  make(map[string]*slog.LevelVar),
+		loggers: make(map[string]*slog.Logger),
+	}
+	for _, subsystem := range subsystems {
+		levelVar := new(slog.LevelVar)
+		levelVar.Set(level)
+		l.levels[subsystem] = levelVar
+		l.loggers[subsystem] = slog.New(&levelHandler{handler: handler, level: levelVar}).
+			With("subsystem", subsystem)
+	}
+	return l
+}
+
+// Logger returns the logger of subsystem.
+func (l *Logging) Logger(subsystem string) *slog.Logger {
+	if logger, ok := l.loggers[subsystem]; ok {
+		return logger
+	}
+	return l.loggers[SubsystemNetwork]
+}
+
+// SetLevel sets the level of subsystem.
+func (l *Logging) SetLevel(subsystem string, level slog.Level) error {
+	levelVar, ok := l.levels[subsystem]
+	if !ok {
+		return fmt.Errorf("unknown subsystem %q (want one of %s)", subsystem, strings.Join(subsystems, ", "))
+	}
+	levelVar.Set(level)
+	return nil
+}
+
+// Levels returns the level of every subsystem.
+func (l *Logging) Levels() map[string]string {
+	levels := make(map[string]string, len(l.levels))
+	for subsystem, levelVar := range l.levels {
+		levels[subsystem] = strings.ToLower(levelVar.Level().String())
 	}
-}
\ No newline at end of file
+	return levels
+}
+
+// SetLevels sets levels from a comma-separated list like
+// "info,consensus=debug": a bare level applies to every subsystem.
+func (l *Logging) SetLevels(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		if item == "" {
+			continue
+		}
+		subsystem, name := "", item
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			subsystem, name = item[:i], item[i+1:]
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("log level %q: %v", item, err)
+		}
+		if subsystem != "" {
+			if err := l.SetLevel(subsystem, level); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, levelVar := range l.levels {
+			levelVar.Set(level)
+		}
+	}
+	return nil
+}
+
+// ServeHTTP returns the levels on GET and changes those given on PUT
+// or POST, e.g. {"consensus": "debug"}.
+func (l *Logging) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var levels map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Check every level before changing any.
+		parsed := make(map[string]slog.Level, len(levels))
+		subsystemNames := make([]string, 0, len(levels))
+		for subsystem, name := range levels {
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(name)); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", subsystem, err), http.StatusBadRequest)
+				return
+			}
+			if _, ok := l.levels[subsystem]; !ok {
+				http.Error(w, fmt.Sprintf("unknown subsystem %q", subsystem), http.StatusBadRequest)
+				return
+			}
+			parsed[subsystem] = level
+			subsystemNames = append(subsystemNames, subsystem)
+		}
+		sort.Strings(subsystemNames)
+		for _, subsystem := range subsystemNames {
+			l.SetLevel(subsystem, parsed[subsystem])
+			l.Logger(subsystem).Info("log level changed", "to", levels[subsystem])
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Levels())
+}
+
+// levelHandler passes on the records at or above the level of its subsystem.
+type levelHandler struct {
+	handler slog.Handler
+	level   *slog.LevelVar
+}
+
+func (h *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{handler: h.handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{handler: h.handler.WithGroup(name), level: h.level}
+}
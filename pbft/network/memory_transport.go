@@ -0,0 +1,148 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Number of messages that may wait for a node on a MemoryNetwork
+// before new ones are dropped.
+const memoryQueueSize = 4096
+
+var errTransportClosed = errors.New("transport is closed")
+
+// MemoryNetwork connects the MemoryTransports of nodes in one process,
+// for tests and simulations. Messages are encoded with the binary codec
+// on the way, so nodes share no memory and signatures are checked as
+// they would be on the wire.
+type MemoryNetwork struct {
+	mu    sync.RWMutex
+	nodes map[string]*MemoryTransport
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*MemoryTransport)}
+}
+
+// Join returns the transport of nodeID, replacing any earlier one.
+func (network *MemoryNetwork) Join(nodeID string) *MemoryTransport {
+	t := &MemoryTransport{
+		nodeID:  nodeID,
+		network: network,
+		inbound: make(chan WireMessage, memoryQueueSize),
+		done:    make(chan struct{}),
+	}
+	network.mu.Lock()
+	network.nodes[nodeID] = t
+	network.mu.Unlock()
+	return t
+}
+
+func (network *MemoryNetwork) leave(t *MemoryTransport) {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	if network.nodes[t.nodeID] == t {
+		delete(network.nodes, t.nodeID)
+	}
+}
+
+func (network *MemoryNetwork) lookup(nodeID string) *MemoryTransport {
+	network.mu.RLock()
+	defer network.mu.RUnlock()
+	return network.nodes[nodeID]
+}
+
+// members returns the transports that joined, sorted by node id.
+func (network *MemoryNetwork) members() []*MemoryTransport {
+	network.mu.RLock()
+	members := make([]*MemoryTransport, 0, len(network.nodes))
+	for _, t := range network.nodes {
+		members = append(members, t)
+	}
+	network.mu.RUnlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].nodeID < members[j].nodeID })
+	return members
+}
+
+// MemoryTransport is the Transport of one node on a MemoryNetwork.
+type MemoryTransport struct {
+	nodeID  string
+	network *MemoryNetwork
+	inbound chan WireMessage
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *MemoryTransport) Send(nodeID string, env *consensus.Envelope) error {
+	if t.closed() {
+		return errTransportClosed
+	}
+	to := t.network.lookup(nodeID)
+	if to == nil {
+		return fmt.Errorf("cannot send %s message to %s: not connected", env.MsgType, nodeID)
+	}
+	data, err := consensus.BinaryCodec.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return to.receive(env.MsgType, data)
+}
+
+func (t *MemoryTransport) Broadcast(env *consensus.Envelope) error {
+	if t.closed() {
+		return errTransportClosed
+	}
+	data, err := consensus.BinaryCodec.Marshal(env)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, to := range t.network.members() {
+		if err := to.receive(env.MsgType, data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// receive queues data without blocking; a node that cannot keep up
+// loses the message, as it would over a full websocket send queue.
+func (t *MemoryTransport) receive(msgType string, data []byte) error {
+	if t.closed() {
+		return nil
+	}
+	select {
+	case t.inbound <- WireMessage{Codec: consensus.BinaryCodec, Data: data}:
+		return nil
+	default:
+		return fmt.Errorf("inbound queue of %s is full, dropped %s message", t.nodeID, msgType)
+	}
+}
+
+func (t *MemoryTransport) Inbound() <-chan WireMessage {
+	return t.inbound
+}
+
+// Close leaves the network. Messages already queued stay readable.
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.network.leave(t)
+	})
+	return nil
+}
+
+func (t *MemoryTransport) closed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
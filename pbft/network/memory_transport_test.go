@@ -0,0 +1,234 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// memoryCluster is a cluster of replicas and one client on a MemoryNetwork.
+type memoryCluster struct {
+	network *MemoryNetwork
+	servers []*Server
+	client  *MemoryTransport
+	signer  consensus.Signer // of the client
+	replies *Requester       // checks the replies
+}
+
+const testClientID = "Client1"
+
+// newMemoryCluster starts n replicas that agree fast. configure, if
+// set, changes the config of each.
+func newMemoryCluster(t *testing.T, n int, configure func(config *Config)) *memoryCluster {
+	t.Helper()
+	mc := &memoryCluster{network: NewMemoryNetwork()}
+	nodeTable := make([]*NodeInfo, n)
+	signers := make([]consensus.Signer, n)
+	for i := range nodeTable {
+		signer, err := consensus.GenerateSigner(consensus.SchemeEd25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[i] = signer
+		nodeTable[i] = &NodeInfo{NodeID: fmt.Sprintf("Node%d", i+1), PubKey: signer.Verifier()}
+	}
+	clientSigner, err := consensus.GenerateSigner(consensus.SchemeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.signer = clientSigner
+	mc.replies = NewRequester(testClientID, clientSigner, nodeTable)
+	mc.client = mc.network.Join(testClientID)
+
+	var logOutput io.Writer = io.Discard
+	if testing.Verbose() {
+		logOutput = os.Stderr
+	}
+	base := DefaultConfig()
+	base.EpochLength = int64(n)
+	base.FirstCandidate = 1
+	base.NewViewCandidate = 1
+	base.PhaseTimeouts = PhaseTimeouts{
+		Prepare:    Duration(time.Second),
+		Vote:       Duration(time.Second),
+		Collate:    Duration(time.Second),
+		ViewChange: Duration(5 * time.Second),
+	}
+	base.AdaptiveTimeouts.Enabled = false
+	base.GenesisDelay = Duration(50 * time.Millisecond)
+	base.ViewChangeDelay = Duration(50 * time.Millisecond)
+	base.Clients = []*NodeInfo{{NodeID: testClientID, PubKey: clientSigner.Verifier()}}
+	base.Logging = NewLogging(logOutput, false, slog.LevelInfo)
+	for i, nodeInfo := range nodeTable {
+		config := *base
+		config.NodeID = nodeInfo.NodeID
+		if configure != nil {
+			configure(&config)
+		}
+		if err := config.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		server := NewServerWithTransport(&config, nodeTable, [][]*NodeInfo{nodeTable}, signers[i],
+			mc.network.Join(nodeInfo.NodeID))
+		if server == nil {
+			t.Fatalf("no server for %s", nodeInfo.NodeID)
+		}
+		mc.servers = append(mc.servers, server)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, server := range mc.servers {
+			if err := server.Stop(ctx); err != nil {
+				t.Errorf("stopping %s: %v", server.Node().MyInfo.NodeID, err)
+			}
+		}
+		mc.client.Close()
+	})
+	for _, server := range mc.servers {
+		if err := server.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mc
+}
+
+// submit sends a request of the client to every replica.
+func (mc *memoryCluster) submit(t *testing.T, data string) *consensus.RequestMsg {
+	t.Helper()
+	request := &consensus.RequestMsg{
+		Timestamp: time.Now().UnixNano(),
+		ClientID:  testClientID,
+		Operation: "Op1",
+		Data:      data,
+	}
+	env, err := consensus.NewEnvelope("/request", testClientID, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Sign(mc.signer); err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.client.Broadcast(env); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+// awaitReplies returns the replicas that replied to request by when,
+// with the result each replied.
+func (mc *memoryCluster) awaitReplies(t *testing.T, request *consensus.RequestMsg, want int, timeout time.Duration) map[string]string {
+	t.Helper()
+	results := make(map[string]string)
+	deadline := time.After(timeout)
+	for len(results) < want {
+		select {
+		case msg := <-mc.client.Inbound():
+			env, err := msg.Codec.Unmarshal(msg.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The client is on the network, so it gets broadcasts too.
+			if env.MsgType != "/reply" {
+				continue
+			}
+			reply, err := mc.replies.verifyReply(env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reply.Timestamp == request.Timestamp {
+				results[reply.NodeID] = reply.Result
+			}
+		case <-deadline:
+			t.Fatalf("%d replies after %v, want %d: %v", len(results), timeout, want, results)
+		}
+	}
+	return results
+}
+
+func TestMemoryClusterCommitsRequest(t *testing.T) {
+	mc := newMemoryCluster(t, 4, nil)
+	request := mc.submit(t, "hello")
+
+	// Every replica executes the request in the same sequence.
+	results := mc.awaitReplies(t, request, 4, 20*time.Second)
+	var sequence string
+	for nodeID, result := range results {
+		if sequence == "" {
+			sequence = result
+		}
+		if result != sequence {
+			t.Errorf("%s executed the request in sequence %s, others in %s", nodeID, result, sequence)
+		}
+	}
+}
+
+func TestMemoryClusterPrimaryCrash(t *testing.T) {
+	// Node1 is the primary of every fourth sequence and crashes after
+	// its second message, before it proposes sequence 5.
+	mc := newMemoryCluster(t, 4, func(config *Config) {
+		if config.NodeID == "Node1" {
+			config.Byzantine = "crash=2"
+		}
+	})
+	live := mc.servers[1:]
+	waitFor(t, 20*time.Second, "the live replicas to execute up to sequence 4", func() bool {
+		for _, server := range live {
+			if atomic.LoadInt64(&server.Node().LastExecuted) < 4 {
+				return false
+			}
+		}
+		return true
+	})
+	waitFor(t, 20*time.Second, "the live replicas to wait on sequence 5", func() bool {
+		for _, server := range live {
+			if state, _ := server.Node().getState(5); state == nil {
+				return false
+			}
+		}
+		return true
+	})
+
+	// The view-change timer of sequence 5 expires on every live replica.
+	waitFor(t, 20*time.Second, "the view change to complete", func() bool {
+		for _, server := range live {
+			m := server.Node().Metrics
+			m.mu.Lock()
+			done := m.viewChangesDone
+			m.mu.Unlock()
+			if done < 1 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// The new view carries on where the crashed primary stopped.
+	waitFor(t, 20*time.Second, "the live replicas to execute sequence 5", func() bool {
+		for _, server := range live {
+			if atomic.LoadInt64(&server.Node().LastExecuted) < 5 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitFor fails the test if cond does not hold within timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %v waiting for %s", timeout, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
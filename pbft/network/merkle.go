@@ -0,0 +1,87 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Merkle tree over the shards of a block. Leaves and inner nodes are
+// hashed with different prefixes, and the last node of a level with an
+// odd number of nodes moves up unchanged.
+
+func merkleLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleTree returns every level of the tree, from the leaves to the root.
+func merkleTree(leaves [][]byte) [][][]byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = merkleNode(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+func merkleRoot(levels [][][]byte) []byte {
+	return levels[len(levels)-1][0]
+}
+
+// merkleProof returns the siblings on the path from leaf index to the root.
+func merkleProof(levels [][][]byte, index int) [][]byte {
+	var proof [][]byte
+	for _, level := range levels[:len(levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// verifyMerkleProof checks that data is leaf index of the tree of total
+// leaves with the given root.
+func verifyMerkleProof(root []byte, data []byte, index int, total int, proof [][]byte) bool {
+	if index < 0 || index >= total {
+		return false
+	}
+	h := merkleLeaf(data)
+	for width := total; width > 1; width = (width + 1) / 2 {
+		if sibling := index ^ 1; sibling < width {
+			if len(proof) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				h = merkleNode(h, proof[0])
+			} else {
+				h = merkleNode(proof[0], h)
+			}
+			proof = proof[1:]
+		}
+		index /= 2
+	}
+	return len(proof) == 0 && bytes.Equal(h, root)
+}
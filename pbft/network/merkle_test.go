@@ -0,0 +1,64 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+)
+
+func merkleLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("shard %d", i))
+	}
+	return leaves
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := merkleLeaves(n)
+		levels := merkleTree(leaves)
+		root := merkleRoot(levels)
+		for i, leaf := range leaves {
+			if !verifyMerkleProof(root, leaf, i, n, merkleProof(levels, i)) {
+				t.Errorf("n=%d: proof of leaf %d rejected", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejected(t *testing.T) {
+	leaves := merkleLeaves(7)
+	levels := merkleTree(leaves)
+	root := merkleRoot(levels)
+	proof := merkleProof(levels, 2)
+
+	tampered := append([][]byte(nil), proof...)
+	tampered[1] = merkleLeaf([]byte("another shard"))
+	otherRoot := merkleRoot(merkleTree(merkleLeaves(6)))
+
+	for _, test := range []struct {
+		name  string
+		root  []byte
+		data  []byte
+		index int
+		total int
+		proof [][]byte
+	}{
+		{"other data", root, []byte("shard 3"), 2, 7, proof},
+		{"other index", root, leaves[2], 3, 7, proof},
+		{"index out of range", root, leaves[2], 7, 7, proof},
+		{"negative index", root, leaves[2], -1, 7, proof},
+		{"other total", root, leaves[6], 6, 8, merkleProof(levels, 6)},
+		{"other root", otherRoot, leaves[2], 2, 7, proof},
+		{"tampered sibling", root, leaves[2], 2, 7, tampered},
+		{"short proof", root, leaves[2], 2, 7, proof[:len(proof)-1]},
+		{"long proof", root, leaves[2], 2, 7, append(proof[:len(proof):len(proof)], root)},
+		{"no proof", root, leaves[2], 2, 7, nil},
+		// A leaf must not pass for an inner node.
+		{"inner node", root, append(append([]byte(nil), levels[0][2]...), levels[0][3]...), 1, 4, proof[1:]},
+	} {
+		if verifyMerkleProof(test.root, test.data, test.index, test.total, test.proof) {
+			t.Errorf("%s: proof accepted", test.name)
+		}
+	}
+}
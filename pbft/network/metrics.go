@@ -0,0 +1,410 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics of a replica, served on /metrics of the admin API in the
+// Prometheus text format. They replace grepping the [StartPrepare],
+// [CommitMsg] and [Execute] lines out of the logs:
+//
+//	curl -s http://<admin>/metrics | grep pbft_phase_duration
+
+// Phases of a sequence, timed one after the other from the moment the
+// replica starts the sequence. A sequence committed on its votes skips
+// the collate phase.
+const (
+	phasePrepare = "prepare" // until its PREPARE arrives
+	phaseVote    = "vote"    // until a quorum of votes, or the vote timer
+	phaseCollate = "collate" // until a quorum of collates, or the collate timer
+	phaseExecute = "execute" // until it is executed, in order
+)
+
+var phases = []string{phasePrepare, phaseVote, phaseCollate, phaseExecute}
+
+// Upper bounds of the histogram buckets, in seconds.
+var (
+	phaseBuckets      = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30}
+	viewChangeBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+)
+
+// Reasons a replica is suspected to be Byzantine.
+const (
+	suspectSignature     = "signature"      // a message with an invalid signature
+	suspectForwardedVote = "forwarded-vote" // a collate forwarding a vote its voter did not sign
+	suspectImpersonation = "impersonation"  // a message naming another node as its author
+	suspectDoubleVote    = "double-vote"    // a second vote in a sequence, for another digest
+	suspectPrepare       = "prepare"        // a PREPARE rejected by the sequence
+	suspectVote          = "vote"           // a vote rejected by the sequence
+	suspectCollate       = "collate"        // a collate rejected by the sequence
+)
+
+// Metrics counts what a node does. It is safe for concurrent use.
+type Metrics struct {
+	mu sync.Mutex
+
+	// Phases each sequence in flight went through.
+	marks    map[int64]*sequenceMarks
+	phases   map[string]*histogram
+	executed uint64
+
+	// Sequences committed on an adaptive quorum, by phase.
+	adaptiveCommits map[string]uint64
+
+	viewChangesStarted  uint64
+	viewChangesDone     uint64
+	viewChangeDurations *histogram
+
+	// Messages that gave a node away, by node and reason.
+	suspects map[suspectKey]uint64
+}
+
+type sequenceMarks struct {
+	last time.Time // end of the last phase
+	done map[string]bool
+}
+
+type suspectKey struct {
+	nodeID string
+	reason string
+}
+
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		marks:               make(map[int64]*sequenceMarks),
+		phases:              make(map[string]*histogram),
+		adaptiveCommits:     make(map[string]uint64),
+		viewChangeDurations: newHistogram(viewChangeBuckets),
+		suspects:            make(map[suspectKey]uint64),
+	}
+	for _, phase := range phases {
+		metrics.phases[phase] = newHistogram(phaseBuckets)
+	}
+	return metrics
+}
+
+// startSequence starts the clock of a sequence.
+func (m *Metrics) startSequence(sequenceID int64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.marks[sequenceID]; !ok {
+		m.marks[sequenceID] = &sequenceMarks{last: now, done: make(map[string]bool)}
+	}
+}
+
+// phaseDone times phase of a sequence: from the end of the phase
+// before until now. Only the first end of a phase counts; it returns
+// false for the others.
+func (m *Metrics) phaseDone(sequenceID int64, phase string, now time.Time) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.observePhase(sequenceID, phase, now)
+}
+
+func (m *Metrics) observePhase(sequenceID int64, phase string, now time.Time) (time.Duration, bool) {
+	marks, ok := m.marks[sequenceID]
+	if !ok || marks.done[phase] || now.Before(marks.last) {
+		return 0, false
+	}
+	d := now.Sub(marks.last)
+	m.phases[phase].observe(d.Seconds())
+	marks.last = now
+	marks.done[phase] = true
+	return d, true
+}
+
+// phaseOf returns the phase a sequence waits in: the first one not done.
+func (m *Metrics) phaseOf(sequenceID int64) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	marks, ok := m.marks[sequenceID]
+	if !ok {
+		return phasePrepare
+	}
+	for _, phase := range phases {
+		if !marks.done[phase] {
+			return phase
+		}
+	}
+	return phaseExecute
+}
+
+// sequenceExecuted times the execute phase of a sequence and forgets
+// the sequences up to it.
+func (m *Metrics) sequenceExecuted(sequenceID int64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observePhase(sequenceID, phaseExecute, now)
+	m.executed++
+	for seqID := range m.marks {
+		if seqID <= sequenceID {
+			delete(m.marks, seqID)
+		}
+	}
+}
+
+// adaptiveCommit counts a sequence committed on the adaptive quorum
+// of phase, when its timer ran out.
+func (m *Metrics) adaptiveCommit(phase string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.adaptiveCommits[phase]++
+}
+
+func (m *Metrics) viewChangeStarted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.viewChangesStarted++
+}
+
+func (m *Metrics) viewChangeDone(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.viewChangesDone++
+	m.viewChangeDurations.observe(d.Seconds())
+}
+
+// suspect counts a message that shows nodeID to be Byzantine.
+func (m *Metrics) suspect(nodeID string, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.suspects[suspectKey{nodeID: nodeID, reason: reason}]++
+}
+
+// histogram is a Prometheus histogram, guarded by the mutex of its Metrics.
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // by bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.sum += v
+	h.count++
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+}
+
+// PeerTraffic is the number of bytes sent to and received from a peer.
+type PeerTraffic struct {
+	Peer     string `json:"peer"`
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+type trafficCounters struct {
+	mu     sync.Mutex
+	byPeer map[string]*PeerTraffic
+}
+
+func newTrafficCounters() *trafficCounters {
+	return &trafficCounters{byPeer: make(map[string]*PeerTraffic)}
+}
+
+func (c *trafficCounters) get(peer string) *PeerTraffic {
+	traffic := c.byPeer[peer]
+	if traffic == nil {
+		traffic = &PeerTraffic{Peer: peer}
+		c.byPeer[peer] = traffic
+	}
+	return traffic
+}
+
+func (c *trafficCounters) sent(peer string, n int) {
+	c.mu.Lock()
+	c.get(peer).Sent += uint64(n)
+	c.mu.Unlock()
+}
+
+func (c *trafficCounters) received(peer string, n int) {
+	c.mu.Lock()
+	c.get(peer).Received += uint64(n)
+	c.mu.Unlock()
+}
+
+// all returns the counters sorted by peer.
+func (c *trafficCounters) all() []PeerTraffic {
+	c.mu.Lock()
+	traffic := make([]PeerTraffic, 0, len(c.byPeer))
+	for _, t := range c.byPeer {
+		traffic = append(traffic, *t)
+	}
+	c.mu.Unlock()
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].Peer < traffic[j].Peer })
+	return traffic
+}
+
+// serveMetrics writes the metrics of the server.
+func (server *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := &metricsWriter{w: bufio.NewWriter(w)}
+	server.writeMetrics(out)
+	out.w.Flush()
+}
+
+func (server *Server) writeMetrics(out *metricsWriter) {
+	node := server.node
+	m := node.Metrics
+
+	m.mu.Lock()
+	out.header("pbft_phase_duration_seconds", "histogram", "Time a sequence spent in each phase.")
+	for _, phase := range phases {
+		out.histogram("pbft_phase_duration_seconds", []string{"phase", phase}, m.phases[phase])
+	}
+	out.header("pbft_committed_sequences_total", "counter", "Sequences executed.")
+	out.sample("pbft_committed_sequences_total", nil, float64(m.executed))
+	out.header("pbft_adaptive_quorum_commits_total", "counter", "Sequences committed on an adaptive quorum when a phase timer ran out.")
+	for _, phase := range []string{phaseVote, phaseCollate} {
+		out.sample("pbft_adaptive_quorum_commits_total", []string{"phase", phase}, float64(m.adaptiveCommits[phase]))
+	}
+	out.header("pbft_view_changes_started_total", "counter", "View changes this replica asked for.")
+	out.sample("pbft_view_changes_started_total", nil, float64(m.viewChangesStarted))
+	out.header("pbft_view_changes_total", "counter", "View changes completed.")
+	out.sample("pbft_view_changes_total", nil, float64(m.viewChangesDone))
+	out.header("pbft_view_change_duration_seconds", "histogram", "Time from the first VIEW-CHANGE to the NEW-VIEW.")
+	out.histogram("pbft_view_change_duration_seconds", nil, m.viewChangeDurations)
+
+	suspects := make([]suspectKey, 0, len(m.suspects))
+	nodes := make(map[string]bool)
+	for key := range m.suspects {
+		suspects = append(suspects, key)
+		nodes[key.nodeID] = true
+	}
+	sort.Slice(suspects, func(i, j int) bool {
+		if suspects[i].nodeID != suspects[j].nodeID {
+			return suspects[i].nodeID < suspects[j].nodeID
+		}
+		return suspects[i].reason < suspects[j].reason
+	})
+	out.header("pbft_byzantine_nodes", "gauge", "Replicas caught sending a message no honest replica sends.")
+	out.sample("pbft_byzantine_nodes", nil, float64(len(nodes)))
+	out.header("pbft_byzantine_messages_total", "counter", "Messages that gave a replica away, by reason.")
+	for _, key := range suspects {
+		out.sample("pbft_byzantine_messages_total", []string{"node", key.nodeID, "reason", key.reason}, float64(m.suspects[key]))
+	}
+	m.mu.Unlock()
+
+	node.StatesMutex.RLock()
+	var inFlight int
+	stableCheckPoint := atomic.LoadInt64(&node.StableCheckPoint)
+	for seqID := range node.States {
+		if seqID > stableCheckPoint {
+			inFlight++
+		}
+	}
+	node.StatesMutex.RUnlock()
+	timeouts := node.Timeouts.All()
+	out.header("pbft_phase_timeout_seconds", "gauge", "Timer a sequence starts a phase with.")
+	for _, phase := range timedPhases {
+		out.sample("pbft_phase_timeout_seconds", []string{"phase", phase}, timeouts[phase].Seconds())
+	}
+	out.header("pbft_failed_view_changes", "gauge", "View changes in a row without progress; each doubles the phase timers.")
+	out.sample("pbft_failed_view_changes", nil, float64(node.Timeouts.Failures()))
+
+	out.header("pbft_states_in_flight", "gauge", "Sequences started and not executed yet.")
+	out.sample("pbft_states_in_flight", nil, float64(inFlight))
+	out.header("pbft_view_id", "gauge", "Current view.")
+	out.sample("pbft_view_id", nil, float64(node.currentView().ID))
+
+	out.header("pbft_queue_depth", "gauge", "Messages waiting in the queues of the node.")
+	queues := []struct {
+		name  string
+		depth int
+	}{
+		{"entrance", len(node.MsgEntrance)},
+		{"delivery", len(node.MsgDelivery)},
+		{"execution", len(node.MsgExecution)},
+		{"error", len(node.MsgError)},
+		{"view", len(node.ViewMsgEntrance)},
+		{"verify", len(server.verifyPool.jobs)},
+	}
+	for _, queue := range queues {
+		out.sample("pbft_queue_depth", []string{"queue", queue.name}, float64(queue.depth))
+	}
+
+	if server.ws == nil {
+		return
+	}
+	out.header("pbft_peer_send_queue_depth", "gauge", "Messages waiting to be written to a peer.")
+	for _, status := range server.ws.Statuses() {
+		out.sample("pbft_peer_send_queue_depth", []string{"peer", status.NodeID}, float64(status.Queued))
+	}
+	traffic := server.ws.Traffic()
+	out.header("pbft_peer_sent_bytes_total", "counter", "Bytes written to a peer.")
+	for _, t := range traffic {
+		out.sample("pbft_peer_sent_bytes_total", []string{"peer", t.Peer}, float64(t.Sent))
+	}
+	out.header("pbft_peer_received_bytes_total", "counter", "Bytes read from a peer.")
+	for _, t := range traffic {
+		out.sample("pbft_peer_received_bytes_total", []string{"peer", t.Peer}, float64(t.Received))
+	}
+	out.header("pbft_dropped_messages_total", "counter", "Messages dropped by flow control.")
+	for _, drop := range server.ws.Drops() {
+		out.sample("pbft_dropped_messages_total",
+			[]string{"peer", drop.Peer, "type", drop.MsgType, "reason", drop.Reason}, float64(drop.Count))
+	}
+}
+
+// metricsWriter writes samples in the Prometheus text format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (out *metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(out.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample; labels are pairs of name and value.
+func (out *metricsWriter) sample(name string, labels []string, value float64) {
+	out.w.WriteString(name)
+	if len(labels) > 0 {
+		out.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				out.w.WriteByte(',')
+			}
+			fmt.Fprintf(out.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		out.w.WriteByte('}')
+	}
+	out.w.WriteByte(' ')
+	out.w.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	out.w.WriteByte('\n')
+}
+
+func (out *metricsWriter) histogram(name string, labels []string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		out.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", le), float64(cumulative))
+	}
+	out.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.count))
+	out.sample(name+"_sum", labels, h.sum)
+	out.sample(name+"_count", labels, float64(h.count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -1,67 +1,123 @@
 package network
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
 	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
-	"time"
-	// "context"
-	"crypto/ecdsa"
-	"log"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 	//"runtime"
 )
 
 type Node struct {
-	MyInfo          *NodeInfo
-	PrivKey         *ecdsa.PrivateKey
-	NodeTable       []*NodeInfo
-	SeedNodeTables	[][]*NodeInfo
-	View            *View
-	EpochID			int64
-	
-	States          map[int64]consensus.PBFT // key: sequenceID, value: state
-	VCStates		map[int64]*consensus.VCState
-	CommittedMsgs   map[int64]*consensus.PrepareMsg // kinda block.
-
-	Committed		[1000]int64
-	Prepared 		[1000]int64
+	MyInfo         *NodeInfo
+	PrivKey        consensus.Signer
+	NodeTable      []*NodeInfo
+	SeedNodeTables [][]*NodeInfo
+	View           *View // under ViewMutex.
+	EpochID        int64 // atomic.
+
+	States        map[int64]consensus.PBFT // key: sequenceID, value: state
+	VCStates      map[int64]*consensus.VCState
+	CommittedMsgs map[int64]*consensus.PrepareMsg // kinda block. under CommittedMutex.
+
+	Committed [1000]int64 // atomic.
+	Prepared  [1000]int64 // atomic.
 
 	//ViewChangeState *consensus.ViewChangeState
-	TotalConsensus  int64 // atomic. number of consensus started so far.
-	IsViewChanging  bool
-	NextCandidateIdx int64
+	TotalConsensus   int64 // atomic. number of consensus started so far.
+	LastProposed     int64 // atomic. last sequence proposed as primary.
+	LastExecuted     int64 // atomic. last sequence executed.
+	IsViewChanging   atomic.Bool
+	NextCandidateIdx int64 // atomic.
+
+	// Parameters of the protocol
+	Config *Config
+
+	// Connections to the other replicas
+	Transport Transport
+
+	// Time source of timers, sleeps and timestamps
+	Clock Clock
+
+	// Request bodies by digest
+	Payloads *PayloadStore
+
+	// Chunks of request bodies being rebuilt
+	Chunks *ChunkStore
+
+	// How this replica misbehaves, for testing; nil if it is honest
+	Byzantine *Byzantine
+
+	// Served on /metrics
+	Metrics *Metrics
+
+	// Phase timers of the sequences
+	Timeouts *Timeouts
+
+	// Levels of the subsystems, served on /admin/log
+	Logging *Logging
+	loggers map[string]*slog.Logger // by subsystem, with the node id
+
+	// Latest errors sent to MsgError, served on /status
+	errors errorLog
+
+	// How each sequence unfolded; nil if not traced
+	Trace *Tracer
+
+	// Clients that may send requests, by id
+	Clients map[string]*NodeInfo
+
+	// Client requests waiting to be proposed, and replies sent
+	Requests *RequestQueue
 
 	// Channels
-	MsgEntrance   chan interface{}
-	MsgSend       chan interface{}
-	MsgDelivery   chan interface{}
-	MsgExecution  chan *consensus.PrepareMsg
-	MsgOutbound   chan *MsgOut
-	MsgError      chan []error
+	MsgEntrance     chan interface{}
+	MsgSend         chan interface{}
+	MsgDelivery     chan interface{}
+	MsgExecution    chan *consensus.PrepareMsg
+	MsgError        chan []error
 	ViewMsgEntrance chan interface{}
-	ViewChangeChan chan ViewChangeChannel
+	ViewChangeChan  chan ViewChangeChannel
+
+	// Run the goroutines one at a time, if the clock does; see work.go
+	stepper        stepper
+	entranceInbox  *inbox // MsgEntrance and ViewMsgEntrance
+	deliveryInbox  *inbox
+	executionInbox *inbox
+	errorInbox     *inbox
+	inboxes        map[consensus.PBFT]*sequenceInbox
+	inboxesMutex   sync.Mutex
 
 	// Mutexes for preventing from concurrent access
-	StatesMutex sync.RWMutex
-	VCStatesMutex sync.RWMutex
+	StatesMutex    sync.RWMutex
+	VCStatesMutex  sync.RWMutex
 	CommittedMutex sync.RWMutex
-	PreparedMutex sync.RWMutex
+	ViewMutex      sync.RWMutex
+
+	// Cancelled by Stop; every goroutine of the node runs under it,
+	// see lifecycle.go
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lifecycle sync.Mutex
+	running   sync.WaitGroup
 
 	// Saved checkpoint messages on this node
 	// key: sequenceID, value: map(key: nodeID, value: checkpointMsg)
-	CheckPointMutex     sync.RWMutex
-	CheckPointMsgsLog   map[int64]map[string]*consensus.CheckPointMsg
+	CheckPointMutex   sync.RWMutex
+	CheckPointMsgsLog map[int64]map[string]*consensus.CheckPointMsg
 
 	// The stable checkpoint that 2f + 1 nodes agreed
-	StableCheckPoint    int64
+	StableCheckPoint int64 // atomic.
 }
 
 type NodeInfo struct {
-	NodeID string `json:"nodeID"`
-	Url    string `json:"url"`
-	PubKey *ecdsa.PublicKey
+	NodeID string             `json:"nodeID"`
+	Url    string             `json:"url"`
+	PubKey consensus.Verifier `json:"-"`
 }
 
 type View struct {
@@ -69,16 +125,9 @@ type View struct {
 	Primary *NodeInfo
 }
 
-// Outbound message
-type MsgOut struct {
-	IP   string
-	Msg  []byte
-	Path string
-}
-
 type ViewChangeChannel struct {
-	Min_S  int64 `json:"min_s"`
-	VCSCheck    bool `json:"vcscheck"`
+	Min_S    int64 `json:"min_s"`
+	VCSCheck bool  `json:"vcscheck"`
 }
 
 // Deadline for the consensus state.
@@ -90,291 +139,347 @@ const CoolingTime = time.Millisecond * 2
 // Number of error messages to start cooling.
 const CoolingTotalErrMsg = 30
 
-// Number of outbound connection for a node.
-const MaxOutboundConnection = 3000
-
 func NewNode(myInfo *NodeInfo, nodeTable []*NodeInfo, seedNodeTables [][]*NodeInfo,
-			viewID int64, decodePrivKey *ecdsa.PrivateKey) *Node {
+	config *Config, decodePrivKey consensus.Signer, transport Transport, clock Clock) *Node {
 	node := &Node{
-		MyInfo:    myInfo,
-		PrivKey: decodePrivKey,
-		NodeTable: nodeTable,
-		SeedNodeTables: seedNodeTables,
-		View:      &View{},
-		EpochID:	0,
-		IsViewChanging: false,
-		NextCandidateIdx: 10,
+		MyInfo:           myInfo,
+		PrivKey:          decodePrivKey,
+		NodeTable:        nodeTable,
+		SeedNodeTables:   seedNodeTables,
+		View:             &View{},
+		EpochID:          0,
+		NextCandidateIdx: config.FirstCandidate,
+		Config:           config,
 		// Consensus-related struct
-		States:          make(map[int64]consensus.PBFT),
-		VCStates: 		 make(map[int64]*consensus.VCState),
-		
+		States:   make(map[int64]consensus.PBFT),
+		VCStates: make(map[int64]*consensus.VCState),
+
 		CheckPointMsgsLog: make(map[int64]map[string]*consensus.CheckPointMsg),
 		StableCheckPoint:  0,
 
-		CommittedMsgs:   make(map[int64]*consensus.PrepareMsg),
+		CommittedMsgs: make(map[int64]*consensus.PrepareMsg),
 
 		// Channels
-		MsgEntrance: make(chan interface{}, len(nodeTable) * 100),
-		MsgDelivery: make(chan interface{}, len(nodeTable) * 100), // TODO: enough?
-		MsgExecution: make(chan *consensus.PrepareMsg, len(nodeTable) * 100),
-		MsgOutbound: make(chan *MsgOut, len(nodeTable)),
-		MsgError: make(chan []error, len(nodeTable)),
+		MsgEntrance:     make(chan interface{}, len(nodeTable)*100),
+		MsgDelivery:     make(chan interface{}, len(nodeTable)*100), // TODO: enough?
+		MsgExecution:    make(chan *consensus.PrepareMsg, len(nodeTable)*100),
+		MsgError:        make(chan []error, len(nodeTable)),
 		ViewMsgEntrance: make(chan interface{}, len(nodeTable)*3),
 	}
 
+	node.Transport = transport
+	node.Clock = clock
+	node.ctx, node.cancel = context.WithCancel(context.Background())
+	if stepper, ok := clock.(stepper); ok {
+		node.stepper = stepper
+		node.inboxes = make(map[consensus.PBFT]*sequenceInbox)
+	}
+	node.entranceInbox = node.newInbox()
+	node.deliveryInbox = node.newInbox()
+	node.executionInbox = node.newInbox()
+	node.errorInbox = node.newInbox()
+	if reporter, ok := transport.(errorReporter); ok {
+		node.spawn(func() { node.forwardErrors(reporter) })
+	}
+	node.Payloads = NewPayloadStore(payloadsPerSender)
+	node.Chunks = NewChunkStore(chunkStoreSize)
+	node.Metrics = NewMetrics()
+	node.Timeouts = NewTimeouts(config.PhaseTimeouts, config.AdaptiveTimeouts)
+	node.Trace = newTracer(myInfo.NodeID, config.TraceOutput, config.Logging.Logger(SubsystemNetwork))
+	node.Clients = make(map[string]*NodeInfo)
+	for _, clientInfo := range config.Clients {
+		node.Clients[clientInfo.NodeID] = clientInfo
+	}
+	node.Requests = NewRequestQueue()
+	node.Logging = config.Logging
+	node.loggers = make(map[string]*slog.Logger)
+	for _, subsystem := range subsystems {
+		node.loggers[subsystem] = config.Logging.Logger(subsystem).With("node", myInfo.NodeID)
+	}
+
 	atomic.StoreInt64(&node.TotalConsensus, 0)
-	node.updateViewID(viewID)
+	node.updateViewID(config.InitialView)
 
 	// Start message dispatcher
-	for i:=0; i < 19; i++ {
-		go node.dispatchMsg()
+	for i := 0; i < config.Dispatchers; i++ {
+		node.spawn(node.dispatchMsg)
 	}
 
-	for i := 0; i < 19; i++ {
+	for i := 0; i < config.Resolvers; i++ {
 		// Start message resolver
-		go node.resolveMsg()
+		node.spawn(node.resolveMsg)
 	}
 
 	// Start message executor
-	go node.executeMsg()
-
-	// Start outbound message sender
-	go node.sendMsg()
+	node.spawn(node.executeMsg)
 
 	// Start message error logger
-	go node.logErrorMsg()
+	node.spawn(node.logErrorMsg)
 
 	return node
 }
 
-// Broadcast marshalled message.
-func (node *Node) Broadcast(msg interface{}, path string) {
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		node.MsgError <- []error{err}
+// Broadcast signed message. It is signed once here and handed to the
+// transport, which queues it for every replica.
+func (node *Node) Broadcast(msg consensus.Message, path string) {
+	if node.Byzantine.intercept(node, msg, path, nil) {
+		return
+	}
+	env := node.signedEnvelope(msg, path, "")
+	if env == nil {
+		return
+	}
+	if err := node.Transport.Broadcast(env); err != nil {
+		node.reportErrors([]error{err})
+	}
+}
+
+// SendTo sends signed message to the replica or client nodeID only.
+func (node *Node) SendTo(nodeID string, msg consensus.Message, path string) {
+	if node.Byzantine.intercept(node, msg, path, []string{nodeID}) {
+		return
+	}
+	env := node.signedEnvelope(msg, path, nodeID)
+	if env == nil {
+		return
+	}
+	if err := node.Transport.Send(nodeID, env); err != nil {
+		node.reportErrors([]error{err})
+	}
+}
+
+// Multicast sends signed message to each of nodeIDs.
+func (node *Node) Multicast(nodeIDs []string, msg consensus.Message, path string) {
+	if node.Byzantine.intercept(node, msg, path, nodeIDs) {
+		return
+	}
+	env := node.signedEnvelope(msg, path, "")
+	if env == nil {
 		return
-	}  
-	node.MsgOutbound <- &MsgOut{IP: node.MyInfo.Url, Msg: jsonMsg, Path: path}
+	}
+	var errs []error
+	for _, nodeID := range nodeIDs {
+		if err := node.Transport.Send(nodeID, env); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		node.reportErrors(errs)
+	}
 }
 
+func (node *Node) signedEnvelope(msg consensus.Message, path string, receiver string) *consensus.Envelope {
+	env, err := consensus.NewEnvelope(path, node.MyInfo.NodeID, msg)
+	if err == nil {
+		env.Receiver = receiver
+		err = env.Sign(node.PrivKey)
+	}
+	if err != nil {
+		node.reportErrors([]error{err})
+		return nil
+	}
+	return env
+}
+
+// timerExpired tells the goroutine that handles the messages of a
+// sequence that the timer of a phase expired.
+type timerExpired string
+
 func (node *Node) startTransitionWithDeadline(seqID int64, state consensus.PBFT) {
 
-	var sigma	[4]time.Duration
-	sigma[consensus.NumOfPhase("Prepare")] = 20000
-	sigma[consensus.NumOfPhase("Vote")] = 20000
-	sigma[consensus.NumOfPhase("Collate")] = 20000
-	sigma[consensus.NumOfPhase("ViewChange")] = 20000
-
-	var timerArr			[4]*time.Timer
-	var cancelCh			[4]chan struct {}
-
-	MsgCh := state.GetMsgReceiveChannel()
-	TimerStartCh := state.GetTimerStartReceiveChannel()
-	TimerStopCh := state.GetTimerStopReceiveChannel()
-	ExitCh := state.GetMsgExitReceiveChannel()
-	ExitCh1 := state.GetMsgExitReceiveChannel1()
-	go func(){
+	var timerArr [4]Timer
+	var cancelCh [4]signal
+	// Starts and stops come on two channels, so a stop can be read
+	// before the start it follows; the phase then does not start.
+	var stoppedEarly [4]bool
+
+	seqInbox := node.openSequence(state)
+	node.spawn(func() {
+		defer node.exitSequence(state, true)
 		for {
-			select {
-			case msgState := <-MsgCh:
-
-				switch msg := msgState.(type) {
-				case *consensus.ReqPrePareMsgs:
-					node.GetPrepare(state, msg)
-				case *consensus.VoteMsg:
-					node.GetVote(state, msg)
-				case *consensus.CollateMsg:
-					node.GetCollate(state, msg)
-				case *consensus.ViewChangeMsg:
-					node.GetViewChange(msg)
-				case *consensus.NewViewMsg:
-					node.GetNewView(msg)
-				}
-			case <-ExitCh1:
-				fmt.Printf("[Terminate Thread] seqId %d finished!!!\n", state.GetSequenceID())
+			msgState, ok := node.nextSequenceMsg(state, seqInbox)
+			if !ok {
+				state.GetLogger().Debug("sequence thread finished")
 				return
 			}
-
+			switch msg := msgState.(type) {
+			case *consensus.ReqPrePareMsgs:
+				node.GetPrepare(state, msg)
+			case *consensus.VoteMsg:
+				node.GetVote(state, msg)
+			case *consensus.CollateMsg:
+				node.GetCollate(state, msg)
+			case *consensus.ViewChangeMsg:
+				node.GetViewChange(msg)
+			case *consensus.NewViewMsg:
+				node.GetNewView(msg)
+			case timerExpired:
+				node.phaseTimedOut(seqID, state, string(msg))
+			}
 		}
-	}()	
-	go func() {
-
+	})
+	node.spawn(func() {
+		defer node.exitSequence(state, false)
 		for {
-			select {
-			// case msgState := <-MsgCh:
-
-			// 	switch msg := msgState.(type) {
-			// 	case *consensus.ReqPrePareMsgs:
-			// 		node.GetPrepare(state, msg)
-			// 	case *consensus.VoteMsg:
-			// 		node.GetVote(state, msg)
-			// 	case *consensus.CollateMsg:
-			// 		node.GetCollate(state, msg)
-			// 	}
-		case phaseName := <- TimerStartCh:
-				phase:=consensus.NumOfPhase(phaseName)
+			request, ok := node.nextTimerRequest(state, seqInbox)
+			if !ok {
+				return
+			}
+			phaseName := request.phase
+			switch {
+			case request.end:
+				// The sequence is over: stop its timers, also those
+				// whose stop may still be on its way.
+				for phase := range timerArr {
+					if timerArr[phase] != nil && timerArr[phase].Stop() {
+						cancelCh[phase].send()
+					}
+				}
+				return
+			case request.stop:
+				phase := consensus.NumOfPhase(phaseName)
+				if timerArr[phase] != nil {
+					state.GetLogger().Debug("timer stopped", "phase", strings.ToLower(phaseName))
+					timerArr[phase].Stop()
+				} else {
+					stoppedEarly[phase] = true
+				}
+				// A phase stopped before it started has no channel
+				// yet; a nil channel would block for good.
+				if cancelCh[phase].ch != nil {
+					cancelCh[phase].send()
+				}
+			default:
+				phase := consensus.NumOfPhase(phaseName)
+				if stoppedEarly[phase] {
+					state.GetLogger().Debug("timer stopped before it started", "phase", strings.ToLower(phaseName))
+					continue
+				}
 				if timerArr[phase] == nil {
-					timerArr[phase] = time.NewTimer(time.Millisecond*sigma[phase])
-					cancelCh[phase] = make(chan struct {}, 10)
-					fmt.Printf("[Seq %d Thread] Start %s Timer\n", seqID, phaseName)
+					timeout := node.Timeouts.Get(timedPhases[phase])
+					timerArr[phase] = node.Clock.NewTimer(timeout)
+					cancelCh[phase] = node.newSignal(10)
+					state.GetLogger().Debug("timer started", "phase", strings.ToLower(phaseName), "timeout", timeout)
 				}
 
-				go func(phase int64, phaseName string) {
-					select {
-					case <-timerArr[phase].C: //when timer is done
-						switch phaseName{
-							case "Prepare":
-								state.GetTimerStartSendChannel() <- "Vote"
-								fmt.Println("Not Receive Preparemsg... BroadCast NULL VOTE ",seqID)
-								var PrepareMsg consensus.PrepareMsg
-								PrepareMsg.ViewID = 0
-								PrepareMsg.SequenceID = seqID
-								PrepareMsg.Digest = ""
-								PrepareMsg.EpochID = 0
-								PrepareMsg.NodeID = ""
-								PrepareMsg.Seed= 0
-													
-								// NULL Vote
-								voteMsg, _:= state.Prepare(&PrepareMsg, nil)
-								if node.Prepared[PrepareMsg.SequenceID] == 0 {
-									atomic.AddInt64(&node.Prepared[PrepareMsg.SequenceID],1)
-								}	
-								voteMsg.NodeID = node.MyInfo.NodeID
-								node.Broadcast(voteMsg, "/vote")
-								
-							case "Vote":
-								fmt.Println("Vote finished....", seqID)
-								collateMsg, _ := state.VoteAQ(int32(len(node.NodeTable)))
-								collateMsg.NodeID = node.MyInfo.NodeID
-								
-
-								switch collateMsg.MsgType {
-								// Stop vote phase and start collate phase if it is not committed
-									case consensus.UNCOMMITTED:
-										fmt.Println("==== ADAPTIVE VOTE QUORUM UNCOMMITED====")
-										node.Broadcast(collateMsg, "/collate")
-									// Stop vote phase and execute the sequence if it is committed
-									case consensus.COMMITTED:
-										//state.GetTimerStopSendChannel() <- "Vote"
-										node.CommittedMutex.Lock()
-										if node.Committed[collateMsg.SequenceID] == 0 {
-											node.CommittedMutex.Unlock()
-											fmt.Println("==== ADAPTIVE VOTE QUORUM COMMITED====")
-											if state.GetPrepareMsg() == nil {
-												for _, vote := range collateMsg.ReceivedVoteMsg {
-													node.MsgExecution <- vote.PrepareMsg
-													log.Printf("vote.PrepareMsg: %s",vote.PrepareMsg)
-													break
-												}
-											} else {
-												node.MsgExecution <- state.GetPrepareMsg()
-											}
-											node.Broadcast(collateMsg, "/collate")
-										} else {
-											node.CommittedMutex.Unlock()
-											fmt.Println("Already Commit and Execute SequenceID :", collateMsg.SequenceID)
-										}
-
-
-										// Log last sequence id for checkpointing
-
-								}	
-							case "Collate":
-								fmt.Println("Collate finished....", seqID)
-								newcollateMsg, _ := state.CollateAQ(int32(len(node.NodeTable)))
-								newcollateMsg.NodeID = node.MyInfo.NodeID
-								switch newcollateMsg.MsgType {
-									case consensus.UNCOMMITTED:
-										
-									// Stop vote phase and execute the sequence if it is committed
-									case consensus.COMMITTED:
-										//state.GetTimerStopSendChannel() <- "Vote"
-										node.CommittedMutex.Lock()
-										if node.Committed[newcollateMsg.SequenceID] == 0 {
-											node.CommittedMutex.Unlock()
-											fmt.Println("==== ADAPTIVE COLLATE QUORUM COMMITED====")
-											if state.GetPrepareMsg() == nil {
-												for _, vote := range newcollateMsg.ReceivedVoteMsg {
-													node.MsgExecution <- vote.PrepareMsg
-													log.Printf("vote.PrepareMsg: %s",vote.PrepareMsg)
-													break
-												}
-											} else {
-												node.MsgExecution <- state.GetPrepareMsg()
-											}
-											node.Broadcast(newcollateMsg, "/collate")
-										} else {
-											node.CommittedMutex.Unlock()
-											fmt.Println("Already Commit and Execute SequenceID :", newcollateMsg.SequenceID)
-										}
-
-										
-										// Log last sequence id for checkpointing
-								}
-							
-							case "ViewChange":
-								fmt.Println("Start ViewChange...")
-								fmt.Printf("&&&&&&&&&&&&&&&&&&& state.GetSequenceID %d &&&&&&&&&&&&&&&&&&\n",state.GetSequenceID())
-								node.StartViewChange(state.GetSequenceID())										
-
-						}
-					case <-cancelCh[phase]: //when timer stop
+				node.spawn(func() {
+					if node.waitTimer(timerArr[phase], cancelCh[phase]) {
+						node.toSequence(state, timerExpired(phaseName))
 					}
-				}(phase, phaseName)
-			case phaseName := <-TimerStopCh:
-				phase := consensus.NumOfPhase(phaseName)
-				if timerArr[phase] != nil {
-					switch phaseName{
-						case "Prepare":
-							fmt.Println("Prepare Timer Stop.... ", seqID )
+				})
+			}
 
-						case "Vote":
-							fmt.Println("Vote Stop.... ", seqID)
+		}
+	})
+}
 
-						case "Collate":
-							fmt.Println("Collate Stop... ", seqID)						
+// phaseTimedOut acts on the expired timer of phaseName of state, in the
+// goroutine that handles the messages of the sequence.
+// The timer may have expired as the phase ended, before it was stopped.
+func (node *Node) phaseTimedOut(seqID int64, state consensus.PBFT, phaseName string) {
+	switch phaseName {
+	case "Prepare":
+		if state.GetPrepareMsg() != nil {
+			return
+		}
+		node.trace(seqID, TraceEvent{Event: TraceTimerExpired, Phase: phasePrepare})
+		node.startTimer(state, "Vote")
+		state.GetLogger().Warn("no PREPARE in time, voting null", "phase", phasePrepare)
+		var PrepareMsg consensus.PrepareMsg
+		PrepareMsg.ViewID = 0
+		PrepareMsg.SequenceID = seqID
+		PrepareMsg.Digest = ""
+		PrepareMsg.EpochID = 0
+		PrepareMsg.NodeID = ""
+		PrepareMsg.Seed = 0
+
+		// NULL Vote
+		voteMsg, _ := state.Prepare(&PrepareMsg, nil)
+		atomic.CompareAndSwapInt64(&node.Prepared[PrepareMsg.SequenceID], 0, 1)
+		voteMsg.NodeID = node.MyInfo.NodeID
+		node.Broadcast(&voteMsg, "/vote")
+
+	case "Vote":
+		state.GetLogger().Debug("vote timer expired", "phase", phaseVote)
+		node.trace(seqID, TraceEvent{Event: TraceTimerExpired, Phase: phaseVote})
+		collateMsg, _ := state.VoteAQ(int32(len(node.NodeTable)))
+		collateMsg.NodeID = node.MyInfo.NodeID
+		node.Metrics.phaseDone(seqID, phaseVote, node.Clock.Now())
 
-						case "ViewChange":
-							fmt.Println("ViewChange Stop... ", seqID)
+		switch collateMsg.MsgType {
+		// Stop vote phase and start collate phase if it is not committed
+		case consensus.UNCOMMITTED:
+			state.GetLogger().Info("adaptive vote quorum not reached", "phase", phaseVote)
+			node.Broadcast(&collateMsg, "/collate")
+			node.trace(seqID, TraceEvent{Event: TraceCollateSent, Type: collateMsg.MsgType.String()})
+		// Stop vote phase and execute the sequence if it is committed
+		case consensus.COMMITTED:
+			//state.GetTimerStopSendChannel() <- "Vote"
+			if atomic.LoadInt64(&node.Committed[collateMsg.SequenceID]) == 0 {
+				state.GetLogger().Info("committed on adaptive vote quorum", "phase", phaseVote)
+				node.Metrics.adaptiveCommit(phaseVote)
+				node.trace(seqID, TraceEvent{Event: TraceCommit, Rule: RuleVoteAQ})
+				node.executeCommitted(state, collateMsg.ReceivedVoteMsg)
+				node.Broadcast(&collateMsg, "/collate")
+				node.trace(seqID, TraceEvent{Event: TraceCollateSent, Type: collateMsg.MsgType.String()})
+			} else {
+				state.GetLogger().Debug("already committed", "phase", phaseVote)
+			}
 
+			// Log last sequence id for checkpointing
 
+		}
+	case "Collate":
+		state.GetLogger().Debug("collate timer expired", "phase", phaseCollate)
+		node.trace(seqID, TraceEvent{Event: TraceTimerExpired, Phase: phaseCollate})
+		newcollateMsg, _ := state.CollateAQ(int32(len(node.NodeTable)))
+		newcollateMsg.NodeID = node.MyInfo.NodeID
+		node.Metrics.phaseDone(seqID, phaseCollate, node.Clock.Now())
+		switch newcollateMsg.MsgType {
+		case consensus.UNCOMMITTED:
 
-					}					
-					timerArr[phase].Stop()
-				}
-				
-				cancelCh[phase] <- struct {}{}
-			case <-ExitCh:
-				// //fmt.Printf("[Terminate Thread] seqId %d finished!!!\n", state.GetSequenceID())
-				// node.StatesMutex.Lock()
-				// node.States[seqID] = nil
-				// node.StatesMutex.Unlock()
-				return
+		// Stop vote phase and execute the sequence if it is committed
+		case consensus.COMMITTED:
+			//state.GetTimerStopSendChannel() <- "Vote"
+			if atomic.LoadInt64(&node.Committed[newcollateMsg.SequenceID]) == 0 {
+				state.GetLogger().Info("committed on adaptive collate quorum", "phase", phaseCollate)
+				node.Metrics.adaptiveCommit(phaseCollate)
+				node.trace(seqID, TraceEvent{Event: TraceCommit, Rule: RuleCollateAQ})
+				node.executeCommitted(state, newcollateMsg.ReceivedVoteMsg)
+				node.Broadcast(&newcollateMsg, "/collate")
+				node.trace(seqID, TraceEvent{Event: TraceCollateSent, Type: newcollateMsg.MsgType.String()})
+			} else {
+				state.GetLogger().Debug("already committed", "phase", phaseCollate)
 			}
 
+			// Log last sequence id for checkpointing
 		}
-	}()
-}
-func (node *Node) BroadCastNextPrepareMsgIfPrimary(sequenceID int64){
-	//var epoch int64 = 0
-	var seed int64 = -1
 
-	data := make([]byte, 1 << 20)
-	for i := range data {
-		data[i] = 'A'
+	case "ViewChange":
+		if node.isCommitted(seqID) {
+			return
+		}
+		state.GetLogger().Warn("sequence timed out, starting a view change")
+		node.trace(seqID, TraceEvent{Event: TraceTimerExpired, Phase: phaseViewChange})
+		node.StartViewChange(state.GetSequenceID())
+
 	}
-	data[len(data)-1]=0
+}
 
+func (node *Node) BroadCastNextPrepareMsgIfPrimary(sequenceID int64) {
+	//var epoch int64 = 0
+	var seed int64 = -1
 
-	node.updateViewID(sequenceID-1)
-	if (sequenceID-1) % 10 == 0 {
-		node.updateEpochID(sequenceID-1)		
+	node.updateViewID(sequenceID - 1)
+	if (sequenceID-1)%node.Config.EpochLength == 0 {
+		node.updateEpochID(sequenceID - 1)
 		//node.NextCandidateIdx = 11
 	}
-	primaryNode := node.getPrimaryInfoByID(node.View.ID)
+	view := node.currentView()
+	primaryNode := node.getPrimaryInfoByID(view.ID)
 
-	fmt.Printf("server.node.MyInfo.NodeID: %s\n", node.MyInfo.NodeID)
-	fmt.Printf("primaryNode.NodeID: %s\n", primaryNode.NodeID)
+	node.logger(SubsystemConsensus).Debug("primary of the next sequence",
+		"seq", sequenceID, "primary", primaryNode.NodeID)
 
 	// if sequenceID % 10 == 1 && sequenceID != 1{
 	// 	epoch += 1
@@ -388,17 +493,19 @@ func (node *Node) BroadCastNextPrepareMsgIfPrimary(sequenceID int64){
 		return
 	}
 
-	prepareMsg := PrepareMsgMaking("Op1", "Client1", data, 
-		node.View.ID,int64(sequenceID),
-		node.MyInfo.NodeID, int(seed), node.EpochID)
+	// A PREPARE whose payload had to be fetched comes in twice.
+	if !node.markProposed(sequenceID) {
+		return
+	}
 
-	log.Printf("Broadcasting dummy message from %s, sequenceId: %d, epochId: %d, viewId: %d",
-		node.MyInfo.NodeID, sequenceID, node.EpochID, node.View.ID)
+	prepareMsg := node.nextProposal(sequenceID, int(seed))
 
-	fmt.Println("[StartPrepare]", "seqID / ",sequenceID,"/", time.Now().UnixNano())
-	time.Sleep(time.Millisecond * 100)
-	node.Broadcast(prepareMsg, "/prepare")
-	fmt.Println("[StartPrepare] After Broadcast!")
+	node.logger(SubsystemConsensus).Info("proposing",
+		"epoch", atomic.LoadInt64(&node.EpochID), "view", view.ID, "seq", sequenceID, "phase", phasePrepare)
+	if !node.sleep(time.Duration(node.Config.ProposeDelay)) {
+		return
+	}
+	node.broadcastPrepare(prepareMsg)
 	//broadcast(errCh, node.MyInfo.Url, dummy, "/prepare", node.PrivKey)
 	// err := <-errCh
 	// if err != nil {
@@ -406,17 +513,50 @@ func (node *Node) BroadCastNextPrepareMsgIfPrimary(sequenceID int64){
 	// }
 }
 
+// markProposed records that this node proposes sequenceID, unless it already did.
+func (node *Node) markProposed(sequenceID int64) bool {
+	for {
+		last := atomic.LoadInt64(&node.LastProposed)
+		if sequenceID <= last {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&node.LastProposed, last, sequenceID) {
+			return true
+		}
+	}
+}
+
 func (node *Node) GetPrepare(state consensus.PBFT, ReqPrePareMsgs *consensus.ReqPrePareMsgs) {
 	prepareMsg := ReqPrePareMsgs.PrepareMsg
 	requestMsg := ReqPrePareMsgs.RequestMsg
+	// The body comes apart from the PREPARE message. Without it
+	// there is nothing to vote for yet.
+	if requestMsg == nil {
+		if requestMsg = node.Payloads.Get(prepareMsg.Digest); requestMsg == nil {
+			state.GetLogger().Debug("PREPARE without its payload, fetching it",
+				"from", prepareMsg.NodeID, "phase", phasePrepare)
+			// Ordering does not need the body; let the next sequence go on.
+			node.BroadCastNextPrepareMsgIfPrimary(prepareMsg.SequenceID + 1)
+			node.StartThreadIfNotExists(prepareMsg.SequenceID + 1)
+			node.fetchPayload(state, ReqPrePareMsgs)
+			return
+		}
+	}
+	// Another replica proposed the request; ours would be a duplicate.
+	node.Requests.remove(requestMsg)
 	//fmt.Println("[PrepareMsg]",prepareMsg.SequenceID,"/",time.Now().UnixNano())
-	fmt.Printf("[GetPrepare] to %s from %s sequenceID: %d\n", 
-						node.MyInfo.NodeID, prepareMsg.NodeID, prepareMsg.SequenceID)
+	state.GetLogger().Debug("PREPARE received", "from", prepareMsg.NodeID, "phase", phasePrepare)
+	node.trace(prepareMsg.SequenceID, TraceEvent{Event: TracePrepareReceived, From: prepareMsg.NodeID, Digest: prepareMsg.Digest})
 	// When receive Prepare, save current time
-	state.SetReceivePrepareTime(time.Now())
+	now := node.Clock.Now()
+	state.SetReceivePrepareTime(now)
+	node.phaseEnded(prepareMsg.SequenceID, phasePrepare, now)
 	voteMsg, err := state.Prepare(prepareMsg, requestMsg)
 	if err != nil {
-		node.MsgError <- []error{err}
+		node.reportErrors([]error{err})
+	}
+	if voteMsg.MsgType == consensus.REJECT {
+		node.Metrics.suspect(prepareMsg.NodeID, suspectPrepare)
 	}
 
 	//Check VoteMsg created
@@ -425,44 +565,36 @@ func (node *Node) GetPrepare(state consensus.PBFT, ReqPrePareMsgs *consensus.Req
 	}
 	node.BroadCastNextPrepareMsgIfPrimary(prepareMsg.SequenceID + 1)
 	// Log last sequence id for checkpointing
-	if node.Prepared[prepareMsg.SequenceID] == 0 {
-		atomic.AddInt64(&node.Prepared[prepareMsg.SequenceID],1)
-	}
+	atomic.CompareAndSwapInt64(&node.Prepared[prepareMsg.SequenceID], 0, 1)
 
 	// Start next sequence thread if does not exists
 	node.StartThreadIfNotExists(prepareMsg.SequenceID + 1)
 
 	// Attach node ID to the message and broadcast voteMsg..
 	voteMsg.NodeID = node.MyInfo.NodeID
-	node.Broadcast(voteMsg, "/vote")
-
-
+	node.Broadcast(&voteMsg, "/vote")
 
 	if prepareMsg.Seed != -1 {
 		//log.Println("Prepare for next Epoch",prepareMsg.Seed)
 		//node.setNewSeedList(prepareMsg.Seed)
 	}
 	// Stop prepare phase and start vote phase if it is not committed
-	// fmt.Println("[Lock-resolve Collate Lock Try]")
-	node.CommittedMutex.Lock()
-	// fmt.Println("[Lock-resolve Collate Lock Release]")
-	if node.Committed[prepareMsg.SequenceID] == 1 {
-		node.CommittedMutex.Unlock()
+	if atomic.LoadInt64(&node.Committed[prepareMsg.SequenceID]) == 1 {
 		// Stop prepare phase and execute the sequence if it is committed
-		state.GetTimerStopSendChannel() <- "Prepare"
+		node.stopTimer(state, "Prepare")
 
-		node.MsgExecution <- prepareMsg
+		node.queueExecution(prepareMsg)
 	} else {
-		node.CommittedMutex.Unlock()
-		state.GetTimerStopSendChannel() <- "Prepare"
-		state.GetTimerStartSendChannel() <- "Vote"
+		node.stopTimer(state, "Prepare")
+		node.startTimer(state, "Vote")
 	}
 
-
 }
 
 func (node *Node) GetVote(state consensus.PBFT, voteMsg *consensus.VoteMsg) {
-	fmt.Println("[GetVote] to",node.MyInfo.NodeID, "from",voteMsg.NodeID, "SeqID:", voteMsg.SequenceID,"MsgType : ",voteMsg.MsgType,"/", time.Now().UnixNano())
+	state.GetLogger().Debug("vote received", "from", voteMsg.NodeID, "type", voteMsg.MsgType, "phase", phaseVote)
+	node.trace(voteMsg.SequenceID, TraceEvent{Event: TraceVoteReceived, From: voteMsg.NodeID,
+		Type: voteMsg.MsgType.String(), Digest: voteMsg.Digest})
 	// if voteMsg.SequenceID >= 1 && voteMsg.SequenceID <= 10 {
 	// 	var PrepareMsg consensus.PrepareMsg
 	// 	PrepareMsg.ViewID = 0
@@ -473,70 +605,66 @@ func (node *Node) GetVote(state consensus.PBFT, voteMsg *consensus.VoteMsg) {
 	// 	PrepareMsg.Seed= 0
 	// 	node.CommittedMsgs[voteMsg.SequenceID] = &PrepareMsg
 	// }
+	if earlier, ok := state.GetVoteMsgs()[voteMsg.NodeID]; ok && earlier.Digest != voteMsg.Digest {
+		node.Metrics.suspect(voteMsg.NodeID, suspectDoubleVote)
+	}
 	collateMsg, err := state.Vote(voteMsg, int64(len(node.NodeTable)))
-	fmt.Println("Node VoteLength : ", len(state.GetVoteMsgs()))
+	state.GetLogger().Debug("votes so far", "count", len(state.GetVoteMsgs()), "phase", phaseVote)
 	if err != nil {
-		node.MsgError <- []error{err}
+		node.reportErrors([]error{err})
+		node.Metrics.suspect(voteMsg.NodeID, suspectVote)
 	}
 
 	// Check COLLATE message created.
 	if collateMsg.SequenceID == 0 {
 		return
 	}
+	node.phaseEnded(collateMsg.SequenceID, phaseVote, node.Clock.Now())
 
 	switch collateMsg.MsgType {
-	
-		// Stop vote phase and execute the sequence if it is committed
+
+	// Stop vote phase and execute the sequence if it is committed
 	case consensus.COMMITTED:
-		
-		
+
 		// fmt.Println("[EXECUTECOMMIT] ","/",voteMsg.SequenceID,"/",time.Since(state.GetReceivePrepareTime()))
-	
-		if state.GetPrepareMsg() == nil {
-			for _, vote := range collateMsg.ReceivedVoteMsg {
-				node.MsgExecution <- vote.PrepareMsg
-				log.Println("vote.PrepareMsg: ",vote.PrepareMsg)
-				break
-			}
-		} else {
-			node.MsgExecution <- state.GetPrepareMsg()
-		}
-	
+		node.trace(collateMsg.SequenceID, TraceEvent{Event: TraceCommit, Rule: RuleVoteQuorum})
+
+		node.executeCommitted(state, collateMsg.ReceivedVoteMsg)
+
 		// atomic.AddInt64(&node.Committed[voteMsg.SequenceID], 1)
 		collateMsg.NodeID = node.MyInfo.NodeID
-		node.Broadcast(collateMsg, "/collate")
-		state.GetTimerStopSendChannel() <- "Vote"
-		state.GetTimerStartSendChannel() <- "Collate"
+		node.Broadcast(&collateMsg, "/collate")
+		node.trace(collateMsg.SequenceID, TraceEvent{Event: TraceCollateSent, Type: collateMsg.MsgType.String()})
+		node.stopTimer(state, "Vote")
+		node.startTimer(state, "Collate")
 		// Log last sequence id for checkpointing
 	case consensus.UNCOMMITTED:
-		state.GetTimerStopSendChannel() <- "Vote"
-		state.GetTimerStartSendChannel() <- "Collate"
+		node.stopTimer(state, "Vote")
+		node.startTimer(state, "Collate")
 		collateMsg.NodeID = node.MyInfo.NodeID
-		node.Broadcast(collateMsg, "/collate")		
+		node.Broadcast(&collateMsg, "/collate")
+		node.trace(collateMsg.SequenceID, TraceEvent{Event: TraceCollateSent, Type: collateMsg.MsgType.String()})
 	}
 
 	// Attach node ID to the message
 
 }
 func (node *Node) GetCollate(state consensus.PBFT, collateMsg *consensus.CollateMsg) {
-	fmt.Printf("[GetCollate] to %s from %s sequenceID: %d TYPE : %d \n", 
-	 				node.MyInfo.NodeID, collateMsg.NodeID, collateMsg.SequenceID, collateMsg.MsgType)
-	
-	
+	state.GetLogger().Debug("collate received", "from", collateMsg.NodeID, "type", collateMsg.MsgType, "phase", phaseCollate)
+	node.trace(collateMsg.SequenceID, TraceEvent{Event: TraceCollateReceived, From: collateMsg.NodeID,
+		Type: collateMsg.MsgType.String()})
 
-
-					 // Check COLLATE message created
-
-	
+	// Check COLLATE message created
 
 	switch collateMsg.MsgType {
-		// Stop vote phase and start collate phase if it is not committed
-		case consensus.UNCOMMITTED:
-				
-				state.FillHoleVoteMsgs(collateMsg)
-				newCollateMsg, err := state.Collate(collateMsg)
+	// Stop vote phase and start collate phase if it is not committed
+	case consensus.UNCOMMITTED:
+
+		state.FillHoleVoteMsgs(collateMsg)
+		newCollateMsg, err := state.Collate(collateMsg)
 		if err != nil {
-			node.MsgError <- []error{err}
+			node.reportErrors([]error{err})
+			node.Metrics.suspect(collateMsg.NodeID, suspectCollate)
 		}
 
 		// Check COLLATE message created
@@ -544,87 +672,63 @@ func (node *Node) GetCollate(state consensus.PBFT, collateMsg *consensus.Collate
 			return
 		}
 		switch newCollateMsg.MsgType {
-			case consensus.UNCOMMITTED:
-				fmt.Println("UNCOMMITTED newCollateMsg.MsgType : ", newCollateMsg.MsgType)
-				newCollateMsg.NodeID = node.MyInfo.NodeID
-				// node.Broadcast(newCollateMsg, "/collate")
-				// Try to stop current phase timer
-				// state.GetTimerStopSendChannel() <- "Collate"
-
-			case consensus.COMMITTED:
-				fmt.Println("COMMITTED newCollateMsg.MsgType : ", newCollateMsg.MsgType)
-				newCollateMsg.NodeID = node.MyInfo.NodeID
-				
-				// Try to stop current phase timer
-				
-
-				// Log last sequence id for checkpointing
-				node.PreparedMutex.Lock()
-				if node.Prepared[newCollateMsg.SequenceID] == 1 {
-					// fmt.Println("[EXECUTECOMMIT]","/",collateMsg.SequenceID,"/",time.Since(state.GetReceivePrepareTime()))
-					node.PreparedMutex.Unlock()
-					if node.Committed[newCollateMsg.SequenceID] == 0 {
-						fmt.Println("========= Collate UNCOMMITED ==> Collate COMMITED ==============",newCollateMsg.SequenceID)
-						// node.Broadcast(newCollateMsg, "/collate")
-						if state.GetPrepareMsg() == nil {
-							for _, vote := range newCollateMsg.ReceivedVoteMsg {
-								node.MsgExecution <- vote.PrepareMsg
-								log.Println("vote.PrepareMsg: ",vote.PrepareMsg)
-								break
-							}
-						} else {
-							node.MsgExecution <- state.GetPrepareMsg()
-						}
-						state.GetTimerStopSendChannel() <- "Collate"
-						
-					}		
+		case consensus.UNCOMMITTED:
+			state.GetLogger().Debug("collates not enough to commit", "phase", phaseCollate)
+			newCollateMsg.NodeID = node.MyInfo.NodeID
+			// node.Broadcast(newCollateMsg, "/collate")
+			// Try to stop current phase timer
+			// state.GetTimerStopSendChannel() <- "Collate"
 
-				} else {
-					node.PreparedMutex.Unlock()
-				}
-				
-					
-			}
-		// Stop vote phase and execute the sequence if it is committed
 		case consensus.COMMITTED:
-			fmt.Println("COMMITTED CollateMsg.MsgType : ", collateMsg.MsgType)
-			state.FillHoleVoteMsgs(collateMsg)
-			newCollateMsg, err := state.Collate(collateMsg)
-			if err != nil {
-				node.MsgError <- []error{err}
-			}			
-			// Attach node ID to the message and broadcast collateMsg..
+			state.GetLogger().Debug("collates enough to commit", "phase", phaseCollate)
 			newCollateMsg.NodeID = node.MyInfo.NodeID
 
 			// Try to stop current phase timer
 
-
 			// Log last sequence id for checkpointing
-			node.PreparedMutex.Lock()
-			if node.Prepared[newCollateMsg.SequenceID] == 1 {
+			if atomic.LoadInt64(&node.Prepared[newCollateMsg.SequenceID]) == 1 {
 				// fmt.Println("[EXECUTECOMMIT]","/",collateMsg.SequenceID,"/",time.Since(state.GetReceivePrepareTime()))
-				node.PreparedMutex.Unlock()
-				if node.Committed[newCollateMsg.SequenceID] == 0 {
-					fmt.Println("========= Collate COMMITED ============== ",newCollateMsg.SequenceID)
+				if atomic.LoadInt64(&node.Committed[newCollateMsg.SequenceID]) == 0 {
+					state.GetLogger().Info("committed on collate quorum", "phase", phaseCollate)
+					node.trace(newCollateMsg.SequenceID, TraceEvent{Event: TraceCommit, Rule: RuleCollateQuorum})
+					node.phaseEnded(newCollateMsg.SequenceID, phaseCollate, node.Clock.Now())
 					// node.Broadcast(newCollateMsg, "/collate")
-					if state.GetPrepareMsg() == nil {
-						for _, vote := range newCollateMsg.ReceivedVoteMsg {
-							node.MsgExecution <- vote.PrepareMsg
-							log.Println("vote.PrepareMsg: ",vote.PrepareMsg)
-							break
-						}
-					} else {
-						node.MsgExecution <- state.GetPrepareMsg()
-					}
-					state.GetTimerStopSendChannel() <- "Collate"
-					
-				}		
+					node.executeCommitted(state, newCollateMsg.ReceivedVoteMsg)
+					node.stopTimer(state, "Collate")
+
+				}
 
-			} else {
-				node.PreparedMutex.Unlock()
 			}
 
+		}
+	// Stop vote phase and execute the sequence if it is committed
+	case consensus.COMMITTED:
+		state.GetLogger().Debug("COMMITTED collate", "from", collateMsg.NodeID, "phase", phaseCollate)
+		state.FillHoleVoteMsgs(collateMsg)
+		newCollateMsg, err := state.Collate(collateMsg)
+		if err != nil {
+			node.reportErrors([]error{err})
+			node.Metrics.suspect(collateMsg.NodeID, suspectCollate)
+		}
+		// Attach node ID to the message and broadcast collateMsg..
+		newCollateMsg.NodeID = node.MyInfo.NodeID
+
+		// Try to stop current phase timer
+
+		// Log last sequence id for checkpointing
+		if atomic.LoadInt64(&node.Prepared[newCollateMsg.SequenceID]) == 1 {
+			// fmt.Println("[EXECUTECOMMIT]","/",collateMsg.SequenceID,"/",time.Since(state.GetReceivePrepareTime()))
+			if atomic.LoadInt64(&node.Committed[newCollateMsg.SequenceID]) == 0 {
+				state.GetLogger().Info("committed on COMMITTED collates", "phase", phaseCollate)
+				node.trace(newCollateMsg.SequenceID, TraceEvent{Event: TraceCommit, Rule: RuleCommittedCollate})
+				node.phaseEnded(newCollateMsg.SequenceID, phaseCollate, node.Clock.Now())
+				// node.Broadcast(newCollateMsg, "/collate")
+				node.executeCommitted(state, newCollateMsg.ReceivedVoteMsg)
+				node.stopTimer(state, "Collate")
+
+			}
 
+		}
 
 	}
 
@@ -634,17 +738,29 @@ func (node *Node) createState(seqID int64) consensus.PBFT {
 	// TODO: From TOCS: To guarantee exactly once semantics,
 	// replicas discard requests whose timestamp is lower than
 	// the timestamp in the last reply they sent to the client.
-	return consensus.CreateState(node.View.ID, node.MyInfo.NodeID, len(node.NodeTable), seqID)
+	viewID := node.viewOf(seqID)
+	logger := node.logger(SubsystemConsensus).With("epoch", atomic.LoadInt64(&node.EpochID), "view", viewID, "seq", seqID)
+	return consensus.CreateState(viewID, node.MyInfo.NodeID, len(node.NodeTable), seqID, logger)
+}
+
+// logger returns the logger of subsystem, with the node id.
+func (node *Node) logger(subsystem string) *slog.Logger {
+	if logger, ok := node.loggers[subsystem]; ok {
+		return logger
+	}
+	return node.loggers[SubsystemConsensus]
 }
 func (node *Node) dispatchMsg() {
 	for {
-		select {
-		case msg := <-node.MsgEntrance:
-			if !node.IsViewChanging {
-				node.MsgDelivery <- msg
-			}
-		case viewmsg := <-node.ViewMsgEntrance:
-			node.MsgDelivery <- viewmsg
+		msg, viewMsg, ok := node.nextEntrance()
+		if !ok {
+			return
+		}
+		if !viewMsg && node.IsViewChanging.Load() {
+			continue
+		}
+		if !send(node, node.deliveryInbox, node.MsgDelivery, msg) {
+			return
 		}
 	}
 }
@@ -655,23 +771,28 @@ func (node *Node) StartThreadIfNotExists(seqID int64) consensus.PBFT {
 		node.States[seqID] = node.createState(seqID)
 		state = node.States[seqID]
 		node.StatesMutex.Unlock()
+		node.Metrics.startSequence(seqID, node.Clock.Now())
 		newTotalConsensus := atomic.AddInt64(&node.TotalConsensus, 1)
-		fmt.Printf("Consensus Process.. newTotalConsensus num is %d\n", newTotalConsensus)	
+		state.GetLogger().Debug("sequence started", "started", newTotalConsensus)
 		node.startTransitionWithDeadline(seqID, state)
-		//state.GetTimerStartSendChannel() <- "ViewChange"
-		state.GetTimerStartSendChannel() <- "Prepare"
+		// A sequence not executed in time starts a view change.
+		node.startTimer(state, "ViewChange")
+		node.startTimer(state, "Prepare")
 		//state.GetTimerStartSendChannel() <- "Total"
-		
-	}else {
+
+	} else {
 		node.StatesMutex.Unlock()
 	}
-	return node.States[seqID]
+	return state
 }
 func (node *Node) resolveMsg() {
 	for {
 		var state consensus.PBFT
 		var err string = ""
-		msgDelivered := <-node.MsgDelivery
+		msgDelivered, ok := receive(node, node.deliveryInbox, node.MsgDelivery)
+		if !ok {
+			return
+		}
 		//fmt.Println("Message came in..")
 		// Resolve the message.
 		switch msg := msgDelivered.(type) {
@@ -688,66 +809,52 @@ func (node *Node) resolveMsg() {
 			//node.PreparedMutex.Unlock()
 			//fmt.Println(msg.PrepareMsg.SequenceID,"came in!!")
 			state = node.StartThreadIfNotExists(msg.PrepareMsg.SequenceID)
-			state.GetMsgSendChannel() <- msg
+			node.toSequence(state, msg)
 
 		case *consensus.VoteMsg:
-			// fmt.Println("[Lock-resolve Collate Lock Try]")
-			node.CommittedMutex.Lock()
-			// fmt.Println("[Lock-resolve Collate Lock Release]")
-			if node.Committed[msg.SequenceID] == 1 {
-				node.CommittedMutex.Unlock()
+			if atomic.LoadInt64(&node.Committed[msg.SequenceID]) == 1 {
 				continue
-			} else {
-				node.CommittedMutex.Unlock()
 			}
 			node.StatesMutex.Lock()
 			state = node.States[msg.SequenceID]
 			node.StatesMutex.Unlock()
 			if state == nil && msg.SequenceID != 1 {
 				state = node.StartThreadIfNotExists(msg.SequenceID)
-				fmt.Println("StartThreadIfNotExists ",msg.SequenceID," make!!")
-				state.GetMsgSendChannel() <- msg
+				node.toSequence(state, msg)
 			} else if state == nil && msg.SequenceID == 1 {
 				//err = "Genesis message is not came in.."
 			} else if state != nil {
-				state.GetMsgSendChannel() <- msg
+				node.toSequence(state, msg)
 			}
-			
+
 		case *consensus.CollateMsg:
-			// fmt.Println("[Lock-resolve Collate Lock Try]")
-			node.CommittedMutex.Lock()
-			// fmt.Println("[Lock-resolve Collate Lock Release]")
 			// fmt.Println("node.Committed[msg.SequenceID] ", node.Committed[msg.SequenceID]," from ",msg.NodeID)
-			if node.Committed[msg.SequenceID] == 1 {
-				node.CommittedMutex.Unlock()
-			 	continue
-			} else {
-				node.CommittedMutex.Unlock()
+			if atomic.LoadInt64(&node.Committed[msg.SequenceID]) == 1 {
+				continue
 			}
 			node.StatesMutex.Lock()
 			state = node.States[msg.SequenceID]
 			node.StatesMutex.Unlock()
 			if state == nil && msg.SequenceID != 1 {
 				state = node.StartThreadIfNotExists(msg.SequenceID)
-				state.GetMsgSendChannel() <- msg
+				node.toSequence(state, msg)
 			} else if state == nil && msg.SequenceID == 1 {
 				//err = "Genesis message is not came in.."
 			} else if state != nil {
 				// fmt.Println("Collate Msg!!!!!", msg.SequenceID," /",msg.ReceivedVoteMsg," from",msg.NodeID)
-				state.GetMsgSendChannel() <- msg
+				node.toSequence(state, msg)
 			}
-			
 
 		//case *consensus.CheckPointMsg:
 		//	node.GetCheckPoint(msg)
 		case *consensus.ViewChangeMsg:
 			state = node.StartThreadIfNotExists(msg.SequenceID)
-			state.GetMsgSendChannel() <- msg
+			node.toSequence(state, msg)
 
 			//node.GetViewChange(msg)
 		case *consensus.NewViewMsg:
 			state = node.StartThreadIfNotExists(msg.SequenceID)
-			state.GetMsgSendChannel() <- msg
+			node.toSequence(state, msg)
 
 			//node.GetNewView(msg)
 		}
@@ -756,8 +863,10 @@ func (node *Node) resolveMsg() {
 			//node.MsgError <- []error{err}
 			// Send message into dispatcher.
 			//fmt.Println(err)
-			node.MsgDelivery <- msgDelivered
-			time.Sleep(time.Millisecond * 50)
+			if !send(node, node.deliveryInbox, node.MsgDelivery, msgDelivered) {
+				return
+			}
+			node.sleep(time.Duration(node.Config.RetryDelay))
 		}
 		//runtime.Gosched()
 	}
@@ -765,12 +874,16 @@ func (node *Node) resolveMsg() {
 func (node *Node) executeMsg() {
 	pairs := make(map[int64]*consensus.PrepareMsg)
 	for {
-		prepareMsg := <- node.MsgExecution
+		prepareMsg, ok := receive(node, node.executionInbox, node.MsgExecution)
+		if !ok {
+			return
+		}
 		pairs[prepareMsg.SequenceID] = prepareMsg
-		fmt.Println("[CommitMsg]",prepareMsg.SequenceID,"/",time.Now().UnixNano())
+		node.logger(SubsystemConsensus).Debug("committed", "seq", prepareMsg.SequenceID)
 		for {
 			var lastSequenceID int64
 			// Find the last committed message.
+			node.CommittedMutex.RLock()
 			msgTotalCnt := int64(len(node.CommittedMsgs))
 			if msgTotalCnt > 0 {
 				lastCommittedMsg := node.CommittedMsgs[msgTotalCnt]
@@ -778,103 +891,160 @@ func (node *Node) executeMsg() {
 			} else {
 				lastSequenceID = 0
 			}
+			node.CommittedMutex.RUnlock()
 			// Stop execution if the message for the
 			// current sequence is not ready to execute.
-			p := pairs[lastSequenceID + 1]
-			
+			p := pairs[lastSequenceID+1]
+
 			if p == nil {
 				//fmt.Println("[STAGE-DONE11] Commit SequenceID : ", int64(len(node.CommittedMsgs)))
 				break
 			}
 
-			node.States[p.SequenceID].GetTimerStopSendChannel() <- "ViewChange"
+			state, _ := node.getState(p.SequenceID)
+			node.stopTimer(state, "ViewChange")
 
-			fmt.Println("[Execute] /", lastSequenceID + 1,"/", time.Now().UnixNano())
+			node.logger(SubsystemConsensus).Info("executed",
+				"epoch", atomic.LoadInt64(&node.EpochID), "view", node.currentView().ID, "seq", lastSequenceID+1, "phase", phaseExecute)
+			node.Metrics.sequenceExecuted(lastSequenceID+1, node.Clock.Now())
+			node.Timeouts.progress()
+			node.Trace.executedSequence(node.Clock.Now(), p.EpochID, p.ViewID, p.Digest, lastSequenceID+1)
 			// Add the committed message in a private log queue
 			// to print the orderly executed messages.
-			node.CommittedMsgs[int64(lastSequenceID + 1)] = p
-			atomic.AddInt64(&node.Committed[int64(lastSequenceID + 1)], 1)
+			node.CommittedMutex.Lock()
+			node.CommittedMsgs[int64(lastSequenceID+1)] = p
+			node.CommittedMutex.Unlock()
+			atomic.AddInt64(&node.Committed[int64(lastSequenceID+1)], 1)
+			atomic.StoreInt64(&node.LastExecuted, lastSequenceID+1)
 			//fmt.Println("[STAGE-DONE] Commit SequenceID : ",lastSequenceID + 1)
-			node.StableCheckPoint = lastSequenceID + 1
+			atomic.StoreInt64(&node.StableCheckPoint, lastSequenceID+1)
 			node.StatesMutex.Lock()
-			
-			ch := node.States[node.StableCheckPoint].GetMsgExitSendChannel()
-			ch1 := node.States[node.StableCheckPoint].GetMsgExitSendChannel1()
-			ch <- 0
-			ch1 <- 0
+
+			node.endTimers(node.States[lastSequenceID+1])
+			node.endMessages(node.States[lastSequenceID+1])
 
 			node.StatesMutex.Unlock()
 			// TODO: execute appropriate operation.
-			
-			delete(pairs, lastSequenceID + 1)
+			node.reply(p)
+
+			delete(pairs, lastSequenceID+1)
+			node.Byzantine.executed(node, lastSequenceID+1)
 			// fmt.Println("[Execute] sequenceID:",lastSequenceID + 1,",",time.Now().UnixNano())
 			// // Add the committed message in a private log queue
 			// // to print the orderly executed messages.
 			// node.CommittedMsgs[int64(lastSequenceID + 1)] = prepareMsg
 			// LogStage("Commit", true)
 
-			node.StableCheckPoint = lastSequenceID + 1
-			node.updateViewID(node.StableCheckPoint)
-			node.updateEpochID(node.StableCheckPoint)
-			if node.StableCheckPoint % 10 == 0 {
+			atomic.StoreInt64(&node.StableCheckPoint, lastSequenceID+1)
+			node.updateViewID(lastSequenceID + 1)
+			node.updateEpochID(lastSequenceID + 1)
+			if (lastSequenceID+1)%node.Config.EpochLength == 0 {
 				//ode.VCStates = make(map[int64]*consensus.VCState)
-				node.NextCandidateIdx = 10
+				atomic.StoreInt64(&node.NextCandidateIdx, node.Config.FirstCandidate)
 			}
+			// A node can commit on the collates of the others before
+			// the PREPARE comes in; as primary of the next sequence it
+			// still has to propose it.
+			next := lastSequenceID + 2
+			node.spawn(func() { node.BroadCastNextPrepareMsgIfPrimary(next) })
 		}
 
 		// Print all committed messages.
 		/*
-		for _, v := range committedMsgs {
-			digest, _ := consensus.Digest(v.RequestMsg.Data)
-			fmt.Printf("***committedMsgs[%d]: clientID=%s, operation=%s, timestamp=%d, data(digest)=%s***\n",
-			           v.RequestMsg.SequenceID, v.RequestMsg.ClientID, v.RequestMsg.Operation, v.RequestMsg.Timestamp, digest)
-		}
-		*/
-	}
-}
-func (node *Node) sendMsg() {
-	sem := make(chan bool, MaxOutboundConnection)
-
-	for {
-		msg := <-node.MsgOutbound
-		// Goroutine for concurrent broadcast() with timeout
-		sem <- true
-		go func() {
-			defer func() { <-sem }()
-			errCh := make(chan error, 10)
-
-			// Goroutine for concurrent broadcast()
-			go func() {
-				broadcast(errCh, msg.IP, msg.Msg, msg.Path, node.PrivKey)
-
-			}()
-			select {
-			case err := <-errCh:
-				if err != nil {
-					node.MsgError <- []error{err}
-					// TODO: view change.
-				}
+			for _, v := range committedMsgs {
+				digest, _ := consensus.Digest(v.RequestMsg.Data)
+				fmt.Printf("***committedMsgs[%d]: clientID=%s, operation=%s, timestamp=%d, data(digest)=%s***\n",
+				           v.RequestMsg.SequenceID, v.RequestMsg.ClientID, v.RequestMsg.Operation, v.RequestMsg.Timestamp, digest)
 			}
-		}()
+		*/
 	}
 }
 func (node *Node) logErrorMsg() {
 	coolingMsgLeft := CoolingTotalErrMsg
 
 	for {
-		errs := <-node.MsgError
+		errs, ok := receive(node, node.errorInbox, node.MsgError)
+		if !ok {
+			return
+		}
 		for _, err := range errs {
 			coolingMsgLeft--
 			if coolingMsgLeft == 0 {
-				fmt.Printf("%d error messages detected! cool down for %d milliseconds\n",
-				           CoolingTotalErrMsg, CoolingTime / time.Millisecond)
-				time.Sleep(CoolingTime)
+				node.logger(SubsystemConsensus).Warn("too many errors, cooling down",
+					"errors", CoolingTotalErrMsg, "for", CoolingTime)
+				node.sleep(CoolingTime)
 				coolingMsgLeft = CoolingTotalErrMsg
 			}
-			fmt.Println(err)
+			node.logger(SubsystemConsensus).Error(err.Error())
+			node.errors.add(node.Clock.Now(), err)
+		}
+	}
+}
+
+// executeCommitted queues the PREPARE of a committed sequence: the one
+// the node received, or else the first one a vote carries, as long as
+// its digest is the one the votes agree on. A PREPARE a Byzantine vote
+// carries, or the null one of a node whose PREPARE timer expired, is
+// not executed.
+func (node *Node) executeCommitted(state consensus.PBFT, votes map[string]*consensus.VoteMsg) {
+	digest, ok := quorumDigest(votes)
+	if !ok {
+		state.GetLogger().Warn("committed without a digest the votes agree on")
+		return
+	}
+	if prepareMsg := state.GetPrepareMsg(); prepareMsg != nil && prepareMsg.Digest == digest {
+		node.queueExecution(prepareMsg)
+		return
+	}
+	for _, vote := range sortedVotes(votes) {
+		if vote.MsgType != consensus.VOTE || vote.Digest != digest || vote.PrepareMsg == nil ||
+			vote.PrepareMsg.Digest != digest || vote.PrepareMsg.SequenceID != state.GetSequenceID() {
+			continue
+		}
+		node.queueExecution(vote.PrepareMsg)
+		state.GetLogger().Debug("executing the PREPARE a vote carries", "voter", vote.NodeID)
+		return
+	}
+	state.GetLogger().Warn("committed without the PREPARE of the digest the votes agree on", "digest", digest)
+}
+
+// quorumDigest returns the digest most of votes are VOTEs for. It
+// returns false if there is none, or if two digests have as many.
+func quorumDigest(votes map[string]*consensus.VoteMsg) (string, bool) {
+	counts := make(map[string]int)
+	for _, vote := range votes {
+		if vote.MsgType == consensus.VOTE {
+			counts[vote.Digest]++
+		}
+	}
+	var digest string
+	var most, ties int
+	for d, count := range counts {
+		switch {
+		case count > most:
+			digest, most, ties = d, count, 1
+		case count == most:
+			ties++
 		}
 	}
+	return digest, most > 0 && ties == 1
+}
+
+// sortedVotes returns votes ordered by node ID, so that every replica,
+// and every run of a simulation, picks the same one first.
+func sortedVotes(votes map[string]*consensus.VoteMsg) []*consensus.VoteMsg {
+	nodeIDs := make([]string, 0, len(votes))
+	for nodeID := range votes {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Strings(nodeIDs)
+	sorted := make([]*consensus.VoteMsg, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		sorted[i] = votes[nodeID]
+	}
+	return sorted
 }
+
 func (node *Node) getState(sequenceID int64) (consensus.PBFT, error) {
 	node.StatesMutex.RLock()
 	state := node.States[sequenceID]
@@ -886,3 +1056,22 @@ func (node *Node) getState(sequenceID int64) (consensus.PBFT, error) {
 
 	return state, nil
 }
+
+// Executed returns a copy of CommittedMsgs: the PREPARE executed for
+// each sequence.
+func (node *Node) Executed() map[int64]*consensus.PrepareMsg {
+	node.CommittedMutex.RLock()
+	defer node.CommittedMutex.RUnlock()
+	executed := make(map[int64]*consensus.PrepareMsg, len(node.CommittedMsgs))
+	for seqID, prepareMsg := range node.CommittedMsgs {
+		executed[seqID] = prepareMsg
+	}
+	return executed
+}
+
+// ExecutedCount returns the number of sequences in CommittedMsgs.
+func (node *Node) ExecutedCount() int {
+	node.CommittedMutex.RLock()
+	defer node.CommittedMutex.RUnlock()
+	return len(node.CommittedMsgs)
+}
@@ -0,0 +1,271 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Request bodies travel apart from the PREPARE messages that order
+// them. The primary pushes each body to every replica on /payload
+// ahead of the PREPARE, which carries only the digest. A replica that
+// gets a PREPARE for a body it does not have asks the replicas that
+// voted for it, and the primary, on /fetch, and only votes once the
+// body is there. A replica takes a body only from the primary of its
+// sequence, or from anyone while it fetches it, and keeps the latest
+// bodies of each sender: a Byzantine replica pushing bodies nobody
+// asked for evicts none but its own.
+
+const (
+	// Number of request bodies kept per sender, for execution and
+	// fetches. A replica is the primary of one sequence in every
+	// epoch, so this covers the last few epochs.
+	payloadsPerSender = 8
+
+	// Time given to a pushed body to arrive before it is fetched.
+	payloadFetchDelay = 50 * time.Millisecond
+
+	// Time between two fetch requests for the same body.
+	payloadFetchRetry = 200 * time.Millisecond
+
+	// Number of fetch requests before giving up; the PREPARE timer
+	// then makes the replica vote NULL.
+	payloadFetchAttempts = 50
+)
+
+// PayloadStore keeps recent request bodies by digest, the latest size
+// of each sender.
+type PayloadStore struct {
+	mu       sync.Mutex
+	size     int
+	bodies   map[string]*consensus.RequestMsg
+	senders  map[string]*payloadRing
+	waiters  map[string][]payloadWaiter
+	fetching map[string]bool
+}
+
+// payloadRing holds the digests of the bodies of one sender, oldest
+// first from next on once it is full.
+type payloadRing struct {
+	order []string
+	next  int
+}
+
+func NewPayloadStore(size int) *PayloadStore {
+	return &PayloadStore{
+		size:     size,
+		bodies:   make(map[string]*consensus.RequestMsg),
+		senders:  make(map[string]*payloadRing),
+		waiters:  make(map[string][]payloadWaiter),
+		fetching: make(map[string]bool),
+	}
+}
+
+// Put stores body, sent by from, under digest if it hashes to digest,
+// and hands it to whoever waits for it. It evicts the oldest body of
+// from once from has size of them.
+func (store *PayloadStore) Put(from string, digest string, body *consensus.RequestMsg) error {
+	if body == nil {
+		return fmt.Errorf("empty payload for %s", digest)
+	}
+	if got, err := consensus.Digest(body); err != nil || got != digest {
+		return fmt.Errorf("payload does not match digest %s", digest)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.bodies[digest]; ok {
+		return nil
+	}
+	ring := store.senders[from]
+	if ring == nil {
+		ring = &payloadRing{order: make([]string, 0, store.size)}
+		store.senders[from] = ring
+	}
+	if len(ring.order) < store.size {
+		ring.order = append(ring.order, digest)
+	} else {
+		delete(store.bodies, ring.order[ring.next])
+		ring.order[ring.next] = digest
+		ring.next = (ring.next + 1) % len(ring.order)
+	}
+	store.bodies[digest] = body
+
+	for _, waiter := range store.waiters[digest] {
+		waiter.send(body)
+	}
+	delete(store.waiters, digest)
+	return nil
+}
+
+// Get returns the body of digest, or nil if it is not here.
+func (store *PayloadStore) Get(digest string) *consensus.RequestMsg {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.bodies[digest]
+}
+
+// awaited reports whether a fetch waits for the body of digest.
+func (store *PayloadStore) awaited(digest string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.waiters[digest]) > 0
+}
+
+// payloadWaiter is a channel that receives a body, with the inbox of
+// the goroutine that reads it.
+type payloadWaiter struct {
+	body  chan *consensus.RequestMsg
+	inbox *inbox
+}
+
+// startFetch returns a waiter that receives the body of digest, and
+// whether the caller should fetch it; only one caller per digest does.
+// box is the inbox of the goroutine that waits.
+func (store *PayloadStore) startFetch(digest string, box *inbox) (payloadWaiter, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	waiter := payloadWaiter{body: make(chan *consensus.RequestMsg, 1), inbox: box}
+	if body, ok := store.bodies[digest]; ok {
+		waiter.send(body)
+		return waiter, false
+	}
+	store.waiters[digest] = append(store.waiters[digest], waiter)
+	if store.fetching[digest] {
+		return waiter, false
+	}
+	store.fetching[digest] = true
+	return waiter, true
+}
+
+func (store *PayloadStore) endFetch(digest string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.fetching, digest)
+}
+
+// broadcastPrepare pushes the request body, or its chunks, ahead of
+// the PREPARE message, which then carries the digest only.
+func (node *Node) broadcastPrepare(reqPrePare *consensus.ReqPrePareMsgs) {
+	payload := &consensus.PayloadMsg{
+		Digest:     reqPrePare.PrepareMsg.Digest,
+		RequestMsg: reqPrePare.RequestMsg,
+	}
+	if err := node.Payloads.Put(node.MyInfo.NodeID, payload.Digest, payload.RequestMsg); err != nil {
+		node.reportErrors([]error{err})
+		return
+	}
+	if !node.Config.Erasure {
+		node.Broadcast(payload, "/payload")
+	} else if err := node.disperseChunks(payload); err != nil {
+		node.reportErrors([]error{err})
+		return
+	}
+	node.Broadcast(&consensus.ReqPrePareMsgs{PrepareMsg: reqPrePare.PrepareMsg}, "/prepare")
+	node.trace(reqPrePare.PrepareMsg.SequenceID, TraceEvent{Event: TracePrepareSent, Digest: reqPrePare.PrepareMsg.Digest})
+}
+
+// GetPayload stores a body pushed by the primary of its sequence, or
+// sent for a fetch of this node, and drops any other.
+func (node *Node) GetPayload(from string, payload *consensus.PayloadMsg) {
+	if !node.Payloads.awaited(payload.Digest) &&
+		(payload.RequestMsg == nil || from != node.primaryOf(payload.RequestMsg.SequenceID)) {
+		node.logger(SubsystemNetwork).Debug("unsolicited payload dropped", "from", from, "digest", payload.Digest)
+		return
+	}
+	if err := node.Payloads.Put(from, payload.Digest, payload.RequestMsg); err != nil {
+		node.reportErrors([]error{err})
+	}
+}
+
+// GetFetch answers a fetch request if the body is here.
+func (node *Node) GetFetch(from string, fetch *consensus.FetchMsg) {
+	body := node.Payloads.Get(fetch.Digest)
+	if body == nil {
+		return
+	}
+	node.SendTo(from, &consensus.PayloadMsg{Digest: fetch.Digest, RequestMsg: body}, "/payload")
+}
+
+// fetchPayload gets the body of a PREPARE message from the replicas
+// that voted for it, or from the primary, and hands the completed
+// message back to the sequence thread.
+func (node *Node) fetchPayload(state consensus.PBFT, reqPrePare *consensus.ReqPrePareMsgs) {
+	prepareMsg := reqPrePare.PrepareMsg
+	digest := prepareMsg.Digest
+	waiter, fetch := node.Payloads.startFetch(digest, node.newInbox())
+
+	node.spawn(func() {
+		if fetch {
+			defer node.Payloads.endFetch(digest)
+		}
+		delay := payloadFetchDelay
+		if node.Config.Erasure {
+			delay = chunkFetchDelay
+		}
+		timer := node.Clock.NewTimer(delay)
+		defer timer.Stop()
+
+		for attempt := 0; ; attempt++ {
+			body, ok := node.waitPayload(waiter, timer)
+			if !ok {
+				return
+			}
+			if body != nil {
+				node.toSequence(state, &consensus.ReqPrePareMsgs{
+					RequestMsg: body,
+					PrepareMsg: prepareMsg,
+				})
+				return
+			}
+			if node.isCommitted(prepareMsg.SequenceID) {
+				return
+			}
+			if attempt >= payloadFetchAttempts {
+				if fetch {
+					node.reportErrors([]error{fmt.Errorf("gave up fetching payload of sequence %d", prepareMsg.SequenceID)})
+				}
+				return
+			}
+			if !fetch {
+				timer.Reset(payloadFetchRetry)
+				continue
+			}
+			if from := node.payloadSource(state, prepareMsg, attempt); from != "" {
+				node.SendTo(from, &consensus.FetchMsg{Digest: digest, SequenceID: prepareMsg.SequenceID}, "/fetch")
+			}
+			timer.Reset(payloadFetchRetry)
+		}
+	})
+}
+
+// payloadSource picks whom to ask for the body of prepareMsg, going
+// round the replicas that voted for its digest and the primary.
+func (node *Node) payloadSource(state consensus.PBFT, prepareMsg *consensus.PrepareMsg, attempt int) string {
+	var sources []string
+	for nodeID, voteMsg := range state.GetVoteMsgs() {
+		if voteMsg.MsgType == consensus.VOTE && voteMsg.Digest == prepareMsg.Digest &&
+			nodeID != node.MyInfo.NodeID && nodeID != prepareMsg.NodeID {
+			sources = append(sources, nodeID)
+		}
+	}
+	sort.Strings(sources)
+	if prepareMsg.NodeID != node.MyInfo.NodeID {
+		sources = append(sources, prepareMsg.NodeID)
+	}
+	if len(sources) == 0 {
+		return ""
+	}
+	return sources[attempt%len(sources)]
+}
+
+func (node *Node) isCommitted(sequenceID int64) bool {
+	if sequenceID < 0 || sequenceID >= int64(len(node.Committed)) {
+		return false
+	}
+	return atomic.LoadInt64(&node.Committed[sequenceID]) == 1
+}
@@ -0,0 +1,47 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// putBody stores a body of its own under from and returns its digest.
+func putBody(t *testing.T, store *PayloadStore, from string, i int) string {
+	t.Helper()
+	body := &consensus.RequestMsg{ClientID: from, Data: fmt.Sprint(i), SequenceID: int64(i)}
+	digest, err := consensus.Digest(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(from, digest, body); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestPayloadStoreBoundsEachSender(t *testing.T) {
+	store := NewPayloadStore(2)
+	honest := putBody(t, store, "Node1", 0)
+	var flood []string
+	for i := 0; i < 10; i++ {
+		flood = append(flood, putBody(t, store, "Node2", i))
+	}
+	if store.Get(honest) == nil {
+		t.Error("the bodies of Node2 evicted the body of Node1")
+	}
+	for i, digest := range flood {
+		if kept := store.Get(digest) != nil; kept != (i >= len(flood)-2) {
+			t.Errorf("body %d of Node2 kept: %v", i, kept)
+		}
+	}
+}
+
+func TestPayloadStoreRejectsWrongDigest(t *testing.T) {
+	store := NewPayloadStore(2)
+	body := &consensus.RequestMsg{ClientID: "Node1", Data: "a"}
+	if err := store.Put("Node1", "not the digest", body); err == nil {
+		t.Error("stored a body under a digest it does not hash to")
+	}
+}
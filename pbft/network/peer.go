@@ -0,0 +1,304 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Number of messages that may wait for a peer before new ones are
+	// dropped, unless Config.SendQueue says otherwise.
+	peerSendQueueSize = 1024
+
+	// Time allowed to write one message to a peer. A prepare carries
+	// the whole request, so this is longer than writeWait.
+	peerWriteWait = 10 * time.Second
+)
+
+// Peer is the long-lived outbound connection to one replica. Messages
+// are queued and written by a single goroutine, which dials the peer's
+// hub when needed and dials again if the connection breaks (see
+// supervisor.go).
+type Peer struct {
+	Info *NodeInfo
+	myID string
+	wire wireOptions
+
+	send    chan *outboundMsg
+	errors  chan<- []error
+	done    <-chan struct{}
+	traffic *trafficCounters // set by PeerSet.attachHub
+
+	// Owned by the writer goroutine.
+	conn       *websocket.Conn
+	codec      consensus.Codec
+	connClosed chan struct{}
+
+	// Set while a message is taken from send and not yet written.
+	busy atomic.Bool
+
+	// Connection state, see Status.
+	mu       sync.Mutex
+	state    PeerState
+	since    time.Time
+	failures int
+	lastErr  error
+	live     *websocket.Conn
+}
+
+// PeerSet holds the outbound connection to every replica in the node
+// table, this node included. Messages for anyone else, such as a
+// client, go back over the connection it opened to our hub.
+type PeerSet struct {
+	peers     map[string]*Peer
+	order     []*Peer
+	hub       *Hub
+	startOnce sync.Once
+	ctx       context.Context // cancelled by Close
+	cancel    context.CancelFunc
+	writers   sync.WaitGroup
+}
+
+// An envelope on its way to the peers. The encoding is shared by all
+// peers that negotiated the same codec.
+type outboundMsg struct {
+	env *consensus.Envelope
+
+	mu      sync.Mutex
+	encoded map[consensus.Codec][]byte
+}
+
+func NewPeerSet(myID string, nodeTable []*NodeInfo, sendQueue int, errors chan<- []error, wire wireOptions) *PeerSet {
+	set := &PeerSet{peers: make(map[string]*Peer)}
+	set.ctx, set.cancel = context.WithCancel(context.Background())
+	for _, nodeInfo := range nodeTable {
+		peer := &Peer{
+			Info:   nodeInfo,
+			myID:   myID,
+			wire:   wire,
+			send:   make(chan *outboundMsg, sendQueue),
+			errors: errors,
+			done:   set.ctx.Done(),
+			since:  time.Now(),
+		}
+		set.peers[nodeInfo.NodeID] = peer
+		set.order = append(set.order, peer)
+	}
+	return set
+}
+
+// Start runs the writer of every peer. Messages queued before
+// are kept and sent once the peer is reachable.
+func (set *PeerSet) Start() {
+	set.startOnce.Do(func() {
+		for _, peer := range set.order {
+			if set.ctx.Err() != nil {
+				return
+			}
+			set.writers.Add(1)
+			go func(peer *Peer) {
+				defer set.writers.Done()
+				peer.writeLoop(set.ctx)
+			}(peer)
+		}
+	})
+}
+
+// Close stops the writers, closes the connections and waits for the
+// writers to return, or for ctx to be done. Queued messages are
+// dropped; see Drain.
+func (set *PeerSet) Close(ctx context.Context) error {
+	set.cancel()
+	// Unblock writes in progress.
+	for _, peer := range set.order {
+		peer.mu.Lock()
+		if peer.live != nil {
+			peer.live.Close()
+		}
+		peer.mu.Unlock()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		set.writers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("writers of the peers still running: %v", ctx.Err())
+	}
+}
+
+// Drain waits until the writers of the connected peers have written
+// what is queued for them, or ctx is done. Messages for peers that are
+// down stay queued.
+func (set *PeerSet) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var pending []string
+		for _, peer := range set.order {
+			if peer.Status().State == PeerConnected && (len(peer.send) > 0 || peer.busy.Load()) {
+				pending = append(pending, peer.Info.NodeID)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("messages still queued for %v: %v", pending, ctx.Err())
+		}
+	}
+}
+
+// attachHub lets messages reach nodes outside the node table through
+// their inbound connections to hub, and counts the traffic of the
+// peers with that of the hub.
+func (set *PeerSet) attachHub(hub *Hub) {
+	set.hub = hub
+	for _, peer := range set.order {
+		peer.traffic = hub.traffic
+	}
+}
+
+// Broadcast queues env for every peer.
+func (set *PeerSet) Broadcast(env *consensus.Envelope) {
+	msg := &outboundMsg{env: env}
+	for _, peer := range set.order {
+		peer.enqueue(msg)
+	}
+}
+
+// SendTo queues env for the node nodeID, which is either a peer or
+// connected to our hub.
+func (set *PeerSet) SendTo(nodeID string, env *consensus.Envelope) error {
+	return set.Multicast([]string{nodeID}, env)
+}
+
+// Multicast queues env for each of nodeIDs.
+func (set *PeerSet) Multicast(nodeIDs []string, env *consensus.Envelope) error {
+	msg := &outboundMsg{env: env}
+	var unknown []string
+	for _, nodeID := range nodeIDs {
+		if peer, ok := set.peers[nodeID]; ok {
+			peer.enqueue(msg)
+			continue
+		}
+		if set.hub == nil || set.hub.sendTo(nodeID, msg) != nil {
+			unknown = append(unknown, nodeID)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("cannot send %s message to %v: not connected", env.MsgType, unknown)
+	}
+	return nil
+}
+
+// enqueue never blocks; a message for a peer that cannot keep up is dropped.
+func (peer *Peer) enqueue(msg *outboundMsg) {
+	if peer.closed() {
+		return
+	}
+	select {
+	case peer.send <- msg:
+	default:
+		peer.report([]error{fmt.Errorf("send queue to %s is full, dropped %s message",
+			peer.Info.NodeID, msg.env.MsgType)})
+	}
+}
+
+// report hands errs to the transport, unless the peer set is closed.
+func (peer *Peer) report(errs []error) {
+	select {
+	case peer.errors <- errs:
+	case <-peer.done:
+	}
+}
+
+func (peer *Peer) writeLoop(ctx context.Context) {
+	defer peer.dropConn()
+	for {
+		select {
+		case msg := <-peer.send:
+			peer.busy.Store(true)
+			for !peer.write(ctx, msg) {
+				// write has backed off; try the same message again.
+				if peer.closed() {
+					peer.busy.Store(false)
+					return
+				}
+			}
+			peer.busy.Store(false)
+		case <-peer.done:
+			return
+		}
+	}
+}
+
+func (peer *Peer) closed() bool {
+	select {
+	case <-peer.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// write sends msg, dialing first if there is no connection. It returns
+// false, after backing off, if msg should be retried on a new connection.
+func (peer *Peer) write(ctx context.Context, msg *outboundMsg) bool {
+	if peer.conn != nil {
+		select {
+		case <-peer.connClosed:
+			peer.dropConn()
+		default:
+		}
+	}
+	if peer.conn == nil {
+		if err := peer.connect(ctx); err != nil {
+			peer.fail(fmt.Errorf("cannot connect: %v", err))
+			return false
+		}
+	}
+
+	data, err := msg.encode(peer.codec)
+	if err != nil {
+		peer.report([]error{err})
+		return true
+	}
+	peer.conn.SetWriteDeadline(time.Now().Add(peerWriteWait))
+	if err := peer.conn.WriteMessage(frameType(peer.codec), data); err != nil {
+		peer.fail(fmt.Errorf("connection lost: %v", err))
+		return false
+	}
+	if peer.traffic != nil {
+		peer.traffic.sent(peer.Info.NodeID, len(data))
+	}
+	return true
+}
+
+func (msg *outboundMsg) encode(codec consensus.Codec) ([]byte, error) {
+	msg.mu.Lock()
+	defer msg.mu.Unlock()
+	if data, ok := msg.encoded[codec]; ok {
+		return data, nil
+	}
+	data, err := codec.Marshal(msg.env)
+	if err != nil {
+		return nil, err
+	}
+	if msg.encoded == nil {
+		msg.encoded = make(map[consensus.Codec][]byte)
+	}
+	msg.encoded[codec] = data
+	return data, nil
+}
@@ -1,268 +1,324 @@
-// TODO: secure connection such as HTTPS, or manual implementation
-// from Section 5.2.2 Key Exchanges on TOCS.
+// Replicas connect over wss:// with mutual TLS unless TLS is disabled,
+// see tls.go.
 package network
 
 import (
-	"crypto/ecdsa"
-	"encoding/json"
-	"fmt"
-	"github.com/gorilla/websocket"
 	"net/http"
-	"net/url"
 	//"fmt"
-	//"sync/atomic"
 	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
-	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
-	//"sync"
 )
+
 const sendPeriod time.Duration = 350
+
 type Server struct {
 	url  string
 	node *Node
+	mux  *http.ServeMux
+
+	transport Transport
+	// Set when the replicas are connected over websockets.
+	ws *WebsocketTransport
+	// Set with -faults; served on /admin/faults of the admin API.
+	faults *FaultyTransport
+
+	verifyPool *VerifyPool
+
+	// Handlers of verified messages, by message type.
+	routes map[string]func(env *consensus.Envelope)
+
+	// Listeners, closed by Stop.
+	mu          sync.Mutex
+	stopping    bool
+	httpServer  *http.Server
+	adminServer *http.Server
 }
- 
-func NewServer(nodeID string, nodeTable []*NodeInfo, seedNodeTables [][]*NodeInfo,
-			viewID int64, decodePrivKey *ecdsa.PrivateKey) *Server {
-	nodeIdx := int(-1)
-	for idx, nodeInfo := range nodeTable {
-		if nodeInfo.NodeID == nodeID {
-			nodeIdx = idx
-			break
-		}
+
+// NewServer returns the server of config.NodeID, connected to the other
+// replicas over websockets.
+func NewServer(config *Config, nodeTable []*NodeInfo, seedNodeTables [][]*NodeInfo,
+	decodePrivKey consensus.Signer) *Server {
+	config = withLogging(config)
+	myInfo := findNode(nodeTable, config.NodeID)
+	if myInfo == nil {
+		config.Logging.Logger(SubsystemNetwork).Error("node does not exist", "node", config.NodeID)
+		return nil
 	}
+	transport, err := NewWebsocketTransport(myInfo, nodeTable, config)
+	if err != nil {
+		config.Logging.Logger(SubsystemNetwork).Error(err.Error(), "node", config.NodeID)
+		return nil
+	}
+	return NewServerWithTransport(config, nodeTable, seedNodeTables, decodePrivKey, transport)
+}
+
+// NewServerWithTransport returns the server of config.NodeID, connected
+// to the other replicas by transport, e.g. a MemoryTransport.
+func NewServerWithTransport(config *Config, nodeTable []*NodeInfo, seedNodeTables [][]*NodeInfo,
+	decodePrivKey consensus.Signer, transport Transport) *Server {
+	return NewServerWithClock(config, nodeTable, seedNodeTables, decodePrivKey,
+		transport, SystemClock)
+}
 
-	if nodeIdx == -1 {
-		log.Printf("Node '%s' does not exist!\n", nodeID)
+// NewServerWithClock is NewServerWithTransport with the node on clock,
+// e.g. the virtual clock of a simulation.
+func NewServerWithClock(config *Config, nodeTable []*NodeInfo, seedNodeTables [][]*NodeInfo,
+	decodePrivKey consensus.Signer, transport Transport, clock Clock) *Server {
+	config = withLogging(config)
+	nodeID := config.NodeID
+	myInfo := findNode(nodeTable, nodeID)
+	if myInfo == nil {
+		config.Logging.Logger(SubsystemNetwork).Error("node does not exist", "node", nodeID)
+		return nil
+	}
+	// Each node misbehaves, and crashes, on its own.
+	byzantine, err := ParseByzantine(config.Byzantine)
+	if err != nil {
+		config.Logging.Logger(SubsystemFaults).Error(err.Error(), "node", nodeID)
 		return nil
 	}
 
-	node := NewNode(nodeTable[nodeIdx], nodeTable, seedNodeTables, viewID, decodePrivKey)
 	server := &Server{
-		url: nodeTable[nodeIdx].Url,
-		node: node,
+		url:    myInfo.Url,
+		mux:    http.NewServeMux(),
+		routes: make(map[string]func(env *consensus.Envelope)),
 	}
-
-	server.setRoute("/prepare")
+	if ws, ok := transport.(*WebsocketTransport); ok {
+		server.ws = ws
+		server.mux.Handle("/prepare", ws.Handler())
+	}
+	if config.Faults {
+		server.faults = NewFaultyTransport(transport, nodeID, nodeTable,
+			config.Logging.Logger(SubsystemFaults).With("node", nodeID))
+		transport = server.faults
+	}
+	server.transport = transport
+	server.node = NewNode(myInfo, nodeTable, seedNodeTables, config, decodePrivKey, transport, clock)
+	if byzantine != nil {
+		server.node.Byzantine = byzantine
+		server.node.logger(SubsystemFaults).Warn("Byzantine", "modes", byzantine.String())
+	}
+	// A clock that runs the goroutines of the node one at a time would
+	// run the workers so too; the receive loop verifies instead.
+	workers := runtime.NumCPU()
+	if server.node.stepper != nil {
+		workers = 0
+	}
+	server.verifyPool = NewVerifyPool(workers, append(nodeTable[:len(nodeTable):len(nodeTable)], config.Clients...),
+		server.deliverMsg, server.node.logger(SubsystemNetwork))
+	if config.SignatureCache != nil {
+		server.verifyPool.cache = config.SignatureCache
+	}
+	server.verifyPool.suspect = server.node.Metrics.suspect
+	server.mux.Handle("/admin/log", server.node.Logging)
+
+	server.Handle("/prepare", server.toMsgEntrance)
+	server.Handle("/vote", server.toMsgEntrance)
+	server.Handle("/collate", server.toMsgEntrance)
+	server.Handle("/viewchange", server.toViewMsgEntrance)
+	server.Handle("/newview", server.toViewMsgEntrance)
+	server.Handle("/payload", func(env *consensus.Envelope) {
+		server.node.GetPayload(env.Sender, env.Msg.(*consensus.PayloadMsg))
+	})
+	server.Handle("/fetch", func(env *consensus.Envelope) {
+		server.node.GetFetch(env.Sender, env.Msg.(*consensus.FetchMsg))
+	})
+	server.Handle("/chunk", func(env *consensus.Envelope) {
+		server.node.GetChunk(env.Sender, env.Msg.(*consensus.ChunkMsg))
+	})
+	server.Handle("/request", func(env *consensus.Envelope) {
+		server.node.GetRequest(env.Msg.(*consensus.RequestMsg))
+	})
 
 	return server
 }
 
-func (server *Server) setRoute(path string) {
-	hub := NewHub()
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		ServeWs(hub, w, r)
+func findNode(nodeTable []*NodeInfo, nodeID string) *NodeInfo {
+	for _, nodeInfo := range nodeTable {
+		if nodeInfo.NodeID == nodeID {
+			return nodeInfo
+		}
 	}
-	http.HandleFunc(path, handler)
-
-	go hub.run()
+	return nil
 }
 
-func (server *Server) Start() {
-	log.Printf("%s Server will be started at %s...\n", server.node.MyInfo.NodeID, server.url)
+// Start runs the node. Over websockets it serves the hub and blocks
+// until Stop, or returns the error that the listener failed with; with
+// any other transport it returns once the node runs.
+func (server *Server) Start() error {
+	server.node.spawn(server.receiveLoop)
 
-	go server.DialOtherNodes()
+	if server.ws == nil {
+		server.DialOtherNodes()
+		return nil
+	}
 
-	if err := http.ListenAndServe(server.url, nil); err != nil {
-		log.Println(err)
-		return
+	server.node.logger(SubsystemNetwork).Info("server starting", "url", server.url)
+
+	server.node.spawn(server.DialOtherNodes)
+
+	httpServer := &http.Server{Addr: server.url, Handler: server.mux}
+	identity := server.ws.identity
+	if identity != nil {
+		httpServer.TLSConfig = identity.serverConfig()
+	}
+	if err := server.serve(httpServer, &server.httpServer, identity != nil); err != nil {
+		server.node.logger(SubsystemNetwork).Error(err.Error())
+		return err
 	}
+	return nil
 }
 
 func (server *Server) DialOtherNodes() {
-	// Sleep until all nodes perform ListenAndServ().
-	time.Sleep(time.Second * 3)
-
-	var cPrepare = make(map[string]*websocket.Conn)
-
-	for _, nodeInfo := range server.node.NodeTable {
-		cPrepare[nodeInfo.NodeID] = server.setReceiveLoop("/prepare", nodeInfo)
+	if server.ws != nil {
+		server.ws.Start()
 	}
-	time.Sleep(time.Second * 3)
+
 	server.sendGenesisMsgIfPrimary()
-	
-	// Wait.
-	select {}
+}
 
-	//defer c.Close()
+// Node returns the replica the server runs.
+func (server *Server) Node() *Node {
+	return server.node
 }
 
-func (server *Server) setReceiveLoop(path string, nodeInfo *NodeInfo) *websocket.Conn {
-	u := url.URL{Scheme: "ws", Host: nodeInfo.Url, Path: path}
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatal("dial:", err)
+// Handler returns the HTTP endpoints of the server, which Start serves
+// over websockets. With another transport they can be served apart.
+func (server *Server) Handler() http.Handler {
+	return server.mux
+}
+
+// receiveLoop hands what the transport receives to the verification pool.
+func (server *Server) receiveLoop() {
+	for {
+		msg, ok := await(server.node, server.transport.Inbound())
+		if !ok {
+			return
+		}
+		server.verifyPool.Submit(msg.Codec, msg.Data)
+	}
+}
+
+// Drops returns the number of messages dropped by flow control,
+// by peer, message type and reason.
+func (server *Server) Drops() []DropCount {
+	if server.ws == nil {
 		return nil
 	}
-	log.Printf("connecting to %s from %s for %s", nodeInfo.NodeID, server.node.MyInfo.NodeID,path)
-	//log.Println("sRL local addr : ",c.LocalAddr(),"sRL remote addr : ",c.RemoteAddr())
-	go server.receiveLoop(c, path, nodeInfo)
+	return server.ws.Drops()
+}
 
-	return c
+// Handle registers the handler of verified messages of type msgType.
+// Handlers run on the verification workers and should not block long.
+func (server *Server) Handle(msgType string, handler func(env *consensus.Envelope)) {
+	server.routes[msgType] = handler
 }
-func (server *Server) receiveLoop(cc *websocket.Conn, path string, nodeInfo *NodeInfo) {
-	c:=cc
-	for {
 
-		_, message, err := c.ReadMessage()
-		if err != nil {
-			u := url.URL{Scheme: "ws", Host: nodeInfo.Url, Path: path}
-			c, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
-			if err != nil {
-				log.Fatal("dial:", err)
-				return 
-			}
-			_, message, err = c.ReadMessage()
-			log.Printf("currunpted message size: %d\n", len(message))
-			continue
+// deliverMsg hands a message whose signature has been verified to the
+// handler of its type. Messages sent to another node, and every message
+// once the node has crashed, are dropped.
+func (server *Server) deliverMsg(env *consensus.Envelope) {
+	// Closing the transport of a crashed node stops what it receives,
+	// but not what the transport and the workers have queued already.
+	if server.node.Byzantine.hasCrashed() {
+		return
+	}
+	if env.Receiver != "" && env.Receiver != server.node.MyInfo.NodeID {
+		server.node.logger(SubsystemNetwork).Warn("message for another node dropped",
+			"type", env.MsgType, "from", env.Sender, "to", env.Receiver)
+		return
+	}
+	// Clients only send requests, each in its own name.
+	if server.node.Clients[env.Sender] != nil {
+		request, ok := env.Msg.(*consensus.RequestMsg)
+		if env.MsgType != "/request" || !ok || request.ClientID != env.Sender {
+			server.node.logger(SubsystemNetwork).Warn("message from client dropped",
+				"type", env.MsgType, "from", env.Sender)
+			return
 		}
-		var rawMsg consensus.SignatureMsg
-		rawMsg, err, ok := deattachSignatureMsg(message, nodeInfo.PubKey)
-		if err != nil {
-			fmt.Println("[receiveLoop-error]", err)
+	} else if env.MsgType == "/request" {
+		server.node.logger(SubsystemNetwork).Warn("request from a replica dropped", "from", env.Sender)
+		return
+	}
+	handler, ok := server.routes[env.MsgType]
+	if !ok {
+		server.node.logger(SubsystemNetwork).Warn("no route for message", "type", env.MsgType, "from", env.Sender)
+		return
+	}
+	handler(env)
+}
+
+func (server *Server) toMsgEntrance(env *consensus.Envelope) {
+	switch msg := env.Msg.(type) {
+	case *consensus.ReqPrePareMsgs:
+		if msg.PrepareMsg == nil || msg.PrepareMsg.SequenceID == 0 {
+			server.node.logger(SubsystemConsensus).Warn("PREPARE without a sequence dropped", "from", env.Sender)
+			return
 		}
-		if ok == false {
-			fmt.Println("[receiveLoop-error] decoding error")
+	case *consensus.VoteMsg:
+		if msg.SequenceID == 0 {
+			server.node.logger(SubsystemConsensus).Warn("vote without a sequence dropped", "from", env.Sender)
+			return
 		}
-		time.Sleep(time.Millisecond * 150)
-		switch rawMsg.MsgType {
-		case "/prepare":
-			// ReqPrePareMsgs have RequestMsg and PrepareMsg
-			var msg consensus.ReqPrePareMsgs
-			_ = json.Unmarshal(rawMsg.MarshalledMsg, &msg)
-			if msg.PrepareMsg.SequenceID == 0 {
-				fmt.Println("[receiveLoop-error] seq 0 came in")
-				continue
-			}
-			fmt.Println("[EndPrepare] to:",server.node.MyInfo.NodeID,"from:",msg.PrepareMsg.NodeID, "/",time.Now().UnixNano())
-			server.node.MsgEntrance <- &msg
-		case "/vote":
-			var msg consensus.VoteMsg
-			_ = json.Unmarshal(rawMsg.MarshalledMsg, &msg)
-			if msg.SequenceID == 0 {
-				fmt.Println("[receiveLoop-error] seq 0 came in")
-				continue
-			}
-			server.node.MsgEntrance <- &msg
-		case "/collate":
-			var msg consensus.CollateMsg
-			_ = json.Unmarshal(rawMsg.MarshalledMsg, &msg)
-			if msg.SequenceID == 0 {
-				fmt.Println("[receiveLoop-error] seq 0 came in")
-				continue
-			}
-			server.node.MsgEntrance <- &msg
-		/*
-		case "/checkpoint":
-			var msg consensus.CheckPointMsg
-			server.node.MsgEntrance <- &msg
-		 */
-		case "/viewchange":
-			var msg consensus.ViewChangeMsg
-			_ = json.Unmarshal(rawMsg.MarshalledMsg, &msg)
-			server.node.ViewMsgEntrance <- &msg
-		case "/newview":
-			var msg consensus.NewViewMsg
-			_ = json.Unmarshal(rawMsg.MarshalledMsg, &msg)
-			server.node.ViewMsgEntrance <- &msg
+	case *consensus.CollateMsg:
+		if msg.SequenceID == 0 {
+			server.node.logger(SubsystemConsensus).Warn("collate without a sequence dropped", "from", env.Sender)
+			return
 		}
 	}
+	send[interface{}](server.node, server.node.entranceInbox, server.node.MsgEntrance, env.Msg)
+}
+
+func (server *Server) toViewMsgEntrance(env *consensus.Envelope) {
+	send[interface{}](server.node, server.node.entranceInbox, server.node.ViewMsgEntrance, env.Msg)
 }
 
 func (server *Server) sendGenesisMsgIfPrimary() {
 	var sequenceID int64 = 1
 	var seed int = -1
 
-	data := make([]byte, 1 << 20)
-	for i := range data {
-		data[i] = 'A'
-	}
-	data[len(data)-1]=0
+	server.node.updateViewID(sequenceID - 1)
+	server.node.updateEpochID(sequenceID - 1)
+	view := server.node.currentView()
+	primaryNode := server.node.getPrimaryInfoByID(view.ID)
 
-	server.node.updateViewID(sequenceID-1)
-	server.node.updateEpochID(sequenceID-1)
-	primaryNode := server.node.getPrimaryInfoByID(server.node.View.ID)
+	server.node.logger(SubsystemConsensus).Info("primary of the first sequence", "primary", primaryNode.NodeID)
 
-	fmt.Printf("server.node.MyInfo.NodeID: %s\n", server.node.MyInfo.NodeID)
-	fmt.Printf("primaryNode.NodeID: %s\n", primaryNode.NodeID)
-		
 	if primaryNode.NodeID != server.node.MyInfo.NodeID {
 		return
 	}
-	
-	prepareMsg := PrepareMsgMaking("Op1", "Client1", data, 
-		server.node.View.ID,int64(sequenceID),
-		server.node.MyInfo.NodeID, int(seed), server.node.EpochID)
 
-	log.Printf("Broadcasting dummy message from %s, sequenceId: %d, epochId: %d, viewId: %d",
-		server.node.MyInfo.NodeID, sequenceID, server.node.EpochID, server.node.View.ID)
+	prepareMsg := server.node.nextProposal(sequenceID, seed)
 
-	fmt.Println("[StartPrepare]", "seqID",sequenceID, time.Now().UnixNano())
-	time.Sleep(time.Millisecond * 300)
-	server.node.Broadcast(prepareMsg, "/prepare")
-
-}
-
-func broadcast(errCh chan<- error, url string, msg []byte, path string, privKey *ecdsa.PrivateKey) {
-	sigMgsBytes := attachSignatureMsg(msg, privKey, path)
-	url = "ws://" + url +"/prepare" // Fix using url.URL{}
-
-	c, _, err := websocket.DefaultDialer.Dial(url, nil)
-	if err != nil {
-		errCh <- err
+	server.node.logger(SubsystemConsensus).Info("proposing",
+		"epoch", atomic.LoadInt64(&server.node.EpochID), "view", view.ID, "seq", sequenceID, "phase", phasePrepare)
+	if !server.node.sleep(time.Duration(server.node.Config.GenesisDelay)) {
 		return
 	}
-	err = c.WriteMessage(websocket.TextMessage, sigMgsBytes)
-	if err != nil {
-		errCh <- err
-		return
-	}
-	defer c.Close()
-	errCh <- nil
-}
-func attachSignatureMsg(msg []byte, privKey *ecdsa.PrivateKey, path string) []byte {
-	var sigMgs consensus.SignatureMsg
-	r,s,signature, err:=consensus.Sign(privKey, msg)
-	if err == nil {
-		sigMgs = consensus.SignatureMsg {
-			Signature: signature,
-			R: r,
-			S: s,
-			MarshalledMsg: msg,
-			MsgType: path,
-		}
-	}
-	sigMgsBytes, _ := json.Marshal(&sigMgs)
-	return sigMgsBytes
-}
+	server.node.broadcastPrepare(prepareMsg)
 
-func deattachSignatureMsg(msg []byte, pubkey *ecdsa.PublicKey)(consensus.SignatureMsg,
-		error, bool){
-	var sigMgs consensus.SignatureMsg
-	err := json.Unmarshal(msg, &sigMgs)
-	ok := false
-	if err != nil {
-		//log.Println("dettachSignature error ", err)
-		return sigMgs, err, false
-	}
-	ok = consensus.Verify(pubkey, sigMgs.R, sigMgs.S, sigMgs.MarshalledMsg)
-	return sigMgs, nil, ok
 }
 
-func PrepareMsgMaking(operation string, clientID string, data []byte, 
-	viewID int64, sID int64, nodeID string, Seed int, epochID int64) *consensus.ReqPrePareMsgs {
+func PrepareMsgMaking(operation string, clientID string, data []byte,
+	viewID int64, sID int64, nodeID string, Seed int, epochID int64, now time.Time) *consensus.ReqPrePareMsgs {
 	var RequestMsg consensus.RequestMsg
-	RequestMsg.Timestamp = time.Now().UnixNano()
+	RequestMsg.Timestamp = now.UnixNano()
 	RequestMsg.Operation = operation
 	RequestMsg.ClientID = clientID
 	RequestMsg.Data = string(data)
 	RequestMsg.SequenceID = sID
-	
-	digest, err := consensus.Digest(RequestMsg)
 
-	if err != nil {
-		fmt.Println(err)
-	}
+	return PrepareMsgFor(&RequestMsg, viewID, sID, nodeID, Seed, epochID)
+}
+
+// PrepareMsgFor returns the PREPARE message of request in sequence sID.
+func PrepareMsgFor(RequestMsg *consensus.RequestMsg,
+	viewID int64, sID int64, nodeID string, Seed int, epochID int64) *consensus.ReqPrePareMsgs {
+	// A request always encodes.
+	digest, _ := consensus.Digest(RequestMsg)
 
 	var PrepareMsg consensus.PrepareMsg
 	PrepareMsg.ViewID = viewID
@@ -270,10 +326,10 @@ func PrepareMsgMaking(operation string, clientID string, data []byte,
 	PrepareMsg.Digest = digest
 	PrepareMsg.EpochID = epochID
 	PrepareMsg.NodeID = nodeID
-	PrepareMsg.Seed= Seed
+	PrepareMsg.Seed = Seed
 
 	var ReqPrePareMsgs consensus.ReqPrePareMsgs
-	ReqPrePareMsgs.RequestMsg = &RequestMsg
+	ReqPrePareMsgs.RequestMsg = RequestMsg
 	ReqPrePareMsgs.PrepareMsg = &PrepareMsg
 
 	return &ReqPrePareMsgs
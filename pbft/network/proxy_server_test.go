@@ -0,0 +1,23 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+func TestDeliverMsgStopsOnCrash(t *testing.T) {
+	delivered := 0
+	server := &Server{
+		node:   &Node{MyInfo: &NodeInfo{NodeID: "Node1"}, Byzantine: &Byzantine{CrashAfter: 1}},
+		routes: map[string]func(env *consensus.Envelope){"/vote": func(*consensus.Envelope) { delivered++ }},
+	}
+	env := &consensus.Envelope{MsgType: "/vote", Sender: "Node2", Msg: &consensus.VoteMsg{NodeID: "Node2"}}
+
+	server.deliverMsg(env)
+	server.node.Byzantine.crashed = 1
+	server.deliverMsg(env)
+	if delivered != 1 {
+		t.Errorf("%d messages delivered, want 1 before the crash", delivered)
+	}
+}
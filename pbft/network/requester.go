@@ -0,0 +1,295 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/gorilla/websocket"
+)
+
+// Requester is a client of the replicas. It connects to the hub of
+// every replica, signs each request and sends it to all of them, and
+// hands back the reply once f+1 replicas agree on its result. The
+// replicas must know the key of the client, see Config.Clients.
+type Requester struct {
+	clientID string
+	signer   consensus.Signer
+	nodes    map[string]*NodeInfo
+	order    []*NodeInfo
+	quorum   int // f+1
+	wire     wireOptions
+
+	conns []*requesterConn
+
+	mu        sync.Mutex
+	pending   map[int64]*pendingRequest // by timestamp
+	lastStamp int64
+}
+
+// requesterConn is the connection of a requester to one replica. As
+// with a peer, requests are queued and written by a goroutine of their
+// own, so a replica that cannot keep up does not hold back the others.
+type requesterConn struct {
+	nodeID string
+	log    *slog.Logger
+	conn   *websocket.Conn
+	codec  consensus.Codec
+	send   chan *outboundMsg
+	done   chan struct{} // closed when the connection breaks
+	once   sync.Once
+}
+
+// pendingRequest collects the replies to a request.
+type pendingRequest struct {
+	results map[string]map[string]bool // replicas by result
+	done    chan *consensus.ReplyMsg
+}
+
+// NewRequester returns the requester of clientID, which signs with
+// signer, for the replicas of nodeTable.
+func NewRequester(clientID string, signer consensus.Signer, nodeTable []*NodeInfo) *Requester {
+	r := &Requester{
+		clientID: clientID,
+		signer:   signer,
+		nodes:    make(map[string]*NodeInfo),
+		order:    nodeTable,
+		quorum:   (len(nodeTable)-1)/3 + 1,
+		pending:  make(map[int64]*pendingRequest),
+		wire: wireOptions{
+			codec: consensus.BinaryCodec,
+			log:   NewLogging(os.Stderr, false, slog.LevelInfo).Logger(SubsystemNetwork),
+		},
+	}
+	for _, nodeInfo := range nodeTable {
+		r.nodes[nodeInfo.NodeID] = nodeInfo
+	}
+	return r
+}
+
+// EnableTLS makes the requester connect over wss:// with the
+// certificate certPEM of its key, issued by the CA of caPEM.
+func (r *Requester) EnableTLS(caPEM []byte, certPEM []byte) error {
+	identity, err := NewTLSIdentity(caPEM, certPEM, r.signer, r.order)
+	if err != nil {
+		return err
+	}
+	r.wire.identity = identity
+	return nil
+}
+
+// SetCodec sets the wire codec the requester prefers, binary by
+// default. Replicas may pick another one.
+func (r *Requester) SetCodec(name string) error {
+	codec, err := consensus.CodecByName(name)
+	if err != nil {
+		return err
+	}
+	r.wire.codec = codec
+	return nil
+}
+
+// Quorum returns the number of replicas that have to agree on a reply.
+func (r *Requester) Quorum() int {
+	return r.quorum
+}
+
+// Connect dials every replica and returns the ones it could not reach.
+// Requests go to the replicas connected.
+func (r *Requester) Connect() []error {
+	var errs []error
+	for _, nodeInfo := range r.order {
+		conn, codec, err := dialHub(context.Background(), nodeInfo, "/prepare", r.clientID, r.wire)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", nodeInfo.NodeID, err))
+			continue
+		}
+		c := &requesterConn{
+			nodeID: nodeInfo.NodeID,
+			log:    r.wire.log,
+			conn:   conn,
+			codec:  codec,
+			send:   make(chan *outboundMsg, peerSendQueueSize),
+			done:   make(chan struct{}),
+		}
+		r.conns = append(r.conns, c)
+		go r.readReplies(c)
+		go c.writeLoop()
+	}
+	return errs
+}
+
+// Submit sends a request to every replica connected, without waiting
+// for it to be written. It returns the timestamp of the request, which
+// tells it apart, and a channel that gets the reply f+1 replicas agree on.
+// A replica whose queue is full misses the request.
+func (r *Requester) Submit(operation string, data []byte) (int64, <-chan *consensus.ReplyMsg, error) {
+	r.mu.Lock()
+	timestamp := time.Now().UnixNano()
+	if timestamp <= r.lastStamp {
+		timestamp = r.lastStamp + 1
+	}
+	r.lastStamp = timestamp
+	request := &pendingRequest{
+		results: make(map[string]map[string]bool),
+		done:    make(chan *consensus.ReplyMsg, 1),
+	}
+	r.pending[timestamp] = request
+	r.mu.Unlock()
+
+	msg := &consensus.RequestMsg{
+		Timestamp: timestamp,
+		ClientID:  r.clientID,
+		Operation: operation,
+		Data:      string(data),
+	}
+	env, err := consensus.NewEnvelope("/request", r.clientID, msg)
+	if err == nil {
+		err = env.Sign(r.signer)
+	}
+	if err != nil {
+		r.Forget(timestamp)
+		return 0, nil, err
+	}
+
+	outbound := &outboundMsg{env: env}
+	sent := 0
+	for _, c := range r.conns {
+		if c.enqueue(outbound) {
+			sent++
+		}
+	}
+	if sent == 0 {
+		r.Forget(timestamp)
+		return 0, nil, errors.New("no replica connected")
+	}
+	return timestamp, request.done, nil
+}
+
+// Forget stops waiting for the replies to the request of timestamp.
+func (r *Requester) Forget(timestamp int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, timestamp)
+}
+
+// Close closes the connections to the replicas.
+func (r *Requester) Close() {
+	for _, c := range r.conns {
+		c.close()
+	}
+}
+
+// enqueue never blocks. It returns false if msg is dropped, because the
+// connection broke or the queue is full.
+func (c *requesterConn) enqueue(msg *outboundMsg) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *requesterConn) writeLoop() {
+	for {
+		select {
+		case msg := <-c.send:
+			data, err := msg.encode(c.codec)
+			if err != nil {
+				c.log.Warn("cannot encode request", "peer", c.nodeID, "err", err)
+				continue
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(peerWriteWait))
+			if err := c.conn.WriteMessage(frameType(c.codec), data); err != nil {
+				c.log.Warn("cannot send request", "peer", c.nodeID, "err", err)
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *requesterConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// readReplies reads the replies of one replica until the connection
+// breaks. Pings from the hub are answered while reading.
+func (r *Requester) readReplies(c *requesterConn) {
+	defer c.close()
+	c.conn.SetReadLimit(maxMessageSize)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		env, err := c.codec.Unmarshal(data)
+		if err != nil {
+			c.log.Warn("undecodable message", "from", c.nodeID, "err", err)
+			continue
+		}
+		reply, err := r.verifyReply(env)
+		if err != nil {
+			c.log.Warn("reply dropped", "from", c.nodeID, "err", err)
+			continue
+		}
+		r.gotReply(reply)
+	}
+}
+
+// verifyReply checks that env is a reply to this client, signed by
+// the replica that sends it.
+func (r *Requester) verifyReply(env *consensus.Envelope) (*consensus.ReplyMsg, error) {
+	reply, ok := env.Msg.(*consensus.ReplyMsg)
+	if env.MsgType != "/reply" || !ok {
+		return nil, fmt.Errorf("unexpected %s message", env.MsgType)
+	}
+	sender := r.nodes[env.Sender]
+	if sender == nil || reply.NodeID != env.Sender {
+		return nil, fmt.Errorf("reply from unknown replica %q", env.Sender)
+	}
+	if env.Scheme != sender.PubKey.Scheme() || !sender.PubKey.Verify(env.SigningBytes(), env.Signature) {
+		return nil, errors.New("invalid signature")
+	}
+	if reply.ClientID != r.clientID {
+		return nil, fmt.Errorf("reply for %s", reply.ClientID)
+	}
+	return reply, nil
+}
+
+// gotReply counts reply and hands it over once f+1 replicas sent the
+// same result.
+func (r *Requester) gotReply(reply *consensus.ReplyMsg) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	request := r.pending[reply.Timestamp]
+	if request == nil {
+		return
+	}
+	replicas := request.results[reply.Result]
+	if replicas == nil {
+		replicas = make(map[string]bool)
+		request.results[reply.Result] = replicas
+	}
+	replicas[reply.NodeID] = true
+	if len(replicas) >= r.quorum {
+		delete(r.pending, reply.Timestamp)
+		request.done <- reply
+	}
+}
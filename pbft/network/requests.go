@@ -0,0 +1,183 @@
+package network
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Clients sign their requests and send them to every replica on
+// /request, since the primary changes with every sequence. Each replica
+// queues them, and the primary of the next sequence proposes the oldest
+// one. Once a sequence executes, every replica replies to its client on
+// /reply; the client takes the result f+1 replicas agree on. Without
+// a client request waiting, the primary proposes a filler request, so
+// the sequences keep going as they did before there were clients.
+// Backups take the request in a PREPARE as the primary sent it; they
+// do not check that its client signed it.
+
+const (
+	// Client requests a replica queues; it drops new ones beyond.
+	requestQueueSize = 10000
+
+	// Replies remembered, to answer a request sent again, and to
+	// reply only once to a request proposed twice.
+	repliesKept = 1 << 14
+)
+
+// A request is told apart by its client and its timestamp.
+type requestKey struct {
+	clientID  string
+	timestamp int64
+}
+
+func keyOf(request *consensus.RequestMsg) requestKey {
+	return requestKey{clientID: request.ClientID, timestamp: request.Timestamp}
+}
+
+// RequestQueue keeps the client requests not proposed yet, oldest
+// first, and the replies to the requests executed.
+type RequestQueue struct {
+	mu      sync.Mutex
+	waiting map[requestKey]*consensus.RequestMsg
+	order   []requestKey // may hold requests no longer waiting
+
+	replies    map[requestKey]*consensus.ReplyMsg
+	replyOrder []requestKey
+	nextReply  int
+}
+
+func NewRequestQueue() *RequestQueue {
+	return &RequestQueue{
+		waiting: make(map[requestKey]*consensus.RequestMsg),
+		replies: make(map[requestKey]*consensus.ReplyMsg),
+	}
+}
+
+// add queues request unless it is queued already. It returns the reply
+// instead if the request was executed.
+func (queue *RequestQueue) add(request *consensus.RequestMsg) (*consensus.ReplyMsg, error) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	key := keyOf(request)
+	if reply, ok := queue.replies[key]; ok {
+		return reply, nil
+	}
+	if _, ok := queue.waiting[key]; ok {
+		return nil, nil
+	}
+	if len(queue.waiting) >= requestQueueSize {
+		return nil, fmt.Errorf("request queue full, dropped request %d of %s", request.Timestamp, request.ClientID)
+	}
+	queue.waiting[key] = request
+	queue.order = append(queue.order, key)
+	return nil, nil
+}
+
+// next takes the oldest request waiting, nil if there is none.
+func (queue *RequestQueue) next() *consensus.RequestMsg {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	for len(queue.order) > 0 {
+		key := queue.order[0]
+		queue.order = queue.order[1:]
+		if request, ok := queue.waiting[key]; ok {
+			delete(queue.waiting, key)
+			return request
+		}
+	}
+	return nil
+}
+
+// remove drops request, proposed by another replica.
+func (queue *RequestQueue) remove(request *consensus.RequestMsg) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	delete(queue.waiting, keyOf(request))
+	if len(queue.waiting) == 0 {
+		queue.order = queue.order[:0]
+	}
+}
+
+// executed records the reply to request. It returns false if the
+// request was executed before, in an earlier sequence.
+func (queue *RequestQueue) executed(request *consensus.RequestMsg, reply *consensus.ReplyMsg) bool {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	key := keyOf(request)
+	delete(queue.waiting, key)
+	if _, ok := queue.replies[key]; ok {
+		return false
+	}
+	if len(queue.replyOrder) < repliesKept {
+		queue.replyOrder = append(queue.replyOrder, key)
+	} else {
+		delete(queue.replies, queue.replyOrder[queue.nextReply])
+		queue.replyOrder[queue.nextReply] = key
+		queue.nextReply = (queue.nextReply + 1) % repliesKept
+	}
+	queue.replies[key] = reply
+	return true
+}
+
+// Len returns the number of requests waiting.
+func (queue *RequestQueue) Len() int {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.waiting)
+}
+
+// GetRequest queues a request of a client, or replies again if it was
+// executed already.
+func (node *Node) GetRequest(request *consensus.RequestMsg) {
+	reply, err := node.Requests.add(request)
+	if err != nil {
+		node.reportErrors([]error{err})
+		return
+	}
+	if reply != nil {
+		node.SendTo(request.ClientID, reply, "/reply")
+	}
+}
+
+// nextProposal returns the PREPARE of sequenceID, for the oldest client
+// request waiting or for a filler request.
+func (node *Node) nextProposal(sequenceID int64, seed int) *consensus.ReqPrePareMsgs {
+	view, epochID := node.currentView(), atomic.LoadInt64(&node.EpochID)
+	if request := node.Requests.next(); request != nil {
+		proposal := *request
+		proposal.SequenceID = sequenceID
+		return PrepareMsgFor(&proposal, view.ID, sequenceID, node.MyInfo.NodeID, seed, epochID)
+	}
+
+	data := make([]byte, node.Config.FillerSize)
+	for i := range data {
+		data[i] = 'A'
+	}
+	data[len(data)-1] = 0
+	return PrepareMsgMaking("Op1", "", data, view.ID, sequenceID,
+		node.MyInfo.NodeID, seed, epochID, node.Clock.Now())
+}
+
+// reply answers the client of the request prepareMsg ordered, once it
+// is executed. Operations are not carried out yet; the result is the sequence.
+func (node *Node) reply(prepareMsg *consensus.PrepareMsg) {
+	request := node.Payloads.Get(prepareMsg.Digest)
+	if request == nil || node.Clients[request.ClientID] == nil {
+		return
+	}
+	reply := &consensus.ReplyMsg{
+		ViewID:    prepareMsg.ViewID,
+		Timestamp: request.Timestamp,
+		ClientID:  request.ClientID,
+		NodeID:    node.MyInfo.NodeID,
+		Result:    strconv.FormatInt(prepareMsg.SequenceID, 10),
+	}
+	if !node.Requests.executed(request, reply) {
+		return
+	}
+	node.SendTo(request.ClientID, reply, "/reply")
+}
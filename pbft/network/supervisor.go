@@ -0,0 +1,193 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Each Peer supervises its own connection. It dials lazily, when the
+// first message for the peer is queued, and after a failure waits with
+// jittered exponential backoff before dialing again. Nodes can thus be
+// started in any order and survive peers restarting.
+
+const (
+	// Backoff after the first failure; it doubles with every further one.
+	peerBackoffBase = 100 * time.Millisecond
+
+	// Upper bound of the backoff.
+	peerBackoffMax = 10 * time.Second
+
+	// After the first failure, only every this many are reported.
+	peerReportEvery = 10
+)
+
+// PeerState is the state of the connection to a peer.
+type PeerState int32
+
+const (
+	PeerIdle         PeerState = iota // never dialed
+	PeerConnecting                    // dialing
+	PeerConnected                     // connected
+	PeerDisconnected                  // closed by the peer, dial again on next message
+	PeerBackoff                       // waiting to dial again after a failure
+)
+
+func (state PeerState) String() string {
+	switch state {
+	case PeerIdle:
+		return "idle"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerBackoff:
+		return "backoff"
+	}
+	return fmt.Sprintf("PeerState(%d)", int32(state))
+}
+
+// PeerStatus describes the connection to a peer.
+type PeerStatus struct {
+	NodeID    string    `json:"nodeID"`
+	State     PeerState `json:"-"`
+	StateName string    `json:"state"`
+	Since     time.Time `json:"since"`
+	Failures  int       `json:"failures"` // consecutive, reset on connect
+	LastError string    `json:"lastError,omitempty"`
+	Queued    int       `json:"queued"`
+}
+
+// Status returns the current state of the connection.
+func (peer *Peer) Status() PeerStatus {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	status := PeerStatus{
+		NodeID:    peer.Info.NodeID,
+		State:     peer.state,
+		StateName: peer.state.String(),
+		Since:     peer.since,
+		Failures:  peer.failures,
+		Queued:    len(peer.send),
+	}
+	if peer.lastErr != nil {
+		status.LastError = peer.lastErr.Error()
+	}
+	return status
+}
+
+// Statuses returns the status of every peer, in node table order.
+func (set *PeerSet) Statuses() []PeerStatus {
+	statuses := make([]PeerStatus, len(set.order))
+	for i, peer := range set.order {
+		statuses[i] = peer.Status()
+	}
+	return statuses
+}
+
+func (peer *Peer) setState(state PeerState) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.state = state
+	peer.since = time.Now()
+}
+
+// connect dials the peer until ctx is done. It is only called by the
+// writer goroutine.
+func (peer *Peer) connect(ctx context.Context) error {
+	peer.setState(PeerConnecting)
+	conn, codec, err := dialHub(ctx, peer.Info, "/prepare", peer.myID, peer.wire)
+	if err != nil {
+		return err
+	}
+	peer.conn, peer.codec = conn, codec
+	peer.connClosed = make(chan struct{})
+	go peer.discardInbound(conn, peer.connClosed)
+
+	peer.mu.Lock()
+	peer.live = conn
+	if peer.failures > 0 {
+		peer.wire.log.Info("connected", "peer", peer.Info.NodeID, "failures", peer.failures)
+	}
+	peer.state = PeerConnected
+	peer.since = time.Now()
+	peer.failures = 0
+	peer.lastErr = nil
+	peer.mu.Unlock()
+	return nil
+}
+
+// dropConn forgets the current connection, if any.
+func (peer *Peer) dropConn() {
+	if peer.conn != nil {
+		peer.conn.Close()
+		peer.conn = nil
+	}
+	peer.mu.Lock()
+	peer.live = nil
+	peer.mu.Unlock()
+}
+
+// fail records a failed dial or write and waits before the next try.
+func (peer *Peer) fail(err error) {
+	peer.dropConn()
+
+	peer.mu.Lock()
+	peer.failures++
+	failures := peer.failures
+	peer.lastErr = err
+	peer.state = PeerBackoff
+	peer.since = time.Now()
+	peer.mu.Unlock()
+
+	if failures == 1 || failures%peerReportEvery == 0 {
+		peer.report([]error{fmt.Errorf("%s: %v (%d failures)", peer.Info.NodeID, err, failures)})
+	}
+	timer := time.NewTimer(backoffDelay(failures))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-peer.done:
+	}
+}
+
+// backoffDelay returns the wait after the given number of consecutive
+// failures: half of the exponential delay plus a random part of the
+// other half, so that peers do not all dial again at the same time.
+func backoffDelay(failures int) time.Duration {
+	delay := peerBackoffMax
+	if shift := failures - 1; shift < 16 {
+		if d := peerBackoffBase << uint(shift); d < peerBackoffMax {
+			delay = d
+		}
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// discardInbound reads the outbound connection so that pings from the
+// hub are answered. Once it fails, the connection is closed and closed
+// is closed, so that the next write dials again.
+func (peer *Peer) discardInbound(conn *websocket.Conn, closed chan struct{}) {
+	defer func() {
+		conn.Close()
+		close(closed)
+		peer.mu.Lock()
+		if peer.live == conn {
+			peer.live = nil
+			peer.state = PeerDisconnected
+			peer.since = time.Now()
+		}
+		peer.mu.Unlock()
+	}()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
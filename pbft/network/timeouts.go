@@ -0,0 +1,171 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// The phase timers of a sequence follow the time the phases have taken
+// of late, as TCP does its retransmission timer: a moving average of
+// the phase, four times its mean deviation, and Config.AdaptiveTimeouts
+// Margin on top. Until a phase has been seen to end, its timer is the
+// one of Config.PhaseTimeouts. Every view change started while the one
+// before brought no progress doubles the timers, and the next sequence
+// executed sets them back. A phase that ends on its timer is not timed:
+// it took no longer than the timer, which would then only shrink.
+//
+// A view change is timed from the first VIEW-CHANGE to the NEW-VIEW
+// (see GetNewView), and its timer backs off as the others do.
+
+const phaseViewChange = "view-change" // from the first VIEW-CHANGE to the NEW-VIEW
+
+// Phases with a timer, by consensus.NumOfPhase.
+var timedPhases = []string{phasePrepare, phaseVote, phaseCollate, phaseViewChange}
+
+// Phases whose timer follows the time they take.
+var adaptivePhases = []string{phasePrepare, phaseVote, phaseCollate, phaseViewChange}
+
+// Doublings of the timers at most; Max bounds them anyway.
+const maxTimeoutBackoff = 10
+
+// Timeouts are the phase timers of a node. It is safe for concurrent use.
+type Timeouts struct {
+	mu       sync.Mutex
+	adaptive AdaptiveTimeouts
+	phases   map[string]*latencyEstimate
+
+	// View changes started in a row without progress, and the
+	// candidate of the one under way, if any.
+	failures     int
+	viewChanging bool
+	candidate    int64
+}
+
+// latencyEstimate is the moving estimate of the time a phase takes.
+type latencyEstimate struct {
+	initial time.Duration
+	fixed   bool // the timer stays initial
+	mean    time.Duration
+	dev     time.Duration
+	samples uint64
+}
+
+func NewTimeouts(phaseTimeouts PhaseTimeouts, adaptive AdaptiveTimeouts) *Timeouts {
+	timeouts := &Timeouts{adaptive: adaptive, phases: make(map[string]*latencyEstimate)}
+	for phase, initial := range map[string]Duration{
+		phasePrepare:    phaseTimeouts.Prepare,
+		phaseVote:       phaseTimeouts.Vote,
+		phaseCollate:    phaseTimeouts.Collate,
+		phaseViewChange: phaseTimeouts.ViewChange,
+	} {
+		timeouts.phases[phase] = &latencyEstimate{initial: time.Duration(initial), fixed: true}
+	}
+	for _, phase := range adaptivePhases {
+		timeouts.phases[phase].fixed = false
+	}
+	return timeouts
+}
+
+// Get returns the timer of phase.
+func (t *Timeouts) Get(phase string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.get(phase)
+}
+
+func (t *Timeouts) get(phase string) time.Duration {
+	estimate := t.phases[phase]
+	if !t.adaptive.Enabled || estimate.fixed {
+		return estimate.initial
+	}
+	d := estimate.initial
+	if estimate.samples > 0 {
+		d = estimate.mean + 4*estimate.dev + time.Duration(t.adaptive.Margin)
+	}
+	max := time.Duration(t.adaptive.Max)
+	for i := 0; i < t.failures && i < maxTimeoutBackoff && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if min := time.Duration(t.adaptive.Min); d < min {
+		d = min
+	}
+	return d
+}
+
+// observe takes in the time phase took to end on its messages.
+func (t *Timeouts) observe(phase string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	estimate := t.phases[phase]
+	if estimate.fixed {
+		return
+	}
+	if estimate.samples == 0 {
+		estimate.mean = d
+		estimate.dev = d / 2
+	} else {
+		diff := d - estimate.mean
+		estimate.mean += diff / 8
+		if diff < 0 {
+			diff = -diff
+		}
+		estimate.dev += (diff - estimate.dev) / 4
+	}
+	estimate.samples++
+}
+
+// viewChangeStarted takes in a view change to candidate, the node
+// table index of the next primary, and returns whether it is a new one.
+// Sequences that time out together start the same view change, which
+// counts once. A new view change counts as failed if it starts while
+// the one before brought no progress.
+func (t *Timeouts) viewChangeStarted(candidate int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.viewChanging && candidate == t.candidate {
+		return false
+	}
+	if t.viewChanging {
+		t.failures++
+	}
+	t.viewChanging = true
+	t.candidate = candidate
+	return true
+}
+
+// progress resets the backoff once a sequence is executed.
+func (t *Timeouts) progress() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = 0
+	t.viewChanging = false
+}
+
+// Failures returns the view changes in a row that brought no progress.
+func (t *Timeouts) Failures() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.failures
+}
+
+// All returns the timers by phase.
+func (t *Timeouts) All() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	all := make(map[string]time.Duration, len(timedPhases))
+	for _, phase := range timedPhases {
+		all[phase] = t.get(phase)
+	}
+	return all
+}
+
+// phaseEnded times phase of a sequence, which ended on the messages it
+// waited for, and lets its timer follow.
+func (node *Node) phaseEnded(sequenceID int64, phase string, now time.Time) {
+	if d, ok := node.Metrics.phaseDone(sequenceID, phase, now); ok {
+		node.Timeouts.observe(phase, d)
+	}
+}
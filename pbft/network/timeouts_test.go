@@ -0,0 +1,163 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestTimeouts() *Timeouts {
+	return NewTimeouts(PhaseTimeouts{
+		Prepare:    Duration(2 * time.Second),
+		Vote:       Duration(2 * time.Second),
+		Collate:    Duration(2 * time.Second),
+		ViewChange: Duration(20 * time.Second),
+	}, AdaptiveTimeouts{
+		Enabled: true,
+		Margin:  Duration(10 * time.Millisecond),
+		Min:     Duration(50 * time.Millisecond),
+		Max:     Duration(5 * time.Second),
+	})
+}
+
+func TestTimeoutsInitial(t *testing.T) {
+	timeouts := newTestTimeouts()
+	if got := timeouts.Get(phaseVote); got != 2*time.Second {
+		t.Errorf("vote timeout %v before any sample, want the configured 2s", got)
+	}
+
+	timeouts.adaptive.Enabled = false
+	timeouts.observe(phaseVote, 100*time.Millisecond)
+	if got := timeouts.Get(phaseVote); got != 2*time.Second {
+		t.Errorf("vote timeout %v without adaptive timeouts, want the configured 2s", got)
+	}
+}
+
+func TestTimeoutsSmoothing(t *testing.T) {
+	timeouts := newTestTimeouts()
+
+	// The first sample is the mean, with half of it as deviation.
+	timeouts.observe(phaseVote, 100*time.Millisecond)
+	if got, want := timeouts.Get(phaseVote), 100*time.Millisecond+4*50*time.Millisecond+10*time.Millisecond; got != want {
+		t.Errorf("vote timeout %v after one sample, want %v", got, want)
+	}
+
+	// Then the mean moves by 1/8 of the difference and the deviation
+	// by 1/4 of its own: 100ms + 80ms/8, 50ms + (80ms-50ms)/4.
+	timeouts.observe(phaseVote, 180*time.Millisecond)
+	estimate := timeouts.phases[phaseVote]
+	if estimate.mean != 110*time.Millisecond || estimate.dev != 57500*time.Microsecond {
+		t.Errorf("mean %v, deviation %v; want 110ms, 57.5ms", estimate.mean, estimate.dev)
+	}
+
+	// A steady phase converges on its time, the deviation on zero.
+	for i := 0; i < 200; i++ {
+		timeouts.observe(phaseVote, 100*time.Millisecond)
+	}
+	got := timeouts.Get(phaseVote)
+	if got < 110*time.Millisecond || got > 115*time.Millisecond {
+		t.Errorf("vote timeout %v after a steady 100ms, want about 110ms", got)
+	}
+
+	// Other phases keep their own estimate.
+	if got := timeouts.Get(phaseCollate); got != 2*time.Second {
+		t.Errorf("collate timeout %v, want the configured 2s", got)
+	}
+}
+
+func TestTimeoutsClamp(t *testing.T) {
+	timeouts := newTestTimeouts()
+	for i := 0; i < 50; i++ {
+		timeouts.observe(phasePrepare, time.Millisecond)
+	}
+	if got := timeouts.Get(phasePrepare); got != 50*time.Millisecond {
+		t.Errorf("prepare timeout %v for a 1ms phase, want the 50ms minimum", got)
+	}
+	for i := 0; i < 50; i++ {
+		timeouts.observe(phaseCollate, 30*time.Second)
+	}
+	if got := timeouts.Get(phaseCollate); got != 5*time.Second {
+		t.Errorf("collate timeout %v for a 30s phase, want the 5s maximum", got)
+	}
+}
+
+func TestTimeoutsBackoff(t *testing.T) {
+	timeouts := newTestTimeouts()
+	timeouts.observe(phaseVote, 100*time.Millisecond)
+	base := timeouts.Get(phaseVote) // 310ms
+
+	// The first view change is no failure, nor are the sequences that
+	// time out with it.
+	if !timeouts.viewChangeStarted(1) {
+		t.Error("first view change not new")
+	}
+	for i := 0; i < 3; i++ {
+		if timeouts.viewChangeStarted(1) {
+			t.Error("view change to the same candidate counted again")
+		}
+	}
+	if timeouts.Failures() != 0 || timeouts.Get(phaseVote) != base {
+		t.Errorf("%d failures, vote timeout %v after one view change; want 0, %v",
+			timeouts.Failures(), timeouts.Get(phaseVote), base)
+	}
+
+	// Every view change to a new candidate without progress doubles.
+	timeouts.viewChangeStarted(2)
+	timeouts.viewChangeStarted(2)
+	if got := timeouts.Get(phaseVote); timeouts.Failures() != 1 || got != 2*base {
+		t.Errorf("%d failures, vote timeout %v; want 1, %v", timeouts.Failures(), got, 2*base)
+	}
+	timeouts.viewChangeStarted(3)
+	if got := timeouts.Get(phaseVote); timeouts.Failures() != 2 || got != 4*base {
+		t.Errorf("%d failures, vote timeout %v; want 2, %v", timeouts.Failures(), got, 4*base)
+	}
+
+	// Backoff stops at the maximum.
+	for candidate := int64(4); candidate < 20; candidate++ {
+		timeouts.viewChangeStarted(candidate)
+	}
+	if got := timeouts.Get(phaseVote); got != 5*time.Second {
+		t.Errorf("vote timeout %v after many failures, want the 5s maximum", got)
+	}
+}
+
+func TestTimeoutsReset(t *testing.T) {
+	timeouts := newTestTimeouts()
+	timeouts.observe(phaseVote, 100*time.Millisecond)
+	base := timeouts.Get(phaseVote)
+	for candidate := int64(1); candidate <= 3; candidate++ {
+		timeouts.viewChangeStarted(candidate)
+	}
+
+	timeouts.progress()
+	if timeouts.Failures() != 0 || timeouts.Get(phaseVote) != base {
+		t.Errorf("%d failures, vote timeout %v after progress; want 0, %v",
+			timeouts.Failures(), timeouts.Get(phaseVote), base)
+	}
+	// The next view change is a first one again, even to the same candidate.
+	if !timeouts.viewChangeStarted(3) || timeouts.Failures() != 0 {
+		t.Errorf("view change after progress: %d failures, want a new one and 0", timeouts.Failures())
+	}
+}
+
+func TestTimeoutsViewChange(t *testing.T) {
+	timeouts := newTestTimeouts()
+	if got := timeouts.Get(phaseViewChange); got != 5*time.Second {
+		t.Errorf("view-change timeout %v before any sample, want the configured 20s within the 5s maximum", got)
+	}
+
+	timeouts.observe(phaseViewChange, 300*time.Millisecond)
+	base := 300*time.Millisecond + 4*150*time.Millisecond + 10*time.Millisecond
+	if got := timeouts.Get(phaseViewChange); got != base {
+		t.Errorf("view-change timeout %v after one sample, want %v", got, base)
+	}
+
+	// A view change that brings no progress backs it off too.
+	timeouts.viewChangeStarted(1)
+	timeouts.viewChangeStarted(2)
+	if got := timeouts.Get(phaseViewChange); got != 2*base {
+		t.Errorf("view-change timeout %v after a failed view change, want %v", got, 2*base)
+	}
+	if got := timeouts.All()[phaseViewChange]; got != 2*base {
+		t.Errorf("view-change timeout %v in All, want %v", got, 2*base)
+	}
+}
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Replicas talk over mutually authenticated TLS. Key generation creates
+// a local CA and gives every node a certificate for its consensus key,
+// with the node id as subject. A connection is only accepted if the
+// certificate chains to the CA, names a node of the node table and
+// carries the public key listed for that node, so a stolen CA key alone
+// is not enough to impersonate a replica.
+
+// Validity of the certificates made by key generation.
+const certValidity = 10 * 365 * 24 * time.Hour
+
+// TLSIdentity is the certificate a node shows its peers, and the CA
+// and node table it checks theirs against. See Config.TLSIdentity.
+type TLSIdentity struct {
+	roots       *x509.CertPool
+	certificate tls.Certificate
+	nodes       map[string]*NodeInfo
+}
+
+// NewTLSIdentity makes the identity of the node that signs with signer.
+// caPEM is the certificate of the CA, certPEM the certificate of the
+// node for the key of signer, and nodeTable lists the peers that may
+// connect.
+func NewTLSIdentity(caPEM []byte, certPEM []byte, signer consensus.Signer, nodeTable []*NodeInfo) (*TLSIdentity, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no CA certificate found")
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no node certificate found")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !samePublicKey(leaf.PublicKey, signer.Verifier().PublicKey()) {
+		return nil, fmt.Errorf("certificate of %s is not for its consensus key", leaf.Subject.CommonName)
+	}
+
+	identity := &TLSIdentity{
+		roots: roots,
+		certificate: tls.Certificate{
+			Certificate: [][]byte{block.Bytes},
+			PrivateKey:  signer.PrivateKey(),
+			Leaf:        leaf,
+		},
+		nodes: make(map[string]*NodeInfo),
+	}
+	for _, nodeInfo := range nodeTable {
+		identity.nodes[nodeInfo.NodeID] = nodeInfo
+	}
+	return identity, nil
+}
+
+// serverConfig requires a certificate from every peer that connects.
+func (identity *TLSIdentity) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{identity.certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    identity.roots,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, err := identity.verifyPeer(cs, "")
+			return err
+		},
+	}
+}
+
+// clientConfig accepts only the certificate of nodeID.
+func (identity *TLSIdentity) clientConfig(nodeID string) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{identity.certificate},
+		RootCAs:      identity.roots,
+		ServerName:   nodeID,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, err := identity.verifyPeer(cs, nodeID)
+			return err
+		},
+	}
+}
+
+// verifyPeer checks the verified certificate of a peer against the node
+// table and returns the id of the peer. If want is set, the peer must be want.
+func (identity *TLSIdentity) verifyPeer(cs tls.ConnectionState, want string) (string, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return "", errors.New("peer sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	nodeID := leaf.Subject.CommonName
+	nodeInfo := identity.nodes[nodeID]
+	if nodeInfo == nil {
+		return "", fmt.Errorf("unknown peer %q", nodeID)
+	}
+	if want != "" && nodeID != want {
+		return "", fmt.Errorf("expected %s, but peer is %s", want, nodeID)
+	}
+	if !samePublicKey(leaf.PublicKey, nodeInfo.PubKey.PublicKey()) {
+		return "", fmt.Errorf("certificate of %s does not match its key in the node table", nodeID)
+	}
+	return nodeID, nil
+}
+
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// NewCA creates the self-signed certificate of a local CA for ca's key.
+func NewCA(ca consensus.Signer) ([]byte, error) {
+	template, err := certTemplate("PA-BFT local CA")
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	return createCertificate(template, template, ca.Verifier().PublicKey(), ca)
+}
+
+// IssueNodeCertificate certifies the consensus key of nodeID with the CA.
+func IssueNodeCertificate(caPEM []byte, ca consensus.Signer, nodeID string,
+	key consensus.Verifier) ([]byte, error) {
+	block, _ := pem.Decode(caPEM)
+	if block == nil {
+		return nil, errors.New("no CA certificate found")
+	}
+	parent, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certTemplate(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	template.DNSNames = []string{nodeID}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+
+	return createCertificate(template, parent, key.PublicKey(), ca)
+}
+
+func certTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+	}, nil
+}
+
+func createCertificate(template *x509.Certificate, parent *x509.Certificate,
+	pub crypto.PublicKey, ca consensus.Signer) ([]byte, error) {
+	caKey, ok := ca.PrivateKey().(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot sign certificates")
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
@@ -0,0 +1,222 @@
+package network
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A trace tells how each sequence unfolded on a node. With -trace a
+// replica writes one JSON line per sequence, once it executes it or
+// gives it up in a view change, and on exit for the sequences still in
+// flight:
+//
+//	pabft -trace /tmp/trace.Node1.jsonl Node1 19
+//
+// Every event of a record carries its time, so the traces of all the
+// replicas merge into one timeline.
+
+// Events of a trace.
+const (
+	TracePrepareSent     = "prepare-sent"
+	TracePrepareReceived = "prepare-received"
+	TraceVoteReceived    = "vote-received"
+	TraceTimerExpired    = "timer-expired" // Phase says which
+	TraceCollateSent     = "collate-sent"
+	TraceCollateReceived = "collate-received"
+	TraceCommit          = "commit" // Rule says why
+	TraceExecute         = "execute"
+	TraceViewChange      = "view-change" // the sequence is given up
+)
+
+// Rules a sequence commits on.
+const (
+	RuleVoteQuorum       = "vote-quorum"       // 2f+1 votes
+	RuleVoteAQ           = "vote-aq"           // adaptive quorum when the vote timer ran out
+	RuleCollateAQ        = "collate-aq"        // adaptive quorum when the collate timer ran out
+	RuleCollateQuorum    = "collate-quorum"    // enough UNCOMMITTED collates
+	RuleCommittedCollate = "committed-collate" // a COMMITTED collate with its votes
+)
+
+// TraceRecord is how a sequence unfolded on a node.
+type TraceRecord struct {
+	NodeID     string       `json:"node"`
+	SequenceID int64        `json:"seq"`
+	Epoch      int64        `json:"epoch"`
+	View       int64        `json:"view"`
+	Digest     string       `json:"digest,omitempty"` // of the request executed
+	Rule       string       `json:"rule,omitempty"`   // the first commit rule that fired
+	Executed   bool         `json:"executed"`
+	Events     []TraceEvent `json:"events"` // in the order they happened
+}
+
+// TraceEvent is a step of a sequence.
+type TraceEvent struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	From   string    `json:"from,omitempty"`   // sender of a message received
+	Type   string    `json:"type,omitempty"`   // of a vote or collate
+	Digest string    `json:"digest,omitempty"` // of a PREPARE or vote
+	Phase  string    `json:"phase,omitempty"`  // of a timer
+	Rule   string    `json:"rule,omitempty"`   // of a commit
+}
+
+// TraceOutput is shared by the tracers of a process; see Config.TraceOutput.
+type TraceOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewTraceOutput returns an output that writes the traces to w.
+func NewTraceOutput(w io.Writer) *TraceOutput {
+	return &TraceOutput{w: w}
+}
+
+// Tracer keeps the records of the sequences of a node until they are
+// written. A nil Tracer traces nothing.
+type Tracer struct {
+	nodeID string
+	out    *TraceOutput
+	log    *slog.Logger
+
+	mu       sync.Mutex
+	records  map[int64]*TraceRecord
+	executed int64 // events of sequences up to this one come too late
+}
+
+func newTracer(nodeID string, out *TraceOutput, log *slog.Logger) *Tracer {
+	if out == nil {
+		return nil
+	}
+	return &Tracer{
+		nodeID:  nodeID,
+		out:     out,
+		log:     log,
+		records: make(map[int64]*TraceRecord),
+	}
+}
+
+// add appends event to the record of a sequence.
+func (t *Tracer) add(sequenceID int64, event TraceEvent) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	record := t.record(sequenceID)
+	if record == nil {
+		return
+	}
+	record.Events = append(record.Events, event)
+	if event.Event == TraceCommit && record.Rule == "" {
+		record.Rule = event.Rule
+	}
+}
+
+// record returns the record of a sequence, nil if it was written.
+func (t *Tracer) record(sequenceID int64) *TraceRecord {
+	if sequenceID <= t.executed {
+		return nil
+	}
+	record, ok := t.records[sequenceID]
+	if !ok {
+		record = &TraceRecord{NodeID: t.nodeID, SequenceID: sequenceID}
+		t.records[sequenceID] = record
+	}
+	return record
+}
+
+// executedSequence writes the record of a sequence executed.
+func (t *Tracer) executedSequence(now time.Time, epoch int64, view int64, digest string, sequenceID int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	record := t.record(sequenceID)
+	if record == nil {
+		t.mu.Unlock()
+		return
+	}
+	record.Epoch, record.View, record.Digest = epoch, view, digest
+	record.Executed = true
+	record.Events = append(record.Events, TraceEvent{Time: now, Event: TraceExecute})
+	delete(t.records, sequenceID)
+	t.executed = sequenceID
+	t.mu.Unlock()
+	t.write(record)
+}
+
+// abandoned writes the record of a sequence given up in a view change.
+// The sequence starts a record anew when it is proposed again.
+func (t *Tracer) abandoned(now time.Time, epoch int64, view int64, sequenceID int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.executed >= sequenceID {
+		// The view change rolled the sequence back.
+		t.executed = sequenceID - 1
+	}
+	record, ok := t.records[sequenceID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	record.Epoch, record.View = epoch, view
+	record.Events = append(record.Events, TraceEvent{Time: now, Event: TraceViewChange})
+	delete(t.records, sequenceID)
+	t.mu.Unlock()
+	t.write(record)
+}
+
+// flush writes the records of the sequences still in flight, as of
+// epoch and view.
+func (t *Tracer) flush(epoch int64, view int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	records := make([]*TraceRecord, 0, len(t.records))
+	for _, record := range t.records {
+		record.Epoch, record.View = epoch, view
+		records = append(records, record)
+	}
+	t.records = make(map[int64]*TraceRecord)
+	t.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].SequenceID < records[j].SequenceID })
+	for _, record := range records {
+		t.write(record)
+	}
+}
+
+func (t *Tracer) write(record *TraceRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	t.out.mu.Lock()
+	defer t.out.mu.Unlock()
+	if _, err := t.out.w.Write(line); err != nil {
+		t.log.Warn("cannot write trace", "node", t.nodeID, "seq", record.SequenceID, "err", err)
+	}
+}
+
+// FlushTrace writes the trace of the sequences in flight, neither
+// executed nor given up yet, e.g. before the node stops.
+func (node *Node) FlushTrace() {
+	node.Trace.flush(atomic.LoadInt64(&node.EpochID), node.currentView().ID)
+}
+
+// trace adds event, at the time of the node, to the trace of a sequence.
+func (node *Node) trace(sequenceID int64, event TraceEvent) {
+	if node.Trace == nil {
+		return
+	}
+	event.Time = node.Clock.Now()
+	node.Trace.add(sequenceID, event)
+}
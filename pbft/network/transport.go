@@ -0,0 +1,177 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Transport moves signed envelopes between the replicas. The node
+// sends through it, and the server verifies what comes out of Inbound
+// and hands it to the node. WebsocketTransport connects replicas over
+// the network; MemoryTransport connects replicas in one process.
+type Transport interface {
+	// Send queues env for nodeID. It does not wait for delivery.
+	Send(nodeID string, env *consensus.Envelope) error
+
+	// Broadcast queues env for every replica, this one included.
+	Broadcast(env *consensus.Envelope) error
+
+	// Inbound returns the messages received, not yet verified. The
+	// channel is not closed; stop reading it after Close.
+	Inbound() <-chan WireMessage
+
+	// Close stops sending and receiving.
+	Close() error
+}
+
+// WireMessage is an envelope as it was received, with its codec.
+type WireMessage struct {
+	Codec consensus.Codec
+	Data  []byte
+}
+
+// errorReporter is implemented by transports that report failures
+// after Send or Broadcast returned, such as a peer that cannot be dialed.
+type errorReporter interface {
+	Errors() <-chan []error
+}
+
+// WebsocketTransport keeps an outbound websocket connection to every
+// replica (see peer.go) and receives on the connections others open to
+// its hub. Handler serves the hub; Start dials the peers.
+type WebsocketTransport struct {
+	peers   *PeerSet
+	hub     *Hub
+	inbound chan WireMessage
+	errors  chan []error
+
+	// The hub is served over TLS if set.
+	identity *TLSIdentity
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWebsocketTransport returns the transport of myInfo, which talks
+// to the replicas of nodeTable as config says: with its codec, inbound
+// policy, send queue and, with TLS, identity.
+func NewWebsocketTransport(myInfo *NodeInfo, nodeTable []*NodeInfo, config *Config) (*WebsocketTransport, error) {
+	config = withLogging(config)
+	codec, err := consensus.CodecByName(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseFlowPolicy(config.Inbound)
+	if err != nil {
+		return nil, err
+	}
+	if config.TLS && config.TLSIdentity == nil {
+		return nil, fmt.Errorf("TLS without the certificate of %s", myInfo.NodeID)
+	}
+	wire := wireOptions{codec: codec, log: config.Logging.Logger(SubsystemNetwork).With("node", myInfo.NodeID)}
+	if config.TLS {
+		wire.identity = config.TLSIdentity
+	}
+	t := &WebsocketTransport{
+		inbound:  make(chan WireMessage, len(nodeTable)*100),
+		errors:   make(chan []error, len(nodeTable)),
+		identity: wire.identity,
+		done:     make(chan struct{}),
+	}
+	t.peers = NewPeerSet(myInfo.NodeID, nodeTable, config.SendQueue, t.errors, wire)
+	t.hub = NewHub(t.deliver, wire, policy, config.InboundLimits, append(nodeTable[:len(nodeTable):len(nodeTable)], config.Clients...))
+	t.peers.attachHub(t.hub)
+	go t.hub.run()
+	return t, nil
+}
+
+// Start runs the writers of the peers. Peers are dialed when the first
+// message for them is queued, and dialed again with backoff until they
+// are up.
+func (t *WebsocketTransport) Start() {
+	t.peers.Start()
+}
+
+// Handler upgrades requests to websocket connections to the hub.
+func (t *WebsocketTransport) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(t.hub, w, r)
+	})
+}
+
+func (t *WebsocketTransport) deliver(codec consensus.Codec, data []byte) {
+	select {
+	case t.inbound <- WireMessage{Codec: codec, Data: data}:
+	case <-t.done:
+	}
+}
+
+func (t *WebsocketTransport) Send(nodeID string, env *consensus.Envelope) error {
+	return t.peers.SendTo(nodeID, env)
+}
+
+func (t *WebsocketTransport) Broadcast(env *consensus.Envelope) error {
+	t.peers.Broadcast(env)
+	return nil
+}
+
+func (t *WebsocketTransport) Inbound() <-chan WireMessage {
+	return t.inbound
+}
+
+func (t *WebsocketTransport) Errors() <-chan []error {
+	return t.errors
+}
+
+// Drain waits until what is queued for the peers that are connected
+// has been written, or ctx is done.
+func (t *WebsocketTransport) Drain(ctx context.Context) error {
+	return t.peers.Drain(ctx)
+}
+
+// Close drops every connection. Queued messages are not sent; see Drain.
+func (t *WebsocketTransport) Close() error {
+	return t.CloseContext(context.Background())
+}
+
+// CloseContext is Close, but waits for the writers of the peers no
+// longer than ctx.
+func (t *WebsocketTransport) CloseContext(ctx context.Context) error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.hub.Close()
+		err = t.peers.Close(ctx)
+	})
+	return err
+}
+
+// Statuses returns the status of the connection to every peer.
+func (t *WebsocketTransport) Statuses() []PeerStatus {
+	return t.peers.Statuses()
+}
+
+// Drops returns the number of messages dropped by flow control.
+func (t *WebsocketTransport) Drops() []DropCount {
+	return t.hub.Drops()
+}
+
+// Traffic returns the number of bytes sent to and received from every peer.
+func (t *WebsocketTransport) Traffic() []PeerTraffic {
+	return t.hub.traffic.all()
+}
+
+// forwardErrors hands the errors of transport to the error logger.
+func (node *Node) forwardErrors(reporter errorReporter) {
+	for {
+		errs, ok := await(node, reporter.Errors())
+		if !ok {
+			return
+		}
+		node.reportErrors(errs)
+	}
+}
@@ -0,0 +1,316 @@
+package network
+
+import (
+	"crypto/sha256"
+	"log/slog"
+	"sync"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// Maximum number of queued messages a worker verifies at once.
+const maxVerifyBatch = 64
+
+// Number of signature results remembered by the verification cache.
+const verifyCacheSize = 1 << 16
+
+// VerifyPool checks the signatures of inbound messages on a pool of
+// workers, between the per-peer socket readers and Node.MsgEntrance.
+// A worker takes every message already queued (up to maxVerifyBatch)
+// and verifies them together, so schemes with batch verification
+// amortize the cost. Messages from one peer may be delivered out of order.
+type VerifyPool struct {
+	jobs    chan *verifyJob
+	cache   *SignatureCache
+	nodes   map[string]*NodeInfo
+	deliver func(env *consensus.Envelope)
+	log     *slog.Logger
+
+	// No workers: Submit verifies on the caller.
+	inline bool
+
+	// Closed by Close, which stops the workers.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// If set, told of the senders of messages that fail verification.
+	suspect func(nodeID string, reason string)
+}
+
+// Inbound message waiting for verification, as read from the wire.
+type verifyJob struct {
+	codec consensus.Codec
+	data  []byte
+}
+
+// One signature check. A message may need several of them,
+// e.g. a COLLATE message and each vote forwarded in it.
+type sigCheck struct {
+	key    [sha256.Size]byte
+	scheme consensus.SignatureScheme
+	data   consensus.SignedData
+	valid  bool
+}
+
+func NewVerifyPool(workers int, nodeTable []*NodeInfo,
+	deliver func(env *consensus.Envelope), log *slog.Logger) *VerifyPool {
+	pool := &VerifyPool{
+		jobs:    make(chan *verifyJob, len(nodeTable)*100),
+		cache:   NewSignatureCache(verifyCacheSize),
+		nodes:   make(map[string]*NodeInfo),
+		deliver: deliver,
+		log:     log,
+		inline:  workers == 0,
+		done:    make(chan struct{}),
+	}
+	for _, nodeInfo := range nodeTable {
+		pool.nodes[nodeInfo.NodeID] = nodeInfo
+	}
+	for i := 0; i < workers; i++ {
+		go pool.worker()
+	}
+	return pool
+}
+
+// Submit queues an encoded envelope. Decoding happens on the workers too.
+// A pool of no workers verifies and delivers it before Submit returns.
+// Once the pool is closed, data is dropped.
+func (pool *VerifyPool) Submit(codec consensus.Codec, data []byte) {
+	if pool.inline {
+		select {
+		case <-pool.done:
+		default:
+			pool.process([]*verifyJob{{codec: codec, data: data}})
+		}
+		return
+	}
+	select {
+	case pool.jobs <- &verifyJob{codec: codec, data: data}:
+	case <-pool.done:
+	}
+}
+
+// Close stops the workers; what is still queued is dropped.
+func (pool *VerifyPool) Close() {
+	pool.closeOnce.Do(func() { close(pool.done) })
+}
+
+func (pool *VerifyPool) worker() {
+	batch := make([]*verifyJob, 0, maxVerifyBatch)
+	for {
+		var job *verifyJob
+		select {
+		case job = <-pool.jobs:
+		case <-pool.done:
+			return
+		}
+		batch = append(batch[:0], job)
+		// Take whatever else is already waiting, without blocking.
+	fill:
+		for len(batch) < maxVerifyBatch {
+			select {
+			case job := <-pool.jobs:
+				batch = append(batch, job)
+			default:
+				break fill
+			}
+		}
+		pool.process(batch)
+	}
+}
+
+func (pool *VerifyPool) process(batch []*verifyJob) {
+	envs := make([]*consensus.Envelope, len(batch))
+	outer := make([]*sigCheck, len(batch))
+	proofs := make([]map[string]*sigCheck, len(batch))
+	var checks []*sigCheck
+
+	for i, job := range batch {
+		env, err := job.codec.Unmarshal(job.data)
+		if err != nil {
+			pool.log.Warn("undecodable message", "err", err)
+			continue
+		}
+		outer[i] = pool.newSigCheck(env)
+		if outer[i] == nil {
+			continue
+		}
+		envs[i] = env
+		checks = append(checks, outer[i])
+
+		// Votes forwarded in a collate carry the signature of their voter.
+		if collateMsg, ok := env.Msg.(*consensus.CollateMsg); ok {
+			proofs[i] = make(map[string]*sigCheck)
+			for nodeID, voteMsg := range collateMsg.ReceivedVoteMsg {
+				if voteMsg == nil || voteMsg.Proof == nil || voteMsg.Proof.Sender != nodeID {
+					continue
+				}
+				if check := pool.newSigCheck(voteMsg.Proof); check != nil {
+					proofs[i][nodeID] = check
+					checks = append(checks, check)
+				}
+			}
+		}
+	}
+
+	pool.verify(checks)
+
+	for i, env := range envs {
+		if env == nil {
+			continue
+		}
+		if !outer[i].valid {
+			pool.log.Warn("invalid signature", "from", env.Sender, "type", env.MsgType)
+			pool.report(env.Sender, suspectSignature)
+			continue
+		}
+		if err := env.CheckAuthor(); err != nil {
+			pool.log.Warn("message in the name of another node", "err", err)
+			pool.report(env.Sender, suspectImpersonation)
+			continue
+		}
+		if collateMsg, ok := env.Msg.(*consensus.CollateMsg); ok {
+			forwarded := len(collateMsg.ReceivedVoteMsg)
+			collateMsg.ReceivedVoteMsg = verifiedVotes(collateMsg.ReceivedVoteMsg, proofs[i])
+			if len(collateMsg.ReceivedVoteMsg) < forwarded {
+				pool.report(env.Sender, suspectForwardedVote)
+			}
+		}
+		// Remember the signed form of a vote, to be forwarded in collates.
+		if voteMsg, ok := env.Msg.(*consensus.VoteMsg); ok {
+			voteMsg.Proof = env
+		}
+		pool.deliver(env)
+	}
+}
+
+func (pool *VerifyPool) report(nodeID string, reason string) {
+	if pool.suspect != nil {
+		pool.suspect(nodeID, reason)
+	}
+}
+
+// verify fills in the result of each check, consulting the cache first
+// and batching the remaining checks by scheme.
+func (pool *VerifyPool) verify(checks []*sigCheck) {
+	pending := make(map[consensus.SignatureScheme][]*sigCheck)
+	for _, check := range checks {
+		if valid, ok := pool.cache.get(check.key); ok {
+			check.valid = valid
+			continue
+		}
+		pending[check.scheme] = append(pending[check.scheme], check)
+	}
+
+	for scheme, group := range pending {
+		items := make([]consensus.SignedData, len(group))
+		for i, check := range group {
+			items[i] = check.data
+		}
+		if consensus.VerifyBatch(scheme, items) {
+			for _, check := range group {
+				check.valid = true
+			}
+		} else {
+			for _, check := range group {
+				check.valid = check.data.Verifier.Verify(check.data.Data, check.data.Signature)
+			}
+		}
+		for _, check := range group {
+			pool.cache.put(check.key, check.valid)
+		}
+	}
+}
+
+// newSigCheck prepares the check of an envelope against the key of its
+// sender. It returns nil if the sender is unknown or signs with another
+// scheme than the one in the envelope.
+func (pool *VerifyPool) newSigCheck(env *consensus.Envelope) *sigCheck {
+	sender := pool.nodes[env.Sender]
+	if sender == nil {
+		pool.log.Warn("message from unknown node", "from", env.Sender)
+		return nil
+	}
+	if env.Scheme != sender.PubKey.Scheme() {
+		pool.log.Warn("message signed with another scheme than the sender's key",
+			"from", env.Sender, "scheme", env.Scheme, "keyScheme", sender.PubKey.Scheme())
+		return nil
+	}
+
+	signingBytes := env.SigningBytes()
+	h := sha256.New()
+	h.Write([]byte(env.Signature))
+	h.Write(signingBytes)
+
+	check := &sigCheck{
+		scheme: env.Scheme,
+		data: consensus.SignedData{
+			Verifier:  sender.PubKey,
+			Data:      signingBytes,
+			Signature: env.Signature,
+		},
+	}
+	copy(check.key[:], h.Sum(nil))
+	return check
+}
+
+// verifiedVotes keeps the forwarded votes whose proof is valid, replacing
+// each with the vote exactly as its voter signed it.
+func verifiedVotes(votes map[string]*consensus.VoteMsg,
+	proofs map[string]*sigCheck) map[string]*consensus.VoteMsg {
+	verified := make(map[string]*consensus.VoteMsg)
+	for nodeID, voteMsg := range votes {
+		check := proofs[nodeID]
+		if check == nil || !check.valid {
+			continue
+		}
+		signedVote, ok := voteMsg.Proof.Msg.(*consensus.VoteMsg)
+		if !ok || signedVote.NodeID != nodeID {
+			continue
+		}
+		signedVote.Proof = voteMsg.Proof
+		verified[nodeID] = signedVote
+	}
+	return verified
+}
+
+// SignatureCache remembers recent verification results so that a signature,
+// such as a vote seen directly and again inside a collate, is only
+// verified once. The oldest entry is evicted first. Replicas in one
+// process with the same node table may share one, see Config.
+type SignatureCache struct {
+	mu      sync.Mutex
+	results map[[sha256.Size]byte]bool
+	order   [][sha256.Size]byte
+	next    int
+}
+
+func NewSignatureCache(size int) *SignatureCache {
+	return &SignatureCache{
+		results: make(map[[sha256.Size]byte]bool, size),
+		order:   make([][sha256.Size]byte, 0, size),
+	}
+}
+
+func (c *SignatureCache) get(key [sha256.Size]byte) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	valid, ok := c.results[key]
+	return valid, ok
+}
+
+func (c *SignatureCache) put(key [sha256.Size]byte, valid bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.results[key]; ok {
+		return
+	}
+	if len(c.order) < cap(c.order) {
+		c.order = append(c.order, key)
+	} else {
+		delete(c.results, c.order[c.next])
+		c.order[c.next] = key
+		c.next = (c.next + 1) % len(c.order)
+	}
+	c.results[key] = valid
+}
@@ -0,0 +1,159 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// countingVerifier counts the signatures it checks one by one.
+type countingVerifier struct {
+	consensus.Verifier
+	calls *int64
+}
+
+func (v countingVerifier) Verify(data, signature []byte) bool {
+	atomic.AddInt64(v.calls, 1)
+	return v.Verifier.Verify(data, signature)
+}
+
+type verifyPoolTest struct {
+	pool      *VerifyPool
+	signers   map[string]consensus.Signer
+	calls     int64
+	delivered []*consensus.Envelope
+	suspects  map[string][]string
+}
+
+// newVerifyPoolTest returns a pool of no workers for n replicas, which
+// the test drives by calling process or Submit.
+func newVerifyPoolTest(t *testing.T, n int) *verifyPoolTest {
+	t.Helper()
+	vt := &verifyPoolTest{signers: make(map[string]consensus.Signer), suspects: make(map[string][]string)}
+	var nodeTable []*NodeInfo
+	for i := 1; i <= n; i++ {
+		signer, err := consensus.GenerateSigner(consensus.SchemeEd25519)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodeID := fmt.Sprintf("Node%d", i)
+		vt.signers[nodeID] = signer
+		nodeTable = append(nodeTable, &NodeInfo{
+			NodeID: nodeID,
+			PubKey: countingVerifier{Verifier: signer.Verifier(), calls: &vt.calls},
+		})
+	}
+	vt.pool = NewVerifyPool(0, nodeTable, func(env *consensus.Envelope) {
+		vt.delivered = append(vt.delivered, env)
+	}, NewLogging(io.Discard, false, slog.LevelInfo).Logger(SubsystemNetwork))
+	vt.pool.suspect = func(nodeID string, reason string) {
+		vt.suspects[nodeID] = append(vt.suspects[nodeID], reason)
+	}
+	return vt
+}
+
+// job returns the encoded vote of author, sent and signed by sender.
+func (vt *verifyPoolTest) job(t *testing.T, sender string, author string) *verifyJob {
+	t.Helper()
+	vote := &consensus.VoteMsg{ViewID: 1, SequenceID: 1, Digest: "digest", NodeID: author}
+	env, err := consensus.NewEnvelope("/vote", sender, vote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Sign(vt.signers[sender]); err != nil {
+		t.Fatal(err)
+	}
+	data, err := consensus.BinaryCodec.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &verifyJob{codec: consensus.BinaryCodec, data: data}
+}
+
+func (vt *verifyPoolTest) deliveredFrom() []string {
+	var senders []string
+	for _, env := range vt.delivered {
+		senders = append(senders, env.Sender)
+	}
+	return senders
+}
+
+func TestVerifyPoolBadSignatureInBatch(t *testing.T) {
+	vt := newVerifyPoolTest(t, 4)
+	batch := []*verifyJob{
+		vt.job(t, "Node1", "Node1"),
+		vt.job(t, "Node2", "Node2"),
+		vt.job(t, "Node3", "Node3"),
+	}
+	// Flip a bit of the signature at the end of Node2's envelope.
+	batch[1].data[len(batch[1].data)-1] ^= 1
+
+	vt.pool.process(batch)
+
+	if got := vt.deliveredFrom(); fmt.Sprint(got) != "[Node1 Node3]" {
+		t.Errorf("delivered from %v, want [Node1 Node3]", got)
+	}
+	if len(vt.suspects) != 1 || fmt.Sprint(vt.suspects["Node2"]) != "["+suspectSignature+"]" {
+		t.Errorf("suspects %v, want Node2 for %s", vt.suspects, suspectSignature)
+	}
+	// The batch failed, so every signature was checked on its own.
+	if vt.calls != 3 {
+		t.Errorf("%d signatures checked one by one, want 3", vt.calls)
+	}
+}
+
+func TestVerifyPoolWithoutWorkersSubmitsInline(t *testing.T) {
+	vt := newVerifyPoolTest(t, 4)
+	job := vt.job(t, "Node1", "Node1")
+
+	vt.pool.Submit(job.codec, job.data)
+	if got := vt.deliveredFrom(); fmt.Sprint(got) != "[Node1]" {
+		t.Errorf("delivered from %v on Submit, want [Node1]", got)
+	}
+	vt.pool.Close()
+	vt.pool.Submit(job.codec, job.data)
+	if len(vt.delivered) != 1 {
+		t.Errorf("%d messages delivered after Close, want 1", len(vt.delivered))
+	}
+}
+
+func TestVerifyPoolCachesResults(t *testing.T) {
+	vt := newVerifyPoolTest(t, 4)
+	good := vt.job(t, "Node1", "Node1")
+	bad := vt.job(t, "Node2", "Node2")
+	bad.data[len(bad.data)-1] ^= 1
+
+	vt.pool.process([]*verifyJob{good})
+	vt.pool.process([]*verifyJob{bad})
+	checked := vt.calls
+	for i := 0; i < 2; i++ {
+		vt.pool.process([]*verifyJob{good})
+		vt.pool.process([]*verifyJob{bad})
+	}
+	if vt.calls != checked {
+		t.Errorf("%d signatures checked again, want none", vt.calls-checked)
+	}
+	if len(vt.delivered) != 3 {
+		t.Errorf("%d messages delivered, want 3", len(vt.delivered))
+	}
+	if len(vt.suspects["Node2"]) != 3 {
+		t.Errorf("Node2 suspected %d times, want 3", len(vt.suspects["Node2"]))
+	}
+}
+
+func TestVerifyPoolRejectsImpersonation(t *testing.T) {
+	vt := newVerifyPoolTest(t, 4)
+	// Node2 signs a vote of Node1 with its own key.
+	vt.pool.process([]*verifyJob{vt.job(t, "Node2", "Node1"), vt.job(t, "Node3", "Node3")})
+
+	if got := vt.deliveredFrom(); fmt.Sprint(got) != "[Node3]" {
+		t.Errorf("delivered from %v, want [Node3]", got)
+	}
+	if fmt.Sprint(vt.suspects["Node2"]) != "["+suspectImpersonation+"]" {
+		t.Errorf("Node2 suspected for %v, want %s", vt.suspects["Node2"], suspectImpersonation)
+	}
+}
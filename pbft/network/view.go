@@ -1,107 +1,76 @@
 package network
 
 import (
-	"fmt"
 	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
-	"time"
 	"sync/atomic"
-	"unsafe"
-	"log"
+	"time"
 )
+
 var seedList []string
+
 func (node *Node) StartViewChange(sequenceID int64) {
 	// Start_ViewChange
-//	LogStage("ViewChange", false)
+	//	LogStage("ViewChange", false)
 	// Create SetP.
 	setp := node.CreateSetP()
 
 	// Create ViewChangeMsg.
 	viewChangeMsg := node.CreateViewChangeMsg(setp, sequenceID)
 
-//	fmt.Printf("++++++++++++++++++++ I'm %s  \n", viewChangeMsg.NodeID)
+	//	fmt.Printf("++++++++++++++++++++ I'm %s  \n", viewChangeMsg.NodeID)
 
 	// VIEW-CHANGE message created by this node will be received
 	// at this node as well as the other nodes.
 	node.Broadcast(viewChangeMsg, "/viewchange")
-	fmt.Println("Breadcast viewchange")
-	LogStage("ViewChange", true)
+	// Every sequence in flight that times out starts the same view change.
+	if node.Timeouts.viewChangeStarted(atomic.LoadInt64(&node.NextCandidateIdx)) {
+		node.Metrics.viewChangeStarted()
+	}
+	node.logger(SubsystemView).Info("VIEW-CHANGE broadcast", "seq", sequenceID,
+		"nextCandidateIdx", atomic.LoadInt64(&node.NextCandidateIdx))
 }
 
 func (node *Node) GetViewChange(viewchangeMsg *consensus.ViewChangeMsg) {
 	var vcs *consensus.VCState
 
 	//LogMsg(viewchangeMsg)
-	fmt.Printf("++++from %s ++++++++++++++++++++ seq: %d \n", viewchangeMsg.NodeID, viewchangeMsg.SequenceID)
+	node.logger(SubsystemView).Debug("VIEW-CHANGE received", "from", viewchangeMsg.NodeID, "seq", viewchangeMsg.SequenceID)
 
 	// Ignore VIEW-CHANGE message if the next view id is not new.
-	
-	vcs = node.VCStates[viewchangeMsg.SequenceID]
+
+	vcs = node.viewChangeState(viewchangeMsg.SequenceID)
 	//fmt.Printf("node.NextCandidateIdx : %d\n", node.NextCandidateIdx)
-	// Create a view state if it does not exist.
-	for vcs == nil {
-		vcs = consensus.CreateViewChangeState(node.MyInfo.NodeID, len(node.NodeTable), node.NextCandidateIdx, node.StableCheckPoint, viewchangeMsg.SequenceID)
-		// Register state into node
-		node.VCStatesMutex.Lock()
-		node.VCStates[viewchangeMsg.SequenceID] = vcs
-		node.VCStatesMutex.Unlock()
-
-		// Assign new VCState if node did not create the state.
-		if !atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(node.VCStates[viewchangeMsg.SequenceID])), unsafe.Pointer(nil), unsafe.Pointer(vcs)) {
-			vcs = node.VCStates[viewchangeMsg.SequenceID]
-		}
-	}
 
-	newViewMsg, err := vcs.ViewChange(viewchangeMsg)
+	newViewMsg, err := vcs.ViewChange(viewchangeMsg, node.Clock.Now())
 	if err != nil {
-		fmt.Println(err)
+		vcs.Log.Error(err.Error())
 		return
 	}
 
 	if newViewMsg != nil {
-		node.IsViewChanging = true
-		time.Sleep(time.Millisecond * 200)
-		fmt.Println("+++++ node.IsViewChanging", node.IsViewChanging)
-
-		var totalcon int64 = node.TotalConsensus	
-		for i := int64(newViewMsg.SequenceID); i <= totalcon; i++ {
-
-			state, _ := node.getState(i)
-			
-			if state != nil {
-				ch := state.GetMsgExitSendChannel()
-				if ch != nil {
-					ch <- 0
-				}
-			}
-			if node.CommittedMsgs[i] != nil {
-				delete(node.CommittedMsgs, i)
-			}
-			if node.Committed[i] != 0 {
-				node.Committed[i] = 0
-			}
-			if node.Prepared[i] != 0 {
-				node.Prepared[i] = 0
-			}
-			delete(node.States, i)
-			atomic.AddInt64(&node.TotalConsensus, -1)
+		node.IsViewChanging.Store(true)
+		if !node.sleep(time.Duration(node.Config.ViewChangeDelay)) {
+			return
 		}
+		vcs.Log.Info("view changing")
 
+		node.abandonSequences(newViewMsg.SequenceID)
 	}
 
-	var nextPrimary = node.getPrimaryInfoByID(node.NextCandidateIdx)
+	var nextPrimary = node.getPrimaryInfoByID(atomic.LoadInt64(&node.NextCandidateIdx))
 
-	if  node.MyInfo == nextPrimary && newViewMsg != nil {
+	if node.MyInfo == nextPrimary && newViewMsg != nil {
 
 		newViewMsg.Min_S = node.FindStableCheckpoint(newViewMsg)
-		newViewMsg.EpochID = newViewMsg.Min_S / 10
+		newViewMsg.EpochID = newViewMsg.Min_S / node.Config.EpochLength
 
-		LogMsg(newViewMsg)
-		fmt.Println("+++++ newView_Broadcast")
+		vcs.Log.Info("NEW-VIEW broadcast", "minS", newViewMsg.Min_S, "epoch", newViewMsg.EpochID,
+			"nextCandidateIdx", newViewMsg.NextCandidateIdx)
 		node.Broadcast(newViewMsg, "/newview")
 	}
 }
 
-func (node *Node) FindStableCheckpoint(newViewMsg *consensus.NewViewMsg) (int64){
+func (node *Node) FindStableCheckpoint(newViewMsg *consensus.NewViewMsg) int64 {
 	// Search min_s the sequence number of the latest stable checkpoint and
 	// max_s the highest sequence number in a prepare message in V.
 	var min_s int64 = 0
@@ -112,61 +81,65 @@ func (node *Node) FindStableCheckpoint(newViewMsg *consensus.NewViewMsg) (int64)
 			min_s = vcm.StableCheckPoint
 		}
 	}
-//	fmt.Println("min_s ", min_s)
+	//	fmt.Println("min_s ", min_s)
 	return min_s
 }
 
-func (node *Node) GetNewView(newviewMsg *consensus.NewViewMsg) {
-	// TODO verify new-view message
-	fmt.Printf("<<<<<<<<<<<<<<<<GetNewView seq %d >>>>>>>>>>>>>>>>: NextCandidateIdx: %d by %s\n", newviewMsg.SequenceID , newviewMsg.NextCandidateIdx, newviewMsg.NodeID)
-
-	node.IsViewChanging = true
-	time.Sleep(time.Millisecond * 200)
-	
-	var totalcon int64 = node.TotalConsensus	
-	for i := int64(newviewMsg.SequenceID); i <= totalcon; i++ {
-	//	fmt.Println("+++++ i,  node.TotalConsensus", i, node.TotalConsensus)
-		
+// viewChangeState returns the view change state of sequenceID, created
+// if it does not exist.
+func (node *Node) viewChangeState(sequenceID int64) *consensus.VCState {
+	node.VCStatesMutex.Lock()
+	defer node.VCStatesMutex.Unlock()
+	vcs := node.VCStates[sequenceID]
+	if vcs == nil {
+		vcs = consensus.CreateViewChangeState(node.MyInfo.NodeID, len(node.NodeTable),
+			atomic.LoadInt64(&node.NextCandidateIdx), atomic.LoadInt64(&node.StableCheckPoint), sequenceID,
+			node.logger(SubsystemView).With("seq", sequenceID))
+		node.VCStates[sequenceID] = vcs
+	}
+	return vcs
+}
+
+// abandonSequences drops the sequences from sequenceID on, which the
+// next view starts over.
+func (node *Node) abandonSequences(sequenceID int64) {
+	epochID, viewID := atomic.LoadInt64(&node.EpochID), node.currentView().ID
+	var totalcon int64 = atomic.LoadInt64(&node.TotalConsensus)
+	for i := sequenceID; i <= totalcon; i++ {
 		state, _ := node.getState(i)
-		
 		if state != nil {
-			ch := state.GetMsgExitSendChannel()
-			if ch != nil {
-				ch <- 0
-			}
-		}
-		if node.CommittedMsgs[i] != nil {
-			delete(node.CommittedMsgs, i)
-		}
-		if node.Committed[i] != 0 {
-			node.Committed[i] = 0
-		}
-		if node.Prepared[i] != 0 {
-			node.Prepared[i] = 0
+			node.endTimers(state)
 		}
+		node.CommittedMutex.Lock()
+		delete(node.CommittedMsgs, i)
+		node.CommittedMutex.Unlock()
+		atomic.StoreInt64(&node.Committed[i], 0)
+		atomic.StoreInt64(&node.Prepared[i], 0)
+		node.Trace.abandoned(node.Clock.Now(), epochID, viewID, i)
+		node.StatesMutex.Lock()
 		delete(node.States, i)
+		node.StatesMutex.Unlock()
 		atomic.AddInt64(&node.TotalConsensus, -1)
 	}
+}
 
-	node.NextCandidateIdx = newviewMsg.NextCandidateIdx
+func (node *Node) GetNewView(newviewMsg *consensus.NewViewMsg) {
+	// TODO verify new-view message
+	node.logger(SubsystemView).Info("NEW-VIEW received", "from", newviewMsg.NodeID, "seq", newviewMsg.SequenceID,
+		"nextCandidateIdx", newviewMsg.NextCandidateIdx)
 
-	var vcs *consensus.VCState
-	vcs = node.VCStates[newviewMsg.SequenceID]
-	
-	// Create a view state if it does not exist.
-	for vcs == nil {
-		vcs = consensus.CreateViewChangeState(node.MyInfo.NodeID, len(node.NodeTable), node.NextCandidateIdx, node.StableCheckPoint, newviewMsg.SequenceID)
-		// Register state into node
-		node.VCStatesMutex.Lock()
-		node.VCStates[newviewMsg.SequenceID] = vcs
-		node.VCStatesMutex.Unlock()
-
-		// Assign new VCState if node did not create the state.
-		if !atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(node.VCStates[newviewMsg.SequenceID])), unsafe.Pointer(nil), unsafe.Pointer(vcs)) {
-			vcs = node.VCStates[newviewMsg.SequenceID]
-		}
+	node.IsViewChanging.Store(true)
+	if !node.sleep(time.Duration(node.Config.ViewChangeDelay)) {
+		return
 	}
-	
+
+	node.abandonSequences(newviewMsg.SequenceID)
+
+	atomic.StoreInt64(&node.NextCandidateIdx, newviewMsg.NextCandidateIdx)
+
+	var vcs *consensus.VCState
+	vcs = node.viewChangeState(newviewMsg.SequenceID)
+
 	// for _, vcm := range newviewMsg.SetViewChangeMsgs {
 	// 	node.GetViewChange(vcm)
 	// }
@@ -174,91 +147,75 @@ func (node *Node) GetNewView(newviewMsg *consensus.NewViewMsg) {
 
 	// Register new-view message into this node
 	node.VCStatesMutex.Lock()
-	node.VCStates[newviewMsg.SequenceID].NewViewMsg = newviewMsg
+	vcs.NewViewMsg = newviewMsg
 	node.VCStatesMutex.Unlock()
 
 	// Fill missing states and messages
 	node.FillHole(newviewMsg)
 	// Change View and Primary
-	node.StableCheckPoint = newviewMsg.Min_S
-	node.EpochID = newviewMsg.EpochID
+	atomic.StoreInt64(&node.StableCheckPoint, newviewMsg.Min_S)
+	atomic.StoreInt64(&node.EpochID, newviewMsg.EpochID)
 
-//	fmt.Println("node.NextCandidateIdex: ",node.NextCandidateIdx)
+	//	fmt.Println("node.NextCandidateIdex: ",node.NextCandidateIdx)
 
-//	fmt.Println("node.TotalConsensus:  ",node.TotalConsensus)
+	//	fmt.Println("node.TotalConsensus:  ",node.TotalConsensus)
 
-///	fmt.Printf("node.StableCheckPoint: %d , newviewMsg.Min_S: %d\n", node.StableCheckPoint, newviewMsg.Min_S)
+	///	fmt.Printf("node.StableCheckPoint: %d , newviewMsg.Min_S: %d\n", node.StableCheckPoint, newviewMsg.Min_S)
 
+	//	fmt.Println("newviewMsg.PrepareMsg: ", newviewMsg.PrepareMsg)
 
-//	fmt.Println("newviewMsg.PrepareMsg: ", newviewMsg.PrepareMsg)
-	
+	node.updateViewID(newviewMsg.SequenceID - 1)
+	node.updateEpochID(newviewMsg.SequenceID - 1)
 
-	node.updateViewID(newviewMsg.SequenceID-1)
-	node.updateEpochID(newviewMsg.SequenceID-1)
-				
-	fmt.Println("node.NextCandidateIdx: ", node.NextCandidateIdx)
-	primaryNode := node.NodeTable[node.NextCandidateIdx]
+	primaryNode := node.NodeTable[atomic.LoadInt64(&node.NextCandidateIdx)]
 
-				
-	fmt.Println("[VIEWCHANGE_DONE] ",",",newviewMsg.SequenceID,",",time.Since(node.VCStates[newviewMsg.SequenceID].GetReceiveViewchangeTime()))
+	viewChangeTime := node.Clock.Now().Sub(vcs.GetReceiveViewchangeTime())
+	vcs.Log.Info("view change done", "epoch", atomic.LoadInt64(&node.EpochID), "view", node.currentView().ID,
+		"primary", primaryNode.NodeID, "took", viewChangeTime)
+	node.Metrics.viewChangeDone(viewChangeTime)
+	node.Timeouts.observe(phaseViewChange, viewChangeTime)
 
 	atomic.AddInt64(&node.NextCandidateIdx, 1)
 
-	if newviewMsg.SequenceID % 10 == 0 {
-	//	node.VCStates = make(map[int64]*consensus.VCState)
-		node.NextCandidateIdx = 7
+	if newviewMsg.SequenceID%node.Config.EpochLength == 0 {
+		//	node.VCStates = make(map[int64]*consensus.VCState)
+		atomic.StoreInt64(&node.NextCandidateIdx, node.Config.NewViewCandidate)
 	}
 
 	node.StartThreadIfNotExists(newviewMsg.SequenceID)
 
-	node.IsViewChanging = false
+	node.IsViewChanging.Store(false)
 
 	if primaryNode.NodeID == node.MyInfo.NodeID {
-		var seed int64 = -1	
+		var seed int64 = -1
 
-		data := make([]byte, 1 << 20)
-		for i := range data {
-			data[i] = 'A'
-		}
-		data[len(data)-1]=0
-
-		prepareMsg := PrepareMsgMaking("Op1", "Client1", data, 
-			node.View.ID,int64(newviewMsg.SequenceID),
-			node.MyInfo.NodeID, int(seed), node.EpochID)
-					
-			log.Printf("Broadcasting dummy message from %s, sequenceId: %d, epochId: %d, viewId: %d",
-				node.MyInfo.NodeID, int64(newviewMsg.SequenceID), node.EpochID, node.View.ID)
-		// Broadcast the dummy message.
-		errCh := make(chan error, 1)
-					
-		fmt.Println("[StartPrepare]", "seqID / ",newviewMsg.SequenceID,"/", time.Now().UnixNano())
-		node.Broadcast(prepareMsg, "/prepare")
-		fmt.Println("[StartPrepare] After Broadcast!")
-
-		err := <-errCh
-		if err != nil {
-			log.Println(err)
-		}
+		prepareMsg := node.nextProposal(newviewMsg.SequenceID, int(seed))
 
+		node.logger(SubsystemConsensus).Info("proposing", "epoch", atomic.LoadInt64(&node.EpochID), "view", node.currentView().ID,
+			"seq", newviewMsg.SequenceID, "phase", phasePrepare)
+		// Broadcast the dummy message.
+		node.broadcastPrepare(prepareMsg)
 	}
 
 }
 
 func (node *Node) FillHole(newviewMsg *consensus.NewViewMsg) {
 	// Check the number of states
-//	fmt.Println("node.TotalConsensus :  ",node.TotalConsensus)
+	//	fmt.Println("node.TotalConsensus :  ",node.TotalConsensus)
 
-//	fmt.Println("newviewMsg.Min_S : ", newviewMsg.Min_S)
+	//	fmt.Println("newviewMsg.Min_S : ", newviewMsg.Min_S)
 	//fmt.Println("newviewMsg.Max_S : ", newviewMsg.Max_S)
 
 	// Currunt Max sequence number of committed request
 	var committedMax int64 = 0
-	for seq, _ := range node.CommittedMsgs{
+	node.CommittedMutex.Lock()
+	defer node.CommittedMutex.Unlock()
+	for seq, _ := range node.CommittedMsgs {
 		if committedMax <= int64(seq) {
 			committedMax = int64(seq)
 		}
 	}
-//	fmt.Println("committedMax : ", committedMax)
+	//	fmt.Println("committedMax : ", committedMax)
 	for committedMax <= newviewMsg.Min_S {
 		var prepare consensus.PrepareMsg
 		newSequenceID := committedMax
@@ -268,53 +225,87 @@ func (node *Node) FillHole(newviewMsg *consensus.NewViewMsg) {
 		prepare.EpochID = newSequenceID / int64(len(node.NodeTable))
 		prepare.NodeID = ""
 
-
-//		fmt.Println("no request in node.CommittedMsgs : ", newSequenceID)
+		//		fmt.Println("no request in node.CommittedMsgs : ", newSequenceID)
 		node.CommittedMsgs[newSequenceID] = &prepare
 		committedMax += 1
 	}
 	// if highest sequence number of received request and state is lower than min-s,
 	// node.TotalConsensus be added util min-s - 1
 
-	for node.TotalConsensus < newviewMsg.Min_S {
+	for atomic.LoadInt64(&node.TotalConsensus) < newviewMsg.Min_S {
 		atomic.AddInt64(&node.TotalConsensus, 1)
 	}
 
-//	fmt.Println("+++++++++++++++++++FILLHOLE DONE++++++++++++++++++++")
+	//	fmt.Println("+++++++++++++++++++FILLHOLE DONE++++++++++++++++++++")
 
 }
 
 func (node *Node) updateEpochID(sequenceID int64) {
-	epochID := sequenceID / 10
-	node.EpochID = epochID
+	epochID := sequenceID / node.Config.EpochLength
+	atomic.StoreInt64(&node.EpochID, epochID)
 }
 
 func (node *Node) updateViewID(viewID int64) {
-	var participant int64 = 10
-	node.View.ID = viewID % participant
-	node.View.Primary = node.getPrimaryInfoByID(node.View.ID)
+	nextViewID := node.viewOf(viewID + 1)
+	primary := node.getPrimaryInfoByID(nextViewID)
+	node.ViewMutex.Lock()
+	node.View.ID = nextViewID
+	node.View.Primary = primary
+	node.ViewMutex.Unlock()
+}
+
+// currentView returns a copy of node.View, which the sequences move on.
+func (node *Node) currentView() View {
+	node.ViewMutex.RLock()
+	defer node.ViewMutex.RUnlock()
+	return *node.View
+}
+
+// viewOf returns the view sequenceID is ordered in. The primary changes
+// with every sequence, so a state takes its view from its sequence
+// rather than from node.View, which the next sequence may have moved on.
+func (node *Node) viewOf(sequenceID int64) int64 {
+	return (sequenceID - 1) % node.Config.EpochLength
+}
+
+// primaryOf returns the node id of the replica that proposes
+// sequenceID: the candidate of the NEW-VIEW that started it over, if
+// this node got one, or else the primary of its view; "" if there is
+// no such sequence.
+func (node *Node) primaryOf(sequenceID int64) string {
+	node.VCStatesMutex.RLock()
+	defer node.VCStatesMutex.RUnlock()
+	if vcs := node.VCStates[sequenceID]; vcs != nil && vcs.NewViewMsg != nil {
+		if idx := vcs.NewViewMsg.NextCandidateIdx; idx >= 0 && idx < int64(len(node.NodeTable)) {
+			return node.NodeTable[idx].NodeID
+		}
+	}
+	if viewID := node.viewOf(sequenceID); sequenceID > 0 && viewID < int64(len(node.NodeTable)) {
+		return node.getPrimaryInfoByID(viewID).NodeID
+	}
+	return ""
 }
 
 func (node *Node) isMyNodePrimary() bool {
-	return node.MyInfo.NodeID == node.View.Primary.NodeID
+	return node.MyInfo.NodeID == node.currentView().Primary.NodeID
 }
 
-func(node *Node) setNewSeedList(seedNo int) int {
+func (node *Node) setNewSeedList(seedNo int) int {
 	node.NodeTable = node.SeedNodeTables[seedNo]
-	fmt.Println("New seed is ",seedNo)
+	node.logger(SubsystemView).Info("new seed", "seed", seedNo)
 	return seedNo
 }
 
 func (node *Node) getPrimaryInfoByID(viewID int64) *NodeInfo {
-	viewIdx := viewID 
+	viewIdx := viewID
 	if viewIdx > int64(len(node.NodeTable)) {
-		log.Printf("Fail this Consensus by %s\n", node.MyInfo.NodeID)
+		node.logger(SubsystemView).Error("no primary for the view", "view", viewID)
 	}
 	return node.NodeTable[viewIdx]
 }
 
 func GetPrepareForNewview(nextviewID int64, sequenceid int64, digest string) *consensus.PrepareMsg {
-	return &consensus.PrepareMsg {
+	return &consensus.PrepareMsg{
 		ViewID:     nextviewID,
 		SequenceID: sequenceid,
 		Digest:     digest,
@@ -340,23 +331,23 @@ func (node *Node) CreateSetP() map[int64]*consensus.SetPm {
 func (node *Node) CreateViewChangeMsg(setp map[int64]*consensus.SetPm, sequenceID int64) *consensus.ViewChangeMsg {
 	// Get checkpoint message log for the latest stable checkpoint (C)
 	// for this node.
-	stableCheckPoint := node.StableCheckPoint
+	stableCheckPoint := atomic.LoadInt64(&node.StableCheckPoint)
 	//setc := node.CheckPointMsgsLog[stableCheckPoint]
-//	fmt.Println("node.StableCheckPoint : ", stableCheckPoint)
+	//	fmt.Println("node.StableCheckPoint : ", stableCheckPoint)
 	//fmt.Println("setc",setc)
 
 	//committeeNum := int64(7)
 
 	return &consensus.ViewChangeMsg{
-		NodeID: node.MyInfo.NodeID,
-		SequenceID: sequenceID,
-		NextCandidateIdx: node.NextCandidateIdx,
+		NodeID:           node.MyInfo.NodeID,
+		SequenceID:       sequenceID,
+		NextCandidateIdx: atomic.LoadInt64(&node.NextCandidateIdx),
 		StableCheckPoint: stableCheckPoint,
 		//SetC: setc,
 		SetP: setp,
 	}
 }
 
-func (node *Node) ChangeLeader(){
+func (node *Node) ChangeLeader() {
 
 }
@@ -0,0 +1,121 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/gorilla/websocket"
+)
+
+// Each websocket connection agrees on one wire codec through its
+// subprotocol. The dialing node offers its preferred codec first and
+// the other one as a fallback; the accepting node takes its own
+// preferred codec if it is offered, and the first offer it supports
+// otherwise. Starting a node with the JSON codec therefore makes its
+// peers talk JSON to it, which is handy for debugging.
+
+var wireCodecs = []consensus.Codec{consensus.BinaryCodec, consensus.JSONCodec}
+
+// wireOptions say how a node, or a requester, talks over websockets.
+type wireOptions struct {
+	codec    consensus.Codec // preferred, see Config.Codec
+	identity *TLSIdentity    // nil without TLS
+	log      *slog.Logger
+}
+
+func subprotocol(codec consensus.Codec) string {
+	return "pabft-" + codec.Name() + ".v" + strconv.Itoa(consensus.EnvelopeVersion)
+}
+
+func offeredSubprotocols(preferred consensus.Codec) []string {
+	offers := []string{subprotocol(preferred)}
+	for _, codec := range wireCodecs {
+		if codec != preferred {
+			offers = append(offers, subprotocol(codec))
+		}
+	}
+	return offers
+}
+
+func codecForSubprotocol(protocol string) consensus.Codec {
+	for _, codec := range wireCodecs {
+		if subprotocol(codec) == protocol {
+			return codec
+		}
+	}
+	return nil
+}
+
+// negotiateCodec picks the codec for an incoming websocket request,
+// preferred if the dialer offers it, and returns the response header
+// that announces it.
+func negotiateCodec(r *http.Request, preferred consensus.Codec) (consensus.Codec, http.Header) {
+	var chosen consensus.Codec
+	for _, protocol := range websocket.Subprotocols(r) {
+		codec := codecForSubprotocol(protocol)
+		if codec == preferred {
+			chosen = codec
+			break
+		}
+		if chosen == nil {
+			chosen = codec
+		}
+	}
+	if chosen == nil {
+		return nil, nil
+	}
+	return chosen, http.Header{"Sec-Websocket-Protocol": {subprotocol(chosen)}}
+}
+
+// Binary codecs go in binary frames, JSON in text frames.
+func frameType(codec consensus.Codec) int {
+	if codec == consensus.JSONCodec {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// dialHub connects to the hub of a node as id and returns the
+// negotiated codec. The hub uses id to send messages back to us; over
+// TLS, when wire has an identity, it takes the id from our certificate instead.
+func dialHub(ctx context.Context, nodeInfo *NodeInfo, path string, id string, wire wireOptions) (*websocket.Conn, consensus.Codec, error) {
+	u := url.URL{Scheme: "ws", Host: nodeInfo.Url, Path: path, RawQuery: url.Values{"id": {id}}.Encode()}
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = offeredSubprotocols(wire.codec)
+	if wire.identity != nil {
+		u.Scheme = "wss"
+		dialer.TLSClientConfig = wire.identity.clientConfig(nodeInfo.NodeID)
+	}
+
+	// The websocket handshake heeds the deadline of ctx only. Close the
+	// connection when ctx is done, so that a peer that accepts and never
+	// answers does not hold up whoever cancels the dial.
+	var stop func() bool
+	dialer.NetDialContext = func(dialCtx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(dialCtx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		stop = context.AfterFunc(ctx, func() { conn.Close() })
+		return conn, nil
+	}
+	c, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if stop != nil {
+		stop()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	codec := codecForSubprotocol(c.Subprotocol())
+	if codec == nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("%s did not agree on a wire codec", nodeInfo.NodeID)
+	}
+	return c, codec, nil
+}
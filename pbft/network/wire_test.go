@@ -0,0 +1,36 @@
+package network
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+func TestNegotiateCodec(t *testing.T) {
+	binary, json := subprotocol(consensus.BinaryCodec), subprotocol(consensus.JSONCodec)
+	for _, test := range []struct {
+		offers    []string
+		preferred consensus.Codec
+		want      consensus.Codec
+	}{
+		{[]string{binary, json}, consensus.BinaryCodec, consensus.BinaryCodec},
+		{[]string{binary, json}, consensus.JSONCodec, consensus.JSONCodec},
+		{[]string{json, binary}, consensus.BinaryCodec, consensus.BinaryCodec},
+		{[]string{binary}, consensus.JSONCodec, consensus.BinaryCodec},
+		{[]string{"pabft-xml.v1", json}, consensus.BinaryCodec, consensus.JSONCodec},
+		{[]string{"pabft-xml.v1"}, consensus.BinaryCodec, nil},
+	} {
+		r := httptest.NewRequest("GET", "/prepare", nil)
+		r.Header.Set("Sec-Websocket-Protocol", strings.Join(test.offers, ", "))
+		codec, header := negotiateCodec(r, test.preferred)
+		if codec != test.want {
+			t.Errorf("offers %v, preferring %s: got %v, want %v", test.offers, test.preferred.Name(), codec, test.want)
+			continue
+		}
+		if codec != nil && header.Get("Sec-Websocket-Protocol") != subprotocol(codec) {
+			t.Errorf("offers %v: announced %q for %s", test.offers, header.Get("Sec-Websocket-Protocol"), codec.Name())
+		}
+	}
+}
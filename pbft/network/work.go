@@ -0,0 +1,399 @@
+package network
+
+import (
+	"sync"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+)
+
+// A node can run on a clock that runs its goroutines one at a time,
+// such as the simulator's: each step of the simulation delivers a
+// message or fires a timer, the goroutine it wakes runs, then the
+// goroutines that one woke in turn, and so on until every goroutine
+// waits again. The next step waits for that, so a run follows from the
+// order of the steps alone.
+//
+// For that the node tells the clock which goroutines are ready to run.
+// spawn does for the goroutines it starts, and an inbox for the
+// goroutines that a message on a channel between goroutines of the
+// node wakes. A goroutine that waits on the clock or the transport
+// parks before it waits, and runs as the one they woke afterwards.
+
+// stepper is implemented by clocks that run the goroutines of the node
+// one at a time.
+type stepper interface {
+	// Ready makes a goroutine ready to run and returns its ticket.
+	// Goroutines run in the order they became ready.
+	Ready() uint64
+
+	// Run waits until it is the turn of the goroutine with ticket;
+	// wokenTicket is the goroutine that the clock or the transport woke.
+	Run(ticket uint64)
+
+	// Park tells that the running goroutine waits, so the next may run.
+	Park()
+}
+
+// wokenTicket is the ticket of the goroutine that the last tick of the
+// clock, or message of the transport, woke.
+const wokenTicket uint64 = 0
+
+func (node *Node) ready() uint64 {
+	if node.stepper == nil {
+		return wokenTicket
+	}
+	return node.stepper.Ready()
+}
+
+func (node *Node) run(ticket uint64) {
+	if node.stepper != nil {
+		node.stepper.Run(ticket)
+	}
+}
+
+func (node *Node) park() {
+	if node.stepper != nil {
+		node.stepper.Park()
+	}
+}
+
+// inbox makes ready the goroutines of the node that wait on a set of
+// channels when a message is sent on one. A message makes a reader
+// ready only while one waits for it, as many as wait: one queued for a
+// reader that waits on a timer, or that is gone, wakes nobody. Senders
+// call post before they send; readers call wait before they wait, then
+// received or woken, as they were woken by a message or by the clock.
+type inbox struct {
+	node    *Node
+	mu      sync.Mutex
+	queued  int      // messages posted and not yet received
+	waiting int      // readers waiting on the channels
+	tickets []uint64 // of the readers that queued messages wake
+}
+
+// newInbox returns an inbox of the node, or nil, which does nothing,
+// if its clock does not run its goroutines one at a time.
+func (node *Node) newInbox() *inbox {
+	if node.stepper == nil {
+		return nil
+	}
+	return &inbox{node: node}
+}
+
+func (box *inbox) post() {
+	if box == nil {
+		return
+	}
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	if box.queued < box.waiting {
+		box.tickets = append(box.tickets, box.node.ready())
+	}
+	box.queued++
+}
+
+func (box *inbox) wait() {
+	if box == nil {
+		return
+	}
+	box.mu.Lock()
+	if box.waiting < box.queued {
+		box.tickets = append(box.tickets, box.node.ready())
+	}
+	box.waiting++
+	box.mu.Unlock()
+	box.node.park()
+}
+
+// received waits for the turn of a reader woken by a message.
+func (box *inbox) received() {
+	if box == nil {
+		return
+	}
+	box.mu.Lock()
+	box.waiting--
+	box.queued--
+	ticket := box.tickets[0]
+	box.tickets = box.tickets[1:]
+	box.mu.Unlock()
+	box.node.run(ticket)
+}
+
+// took tells that the running reader took a message it did not wait for.
+func (box *inbox) took() {
+	if box == nil {
+		return
+	}
+	box.mu.Lock()
+	box.queued--
+	box.mu.Unlock()
+}
+
+// woken waits for the turn of a reader woken by the clock. The clock
+// only ticks once every goroutine waits, when no message is queued for
+// a reader that waits.
+func (box *inbox) woken() {
+	if box == nil {
+		return
+	}
+	box.mu.Lock()
+	box.waiting--
+	box.mu.Unlock()
+	box.node.run(wokenTicket)
+}
+
+// send hands v to the goroutine of the node that reads ch, and that
+// box wakes. It returns false if the node stopped first.
+func send[T any](node *Node, box *inbox, ch chan<- T, v T) bool {
+	box.post()
+	select {
+	case ch <- v:
+		return true
+	case <-node.ctx.Done():
+		return false
+	}
+}
+
+// receive waits for what send hands to the goroutine that box wakes.
+// It returns false once the node stops.
+func receive[T any](node *Node, box *inbox, ch <-chan T) (T, bool) {
+	box.wait()
+	select {
+	case v := <-ch:
+		box.received()
+		return v, true
+	case <-node.ctx.Done():
+		var zero T
+		return zero, false
+	}
+}
+
+// await waits for what the clock or the transport sends on ch. It
+// returns false once the node stops.
+func await[T any](node *Node, ch <-chan T) (T, bool) {
+	node.park()
+	select {
+	case v := <-ch:
+		node.run(wokenTicket)
+		return v, true
+	case <-node.ctx.Done():
+		var zero T
+		return zero, false
+	}
+}
+
+// nextEntrance waits for a message on MsgEntrance or ViewMsgEntrance,
+// and tells whether it came on ViewMsgEntrance. It returns false once
+// the node stops.
+func (node *Node) nextEntrance() (msg interface{}, viewMsg bool, ok bool) {
+	node.entranceInbox.wait()
+	select {
+	case msg = <-node.MsgEntrance:
+		node.entranceInbox.received()
+		return msg, false, true
+	case msg = <-node.ViewMsgEntrance:
+		node.entranceInbox.received()
+		return msg, true, true
+	case <-node.ctx.Done():
+		return nil, false, false
+	}
+}
+
+// signal is a channel that wakes a goroutine of the node, with the
+// inbox of that goroutine.
+type signal struct {
+	ch  chan struct{}
+	box *inbox
+}
+
+func (node *Node) newSignal(size int) signal {
+	return signal{ch: make(chan struct{}, size), box: node.newInbox()}
+}
+
+func (sig signal) send() {
+	sig.box.post()
+	sig.ch <- struct{}{}
+}
+
+// waitTimer waits until timer fires, and returns true, or until cancel
+// is sent or the node stops.
+func (node *Node) waitTimer(timer Timer, cancel signal) bool {
+	cancel.box.wait()
+	select {
+	case <-timer.C():
+		cancel.box.woken()
+		return true
+	case <-cancel.ch:
+		cancel.box.received()
+		return false
+	case <-node.ctx.Done():
+		return false
+	}
+}
+
+func (waiter payloadWaiter) send(body *consensus.RequestMsg) {
+	waiter.inbox.post()
+	waiter.body <- body
+}
+
+// waitPayload waits for the body waiter receives, or for timer, and
+// returns nil if the timer fired first. It returns false once the node
+// stops.
+func (node *Node) waitPayload(waiter payloadWaiter, timer Timer) (*consensus.RequestMsg, bool) {
+	waiter.inbox.wait()
+	select {
+	case body := <-waiter.body:
+		waiter.inbox.received()
+		return body, true
+	case <-timer.C():
+		waiter.inbox.woken()
+		return nil, true
+	case <-node.ctx.Done():
+		return nil, false
+	}
+}
+
+// sequenceInbox holds the inboxes of the two goroutines of a sequence,
+// see startTransitionWithDeadline: the one that handles its messages,
+// and the one that starts and stops its timers. It is dropped once
+// both returned.
+type sequenceInbox struct {
+	msgs   *inbox
+	timers *inbox
+
+	msgsExited   bool
+	timersExited bool
+}
+
+// openSequence returns the inboxes of the goroutines of state, which
+// start. They do nothing if the clock does not run goroutines one at
+// a time.
+func (node *Node) openSequence(state consensus.PBFT) *sequenceInbox {
+	if node.stepper == nil {
+		return &sequenceInbox{}
+	}
+	box := &sequenceInbox{msgs: node.newInbox(), timers: node.newInbox()}
+	node.inboxesMutex.Lock()
+	node.inboxes[state] = box
+	node.inboxesMutex.Unlock()
+	return box
+}
+
+// sequenceInbox returns the inboxes of state, which do nothing once its
+// goroutines returned.
+func (node *Node) sequenceInbox(state consensus.PBFT) *sequenceInbox {
+	if node.stepper == nil {
+		return &sequenceInbox{}
+	}
+	node.inboxesMutex.Lock()
+	defer node.inboxesMutex.Unlock()
+	if box, ok := node.inboxes[state]; ok {
+		return box
+	}
+	return &sequenceInbox{}
+}
+
+// nextSequenceMsg waits for the next message of state. It returns false
+// once the sequence or the node ends.
+func (node *Node) nextSequenceMsg(state consensus.PBFT, box *sequenceInbox) (interface{}, bool) {
+	box.msgs.wait()
+	select {
+	case msg := <-state.GetMsgReceiveChannel():
+		box.msgs.received()
+		// Go picks at random between the ready cases of a select:
+		// once the sequence is over, drop the message whatever was
+		// picked.
+		select {
+		case <-state.GetMsgExitReceiveChannel1():
+			box.msgs.took()
+			return nil, false
+		default:
+		}
+		return msg, true
+	case <-state.GetMsgExitReceiveChannel1():
+		box.msgs.received()
+		return nil, false
+	case <-node.ctx.Done():
+		return nil, false
+	}
+}
+
+// timerRequest asks the goroutine of a sequence that starts and stops
+// its timers to start or to stop the timer of phase, or to end.
+type timerRequest struct {
+	phase string
+	stop  bool
+	end   bool
+}
+
+// nextTimerRequest waits for the next timer request of state. It
+// returns false once the node stops.
+func (node *Node) nextTimerRequest(state consensus.PBFT, box *sequenceInbox) (timerRequest, bool) {
+	box.timers.wait()
+	select {
+	case phase := <-state.GetTimerStartReceiveChannel():
+		box.timers.received()
+		return timerRequest{phase: phase}, true
+	case phase := <-state.GetTimerStopReceiveChannel():
+		box.timers.received()
+		return timerRequest{phase: phase, stop: true}, true
+	case <-state.GetMsgExitReceiveChannel():
+		box.timers.received()
+		return timerRequest{end: true}, true
+	case <-node.ctx.Done():
+		return timerRequest{}, false
+	}
+}
+
+// toSequence hands msg to the goroutine of state that handles messages.
+func (node *Node) toSequence(state consensus.PBFT, msg interface{}) {
+	node.sequenceInbox(state).msgs.post()
+	state.GetMsgSendChannel() <- msg
+}
+
+// startTimer starts the timer of phase of state.
+func (node *Node) startTimer(state consensus.PBFT, phase string) {
+	node.sequenceInbox(state).timers.post()
+	state.GetTimerStartSendChannel() <- phase
+}
+
+// stopTimer stops the timer of phase of state.
+func (node *Node) stopTimer(state consensus.PBFT, phase string) {
+	node.sequenceInbox(state).timers.post()
+	state.GetTimerStopSendChannel() <- phase
+}
+
+// endTimers ends the goroutine of state that starts and stops its timers.
+func (node *Node) endTimers(state consensus.PBFT) {
+	node.sequenceInbox(state).timers.post()
+	state.GetMsgExitSendChannel() <- 0
+}
+
+// endMessages ends the goroutine of state that handles its messages.
+func (node *Node) endMessages(state consensus.PBFT) {
+	node.sequenceInbox(state).msgs.post()
+	state.GetMsgExitSendChannel1() <- 0
+}
+
+// exitSequence tells that a goroutine of state returned, the one that
+// handles its messages if msgs, and drops the inboxes of state once
+// both did: nothing reads what is sent to state afterwards.
+func (node *Node) exitSequence(state consensus.PBFT, msgs bool) {
+	if node.stepper == nil {
+		return
+	}
+	node.inboxesMutex.Lock()
+	defer node.inboxesMutex.Unlock()
+	box, ok := node.inboxes[state]
+	if !ok {
+		return
+	}
+	if msgs {
+		box.msgsExited = true
+	} else {
+		box.timersExited = true
+	}
+	if box.msgsExited && box.timersExited {
+		delete(node.inboxes, state)
+	}
+}
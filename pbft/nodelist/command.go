@@ -0,0 +1,103 @@
+package nodelist
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Command runs the nodelist subcommand with args and returns its exit
+// status.
+func Command(args []string, stdout io.Writer, stderr io.Writer) int {
+	usage := func() int {
+		fmt.Fprintln(stderr, "Usage: nodelist local -n <number of nodes> [-host localhost] [-o file]")
+		fmt.Fprintln(stderr, "       nodelist hosts -n <number of nodes> [-o file] <host>...")
+		fmt.Fprintln(stderr, "       nodelist aws [-config config_aws.json] [-dir nodeList] [-n <number of nodes>]")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+	layout, args := args[0], args[1:]
+	flags := flag.NewFlagSet("nodelist "+layout, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	n := flags.Int("n", 0, "number of nodes")
+	fail := func(err error) int {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	switch layout {
+	case "local":
+		host := flags.String("host", "localhost", "host of every replica")
+		output := flags.String("o", "", "write the node list to this file rather than stdout")
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		if *n < 1 || flags.NArg() > 0 {
+			return usage()
+		}
+		if err := WriteFile(*output, Local(*n, *host), stdout); err != nil {
+			return fail(err)
+		}
+	case "hosts":
+		output := flags.String("o", "", "write the node list to this file rather than stdout")
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		if *n < 1 || flags.NArg() == 0 {
+			return usage()
+		}
+		nodeTable, err := Hosts(*n, flags.Args())
+		if err != nil {
+			return fail(err)
+		}
+		if err := WriteFile(*output, nodeTable, stdout); err != nil {
+			return fail(err)
+		}
+	case "aws":
+		configPath := flags.String("config", "config_aws.json", "instances and replicas per instance")
+		dir := flags.String("dir", "nodeList", "directory of the node lists")
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		if flags.NArg() > 0 {
+			return usage()
+		}
+		layout, err := ReadLayout(*configPath)
+		if err != nil {
+			return fail(err)
+		}
+		nodeTables, err := layout.NodeTables()
+		if err != nil {
+			return fail(fmt.Errorf("%s: %v", *configPath, err))
+		}
+		if *n > 0 && nodeTables[*n] == nil {
+			return fail(fmt.Errorf("%s has no layout for %d nodes", *configPath, *n))
+		}
+		sizes := make([]int, 0, len(nodeTables))
+		for size := range nodeTables {
+			if *n == 0 || size == *n {
+				sizes = append(sizes, size)
+			}
+		}
+		sort.Ints(sizes)
+		for _, size := range sizes {
+			path := filepath.Join(*dir, "nodeNum"+strconv.Itoa(size), "nodeList_aws.json")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return fail(err)
+			}
+			if err := WriteFile(path, nodeTables[size], stdout); err != nil {
+				return fail(err)
+			}
+			fmt.Fprintln(stderr, "wrote", path)
+		}
+	default:
+		return usage()
+	}
+	return 0
+}
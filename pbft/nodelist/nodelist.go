@@ -0,0 +1,173 @@
+// Package nodelist makes the node lists the replicas read: a JSON
+// array of {"nodeID", "url"}, with Node<i> on port 1110+i.
+//
+//	pabft nodelist local -n 19 -o /tmp/node.list
+//	pabft nodelist hosts -n 19 10.0.0.1 10.0.0.2 10.0.0.3 > node.list
+//	pabft nodelist aws -config config_aws.json -dir nodeList
+//
+// A local list has every replica on one host. A hosts list spreads the
+// replicas over the hosts given, in order and as evenly as it can. The
+// aws layout reads the instances and how many replicas each runs from a
+// file like config_aws.json, and writes
+// <dir>/nodeNum<N>/nodeList_aws.json for every cluster size in it.
+package nodelist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// Node<i> listens on basePort+i.
+const basePort = 1110
+
+// Local returns the node list of n replicas on host.
+func Local(n int, host string) []*network.NodeInfo {
+	nodeTable, _ := Spread([]string{host}, []int{n})
+	return nodeTable
+}
+
+// Hosts returns the node list of n replicas spread over hosts, the first
+// ones taking one more if n does not divide evenly.
+func Hosts(n int, hosts []string) ([]*network.NodeInfo, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts")
+	}
+	counts := make([]int, len(hosts))
+	for i := range counts {
+		counts[i] = n / len(hosts)
+		if i < n%len(hosts) {
+			counts[i]++
+		}
+	}
+	return Spread(hosts, counts)
+}
+
+// Spread returns the node list with counts[i] replicas on hosts[i].
+func Spread(hosts []string, counts []int) ([]*network.NodeInfo, error) {
+	if len(counts) > len(hosts) {
+		return nil, fmt.Errorf("%d hosts for %d groups of replicas", len(hosts), len(counts))
+	}
+	var nodeTable []*network.NodeInfo
+	for i, count := range counts {
+		if count < 0 {
+			return nil, fmt.Errorf("%d replicas on %s", count, hosts[i])
+		}
+		for j := 0; j < count; j++ {
+			n := len(nodeTable) + 1
+			nodeTable = append(nodeTable, &network.NodeInfo{
+				NodeID: fmt.Sprintf("Node%d", n),
+				Url:    fmt.Sprintf("%s:%d", hosts[i], basePort+n),
+			})
+		}
+	}
+	return nodeTable, nil
+}
+
+// Layout is the deployment of a file like config_aws.json: the
+// instances, and for each cluster size how many replicas run on each
+// instance, in the order of the instances.
+type Layout struct {
+	Instances []struct {
+		Ip string `json:"ip"`
+	} `json:"instanceIpList"`
+	Clusters []struct {
+		TotalNodeNum   int `json:"totalNodeNum"`
+		PerInstanceNum []struct {
+			NumOfNode int `json:"NumOfNode"`
+		} `json:"perInstanceNum"`
+	} `json:"instanceInfos"`
+}
+
+// ReadLayout reads the layout file at path.
+func ReadLayout(path string) (*Layout, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var layout Layout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &layout, nil
+}
+
+// NodeTables returns the node list of every cluster size in layout.
+func (layout *Layout) NodeTables() (map[int][]*network.NodeInfo, error) {
+	hosts := make([]string, len(layout.Instances))
+	for i, instance := range layout.Instances {
+		hosts[i] = instance.Ip
+	}
+	nodeTables := make(map[int][]*network.NodeInfo)
+	for _, cluster := range layout.Clusters {
+		counts := make([]int, len(cluster.PerInstanceNum))
+		for i, perInstance := range cluster.PerInstanceNum {
+			counts[i] = perInstance.NumOfNode
+		}
+		nodeTable, err := Spread(hosts, counts)
+		if err != nil {
+			return nil, fmt.Errorf("%d nodes: %v", cluster.TotalNodeNum, err)
+		}
+		if len(nodeTable) != cluster.TotalNodeNum {
+			return nil, fmt.Errorf("%d nodes: the instances run %d", cluster.TotalNodeNum, len(nodeTable))
+		}
+		nodeTables[cluster.TotalNodeNum] = nodeTable
+	}
+	return nodeTables, nil
+}
+
+// Read reads the node list at path.
+func Read(path string) ([]*network.NodeInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nodeTable []*network.NodeInfo
+	if err := json.Unmarshal(data, &nodeTable); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return nodeTable, nil
+}
+
+// Write writes nodeTable as a node list, a replica a line.
+func Write(w io.Writer, nodeTable []*network.NodeInfo) error {
+	if _, err := fmt.Fprintln(w, "["); err != nil {
+		return err
+	}
+	for i, nodeInfo := range nodeTable {
+		line, err := json.Marshal(nodeInfo)
+		if err != nil {
+			return err
+		}
+		comma := ","
+		if i == len(nodeTable)-1 {
+			comma = ""
+		}
+		if _, err := fmt.Fprintf(w, "\t%s%s\n", line, comma); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "]")
+	return err
+}
+
+// WriteFile writes nodeTable as a node list to path, or to stdout if
+// path is empty or "-".
+func WriteFile(path string, nodeTable []*network.NodeInfo, stdout io.Writer) error {
+	if path == "" || path == "-" {
+		return Write(stdout, nodeTable)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Write(file, nodeTable); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -7,12 +7,7 @@ then
 	echo "Usage: $0 <# of nodes>"
 	echo "Example: $0 4"
 	echo "Try to spawn 4 nodes"
-	echo "node Node1 spawned!"
-	echo "node Node2 spawned!"
-	echo "node Node3 spawned!"
-	echo "node Node4 spawned!"
-	echo "4 nodes are running"
-	echo "(wait)"
+	echo "4 nodes are running (Ctrl-C stops them, type help for commands)"
 
 	exit
 fi
@@ -29,9 +24,8 @@ then
 	echo "Logging directory $LOGPATH cannot be accessed!"
 	exit
 fi
-
 # Build binary file first.
-go build main.go
+go build -o pabft .
 exitcode=$?
 if [[ $exitcode -ne 0 ]]
 then
@@ -47,15 +41,7 @@ echo "Logs are saved in $LOGPATH"
 echo ""
 echo "Try to spawn $TOTALNODE nodes"
 
-echo `awk -v N=$1 -f nodelist.awk /dev/null` > $NODELISTPATH
-
-for i in `seq 1 $1`
-do
- 	nodename="Node$i"
+printf "${RED}$TOTALNODE nodes are running${NC} (Ctrl-C stops them, type help for commands)\n"
 
- 	echo "node $nodename spawned!"
- 	(NODENAME=$nodename; ./main $NODENAME $1 2>&1 > "$LOGPATH/$NODENAME.log") &
- done
-printf "${RED}$TOTALNODE nodes are running${NC}\n"
-echo "(wait)"
-wait
+# The cluster writes the node list, keeps the logs and stops the nodes.
+exec ./pabft cluster -n $TOTALNODE -node-list $NODELISTPATH -logs $LOGPATH -- -trace "$LOGPATH/{id}.trace.jsonl"
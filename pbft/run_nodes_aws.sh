@@ -23,7 +23,7 @@ then
 fi
 
 # Build binary file first.
-go build main.go
+go build -o pabft .
 exitcode=$?
 if [[ $exitcode -ne 0 ]]
 then
@@ -39,15 +39,14 @@ echo "Logs are saved in $LOGPATH"
 echo ""
 echo "Try to spawn $TOTALNODE nodes"
 
-# echo `awk -v N=$1 -f nodelist.awk /dev/null` > $NODELISTPATH
-go run gen_nodelist.go "aws"
+./pabft nodelist aws -n $TOTALNODE
 
 for i in `seq $2 $3`
 do
  	nodename="Node$i"
 
  	echo "node $nodename spawned!"
- 	(NODENAME=$nodename; ./main $NODENAME $1 $NODELISTPATH 2>&1 > "$LOGPATH/$NODENAME.log") &
+ 	(NODENAME=$nodename; ./pabft run -trace "$LOGPATH/$NODENAME.trace.jsonl" -node-list $NODELISTPATH -id $NODENAME > "$LOGPATH/$NODENAME.log" 2>&1) &
  done
 printf "${RED}$TOTALNODE nodes are running${NC}\n"
 echo "(wait)"
@@ -31,7 +31,7 @@ then
 fi
 
 # Build binary file first.
-go build main.go
+go build -o pabft .
 exitcode=$?
 if [[ $exitcode -ne 0 ]]
 then
@@ -47,17 +47,17 @@ echo "Logs are saved in $LOGPATH"
 echo ""
 echo "Try to spawn $TOTALNODE nodes"
 
-echo `awk -v N=$1 -f nodelist.awk /dev/null` > $NODELISTPATH
+./pabft nodelist local -n $TOTALNODE -o $NODELISTPATH
 
 # for i in `seq 1 $1`
 # do
 # 	nodename="Node$i"
 
 # 	echo "node $nodename spawned!"
-# 	(NODENAME=$nodename; ./main $NODENAME $NODELISTPATH 2>&1 > "$LOGPATH/$NODENAME.log") &
+# 	(NODENAME=$nodename; ./pabft run -node-list $NODELISTPATH -id $NODENAME > "$LOGPATH/$NODENAME.log" 2>&1) &
 # done
-(NODENAME=$nodename; ./main "Node3" 2>&1 > "$LOGPATH/Node3.log") &
-(NODENAME=$nodename; ./main "Node4" 2>&1 > "$LOGPATH/Node4.log") &
+(NODENAME=$nodename; ./pabft run -id "Node3" > "$LOGPATH/Node3.log" 2>&1) &
+(NODENAME=$nodename; ./pabft run -id "Node4" > "$LOGPATH/Node4.log" 2>&1) &
 sudo sshpass -p"2019" ssh -o StrictHostKeyChecking=no jmslon@192.168.0.2 "cd go/src/github.com/bigpicturelabs/consensusPBFT/pbft/&& bash ./run_nodes2.sh 4"
 printf "${RED}$TOTALNODE nodes are running${NC}\n"
 echo "(wait)"
@@ -0,0 +1,104 @@
+package sim
+
+import (
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// epoch is the wall time a simulation starts at, so that timestamps in
+// messages do not depend on when it runs.
+var epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// clock is the virtual clock of the cluster as one replica sees it.
+// Its timers fire when the scheduler gets to them.
+type clock struct {
+	cluster *Cluster
+	nodeID  string
+}
+
+// Ready, Run and Park run the goroutines of the replica one at a time,
+// each in its turn, as network.Node asks of a clock that does.
+func (c *clock) Ready() uint64 {
+	return c.cluster.ready()
+}
+
+func (c *clock) Run(ticket uint64) {
+	c.cluster.runTurn(ticket)
+}
+
+func (c *clock) Park() {
+	c.cluster.park()
+}
+
+func (c *clock) Now() time.Time {
+	return epoch.Add(c.cluster.Now())
+}
+
+func (c *clock) Sleep(d time.Duration) {
+	<-c.NewTimer(d).C()
+}
+
+func (c *clock) NewTimer(d time.Duration) network.Timer {
+	t := &timer{
+		cluster: c.cluster,
+		nodeID:  c.nodeID,
+		c:       make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// timer is a network.Timer on the virtual clock. Stop and Reset make
+// the events already queued for it stale rather than removing them.
+type timer struct {
+	cluster *Cluster
+	nodeID  string
+	c       chan time.Time
+
+	// Guarded by cluster.mu.
+	duration   time.Duration
+	at         time.Duration
+	generation uint64
+	active     bool
+}
+
+func (t *timer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *timer) Stop() bool {
+	t.cluster.mu.Lock()
+	defer t.cluster.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	t.generation++
+	return wasActive
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	if d < 0 {
+		d = 0
+	}
+	t.cluster.mu.Lock()
+	defer t.cluster.mu.Unlock()
+	wasActive := t.active
+	t.active = true
+	t.generation++
+	t.duration = d
+	t.at = t.cluster.now + d
+	t.cluster.timersSet = append(t.cluster.timersSet, t)
+	return wasActive
+}
+
+// fire delivers the tick of a timer, as time.Timer does: without
+// blocking, into a channel of one. The goroutine that waits for it
+// runs next.
+func (t *timer) fire(now time.Duration) {
+	t.cluster.wake(true)
+	select {
+	case t.c <- epoch.Add(now):
+	default:
+		t.cluster.wake(false)
+	}
+}
@@ -0,0 +1,351 @@
+// Package sim runs whole PBFT clusters in one process on a virtual
+// clock. The replicas are the real network.Server and network.Node;
+// only their transport and clock are the simulator's. A scheduler
+// seeded from Config.Seed delivers one message or fires one timer at a
+// time and lets the replicas settle before the next, so a run follows
+// from its seed. A virtual second of 19 replicas takes about a quarter
+// of a second, and of 31 replicas under a second:
+//
+//	cluster, err := sim.NewCluster(sim.Config{Nodes: 19, Seed: 42})
+//	if err != nil {
+//		return err
+//	}
+//	defer cluster.Close()
+//	result := cluster.Run(2 * time.Minute)
+//	if err := cluster.CheckAgreement(); err != nil {
+//		return fmt.Errorf("seed %d: %v", result.Seed, err)
+//	}
+//
+// The goroutines of the replicas run one at a time, in the order they
+// became ready (see the network package's work.go), so two runs of a
+// seed take the same course and end with the same Result.Trace: to
+// reproduce a failure, run its seed again. A test steps in between two
+// events with Cluster.Do.
+package sim
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// The replicas pick primaries from the first 11 entries of the node table.
+const minNodes = 11
+
+// Bytes of the requests the primaries propose by default: the 1 MiB of
+// a replica spends most of a run hashing and verifying it.
+const fillerSize = 1 << 10
+
+// Signature results the replicas share: each verifies what the others
+// already did, so a broadcast signature is checked once, not by each.
+const signatureCacheSize = 1 << 16
+
+// Config describes a cluster and the network between its replicas.
+type Config struct {
+	// Nodes is the number of replicas, Node1 to NodeN. 19 if zero.
+	Nodes int
+
+	// Seed makes the keys of the replicas and every choice of the
+	// scheduler: runs with the same seed and config make the same choices.
+	Seed int64
+
+	// Latency is the shortest time a message takes, 2ms if zero.
+	// Jitter is the random extra time, up to Jitter; 3ms if zero.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Loss is the probability that a message between two replicas is lost.
+	Loss float64
+
+	// Drop, if set, is asked about every message before it is sent on
+	// its way, and loses it if it returns true.
+	Drop func(m Message) bool
+
+	// Byzantine, by node id, makes replicas misbehave on purpose.
+	Byzantine map[string]*network.Byzantine
+
+	// Node configures the replicas, each with its own node id;
+	// network.DefaultConfig if nil, with filler requests of fillerSize.
+	Node *network.Config
+}
+
+// Message is a message in flight, as Config.Drop sees it.
+type Message struct {
+	From    string
+	To      string
+	MsgType string
+	SentAt  time.Duration
+}
+
+// Result sums up a run.
+type Result struct {
+	Seed    int64
+	Elapsed time.Duration // virtual time since the cluster started
+	Steps   int           // messages delivered and timers fired
+	Dropped int           // messages lost on the way
+
+	// Executed is the number of sequences each replica executed.
+	Executed map[string]int
+
+	// Trace is a hash of every step in order: equal for two runs that
+	// took the same course.
+	Trace string
+}
+
+// Cluster is a set of replicas on a simulated network.
+type Cluster struct {
+	config     Config
+	rand       *rand.Rand
+	nodeIDs    []string
+	servers    map[string]*network.Server
+	transports map[string]*transport
+	trace      hash.Hash
+	steps      int
+
+	mu        sync.Mutex
+	now       time.Duration
+	queue     eventQueue
+	seq       uint64
+	sent      []*delivery
+	timersSet []*timer
+	dropped   int
+
+	// Turns of the goroutines of the replicas, see runTurn.
+	turnMu     sync.Mutex
+	tickets    uint64
+	readyQueue []uint64
+	running    bool
+	woken      bool
+	stopped    bool
+	waiters    map[uint64]chan struct{}
+	settled    chan struct{}
+}
+
+// NewCluster creates the replicas of config and starts them.
+func NewCluster(config Config) (*Cluster, error) {
+	if config.Nodes == 0 {
+		config.Nodes = 19
+	}
+	if config.Nodes < minNodes {
+		return nil, fmt.Errorf("a cluster needs at least %d nodes, not %d", minNodes, config.Nodes)
+	}
+	if config.Latency == 0 {
+		config.Latency = 2 * time.Millisecond
+	}
+	if config.Jitter == 0 {
+		config.Jitter = 3 * time.Millisecond
+	}
+	if config.Latency < 0 || config.Jitter < 0 {
+		return nil, fmt.Errorf("negative latency")
+	}
+	if config.Loss < 0 || config.Loss > 1 {
+		return nil, fmt.Errorf("loss %v is not in [0, 1]", config.Loss)
+	}
+	for nodeID := range config.Byzantine {
+		var n int
+		if _, err := fmt.Sscanf(nodeID, "Node%d", &n); err != nil || n < 1 || n > config.Nodes {
+			return nil, fmt.Errorf("byzantine %s is not in the cluster", nodeID)
+		}
+	}
+
+	c := &Cluster{
+		config:     config,
+		rand:       rand.New(rand.NewSource(config.Seed)),
+		servers:    make(map[string]*network.Server),
+		transports: make(map[string]*transport),
+		trace:      fnv.New64a(),
+		waiters:    make(map[uint64]chan struct{}),
+	}
+
+	nodeTable := make([]*network.NodeInfo, config.Nodes)
+	signers := make([]consensus.Signer, config.Nodes)
+	for i := range nodeTable {
+		seed := make([]byte, ed25519.SeedSize)
+		c.rand.Read(seed)
+		signer, err := consensus.NewSigner(ed25519.NewKeyFromSeed(seed))
+		if err != nil {
+			return nil, err
+		}
+		nodeID := fmt.Sprintf("Node%d", i+1)
+		nodeTable[i] = &network.NodeInfo{NodeID: nodeID, Url: "sim:" + nodeID, PubKey: signer.Verifier()}
+		signers[i] = signer
+		c.nodeIDs = append(c.nodeIDs, nodeID)
+		c.transports[nodeID] = &transport{
+			cluster: c,
+			nodeID:  nodeID,
+			inbound: make(chan network.WireMessage, inboundQueueSize),
+		}
+	}
+	sort.Strings(c.nodeIDs)
+
+	base := *network.DefaultConfig()
+	base.FillerSize = fillerSize
+	if config.Node != nil {
+		base = *config.Node
+	}
+	// The replicas differ in their node id only.
+	base.NodeID = nodeTable[0].NodeID
+	if err := base.Validate(); err != nil {
+		return nil, err
+	}
+	if err := base.CheckNodeTable(nodeTable); err != nil {
+		return nil, err
+	}
+	if base.SignatureCache == nil {
+		base.SignatureCache = network.NewSignatureCache(signatureCacheSize)
+	}
+	// The replicas log to one place.
+	if base.Logging == nil {
+		base.Logging = network.NewLogging(os.Stderr, base.LogFormat == "json", slog.LevelInfo)
+		base.Logging.SetLevels(base.LogLevel)
+	}
+	seedNodeTables := [][]*network.NodeInfo{nodeTable}
+	for i, nodeInfo := range nodeTable {
+		nodeID := nodeInfo.NodeID
+		nodeConfig := base
+		nodeConfig.NodeID = nodeID
+		c.servers[nodeID] = network.NewServerWithClock(&nodeConfig, nodeTable, seedNodeTables,
+			signers[i], c.transports[nodeID], &clock{cluster: c, nodeID: nodeID})
+		if b := config.Byzantine[nodeID]; b != nil {
+			misbehaviour := *b
+			c.servers[nodeID].Node().Byzantine = &misbehaviour
+		}
+	}
+	// The primary sleeps on the virtual clock before its first PREPARE.
+	for _, nodeID := range c.nodeIDs {
+		server := c.servers[nodeID]
+		ticket := c.ready()
+		go func() {
+			c.runTurn(ticket)
+			defer c.park()
+			server.Start()
+		}()
+	}
+	return c, nil
+}
+
+// Now returns the virtual time since the cluster started.
+func (c *Cluster) Now() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Run runs the cluster for d of virtual time.
+func (c *Cluster) Run(d time.Duration) *Result {
+	return c.RunUntil(d, nil)
+}
+
+// RunUntil runs the cluster for at most d of virtual time, and stops
+// early once done returns true. done is called between steps.
+func (c *Cluster) RunUntil(d time.Duration, done func(c *Cluster) bool) *Result {
+	limit := c.Now() + d
+	for c.step(limit) {
+		if done != nil && done(c) {
+			break
+		}
+	}
+	return c.Result()
+}
+
+// Do runs f between two steps, in a turn of its own as if it were a
+// goroutine of the replicas, e.g. to have one start a view change.
+// What f sets off runs before the next step.
+func (c *Cluster) Do(f func()) {
+	c.waitSettled()
+	c.runTurn(c.ready())
+	defer c.park()
+	f()
+}
+
+// Result sums up the run so far.
+func (c *Cluster) Result() *Result {
+	result := &Result{
+		Seed:     c.config.Seed,
+		Elapsed:  c.Now(),
+		Steps:    c.steps,
+		Executed: make(map[string]int),
+		Trace:    hex.EncodeToString(c.trace.Sum(nil)),
+	}
+	c.mu.Lock()
+	result.Dropped = c.dropped
+	c.mu.Unlock()
+	for nodeID := range c.servers {
+		result.Executed[nodeID] = c.Executed(nodeID)
+	}
+	return result
+}
+
+// Executed returns the number of sequences nodeID executed.
+func (c *Cluster) Executed(nodeID string) int {
+	server := c.servers[nodeID]
+	if server == nil {
+		return 0
+	}
+	return server.Node().ExecutedCount()
+}
+
+// CheckAgreement returns an error if two honest replicas executed
+// different requests for the same sequence.
+func (c *Cluster) CheckAgreement() error {
+	executed := make(map[int64]string)
+	by := make(map[int64]string)
+	for _, nodeID := range c.nodeIDs {
+		if c.config.Byzantine[nodeID] != nil {
+			continue
+		}
+		for seqID, prepareMsg := range c.servers[nodeID].Node().Executed() {
+			digest, ok := executed[seqID]
+			if !ok {
+				executed[seqID] = prepareMsg.Digest
+				by[seqID] = nodeID
+				continue
+			}
+			if digest != prepareMsg.Digest {
+				return fmt.Errorf("sequence %d: %s executed %q, %s executed %q",
+					seqID, by[seqID], digest, nodeID, prepareMsg.Digest)
+			}
+		}
+	}
+	return nil
+}
+
+// Server returns the server of nodeID, e.g. to look at its node.
+func (c *Cluster) Server(nodeID string) *network.Server {
+	return c.servers[nodeID]
+}
+
+// NodeIDs returns the ids of the replicas, sorted.
+func (c *Cluster) NodeIDs() []string {
+	return append([]string(nil), c.nodeIDs...)
+}
+
+// Close stops the replicas, which writes the traces of the sequences
+// in flight. Do not run the cluster afterwards.
+func (c *Cluster) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.stopTurns()
+	for _, nodeID := range c.nodeIDs {
+		c.servers[nodeID].Stop(ctx)
+	}
+}
+
+func writeInt(h hash.Hash, v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	h.Write(buf[:])
+}
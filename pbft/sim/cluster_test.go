@@ -0,0 +1,146 @@
+package sim
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// newTestCluster returns a cluster of config that logs nothing, and
+// closes it when the test ends.
+func newTestCluster(t *testing.T, config Config) *Cluster {
+	t.Helper()
+	node := network.DefaultConfig()
+	node.Logging = network.NewLogging(io.Discard, false, slog.LevelInfo)
+	node.FillerSize = fillerSize
+	config.Node = node
+	c, err := NewCluster(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// byzantine returns the replicas of nodeIDs, each in the modes of spec.
+func byzantine(t *testing.T, spec string, nodeIDs ...string) map[string]*network.Byzantine {
+	t.Helper()
+	replicas := make(map[string]*network.Byzantine)
+	for _, nodeID := range nodeIDs {
+		b, err := network.ParseByzantine(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas[nodeID] = b
+	}
+	return replicas
+}
+
+// checkExecuted fails the test unless each of nodeIDs executed at least
+// min sequences, and the honest replicas agree on them.
+func checkExecuted(t *testing.T, c *Cluster, min int, nodeIDs ...string) {
+	t.Helper()
+	for _, nodeID := range nodeIDs {
+		if n := c.Executed(nodeID); n < min {
+			t.Errorf("%s executed %d sequences, want at least %d", nodeID, n, min)
+		}
+	}
+	if err := c.CheckAgreement(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSameSeedSameRun(t *testing.T) {
+	run := func(seed int64) *Result {
+		return newTestCluster(t, Config{Nodes: 11, Seed: seed}).Run(time.Second)
+	}
+	first, second := run(7), run(7)
+	if first.Trace != second.Trace || first.Steps != second.Steps {
+		t.Errorf("seed 7 ran twice: trace %s after %d steps, then %s after %d",
+			first.Trace, first.Steps, second.Trace, second.Steps)
+	}
+	if other := run(8); other.Trace == first.Trace {
+		t.Errorf("seeds 7 and 8 ran the same course: trace %s", other.Trace)
+	}
+}
+
+func TestPrimaryCrash(t *testing.T) {
+	// Node1 is the primary of sequences 1 and 11, and crashes once it
+	// executed the second.
+	c := newTestCluster(t, Config{Nodes: 11, Seed: 1, Byzantine: byzantine(t, "crash=2", "Node1")})
+	live := c.NodeIDs()[1:]
+	c.Run(2 * time.Second)
+	for _, nodeID := range live {
+		if n := c.Executed(nodeID); n != 10 {
+			t.Fatalf("%s executed %d sequences before the view change, want 10", nodeID, n)
+		}
+	}
+
+	// The view-change timer of sequence 11 expires on every live replica.
+	c.RunUntil(30*time.Second, func(c *Cluster) bool {
+		for _, nodeID := range live {
+			if c.Executed(nodeID) < 11 {
+				return false
+			}
+		}
+		return true
+	})
+	checkExecuted(t, c, 11, live...)
+}
+
+func TestPartition(t *testing.T) {
+	// Three replicas that are never primary are cut off from the
+	// others, which still make a quorum.
+	cutOff := map[string]bool{"Node11": true, "Node12": true, "Node13": true}
+	c := newTestCluster(t, Config{Nodes: 13, Seed: 1, Drop: func(m Message) bool {
+		return cutOff[m.From] != cutOff[m.To]
+	}})
+	c.Run(1200 * time.Millisecond)
+
+	var connected []string
+	for _, nodeID := range c.NodeIDs() {
+		if cutOff[nodeID] {
+			if n := c.Executed(nodeID); n != 0 {
+				t.Errorf("%s executed %d sequences cut off, want none", nodeID, n)
+			}
+		} else {
+			connected = append(connected, nodeID)
+		}
+	}
+	checkExecuted(t, c, 5, connected...)
+}
+
+func TestByzantine(t *testing.T) {
+	// Node10, the primary of sequence 10, and Node11 misbehave: f is 3.
+	tests := []struct {
+		modes string
+		// Executed by every honest replica.
+		executed int
+	}{
+		{modes: "silent", executed: 9},
+		{modes: "withhold", executed: 9},
+		{modes: "forge-collate", executed: 5},
+		{modes: "delay=50ms", executed: 5},
+		{modes: "equivocate", executed: 9},
+		{modes: "wrong-digest", executed: 9},
+		{modes: "double-vote", executed: 9},
+	}
+	for _, test := range tests {
+		t.Run(test.modes, func(t *testing.T) {
+			t.Parallel()
+			replicas := byzantine(t, test.modes, "Node10", "Node11")
+			c := newTestCluster(t, Config{Nodes: 11, Seed: 1, Byzantine: replicas})
+			c.Run(1200 * time.Millisecond)
+			var honest []string
+			for _, nodeID := range c.NodeIDs() {
+				if replicas[nodeID] == nil {
+					honest = append(honest, nodeID)
+				}
+			}
+			checkExecuted(t, c, test.executed, honest...)
+		})
+	}
+}
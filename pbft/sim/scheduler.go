@@ -0,0 +1,301 @@
+package sim
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// delivery is a message in flight from one replica to another.
+type delivery struct {
+	from    string
+	to      string
+	msgType string
+	data    []byte
+	digest  [32]byte
+	sentAt  time.Duration
+}
+
+// event is a delivery or the expiry of a timer, due at a virtual time.
+// Ties go to the event queued first.
+type event struct {
+	at         time.Duration
+	seq        uint64
+	delivery   *delivery
+	timer      *timer
+	generation uint64
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*event))
+}
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// step lets the replicas settle after the last event, queues what they
+// sent and the timers they set meanwhile, and runs the next event. It
+// returns false when nothing is left to run before limit.
+func (c *Cluster) step(limit time.Duration) bool {
+	c.waitSettled()
+	c.mu.Lock()
+	c.schedule()
+	var next *event
+	for c.queue.Len() > 0 && next == nil {
+		e := heap.Pop(&c.queue).(*event)
+		if e.at > limit {
+			heap.Push(&c.queue, e)
+			break
+		}
+		if e.timer != nil && (!e.timer.active || e.timer.generation != e.generation) {
+			continue
+		}
+		next = e
+	}
+	if next == nil {
+		if limit > c.now {
+			c.now = limit
+		}
+		c.mu.Unlock()
+		return false
+	}
+	c.now = next.at
+	if next.timer != nil {
+		next.timer.active = false
+	}
+	c.mu.Unlock()
+
+	c.run(next)
+	return true
+}
+
+// schedule queues the messages sent and the timers set since the last
+// step. They are put in a canonical order first, and only then do they
+// draw on the random source, so that the course of a run depends on
+// what the replicas sent, not on the order they sent it in.
+func (c *Cluster) schedule() {
+	sent := c.sent
+	c.sent = nil
+	sort.SliceStable(sent, func(i, j int) bool {
+		a, b := sent[i], sent[j]
+		if a.from != b.from {
+			return a.from < b.from
+		}
+		if a.to != b.to {
+			return a.to < b.to
+		}
+		if a.msgType != b.msgType {
+			return a.msgType < b.msgType
+		}
+		return bytes.Compare(a.digest[:], b.digest[:]) < 0
+	})
+	for _, m := range sent {
+		if c.lost(m) {
+			c.dropped++
+			continue
+		}
+		latency := c.config.Latency
+		if c.config.Jitter > 0 {
+			latency += time.Duration(c.rand.Int63n(int64(c.config.Jitter) + 1))
+		}
+		c.push(&event{at: c.now + latency, delivery: m})
+	}
+
+	timers := c.timersSet
+	c.timersSet = nil
+	sort.SliceStable(timers, func(i, j int) bool {
+		a, b := timers[i], timers[j]
+		if a.at != b.at {
+			return a.at < b.at
+		}
+		return a.nodeID < b.nodeID
+	})
+	queued := make(map[*timer]bool)
+	for _, t := range timers {
+		if !t.active || queued[t] {
+			continue
+		}
+		queued[t] = true
+		c.push(&event{at: t.at, timer: t, generation: t.generation})
+	}
+}
+
+func (c *Cluster) lost(m *delivery) bool {
+	if c.config.Loss > 0 && m.from != m.to && c.rand.Float64() < c.config.Loss {
+		return true
+	}
+	return c.config.Drop != nil && c.config.Drop(Message{
+		From:    m.from,
+		To:      m.to,
+		MsgType: m.msgType,
+		SentAt:  m.sentAt,
+	})
+}
+
+func (c *Cluster) push(e *event) {
+	c.seq++
+	e.seq = c.seq
+	heap.Push(&c.queue, e)
+}
+
+// run delivers a message or fires a timer, and adds it to the trace.
+func (c *Cluster) run(e *event) {
+	c.steps++
+	if e.timer != nil {
+		c.trace.Write([]byte(e.timer.nodeID))
+		writeInt(c.trace, int64(e.at))
+		writeInt(c.trace, int64(e.timer.duration))
+		e.timer.fire(e.at)
+		return
+	}
+	m := e.delivery
+	c.trace.Write([]byte(m.from + ">" + m.to + m.msgType))
+	writeInt(c.trace, int64(e.at))
+	c.trace.Write(m.digest[:])
+	if !c.transports[m.to].deliver(m) {
+		c.mu.Lock()
+		c.dropped++
+		c.mu.Unlock()
+	}
+}
+
+// ready makes a goroutine of a replica ready to run, after those that
+// already are, and returns its ticket.
+func (c *Cluster) ready() uint64 {
+	c.turnMu.Lock()
+	defer c.turnMu.Unlock()
+	c.tickets++
+	c.readyQueue = append(c.readyQueue, c.tickets)
+	return c.tickets
+}
+
+// runTurn waits until it is the turn of the goroutine with ticket: no
+// other goroutine runs, and it is the first ready one, or the one the
+// last event woke, which runs before any other. A goroutine that has to
+// wait is handed the turn on a channel of its own, so that a handoff
+// wakes only the goroutine whose turn it is.
+func (c *Cluster) runTurn(ticket uint64) {
+	c.turnMu.Lock()
+	if c.stopped {
+		c.turnMu.Unlock()
+		return
+	}
+	if c.isTurn(ticket) {
+		c.take(ticket)
+		c.turnMu.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	c.waiters[ticket] = turn
+	c.turnMu.Unlock()
+	<-turn
+}
+
+func (c *Cluster) isTurn(ticket uint64) bool {
+	if c.running {
+		return false
+	}
+	if ticket == 0 {
+		return c.woken
+	}
+	return !c.woken && len(c.readyQueue) > 0 && c.readyQueue[0] == ticket
+}
+
+// take gives the turn to the goroutine with ticket.
+func (c *Cluster) take(ticket uint64) {
+	if ticket == 0 {
+		c.woken = false
+	} else {
+		c.readyQueue = c.readyQueue[1:]
+	}
+	c.running = true
+}
+
+// handOff hands the turn to the next goroutine if it waits for it, or
+// tells waitSettled that the replicas settled. turnMu is held.
+func (c *Cluster) handOff() {
+	if c.running {
+		return
+	}
+	var next uint64
+	switch {
+	case c.woken:
+		next = 0
+	case len(c.readyQueue) > 0:
+		next = c.readyQueue[0]
+	default:
+		if c.settled != nil {
+			close(c.settled)
+			c.settled = nil
+		}
+		return
+	}
+	if turn, ok := c.waiters[next]; ok {
+		delete(c.waiters, next)
+		c.take(next)
+		close(turn)
+	}
+}
+
+// park tells that the running goroutine waits, so the next may run.
+func (c *Cluster) park() {
+	c.turnMu.Lock()
+	defer c.turnMu.Unlock()
+	c.running = false
+	c.handOff()
+}
+
+// wake tells that the next event will wake a goroutine, or, if woke is
+// false, that it did not after all.
+func (c *Cluster) wake(woke bool) {
+	c.turnMu.Lock()
+	defer c.turnMu.Unlock()
+	c.woken = woke
+	c.handOff()
+}
+
+// waitSettled returns once the replicas are settled: no goroutine runs
+// or is ready to, each waits for a message, a virtual timer or Stop.
+func (c *Cluster) waitSettled() {
+	c.turnMu.Lock()
+	if c.stopped || !(c.running || c.woken || len(c.readyQueue) > 0) {
+		c.turnMu.Unlock()
+		return
+	}
+	if c.settled == nil {
+		c.settled = make(chan struct{})
+	}
+	settled := c.settled
+	c.turnMu.Unlock()
+	<-settled
+}
+
+// stopTurns lets every goroutine run from now on, so that the replicas
+// can stop.
+func (c *Cluster) stopTurns() {
+	c.turnMu.Lock()
+	defer c.turnMu.Unlock()
+	c.stopped = true
+	for ticket, turn := range c.waiters {
+		delete(c.waiters, ticket)
+		close(turn)
+	}
+	if c.settled != nil {
+		close(c.settled)
+		c.settled = nil
+	}
+}
@@ -0,0 +1,92 @@
+package sim
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/bigpicturelabs/consensusPBFT/pbft/consensus"
+	"github.com/bigpicturelabs/consensusPBFT/pbft/network"
+)
+
+// Number of delivered messages a replica may not have read yet.
+const inboundQueueSize = 1 << 16
+
+var errClosed = errors.New("transport is closed")
+
+// transport is the network.Transport of one replica. What it sends is
+// handed to the scheduler, which delivers it after a simulated latency.
+type transport struct {
+	cluster *Cluster
+	nodeID  string
+	inbound chan network.WireMessage
+	closed  bool // guarded by cluster.mu
+}
+
+func (t *transport) Send(nodeID string, env *consensus.Envelope) error {
+	if _, ok := t.cluster.transports[nodeID]; !ok {
+		return fmt.Errorf("cannot send %s message to %s: not in the cluster", env.MsgType, nodeID)
+	}
+	return t.send([]string{nodeID}, env)
+}
+
+func (t *transport) Broadcast(env *consensus.Envelope) error {
+	return t.send(t.cluster.nodeIDs, env)
+}
+
+// send encodes env once for all of to, as the wire would.
+func (t *transport) send(to []string, env *consensus.Envelope) error {
+	data, err := consensus.BinaryCodec.Marshal(env)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+
+	t.cluster.mu.Lock()
+	defer t.cluster.mu.Unlock()
+	if t.closed {
+		return errClosed
+	}
+	for _, nodeID := range to {
+		t.cluster.sent = append(t.cluster.sent, &delivery{
+			from:    t.nodeID,
+			to:      nodeID,
+			msgType: env.MsgType,
+			data:    data,
+			digest:  digest,
+			sentAt:  t.cluster.now,
+		})
+	}
+	return nil
+}
+
+func (t *transport) Inbound() <-chan network.WireMessage {
+	return t.inbound
+}
+
+// Close stops sending and receiving; the replica looks crashed to the others.
+func (t *transport) Close() error {
+	t.cluster.mu.Lock()
+	defer t.cluster.mu.Unlock()
+	t.closed = true
+	return nil
+}
+
+// deliver hands a message to the replica, unless it closed its
+// transport. Its receive loop runs next.
+func (t *transport) deliver(m *delivery) bool {
+	t.cluster.mu.Lock()
+	closed := t.closed
+	t.cluster.mu.Unlock()
+	if closed {
+		return false
+	}
+	t.cluster.wake(true)
+	select {
+	case t.inbound <- network.WireMessage{Codec: consensus.BinaryCodec, Data: m.data}:
+		return true
+	default:
+		t.cluster.wake(false)
+		return false
+	}
+}